@@ -0,0 +1,250 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HealthCheckInterval is the interval of the health checks of
+// AccountManager.Run - 1 minute by default.
+var HealthCheckInterval = time.Minute
+
+// ErrUnknownAccount is returned by AccountManager for names not added.
+var ErrUnknownAccount = errors.New("unknown account")
+
+// AccountManager owns named Clients (such as "support" and "billing"):
+// it connects them lazily, serializes their use, reconnects them after a
+// connection error, and checks their health periodically (see Run).
+type AccountManager struct {
+	mu       sync.Mutex
+	accounts map[string]*managedAccount
+}
+
+// AccountStatus is the status of an account of an AccountManager.
+type AccountStatus struct {
+	Name      string
+	Connected bool
+	// LastCheck is the time of the last health check, LastError is the
+	// error of the last connect, operation or health check.
+	LastCheck time.Time
+	LastError error
+}
+
+type managedAccount struct {
+	mu        sync.Mutex // held while the client is in use
+	c         Client
+	connected bool
+
+	statusMu sync.Mutex // guards status, readable while the client is in use
+	status   AccountStatus
+}
+
+// NewAccountManager returns an AccountManager without accounts.
+func NewAccountManager() *AccountManager {
+	return &AccountManager{accounts: make(map[string]*managedAccount)}
+}
+
+// Add adds the (not connected) client under name.
+func (m *AccountManager) Add(name string, c Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.accounts[name]; ok {
+		return fmt.Errorf("account %q already exists", name)
+	}
+	m.accounts[name] = &managedAccount{c: c, status: AccountStatus{Name: name}}
+	return nil
+}
+
+// Remove removes the account, logging out if it is connected.
+func (m *AccountManager) Remove(name string) error {
+	m.mu.Lock()
+	a, ok := m.accounts[name]
+	delete(m.accounts, name)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%q: %w", name, ErrUnknownAccount)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.disconnect(true)
+}
+
+// Names returns the names of the accounts, sorted.
+func (m *AccountManager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.accounts))
+	for name := range m.accounts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Do calls fn with the connected client of the account - exclusively, the
+// other calls for the same account wait. After a connection error (of the
+// connect or of fn) the client is closed, and reconnected by the next call.
+func (m *AccountManager) Do(name string, fn func(Client) error) error {
+	a, err := m.account(name)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err = a.connect(); err != nil {
+		return err
+	}
+	err = fn(a.c)
+	a.setError(err)
+	if isConnError(err) {
+		Log.Warn("account", "name", name, "error", err)
+		a.disconnect(false)
+	}
+	return err
+}
+
+// Status returns the status of the accounts, sorted by name.
+func (m *AccountManager) Status() []AccountStatus {
+	names := m.Names()
+	statuses := make([]AccountStatus, 0, len(names))
+	for _, name := range names {
+		if a, err := m.account(name); err == nil {
+			a.statusMu.Lock()
+			statuses = append(statuses, a.status)
+			a.statusMu.Unlock()
+		}
+	}
+	return statuses
+}
+
+// Check checks the health of the connected accounts (with Ping, for
+// HealthClients), and (re)connects the disconnected ones.
+// Returns the errors by account name.
+func (m *AccountManager) Check() map[string]error {
+	errs := make(map[string]error)
+	for _, name := range m.Names() {
+		a, err := m.account(name)
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		if err = a.check(); err != nil {
+			Log.Warn("health check", "account", name, "error", err)
+			errs[name] = err
+		}
+		a.mu.Unlock()
+	}
+	return errs
+}
+
+// Run checks the health of the accounts every HealthCheckInterval, till ctx
+// is cancelled; then logs out of all of them. Returns ctx.Err().
+func (m *AccountManager) Run(ctx context.Context) error {
+	defer m.Close()
+	for {
+		m.Check()
+		if !sleepContext(ctx, HealthCheckInterval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Close logs out of all the connected accounts; they are reconnected
+// by the next Do or Check.
+func (m *AccountManager) Close() error {
+	var firstErr error
+	for _, name := range m.Names() {
+		a, err := m.account(name)
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		if err = a.disconnect(true); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		a.mu.Unlock()
+	}
+	return firstErr
+}
+
+func (m *AccountManager) account(name string) (*managedAccount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a, ok := m.accounts[name]; ok {
+		return a, nil
+	}
+	return nil, fmt.Errorf("%q: %w", name, ErrUnknownAccount)
+}
+
+// connect connects the client, if not connected. Must be called with a.mu held.
+func (a *managedAccount) connect() error {
+	if a.connected {
+		return nil
+	}
+	err := a.c.Connect()
+	a.setError(err)
+	if err != nil {
+		return err
+	}
+	a.connected = true
+	a.statusMu.Lock()
+	a.status.Connected = true
+	a.statusMu.Unlock()
+	return nil
+}
+
+// disconnect closes the client, if connected. Must be called with a.mu held.
+func (a *managedAccount) disconnect(commit bool) error {
+	if !a.connected {
+		return nil
+	}
+	a.connected = false
+	a.statusMu.Lock()
+	a.status.Connected = false
+	a.statusMu.Unlock()
+	return a.c.Close(commit)
+}
+
+// check pings the connected client, or connects it. Must be called with a.mu held.
+func (a *managedAccount) check() error {
+	var err error
+	if !a.connected {
+		err = a.connect()
+	} else if hc, ok := a.c.(HealthClient); ok {
+		if err = hc.Ping(); err != nil {
+			a.disconnect(false)
+			err = a.connect()
+		}
+		a.setError(err)
+	}
+	a.statusMu.Lock()
+	a.status.LastCheck = time.Now()
+	a.statusMu.Unlock()
+	return err
+}
+
+func (a *managedAccount) setError(err error) {
+	a.statusMu.Lock()
+	a.status.LastError = err
+	a.statusMu.Unlock()
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// ACLClient is a Client which can manage access control lists (RFC 4314).
+type ACLClient interface {
+	Client
+	MyRights(mbox string) (Rights, error)
+	GetACL(mbox string) (map[string]Rights, error)
+	SetACL(mbox, identifier string, rights Rights) error
+	DeleteACL(mbox, identifier string) error
+}
+
+// Rights is a set of RFC 4314 rights, such as "lrswipkxte".
+type Rights string
+
+// Has reports whether all the given rights are present.
+func (r Rights) Has(rights string) bool {
+	for _, c := range rights {
+		if !strings.ContainsRune(string(r), c) {
+			return false
+		}
+	}
+	return true
+}
+
+// CanStoreFlags reports whether the \Seen, \Deleted and other flags can be stored.
+func (r Rights) CanStoreFlags() bool {
+	return r.Has("swt")
+}
+
+// MyRights returns the rights of the logged in user on mbox.
+//
+// Returns imap.NotAvailableError if the server does not support ACL.
+func (c *client) MyRights(mbox string) (Rights, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["ACL"] {
+		return "", imap.NotAvailableError("ACL")
+	}
+	cmd, err := c.wait(c.c.Send("MYRIGHTS", c.mailboxName(mbox)))
+	if err != nil {
+		return "", err
+	}
+	var rights Rights
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if resp.Label == "MYRIGHTS" && len(resp.Fields) >= 3 {
+			rights = Rights(imap.AsString(resp.Fields[2]))
+		}
+	}
+	c.c.Data = nil
+	return rights, nil
+}
+
+// GetACL returns the access control list of mbox, by identifier.
+//
+// Returns imap.NotAvailableError if the server does not support ACL.
+func (c *client) GetACL(mbox string) (map[string]Rights, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["ACL"] {
+		return nil, imap.NotAvailableError("ACL")
+	}
+	cmd, err := c.wait(c.c.Send("GETACL", c.mailboxName(mbox)))
+	if err != nil {
+		return nil, err
+	}
+	acl := make(map[string]Rights)
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if resp.Label != "ACL" {
+			continue
+		}
+		for i := 2; i+1 < len(resp.Fields); i += 2 {
+			acl[imap.AsString(resp.Fields[i])] = Rights(imap.AsString(resp.Fields[i+1]))
+		}
+	}
+	c.c.Data = nil
+	return acl, nil
+}
+
+// SetACL sets the rights of identifier on mbox. Rights starting with
+// "+" or "-" are added to or removed from the existing ones.
+//
+// Returns imap.NotAvailableError if the server does not support ACL.
+func (c *client) SetACL(mbox, identifier string, rights Rights) error {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["ACL"] {
+		return imap.NotAvailableError("ACL")
+	}
+	_, err := c.wait(c.c.Send("SETACL", c.mailboxName(mbox),
+		c.c.Quote(identifier), c.c.Quote(string(rights))))
+	return err
+}
+
+// DeleteACL removes the rights of identifier from mbox.
+//
+// Returns imap.NotAvailableError if the server does not support ACL.
+func (c *client) DeleteACL(mbox, identifier string) error {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["ACL"] {
+		return imap.NotAvailableError("ACL")
+	}
+	_, err := c.wait(c.c.Send("DELETEACL", c.mailboxName(mbox), c.c.Quote(identifier)))
+	return err
+}
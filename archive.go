@@ -0,0 +1,238 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is a rule of an ArchiveLoop: the messages of Mailbox
+// older than OlderThan are moved to MoveTo, or deleted.
+type RetentionPolicy struct {
+	// Name identifies the policy in the logs and the reports.
+	Name string
+	// Mailbox is the mailbox to clean up.
+	Mailbox string
+	// OlderThan is the minimal age of the messages, by their internal date
+	// (in days, as the IMAP date searches).
+	OlderThan time.Duration
+	// MoveTo is the destination mailbox; a %Y (%m) in it is replaced with
+	// the year (month) of the internal date, like "Archive/%Y".
+	MoveTo string
+	// Delete deletes (and expunges) the messages instead of moving them.
+	Delete bool
+}
+
+// ErrNoRetentionAction is returned for a RetentionPolicy with neither MoveTo nor Delete,
+// instead of deleting the messages.
+var ErrNoRetentionAction = errors.New("retention policy has neither MoveTo nor Delete")
+
+// ArchiveReport is the result of applying a RetentionPolicy to the messages
+// of one period (year or month with %Y or %m in MoveTo) of the mailbox.
+type ArchiveReport struct {
+	Policy, Mailbox string
+	// Target is the destination mailbox, empty if the messages are deleted.
+	Target string
+	UIDs   []uint32
+	// Size is the total size of the messages, if known (by QuotaPolicy).
+	Size int64
+	// DryRun is true if the messages were not touched.
+	DryRun bool
+}
+
+// ArchiveLoop enforces retention policies - the mirror image of the
+// delivery Loop: it periodically moves or deletes the old messages,
+// with date searches and bulk moves.
+type ArchiveLoop struct {
+	// Client is the connection to the server, connected in each round.
+	Client Client
+	// Policies are applied in order, in each round.
+	Policies []RetentionPolicy
+	// QuotaPolicies are applied in order, after Policies.
+	QuotaPolicies []QuotaPolicy
+	// Interval is the time between two rounds - 24 hours if zero.
+	Interval time.Duration
+	// DryRun only reports the messages which would be moved or deleted.
+	DryRun bool
+	// OnReport is called with the report of each (non-empty) period, if not nil.
+	OnReport func(ArchiveReport)
+}
+
+// Run calls One every Interval, till ctx is cancelled. Returns ctx.Err().
+func (a *ArchiveLoop) Run(ctx context.Context) error {
+	interval := a.Interval
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+	for {
+		reports, err := a.One(ctx)
+		if err != nil {
+			Log.Error("ArchiveLoop one round", "reports", len(reports), "error", err)
+		} else {
+			Log.Info("ArchiveLoop one round", "reports", len(reports))
+		}
+		if !sleepContext(ctx, interval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// One connects, applies the policies once, and closes the connection
+// (committing the deletions). Returns the reports of the non-empty periods.
+func (a *ArchiveLoop) One(ctx context.Context) ([]ArchiveReport, error) {
+	if err := a.Client.Connect(); err != nil {
+		return nil, err
+	}
+	var reports []ArchiveReport
+	var err error
+	for _, p := range a.Policies {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var rs []ArchiveReport
+		rs, err = a.apply(ctx, p, time.Now())
+		reports = append(reports, rs...)
+		if err != nil {
+			Log.Error("archive", "policy", p.Name, "mbox", p.Mailbox, "error", err)
+			break
+		}
+	}
+	for _, p := range a.QuotaPolicies {
+		if err != nil {
+			break
+		}
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var rs []ArchiveReport
+		rs, err = a.applyQuota(p)
+		reports = append(reports, rs...)
+		if err != nil {
+			Log.Error("quota cleanup", "policy", p.Name, "error", err)
+		}
+	}
+	if closeErr := a.Client.Close(!a.DryRun); err == nil {
+		err = closeErr
+	}
+	return reports, err
+}
+
+// apply applies the policy to the messages older than its age at now.
+//
+// With a period in MoveTo, the messages are moved period by period,
+// backwards from the cutoff, till all the old messages are moved.
+func (a *ArchiveLoop) apply(ctx context.Context, p RetentionPolicy, now time.Time) ([]ArchiveReport, error) {
+	if p.MoveTo == "" && !p.Delete {
+		return nil, fmt.Errorf("policy %q: %w", p.Name, ErrNoRetentionAction)
+	}
+	c := a.Client
+	cutoff := now.Add(-p.OlderThan)
+	old := SearchCriteria{Before: cutoff, WithoutFlags: []string{`\Deleted`}}
+	uids, err := c.Search(p.Mailbox, old)
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+	monthly := strings.Contains(p.MoveTo, "%m")
+	if p.Delete || !monthly && !strings.Contains(p.MoveTo, "%Y") {
+		r, err := a.archive(p, uids, p.MoveTo)
+		return []ArchiveReport{r}, err
+	}
+
+	var reports []ArchiveReport
+	left := len(uids)
+	end := cutoff
+	// 100 years back at most, in case the server contradicts itself
+	for start := periodStart(cutoff, monthly); left > 0 && start.After(cutoff.AddDate(-100, 0, 0)); start = prevPeriod(start, monthly) {
+		if err = ctx.Err(); err != nil {
+			return reports, err
+		}
+		crit := old
+		crit.Since, crit.Before = start, end
+		end = start
+		if uids, err = c.Search(p.Mailbox, crit); err != nil {
+			return reports, err
+		}
+		if len(uids) == 0 {
+			continue
+		}
+		left -= len(uids)
+		r, err := a.archive(p, uids, periodName(p.MoveTo, start))
+		reports = append(reports, r)
+		if err != nil {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
+
+// archive moves the messages to target (or deletes them), and reports it.
+func (a *ArchiveLoop) archive(p RetentionPolicy, uids []uint32, target string) (ArchiveReport, error) {
+	r := ArchiveReport{Policy: p.Name, Mailbox: p.Mailbox, Target: target, UIDs: uids, DryRun: a.DryRun}
+	if p.Delete {
+		r.Target = ""
+	}
+	return r, a.remove(r)
+}
+
+// remove moves the messages of the report (selected already) to its
+// Target, or deletes them if it is empty - unless DryRun - and reports it.
+func (a *ArchiveLoop) remove(r ArchiveReport) error {
+	Log.Info("archive", "policy", r.Policy, "mbox", r.Mailbox, "target", r.Target, "n", len(r.UIDs), "dryRun", a.DryRun)
+	var err error
+	if !a.DryRun {
+		if r.Target == "" {
+			err = a.Client.DeleteMany(r.UIDs, true)
+		} else {
+			err = a.Client.MoveMany(r.UIDs, r.Target)
+		}
+	}
+	if a.OnReport != nil {
+		a.OnReport(r)
+	}
+	return err
+}
+
+// periodStart returns the start of the year (month) of t.
+func periodStart(t time.Time, monthly bool) time.Time {
+	month := time.January
+	if monthly {
+		month = t.Month()
+	}
+	return time.Date(t.Year(), month, 1, 0, 0, 0, 0, t.Location())
+}
+
+// prevPeriod returns the start of the year (month) before start.
+func prevPeriod(start time.Time, monthly bool) time.Time {
+	if monthly {
+		return start.AddDate(0, -1, 0)
+	}
+	return start.AddDate(-1, 0, 0)
+}
+
+// periodName replaces %Y and %m in name with the year and month of t.
+func periodName(name string, t time.Time) string {
+	month := strconv.Itoa(int(t.Month()))
+	if len(month) == 1 {
+		month = "0" + month
+	}
+	return strings.NewReplacer("%Y", strconv.Itoa(t.Year()), "%m", month).Replace(name)
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"time"
+)
+
+// BackupVersion is the version of the backup format written by Backup.
+const BackupVersion = 1
+
+// BackupManifestName is the name of the manifest in the backup archive.
+const BackupManifestName = "manifest.json"
+
+// BackupManifest describes a mailbox backup.
+//
+// The backup is a tar archive: its first entry is the manifest (BackupManifestName),
+// a JSON encoded BackupManifest, followed by the messages as "messages/<uid>.eml"
+// entries, in the order of BackupManifest.Messages.
+type BackupManifest struct {
+	Version     int             `json:"version"`
+	Mailbox     string          `json:"mailbox"`
+	UIDValidity uint32          `json:"uidvalidity"`
+	Created     time.Time       `json:"created"`
+	Messages    []BackupMessage `json:"messages"`
+}
+
+// BackupMessage is the metadata of a message of the backup.
+type BackupMessage struct {
+	UID uint32 `json:"uid"`
+	// File is the name of the tar entry of the message.
+	File         string    `json:"file"`
+	Flags        []string  `json:"flags"`
+	InternalDate time.Time `json:"internal_date"`
+	Size         uint32    `json:"size"`
+}
+
+// Backup writes the (not deleted) messages of mbox to w, as a tar archive
+// with a manifest of their flags and internal dates (see BackupManifest),
+// and returns the number of the messages written.
+func Backup(c Client, mbox string, w io.Writer) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	infos, err := c.ListWithInfo(mbox, "", true)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	man := BackupManifest{Version: BackupVersion, Mailbox: mbox, UIDValidity: st.UIDValidity,
+		Created: now, Messages: make([]BackupMessage, 0, len(infos))}
+	for _, info := range infos {
+		man.Messages = append(man.Messages, BackupMessage{
+			UID: info.UID, File: "messages/" + strconv.FormatUint(uint64(info.UID), 10) + ".eml",
+			Flags: sortedFlags(info.Flags), InternalDate: info.InternalDate, Size: info.Size,
+		})
+	}
+	b, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	tw := tar.NewWriter(w)
+	if err = writeTarEntry(tw, BackupManifestName, now, b); err != nil {
+		return 0, err
+	}
+	if err = c.Select(mbox); err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	for i, msg := range man.Messages {
+		buf.Reset()
+		if _, err = c.ReadTo(&buf, msg.UID); err != nil {
+			return i, err
+		}
+		if err = writeTarEntry(tw, msg.File, msg.InternalDate, buf.Bytes()); err != nil {
+			return i, err
+		}
+	}
+	return len(man.Messages), tw.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, modTime time.Time, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// ErrBadBackup is returned by Restore if r is not a backup written by Backup.
+var ErrBadBackup = errors.New("not a mailbox backup")
+
+// Restore appends the messages of the backup read from r (written by Backup)
+// to mbox (the mailbox of the backup, if empty), creating it if needed,
+// with their flags and internal dates, and returns the number of the
+// messages appended. The messages get new UIDs.
+func Restore(c Client, mbox string, r io.Reader) (int, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != BackupManifestName {
+		return 0, fmt.Errorf("%w: no %s first", ErrBadBackup, BackupManifestName)
+	}
+	var man BackupManifest
+	if err = json.NewDecoder(tr).Decode(&man); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrBadBackup, err)
+	}
+	if man.Version != BackupVersion {
+		return 0, fmt.Errorf("%w: unknown version %d", ErrBadBackup, man.Version)
+	}
+	if mbox == "" {
+		mbox = man.Mailbox
+	}
+	if err = c.CreateMailbox(mbox); err != nil {
+		Log.Debug("CreateMailbox", "mbox", mbox, "error", err)
+	}
+	files := make(map[string]BackupMessage, len(man.Messages))
+	for _, msg := range man.Messages {
+		files[path.Clean(msg.File)] = msg
+	}
+	var n int
+	for {
+		if hdr, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return n, err
+		}
+		msg, ok := files[path.Clean(hdr.Name)]
+		if !ok {
+			Log.Warn("Restore", "entry", hdr.Name, "error", "not in the manifest")
+			continue
+		}
+		if _, err = c.Append(mbox, msg.Flags, msg.InternalDate, tr); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if n != len(man.Messages) {
+		return n, fmt.Errorf("%w: %d of the %d messages of the manifest are missing", ErrBadBackup, len(man.Messages)-n, len(man.Messages))
+	}
+	return n, nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// BinaryClient is a Client which can fetch the body parts with their
+// content-transfer-encoding decoded by the server (RFC 3516).
+type BinaryClient interface {
+	Client
+	ReadBinaryTo(w io.Writer, msgID uint32, part string) (int64, error)
+	BinarySize(msgID uint32, part string) (uint32, error)
+}
+
+// ReadBinaryTo writes the decoded body part (such as "2" or "1.3", the whole
+// message if empty) of the message into w, with FETCH BINARY.PEEK[part] - so
+// a base64 attachment is transferred as is, ~33% smaller, without decoding.
+//
+// Returns imap.NotAvailableError if the server does not support BINARY.
+func (c *client) ReadBinaryTo(w io.Writer, msgID uint32, part string) (int64, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["BINARY"] {
+		return 0, imap.NotAvailableError("BINARY")
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(msgID)
+	var n int64
+	found := false
+	err := c.retry("ReadBinaryTo", func() error {
+		return c.fetch(set, []string{"BINARY.PEEK[" + part + "]"}, func(resp *imap.Response) error {
+			info := resp.MessageInfo()
+			if info.UID != msgID {
+				return nil
+			}
+			for k, f := range info.Attrs {
+				if strings.HasPrefix(k, "BINARY[") {
+					found = true
+					m, err := w.Write(imap.AsBytes(f))
+					n += int64(m)
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err == nil && !found {
+		err = &imap.ProtocolError{Info: "no BINARY[" + part + "] for UID " + strconv.FormatUint(uint64(msgID), 10)}
+	}
+	return n, err
+}
+
+// BinarySize returns the decoded size of the body part, with FETCH BINARY.SIZE[part].
+//
+// Returns imap.NotAvailableError if the server does not support BINARY.
+func (c *client) BinarySize(msgID uint32, part string) (uint32, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["BINARY"] {
+		return 0, imap.NotAvailableError("BINARY")
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(msgID)
+	var size uint32
+	found := false
+	err := c.retry("BinarySize", func() error {
+		return c.fetch(set, []string{"BINARY.SIZE[" + part + "]"}, func(resp *imap.Response) error {
+			info := resp.MessageInfo()
+			if info.UID != msgID {
+				return nil
+			}
+			for k, f := range info.Attrs {
+				if strings.HasPrefix(k, "BINARY.SIZE[") {
+					size, found = imap.AsNumber(f), true
+				}
+			}
+			return nil
+		})
+	})
+	if err == nil && !found {
+		err = &imap.ProtocolError{Info: "no BINARY.SIZE[" + part + "] for UID " + strconv.FormatUint(uint64(msgID), 10)}
+	}
+	return size, err
+}
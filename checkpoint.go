@@ -0,0 +1,136 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Checkpoint is the position of the incremental processing of a mailbox:
+// the messages up to UID are processed. It is valid only while the
+// UIDVALIDITY of the mailbox is UIDValidity.
+type Checkpoint struct {
+	UIDValidity uint32
+	UID         uint32
+}
+
+// Checkpointer stores the Checkpoints of the mailboxes.
+type Checkpointer interface {
+	// Load returns the Checkpoint of the mailbox; the zero Checkpoint if there is none.
+	Load(mailbox string) (Checkpoint, error)
+	// Save stores the Checkpoint of the mailbox.
+	Save(mailbox string, cp Checkpoint) error
+}
+
+// MemoryCheckpointer is an in-memory Checkpointer.
+type MemoryCheckpointer struct {
+	mu sync.Mutex
+	m  map[string]Checkpoint
+}
+
+// NewMemoryCheckpointer returns a new, empty MemoryCheckpointer.
+func NewMemoryCheckpointer() *MemoryCheckpointer {
+	return &MemoryCheckpointer{m: make(map[string]Checkpoint)}
+}
+
+// Load returns the Checkpoint of the mailbox.
+func (mc *MemoryCheckpointer) Load(mailbox string) (Checkpoint, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.m[mailbox], nil
+}
+
+// Save stores the Checkpoint of the mailbox.
+func (mc *MemoryCheckpointer) Save(mailbox string, cp Checkpoint) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.m[mailbox] = cp
+	return nil
+}
+
+// FileCheckpointer is a Checkpointer which stores the Checkpoints of all
+// the mailboxes in a JSON file, replaced atomically on each Save.
+type FileCheckpointer struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileCheckpointer returns a FileCheckpointer using the file at path,
+// which is created on the first Save.
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{path: path}
+}
+
+// Load returns the Checkpoint of the mailbox.
+func (fc *FileCheckpointer) Load(mailbox string) (Checkpoint, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	m, err := fc.load()
+	return m[mailbox], err
+}
+
+// Save stores the Checkpoint of the mailbox.
+func (fc *FileCheckpointer) Save(mailbox string, cp Checkpoint) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	m, err := fc.load()
+	if err != nil {
+		return err
+	}
+	m[mailbox] = cp
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fc.path, b)
+}
+
+func (fc *FileCheckpointer) load() (map[string]Checkpoint, error) {
+	m := make(map[string]Checkpoint)
+	b, err := os.ReadFile(fc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	return m, json.Unmarshal(b, &m)
+}
+
+// writeFileAtomic writes data to a temporary file next to path, then renames it to path.
+func writeFileAtomic(path string, data []byte) error {
+	fh, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(data); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(fh.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fh.Name())
+	}
+	return err
+}
@@ -20,20 +20,27 @@ package imapclient
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
+	"math"
+	"net"
+	"net/textproto"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/mxk/go-imap/imap"
-	"github.com/tgulacsi/go/loghlp"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 var (
-	// Log uses DiscardHandler (produces no output) by default.
+	// Log is the default logger of the clients (see WithLogger), and of the loops.
+	// Uses DiscardHandler (produces no output) by default.
 	Log = log15.New("lib", "imapclient")
 
 	// Timeout is the client timeout - 30 seconds by default.
@@ -41,6 +48,21 @@ var (
 
 	// TLSConfig is the client's config for DialTLS.
 	TLSConfig = tls.Config{InsecureSkipVerify: true}
+
+	// ConnectRetries is the number of times Connect retries a failed dial - 0 by default.
+	// It is the default of WithConnectRetries.
+	ConnectRetries = 0
+
+	// ConnectBackoff is the wait before the first dial retry, doubled after each retry.
+	// It is the default of WithConnectRetries.
+	ConnectBackoff = 1 * time.Second
+
+	// CompressLevel is the deflate level of COMPRESS=DEFLATE - 2 by default.
+	CompressLevel = 2
+
+	// GreetingTimeout is the time to wait for the server greeting after dialing - 10 seconds by default.
+	// It is the default of WithGreetingTimeout, if WithConnectTimeout is not given either.
+	GreetingTimeout = 10 * time.Second
 )
 
 func init() {
@@ -57,16 +79,66 @@ type Client interface {
 	Connect() error
 	Close(commit bool) error
 	List(mbox, pattern string, all bool) ([]uint32, error)
+	ListWithInfo(mbox, pattern string, all bool) ([]MessageInfo, error)
+	ListIter(mbox, pattern string, all bool, fn func(uids []uint32) error) error
+	ListSince(mbox string, since time.Time) ([]uint32, error)
+	ListBetween(mbox string, from, to time.Time) ([]uint32, error)
+	ListNewer(mbox string, lastUID uint32) ([]uint32, error)
+	Mailboxes(pattern string) ([]Mailbox, error)
+	MailboxTree() (*MailboxTree, error)
+	MailboxesStatus(pattern string) ([]Mailbox, error)
+	SubscribedMailboxes() ([]Mailbox, error)
+	CreateMailbox(mbox string) error
+	DeleteMailbox(mbox string) error
+	RenameMailbox(oldName, newName string) error
+	Subscribe(mbox string) error
+	Unsubscribe(mbox string) error
+	Status(mbox string) (*imap.MailboxStatus, error)
+	MessageCount(mbox string) (int, error)
+	UnreadCount(mbox string) (int, error)
+	Select(mbox string) error
+	Selected() string
+	Search(mbox string, crit SearchCriteria) ([]uint32, error)
+	SearchPage(mbox string, crit SearchCriteria, offset, limit int) ([]uint32, int, error)
+	Sort(mbox string, criteria []SortKey, search SearchCriteria) ([]uint32, error)
 	ReadTo(w io.Writer, msgID uint32) (int64, error)
+	FetchMany(uids []uint32, fn func(uid uint32, r io.Reader) error) error
 	GetFlags(msgID uint32) (imap.FlagSet, error)
+	GetSize(msgID uint32) (uint32, error)
+	GetHeaders(msgID uint32) (textproto.MIMEHeader, error)
+	FetchHeaderFields(msgID uint32, fields []string) (textproto.MIMEHeader, error)
+	GetEnvelope(msgID uint32) (*Envelope, error)
+	ListKeywords(msgID uint32) ([]string, error)
+	PermanentFlags(mbox string) (imap.FlagSet, error)
 	SetFlag(msgID uint32, keyword string, st bool) error
 	SetFlagRegex(msgID uint32, regex string, st bool) error
+	SetFlags(uids []uint32, keyword string, st bool) error
+	SetFlagsSilent(uids []uint32, keyword string, st bool) error
+	ReplaceFlags(msgID uint32, flags []string) error
 	MarkSeen(msgID uint32) error
+	MarkSeenAll(uids []uint32) error
 	MarkUnseen(msgID uint32) error
 	MarkDeleted(msgID uint32) error
 	MarkUndeleted(msgID uint32) error
+	DeleteMany(uids []uint32, expunge bool) error
+	Delete(msgID uint32, permanent bool) error
+	MarkAnswered(msgID uint32) error
+	MarkFlagged(msgID uint32) error
+	MarkUnflagged(msgID uint32) error
+	MarkDraft(msgID uint32) error
 	Move(msgID uint32, mbox string) error
+	MoveMany(uids []uint32, mbox string) error
+	SpecialUse(use string) (string, error)
+	MoveToTrash(uids ...uint32) error
+	MoveToJunk(uids ...uint32) error
+	Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error)
+	Expunge(uids ...uint32) error
+	ExpungeAll() error
+	Check() error
 	SetLogMask(mask imap.LogMask) imap.LogMask
+	Capabilities() map[string]bool
+	Supports(capability string) bool
+	Compressed() bool
 }
 
 const (
@@ -78,111 +150,360 @@ const (
 type client struct {
 	host, username, password string
 	port, tls                int
-	noUTF8                   bool
+	noUTF8, qresync          bool
 	c                        *imap.Client
 	created                  []string
+	tokens                   TokenSource
+
+	conn          net.Conn
+	preConn       net.Conn // handed over by NewClientFromConn, not used yet
+	fromConn      bool
+	dialer        Dialer
+	proxy         *url.URL
+	proxyFromEnv  bool
+	tlsConfig     *tls.Config
+	certStore     CertStore
+	tlsPolicy     tlsPolicy
+	timeout       time.Duration
+	timeouts      struct{ connect, read, idle, greeting time.Duration }
+	retries       *dialRetries
+	logger        Logger
+	logMask       imap.LogMask
+	logMaskSet    bool
+	noCompress    bool
+	compressed    bool
+	compressLevel int
+	transcript    io.Writer
+	progress      func(Progress)
+	events        chan<- Event
+
+	isTLS, requireStartTLS bool
+	allowCleartext         bool
+
+	retryPolicy RetryPolicy
+	selected    string
+	pipelining  int
+	middlewares []Middleware
+
+	mu            sync.Mutex
+	depth         int32
+	lastUsed      time.Time
+	keepAlive     time.Duration
+	keepAliveStop chan struct{}
+	idleLogout    time.Duration
+	loggedOut     bool
+
+	id    map[string]string
+	ns    *Namespaces
+	delim *string
+
+	specialUse, specialUseCache map[string]string
+	followReferrals             bool
+	approveReferral             func(host string) bool
 }
 
-// NewClient returns a new (not connected) Client, using TLS iff port == 143.
+// NewClient returns a new (not connected) Client: with implicit TLS on port 993
+// (and on the ports other than 143), plaintext upgraded with STARTTLS (if the
+// server supports it) on port 143. Port 0 means 993, falling back to 143 if
+// that cannot be connected to.
+//
+// On port 143, against a server without STARTTLS, Connect refuses to send the
+// password in cleartext, so it cannot log in: use
+// NewClientWithOptions(host, WithPort(port), WithAuth(username, password), WithoutTLS(), WithAllowCleartext())
+// to allow that explicitly.
+//
+// It is a shorthand for NewClientWithOptions, which allows overriding the
+// selection (see WithPort, WithTLS, WithoutTLS and WithRequireStartTLS).
 func NewClient(host string, port int, username, password string) Client {
-	if port == 0 {
-		port = 143
-	}
-	if port == 143 {
-		return NewClientNoTLS(host, port, username, password)
+	opts := []Option{WithPort(port), WithAuth(username, password)}
+	if port != 0 && port != 143 {
+		opts = append(opts, WithTLS(nil))
 	}
-	return NewClientTLS(host, port, username, password)
+	return NewClientWithOptions(host, opts...)
 }
 
-// NewClientTLS returns a new (not connected) Client, using TLS.
+// NewClientTLS returns a new (not connected) Client, using TLS (port 993 by default).
 func NewClientTLS(host string, port int, username, password string) Client {
-	if port == 0 {
-		port = 143
-	}
-	return &client{host: host, port: port, username: username, password: password, tls: forceTLS}
+	return NewClientWithOptions(host, WithPort(port), WithAuth(username, password), WithTLS(nil))
 }
 
-// NewClientNoTLS returns a new (not connected) Client, without TLS.
+// NewClientNoTLS returns a new (not connected) Client, without TLS (port 143 by default).
+// It sends the password in cleartext (see WithAllowCleartext).
 func NewClientNoTLS(host string, port int, username, password string) Client {
-	if port == 0 {
-		port = 143
+	return NewClientWithOptions(host, WithPort(port), WithAuth(username, password), WithoutTLS(), WithAllowCleartext())
+}
+
+// getTimeout returns the timeout of the client, Timeout if not set.
+func (c *client) getTimeout() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
 	}
-	return &client{host: host, port: port, username: username, password: password, tls: noTLS}
+	return Timeout
 }
 
-// String returns the connection parameters.
-func (c client) String() string {
-	return c.username + "@" + c.host + ":" + strconv.Itoa(c.port)
+// connectTimeout returns the timeout for dialing and authentication.
+func (c *client) connectTimeout() time.Duration {
+	if c.timeouts.connect > 0 {
+		return c.timeouts.connect
+	}
+	return c.getTimeout()
 }
 
-// SetLogMask allows setting the underlying imap.LogMask.
-func (c client) SetLogMask(mask imap.LogMask) imap.LogMask {
-	return c.c.SetLogMask(imap.LogAll)
+// greetingTimeout returns the timeout for the server greeting (and the
+// implicit TLS handshake): the one set with WithGreetingTimeout, or with
+// WithConnectTimeout, or GreetingTimeout.
+func (c *client) greetingTimeout() time.Duration {
+	if c.timeouts.greeting > 0 {
+		return c.timeouts.greeting
+	}
+	if c.timeouts.connect > 0 {
+		return c.timeouts.connect
+	}
+	return GreetingTimeout
 }
 
-// ReadTo reads the message identified by the given msgID, into the io.Writer.
-func (c client) ReadTo(w io.Writer, msgID uint32) (int64, error) {
-	var length int64
-	set := &imap.SeqSet{}
-	set.AddNum(msgID)
+// dialRetries is the dial retry policy of WithConnectRetries.
+type dialRetries struct {
+	n       int
+	backoff time.Duration
+}
 
-	cmd, err := c.c.UIDFetch(set, "BODY.PEEK[]")
-	if err != nil {
-		return length, err
+// connectRetries returns the number of dial retries, and the first backoff.
+func (c *client) connectRetries() (int, time.Duration) {
+	if c.retries != nil {
+		return c.retries.n, c.retries.backoff
 	}
+	return ConnectRetries, ConnectBackoff
+}
 
-	for cmd.InProgress() {
-		// wait for server response
-		if err = c.c.Recv(Timeout); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return length, err
-		}
-		// Process data.
-		for _, resp := range cmd.Data {
-			//Log.Debug("resp", "resp", resp, "messageinfo", resp.MessageInfo(), "attrs", resp.MessageInfo().Attrs)
-			n, err := w.Write(imap.AsBytes(resp.MessageInfo().Attrs["BODY[]"]))
-			if err != nil {
-				return length, err
+// readTimeout returns the timeout for receiving a server response.
+func (c *client) readTimeout() time.Duration {
+	if c.timeouts.read > 0 {
+		return c.timeouts.read
+	}
+	return c.getTimeout()
+}
+
+// idleTimeout returns the maximum time of an IDLE command.
+func (c *client) idleTimeout() time.Duration {
+	if c.timeouts.idle > 0 {
+		return c.timeouts.idle
+	}
+	return IdleTimeout
+}
+
+// wait is like imap.Wait, but gives up if no response arrives within
+// the read timeout.
+func (c *client) wait(cmd *imap.Command, err error) (*imap.Command, error) {
+	if err != nil {
+		return cmd, classify("", nil, err)
+	}
+	return cmd, c.intercept(cmd.Name(true), func() error {
+		for cmd.InProgress() {
+			if err := c.c.Recv(c.readTimeout()); err != nil {
+				return classify("", ErrConnection, err)
 			}
-			length += int64(n)
 		}
-		cmd.Data = nil
+		_, err := cmd.Result(imap.OK)
+		return classify("", nil, err)
+	})
+}
+
+// withDeadline calls fn with the connection deadline set to d from now.
+func (c *client) withDeadline(d time.Duration, fn func() error) error {
+	if c.conn != nil && d > 0 {
+		c.conn.SetDeadline(time.Now().Add(d))
+		defer c.conn.SetDeadline(time.Time{})
 	}
+	return fn()
+}
 
-	// Check command completion status.
-	if _, err = cmd.Result(imap.OK); err != nil {
-		return length, err
+// String returns the connection parameters.
+func (c *client) String() string {
+	return c.username + "@" + c.host + ":" + strconv.Itoa(c.port)
+}
+
+// SetLogMask sets the imap.LogMask of the protocol log (see WithLogMask),
+// and returns the previous one.
+func (c *client) SetLogMask(mask imap.LogMask) imap.LogMask {
+	c.enter()
+	defer c.leave()
+	old := c.logMask
+	c.logMask, c.logMaskSet = mask, true
+	if c.c != nil {
+		return c.c.SetLogMask(mask)
 	}
-	return length, nil
+	return old
 }
 
-// Move the msgID to the given mbox.
-func (c *client) Move(msgID uint32, mbox string) error {
-	created := false
-	for _, k := range c.created {
-		if mbox == k {
-			created = true
-			break
-		}
+// Capabilities returns the capabilities advertised by the server, after Connect.
+func (c *client) Capabilities() map[string]bool {
+	c.enter()
+	defer c.leave()
+	if c.c == nil {
+		return nil
+	}
+	caps := make(map[string]bool, len(c.c.Caps))
+	for k, v := range c.c.Caps {
+		caps[k] = v
 	}
-	if !created {
-		Log.Info("Create", "mbox", mbox)
-		c.created = append(c.created, mbox)
-		if _, err := imap.Wait(c.c.Create(mbox)); err != nil {
-			Log.Error("Create", "mbox", mbox, "error", err)
+	return caps
+}
+
+// Supports reports whether the server advertises the capability (such as
+// "MOVE", "IDLE" or "AUTH=PLAIN").
+func (c *client) Supports(capability string) bool {
+	c.enter()
+	defer c.leave()
+	return c.c != nil && c.c.Caps[strings.ToUpper(capability)]
+}
+
+// Compressed reports whether the connection is compressed with COMPRESS=DEFLATE.
+func (c *client) Compressed() bool {
+	c.enter()
+	defer c.leave()
+	return c.c != nil && c.compressed
+}
+
+// ReadTo reads the message identified by the given msgID, into the io.Writer.
+//
+// The message is fetched in ReadChunkSize pieces, so memory usage is bounded
+// regardless of the message size. It uses BODY.PEEK, so it never sets \Seen.
+// The body literals are written to w as they are received, without being
+// buffered first. See WithProgress for the progress reporting.
+func (c *client) ReadTo(w io.Writer, msgID uint32) (int64, error) {
+	c.enter()
+	defer c.leave()
+	set := getSeqSet(msgID)
+	defer putSeqSet(set)
+
+	bw := &bodyWriter{w: w}
+	chunk := int64(ReadChunkSize)
+	var size int64
+	var itemBuf []byte
+	itemArr := [2]string{"BODY.PEEK[]", "RFC822.SIZE"}
+	for {
+		var got int64
+		err := c.retry("ReadTo", func() error {
+			// after a reconnect, fetch only the not yet written part
+			items := itemArr[:1]
+			switch {
+			case chunk > 0:
+				itemBuf = partialItem(itemBuf[:0], bw.n, chunk-got)
+				items[0] = string(itemBuf)
+				if bw.n == 0 {
+					items = itemArr[:2]
+				}
+			case bw.n > 0:
+				itemBuf = partialItem(itemBuf[:0], bw.n, math.MaxUint32)
+				items[0] = string(itemBuf)
+			}
+			prev := c.c.SetLiteralReader(bw)
+			defer c.c.SetLiteralReader(prev)
+			start := bw.n
+			err := c.fetch(set, items, func(resp *imap.Response) error {
+				if info := resp.MessageInfo(); info.Size > 0 {
+					size = int64(info.Size)
+				}
+				return nil
+			})
+			got += bw.n - start
+			if bw.err != nil {
+				return bw.err
+			}
+			return err
+		})
+		if err == nil && got > 0 {
+			c.reportProgress(Progress{UID: msgID, Received: bw.n, Total: size, Message: 1, Messages: 1})
+		}
+		if err != nil || chunk <= 0 || got < chunk || size > 0 && bw.n >= size {
+			return bw.n, err
 		}
 	}
+}
+
+// Move the msgID to the given mbox.
+//
+// Uses UID MOVE (RFC 6851) if the server supports it, UID COPY and \Deleted otherwise.
+// If the server has a personal namespace prefix (such as "INBOX."), then mbox is put under it.
+func (c *client) Move(msgID uint32, mbox string) error {
+	return c.MoveMany([]uint32{msgID}, mbox)
+}
 
+// MoveMany moves the messages to mbox (creating it if needed) with one
+// UID MOVE, or, without MOVE support, one UID COPY and one UID STORE of \Deleted.
+func (c *client) MoveMany(uids []uint32, mbox string) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	c.enter()
+	defer c.leave()
+	mbox = c.serverName(mbox)
+	c.ensureCreated(mbox)
+	return c.moveMany(uids, mbox)
+}
+
+// moveMany moves the messages to the existing mbox, given by its server name.
+func (c *client) moveMany(uids []uint32, mbox string) error {
 	set := &imap.SeqSet{}
-	set.AddNum(msgID)
+	set.AddNum(uids...)
 
-	if _, err := imap.Wait(c.c.UIDCopy(set, mbox)); err != nil {
+	if c.c.Caps["MOVE"] {
+		_, err := c.wait(c.c.Send("UID MOVE", set, c.mailboxName(mbox)))
 		return err
 	}
 
-	return c.MarkDeleted(msgID)
+	if _, err := c.wait(c.c.UIDCopy(set, mbox)); err != nil {
+		return err
+	}
+
+	return c.store("MoveMany", uids, `\Deleted`, true, true)
+}
+
+// ensureCreated creates mbox, once per client - errors (such as ALREADYEXISTS)
+// are just logged.
+func (c *client) ensureCreated(mbox string) {
+	for _, k := range c.created {
+		if mbox == k {
+			return
+		}
+	}
+	c.logger.Info("Create", "mbox", mbox)
+	c.created = append(c.created, mbox)
+	if _, err := c.wait(c.c.Create(mbox)); err != nil {
+		c.logger.Error("Create", "mbox", mbox, "error", err)
+	}
+}
+
+// Append appends the message read from r to mbox, with the given flags,
+// and date as internal date (unless it is zero).
+// Returns the UID of the new message if the server supports UIDPLUS, 0 otherwise.
+//
+// The message is sent as a literal by go-imap's command writer: this package
+// does not support non-synchronizing literals (LITERAL+, RFC 7888), so each
+// Append waits for the continuation request of the server.
+func (c *client) Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error) {
+	c.enter()
+	defer c.leave()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var idate *time.Time
+	if !date.IsZero() {
+		idate = &date
+	}
+	mbox = c.serverName(mbox)
+	cmd, err := c.wait(c.c.Append(mbox, imap.NewFlagSet(flags...), idate, imap.NewLiteral(body)))
+	if err != nil {
+		return 0, err
+	}
+	if rsp, err := cmd.Result(imap.OK); err == nil && rsp != nil && strings.EqualFold(rsp.Label, "APPENDUID") {
+		if args := respCodeArgs(rsp); len(args) >= 2 {
+			return uint32(asUint64(args[1])), nil
+		}
+	}
+	return 0, nil
 }
 
 // Get the Flags by MsgId.
@@ -206,82 +527,195 @@ func (c *client) SetFlagRegex(msgID uint32, regex string, st bool) error {
 
 // Get the Flags by MsgId.
 func (c *client) GetFlags(msgID uint32) (imap.FlagSet, error) {
-	set := &imap.SeqSet{}
-	set.AddNum(msgID)
+	c.enter()
+	defer c.leave()
+	set := getSeqSet(msgID)
+	defer putSeqSet(set)
 
-	cmd, err := imap.Wait(c.c.UIDFetch(set, "FLAGS"))
-	if err != nil {
-		return nil, err
+	var flags imap.FlagSet
+	found := false
+	err := c.retry("GetFlags", func() error {
+		return c.fetch(set, []string{"FLAGS"}, func(resp *imap.Response) error {
+			if info := resp.MessageInfo(); info.UID == msgID {
+				flags, found = info.Flags, true
+			}
+			return nil
+		})
+	})
+	if err == nil && !found {
+		err = &imap.ProtocolError{Info: "no FLAGS for UID " + strconv.FormatUint(uint64(msgID), 10)}
+	}
+	return flags, err
+}
+
+// GetSize returns the RFC822.SIZE of the message, without fetching its body.
+func (c *client) GetSize(msgID uint32) (uint32, error) {
+	c.enter()
+	defer c.leave()
+	set := getSeqSet(msgID)
+	defer putSeqSet(set)
+	var size uint32
+	found := false
+	err := c.retry("GetSize", func() error {
+		return c.fetch(set, []string{"RFC822.SIZE"}, func(resp *imap.Response) error {
+			if info := resp.MessageInfo(); info.UID == msgID {
+				size, found = info.Size, true
+			}
+			return nil
+		})
+	})
+	if err == nil && !found {
+		err = &imap.ProtocolError{Info: "no RFC822.SIZE for UID " + strconv.FormatUint(uint64(msgID), 10)}
 	}
+	return size, err
+}
 
-	if _, err = cmd.Result(imap.OK); err != nil {
+// ListKeywords returns the keywords (the flags which are not system flags,
+// such as $Processed) of the message, sorted.
+func (c *client) ListKeywords(msgID uint32) ([]string, error) {
+	flags, err := c.GetFlags(msgID)
+	if err != nil {
 		return nil, err
 	}
+	return keywords(flags), nil
+}
 
-	resp := cmd.Data[0].MessageInfo()
-	return resp.Flags, nil
+// keywords returns the non-system flags, sorted.
+func keywords(flags imap.FlagSet) []string {
+	kws := make([]string, 0, len(flags))
+	for f := range flags {
+		if !strings.HasPrefix(f, `\`) {
+			kws = append(kws, f)
+		}
+	}
+	sort.Strings(kws)
+	return kws
 }
 
 // List the messages from the given mbox, matching the pattern.
 // Lists only new (UNSEEN) messages iff all is false.
 func (c *client) List(mbox, pattern string, all bool) ([]uint32, error) {
-	Log.Debug("List", "mbox", mbox, "pattern", pattern)
-	_, err := imap.Wait(c.c.Select(mbox, false))
-	if err != nil {
-		return nil, err
-	}
-	var fields = make([]imap.Field, 0, 4)
+	c.logger.Debug("List", "mbox", mbox, "pattern", pattern)
+	return c.Search(mbox, listCriteria(pattern, all))
+}
+
+// listCriteria returns the SearchCriteria of List.
+func listCriteria(pattern string, all bool) SearchCriteria {
+	crit := SearchCriteria{Subject: pattern}
 	if all {
-		fields = append(fields, imap.Field("NOT"), imap.Field("DELETED"))
+		crit.WithoutFlags = []string{`\Deleted`}
 	} else {
-		fields = append(fields, imap.Field("UNSEEN"))
-	}
-	if pattern != "" {
-		fields = append(fields, imap.Field("SUBJECT"), c.c.Quote(pattern))
-	}
-	ok := false
-	var cmd *imap.Command
-	if !c.noUTF8 {
-		if cmd, err = imap.Wait(c.c.UIDSearch(fields...)); err != nil {
-			Log.Debug("UIDSearch", "fields", fields, "error", err)
-			if strings.Index(err.Error(), "BADCHARSET") >= 0 {
-				c.noUTF8 = true
-			} else {
-				return nil, err
-			}
-		} else {
-			ok = true
-		}
+		crit.WithoutFlags = []string{`\Seen`}
 	}
-	if !ok && c.noUTF8 {
-		if pattern != "" {
-			fields[len(fields)-1] = c.c.Quote(imap.UTF7Encode(pattern))
-		}
-		cmd, err = imap.Wait(c.c.Send("UID SEARCH", fields))
-		Log.Debug("UID SEARCH", "fields", fields, "error", err)
-		if err != nil {
-			return nil, err
+	return crit
+}
+
+// ListSince lists the not deleted messages of mbox with an internal date
+// on or after the day of since.
+func (c *client) ListSince(mbox string, since time.Time) ([]uint32, error) {
+	c.logger.Debug("ListSince", "mbox", mbox, "since", since)
+	return c.Search(mbox, betweenCriteria(since, time.Time{}))
+}
+
+// ListBetween lists the not deleted messages of mbox with an internal date
+// on or after the day of from, and before the day of to.
+// The zero from or to means no limit on that side.
+func (c *client) ListBetween(mbox string, from, to time.Time) ([]uint32, error) {
+	c.logger.Debug("ListBetween", "mbox", mbox, "from", from, "to", to)
+	return c.Search(mbox, betweenCriteria(from, to))
+}
+
+// ListNewer lists the messages of mbox with UID above lastUID (in increasing
+// order), with one UID SEARCH UID lastUID+1:* - the primitive of incremental
+// consumers, which remember the last processed UID.
+func (c *client) ListNewer(mbox string, lastUID uint32) ([]uint32, error) {
+	c.logger.Debug("ListNewer", "mbox", mbox, "lastUID", lastUID)
+	uids, err := c.Search(mbox, newerCriteria(SearchCriteria{}, lastUID))
+	return uidsAbove(uids, lastUID), err
+}
+
+// newerCriteria returns crit restricted to the UIDs above lastUID.
+func newerCriteria(crit SearchCriteria, lastUID uint32) SearchCriteria {
+	crit.Raw = append(crit.Raw[:len(crit.Raw):len(crit.Raw)],
+		imap.Field("UID"), imap.Field(strconv.FormatUint(uint64(lastUID)+1, 10)+":*"))
+	return crit
+}
+
+// uidsAbove returns the UIDs above lastUID, sorted: n:* matches the last
+// message even if its UID is below n.
+func uidsAbove(uids []uint32, lastUID uint32) []uint32 {
+	filtered := uids[:0]
+	for _, uid := range uids {
+		if uid > lastUID {
+			filtered = append(filtered, uid)
 		}
 	}
-	if _, err = cmd.Result(imap.OK); err != nil {
-		return nil, err
-	}
-	Log.Debug("List", "data", cmd.Data)
-	var uids []uint32
-	for _, resp := range cmd.Data {
-		uids = append(uids, resp.SearchResults()...)
-	}
-	return uids, nil
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i] < filtered[j] })
+	return filtered
+}
+
+// betweenCriteria returns the SearchCriteria of ListSince and ListBetween.
+func betweenCriteria(from, to time.Time) SearchCriteria {
+	return SearchCriteria{Since: from, Before: to, WithoutFlags: []string{`\Deleted`}}
 }
 
 // Close closes the currently selected mailbox, then logs out.
 func (c *client) Close(expunge bool) error {
+	c.lock()
+	defer c.leave()
+	c.stopKeepAlive()
+	if c.loggedOut {
+		c.c, c.loggedOut, c.selected = nil, false, ""
+	}
 	if c.c == nil {
 		return nil
 	}
 	c.c.Close(expunge)
-	_, err := imap.Wait(c.c.Logout(Timeout))
+	_, err := c.wait(c.c.Logout(c.readTimeout()))
 	c.c = nil
+	c.selected = ""
+	c.emit(Event{Type: EventDisconnected, Err: err})
+	return err
+}
+
+// Expunge permanently removes those of the given messages which are
+// flagged \Deleted, using UID EXPUNGE - other \Deleted messages are kept.
+// Without UIDs, it does nothing: see ExpungeAll.
+//
+// Returns imap.NotAvailableError if the server does not support UIDPLUS.
+func (c *client) Expunge(uids ...uint32) error {
+	c.enter()
+	defer c.leave()
+	if len(uids) == 0 {
+		return nil
+	}
+	if !c.c.Caps["UIDPLUS"] {
+		return imap.NotAvailableError("UIDPLUS")
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+	return c.retry("Expunge", func() error {
+		_, err := c.wait(c.c.Expunge(set))
+		return err
+	})
+}
+
+// ExpungeAll permanently removes all the \Deleted messages of the selected
+// mailbox, with EXPUNGE - as Close(true) does, but keeping the mailbox selected.
+func (c *client) ExpungeAll() error {
+	c.enter()
+	defer c.leave()
+	return c.retry("ExpungeAll", func() error {
+		_, err := c.wait(c.c.Expunge(nil))
+		return err
+	})
+}
+
+// Check requests a checkpoint of the selected mailbox (CHECK).
+func (c *client) Check() error {
+	c.enter()
+	defer c.leave()
+	_, err := c.wait(c.c.Check())
 	return err
 }
 
@@ -305,56 +739,386 @@ func (c *client) MarkUndeleted(msgID uint32) error {
 	return c.SetFlag(msgID, `\Deleted`, false)
 }
 
+// Mark the message answered
+func (c *client) MarkAnswered(msgID uint32) error {
+	return c.SetFlag(msgID, `\Answered`, true)
+}
+
+// Mark the message flagged (important)
+func (c *client) MarkFlagged(msgID uint32) error {
+	return c.SetFlag(msgID, `\Flagged`, true)
+}
+
+// Mark the message unflagged
+func (c *client) MarkUnflagged(msgID uint32) error {
+	return c.SetFlag(msgID, `\Flagged`, false)
+}
+
+// Mark the message draft
+func (c *client) MarkDraft(msgID uint32) error {
+	return c.SetFlag(msgID, `\Draft`, true)
+}
+
+// Delete deletes the message: if permanent, it is flagged \Deleted, and
+// removed immediately with UID EXPUNGE (which needs UIDPLUS); otherwise it is
+// moved to the Trash mailbox (see SpecialUse) - or deleted permanently,
+// if it is in the Trash already.
+func (c *client) Delete(msgID uint32, permanent bool) error {
+	if !permanent {
+		trash, err := c.SpecialUse(UseTrash)
+		if err != nil {
+			return err
+		}
+		if c.Selected() != trash {
+			return c.MoveToTrash(msgID)
+		}
+	}
+	return c.DeleteMany([]uint32{msgID}, true)
+}
+
+// DeleteMany marks the messages deleted with one UID STORE, and, if expunge
+// is true, removes exactly those messages with UID EXPUNGE.
+//
+// Expunging needs UIDPLUS, as a plain EXPUNGE would remove the other \Deleted
+// messages, too: without it, imap.NotAvailableError("UIDPLUS") is returned
+// (after the messages are marked deleted).
+func (c *client) DeleteMany(uids []uint32, expunge bool) error {
+	if err := c.store("DeleteMany", uids, `\Deleted`, true, true); err != nil || !expunge {
+		return err
+	}
+	return c.Expunge(uids...)
+}
+
 // Set the specified keyword
 func (c *client) SetFlag(msgID uint32, keyword string, st bool) error {
-	set := &imap.SeqSet{}
-	set.AddNum(msgID)
+	return c.store("SetFlag", []uint32{msgID}, keyword, st, false)
+}
+
+// SetFlags sets (or unsets) the keyword on all the messages, with one UID STORE.
+func (c *client) SetFlags(uids []uint32, keyword string, st bool) error {
+	return c.store("SetFlags", uids, keyword, st, false)
+}
+
+// SetFlagsSilent is SetFlags with +FLAGS.SILENT (-FLAGS.SILENT), so the server
+// does not echo the new flags of each message.
+func (c *client) SetFlagsSilent(uids []uint32, keyword string, st bool) error {
+	return c.store("SetFlagsSilent", uids, keyword, st, true)
+}
+
+// ReplaceFlags sets the flags of the message to exactly flags, atomically,
+// with one UID STORE FLAGS (\Recent is ignored, as it cannot be stored).
+func (c *client) ReplaceFlags(msgID uint32, flags []string) error {
+	c.enter()
+	defer c.leave()
+	set := getSeqSet(msgID)
+	defer putSeqSet(set)
+	list := make([]imap.Field, 0, len(flags))
+	for _, f := range flags {
+		if !strings.EqualFold(f, `\Recent`) {
+			list = append(list, imap.Field(f))
+		}
+	}
+	return c.retry("ReplaceFlags", func() error {
+		_, err := c.wait(c.c.UIDStore(set, "FLAGS", list))
+		return err
+	})
+}
+
+// MarkSeenAll marks all the messages seen, with one (silent) UID STORE.
+func (c *client) MarkSeenAll(uids []uint32) error {
+	return c.store("MarkSeenAll", uids, `\Seen`, true, true)
+}
+
+// store adds (or removes) the keyword to the messages, with one UID STORE -
+// with .SILENT iff silent is true.
+func (c *client) store(name string, uids []uint32, keyword string, st, silent bool) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	c.enter()
+	defer c.leave()
+	set := getSeqSet(uids...)
+	defer putSeqSet(set)
 
 	item := "+FLAGS"
-	if !st {
+	switch {
+	case st && silent:
+		item = "+FLAGS.SILENT"
+	case silent:
+		item = "-FLAGS.SILENT"
+	case !st:
 		item = "-FLAGS"
 	}
-	_, err := imap.Wait(c.c.UIDStore(set, item, imap.Field(keyword)))
-	return err
+	return c.retry(name, func() error {
+		_, err := c.wait(c.c.UIDStore(set, item, imap.Field(keyword)))
+		return err
+	})
 }
 
-// Connect to the server.
-func (c *client) Connect() error {
-	addr := c.host + ":" + strconv.Itoa(c.port)
+// getTLSConfig returns a copy of the TLS config of the client (TLSConfig if not set),
+// with the TLS policy applied, and ServerName set to the host if empty.
+func (c *client) getTLSConfig() *tls.Config {
+	cfg := TLSConfig.Clone()
+	if c.tlsConfig != nil {
+		cfg = c.tlsConfig.Clone()
+	}
+	c.tlsPolicy.apply(cfg)
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.host
+	}
+	if c.certStore != nil {
+		cfg.InsecureSkipVerify = true // the pinned key is verified instead
+		cfg.VerifyConnection = c.verifyPinned
+	}
+	return cfg
+}
+
+// dialPorts dials the port of the client - or, if it is 0, port 993 with TLS,
+// then port 143 (unless 993 failed with a certificate error), and keeps the
+// port which could be connected to.
+func (c *client) dialPorts() (*imap.Client, error) {
+	if c.port != 0 || c.fromConn {
+		return c.dial(c.host + ":" + strconv.Itoa(c.port))
+	}
 	var err error
-	if c.tls == noTLS || c.tls == maybeTLS && c.port == 143 {
-		c.c, err = imap.Dial(addr)
-	} else {
-		c.c, err = imap.DialTLS(addr, &TLSConfig)
+	for _, port := range []int{993, 143} {
+		c.port = port
+		var ic *imap.Client
+		if ic, err = c.dial(c.host + ":" + strconv.Itoa(port)); err == nil {
+			return ic, nil
+		}
+		var certErr *tls.CertificateVerificationError
+		var mismatch *CertMismatchError
+		if errors.As(err, &certErr) || errors.As(err, &mismatch) {
+			break
+		}
+		c.logger.Info("Connect", "host", c.host, "port", port, "error", err)
+	}
+	c.port = 0
+	return nil, err
+}
+
+// dial connects to addr and waits for the server greeting (see greetingTimeout).
+func (c *client) dial(addr string) (*imap.Client, error) {
+	if c.fromConn {
+		return c.dialPre()
+	}
+	var d Dialer = &net.Dialer{Timeout: c.connectTimeout()}
+	if c.dialer != nil {
+		d = c.dialer
 	}
+	proxy := c.proxy
+	if proxy == nil && c.proxyFromEnv {
+		var err error
+		if proxy, err = proxyFromEnvironment(c.host); err != nil {
+			return nil, err
+		}
+	}
+	if proxy != nil {
+		d = proxyDialer{proxy: proxy, forward: d, timeout: c.connectTimeout()}
+	}
+	conn, err := d.Dial("tcp", addr)
 	if err != nil {
+		return nil, err
+	}
+	c.isTLS = !(c.tls == noTLS || c.tls == maybeTLS && c.port == 143)
+	if c.isTLS {
+		conn = tls.Client(conn, c.getTLSConfig())
+	}
+	if c.transcript != nil {
+		conn = newRecordConn(conn, c.transcript)
+	}
+	return c.newIMAP(conn)
+}
+
+// dialPre uses the connection handed over to NewClientFromConn - only once.
+func (c *client) dialPre() (*imap.Client, error) {
+	conn := c.preConn
+	if conn == nil {
+		return nil, ErrConnHandedOver
+	}
+	c.preConn = nil
+	_, isTLS := conn.(*tls.Conn)
+	c.isTLS = isTLS || c.tls == forceTLS
+	if c.transcript != nil {
+		conn = newRecordConn(conn, c.transcript)
+	}
+	return c.newIMAP(conn)
+}
+
+func (c *client) newIMAP(conn net.Conn) (*imap.Client, error) {
+	ic, err := imap.NewClient(conn, c.host, c.greetingTimeout())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conn = conn
+	return ic, nil
+}
+
+// startTLS upgrades a plaintext connection with STARTTLS, if supported by the server.
+// Errors are returned only if STARTTLS is required.
+func (c *client) startTLS() error {
+	if c.isTLS || c.c.State() != imap.Login {
+		return nil
+	}
+	if !c.c.Caps["STARTTLS"] {
+		if c.requireStartTLS {
+			return ErrNoStartTLS
+		}
+		return nil
+	}
+	var err error
+	if err = c.withDeadline(c.connectTimeout(), func() error {
+		_, err := c.c.StartTLS(c.getTLSConfig())
 		return err
+	}); err != nil {
+		var mismatch *CertMismatchError
+		if c.requireStartTLS || errors.As(err, &mismatch) {
+			c.logger.Error("StartTLS", "error", err)
+			return err
+		}
+		c.logger.Warn("StartTLS", "error", err)
+		return nil
+	}
+	c.isTLS = true
+	return nil
+}
+
+// authenticate logs in, if the connection is not authenticated yet:
+// with OAuth if there is a TokenSource, else with the strongest registered
+// SASL mechanism supported by the server (see RegisterSASL), then LOGIN.
+//
+// LOGIN is never sent if the server advertises LOGINDISABLED, and the password
+// is not sent over an unencrypted connection, unless WithAllowCleartext is given.
+// Neither is it sent after a SASL mechanism failed the mutual authentication
+// of the server (ErrScramServer), or the server rejected the credentials
+// with AUTHENTICATIONFAILED.
+func (c *client) authenticate() error {
+	if c.c.State() == imap.Login && c.tokens != nil {
+		if err := c.oauth(); err != nil {
+			return err
+		}
+	}
+	var saslErr error
+	if c.c.State() == imap.Login && c.password != "" {
+		saslErr = c.authSASL()
+	}
+	if saslErr != nil && saslFinal(saslErr) {
+		return saslErr
+	}
+	if c.c.State() == imap.Login {
+		if c.c.Caps["LOGINDISABLED"] {
+			if saslErr != nil {
+				return &AuthRefusedError{Reason: "the server advertises LOGINDISABLED, and SASL failed", Err: saslErr}
+			}
+			return &AuthRefusedError{Reason: "the server advertises LOGINDISABLED, and supports no usable SASL mechanism"}
+		}
+		if c.password != "" && !c.isTLS && !c.allowCleartext {
+			return &AuthRefusedError{Reason: "LOGIN would send the password unencrypted (see WithAllowCleartext)", Err: saslErr}
+		}
+		if _, err := c.c.Login(c.username, c.password); err != nil {
+			c.logger.Error("Login", "username", c.username, "capabilities", c.c.Caps, "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Connect to the server.
+//
+// A failed dial is retried ConnectRetries times, sleeping ConnectBackoff
+// (doubled after each attempt) in between - see WithConnectRetries.
+// Referrals are followed if WithFollowReferrals is given.
+func (c *client) Connect() error {
+	c.lock()
+	defer c.leave()
+	c.loggedOut = false
+	// the referrals are followed for this Connect only
+	host, port, username, tls, requireStartTLS := c.host, c.port, c.username, c.tls, c.requireStartTLS
+	followed := false
+	defer func() {
+		if followed {
+			c.host, c.port, c.username, c.tls, c.requireStartTLS = host, port, username, tls, requireStartTLS
+		}
+	}()
+	for hops := 0; ; hops++ {
+		err := c.connect()
+		ref := Referral(err)
+		if ref == "" || !c.followReferrals || hops >= MaxReferrals {
+			return err
+		}
+		c.logger.Info("Connect", "referral", ref, "error", err)
+		followed = true
+		if ferr := c.follow(ref); ferr != nil {
+			c.logger.Error("follow referral", "referral", ref, "error", ferr)
+			return err
+		}
+	}
+}
+
+func (c *client) connect() error {
+	var err error
+	start := time.Now()
+	retries, backoff := c.connectRetries()
+	for i := 0; ; i++ {
+		if c.c, err = c.dialPorts(); err == nil {
+			break
+		}
+		if i >= retries || c.fromConn || kindOf(err) == ErrReferral {
+			return classify("Connect", ErrConnection, err)
+		}
+		c.logger.Warn("Connect", "host", c.host, "port", c.port, "attempt", i+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	c.emit(Event{Type: EventConnected, Duration: time.Since(start)})
+	c.qresync, c.ns, c.delim, c.specialUseCache = false, nil, nil, nil
+	c.c.SetLogger(stdLog(c.logger))
+	if c.logMaskSet {
+		c.c.SetLogMask(c.logMask)
 	}
-	c.c.SetLogger(loghlp.AsStdLog(Log, log15.LvlDebug))
 	// Print server greeting (first response in the unilateral server data queue)
-	Log.Debug("Server says", "hello", c.c.Data[0].Info)
+	c.logger.Debug("Server says", "hello", c.c.Data[0].Info, "preauth", c.c.State() != imap.Login)
 	c.c.Data = nil
 
-	Log.Debug("server", "capabilities", c.c.Caps)
+	c.logger.Debug("server", "capabilities", c.c.Caps)
 	// Enable encryption, if supported by the server
-	if c.c.Caps["STARTTLS"] {
-		c.c.StartTLS(nil)
+	if err = c.startTLS(); err != nil {
+		c.conn.Close()
+		c.c = nil
+		return err
 	}
 
 	// Authenticate
-	if c.c.State() == imap.Login {
-		if _, err = c.c.Login(c.username, c.password); err != nil {
-			Log.Error("Login", "username", c.username, "capabilities", c.c.Caps, "error", err)
-			if _, err = c.c.Auth(CramAuth(c.username, c.password)); err != nil {
-				Log.Error("Authenticate", "username", c.username, "capabilities", c.c.Caps, "error", err)
-				return err
-			}
+	if err = c.withDeadline(c.connectTimeout(), c.authenticate); err != nil {
+		c.conn.Close()
+		c.c = nil
+		return classify("Login", ErrAuth, err)
+	}
+	c.emit(Event{Type: EventAuthenticated})
+
+	if c.id != nil && c.c.Caps["ID"] {
+		if server, err := c.sendID(c.id); err != nil {
+			c.logger.Warn("ID", "error", err)
+		} else {
+			c.logger.Debug("ID", "server", server)
 		}
 	}
 
-	if _, err := c.c.CompressDeflate(2); err != nil {
-		Log.Info("CompressDeflate", "error", err)
+	c.compressed = false
+	if !c.noCompress && c.c.Caps["COMPRESS=DEFLATE"] {
+		level := c.compressLevel
+		if level == 0 {
+			level = CompressLevel
+		}
+		if _, err := c.c.CompressDeflate(level); err != nil {
+			c.logger.Info("CompressDeflate", "level", level, "error", err)
+		} else {
+			c.compressed = true
+		}
 	}
 
+	c.startKeepAlive()
 	return nil
 }
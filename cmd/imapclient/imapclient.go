@@ -0,0 +1,345 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command imapclient is a command-line IMAP client, for scripting and
+// debugging server issues.
+//
+//	imapclient [global flags] <command> [command flags] [args]
+//
+// Commands:
+//
+//	folders [pattern]                  list the mailboxes
+//	list [-mbox INBOX] [-all] [-pattern subject] [-json]
+//	                                   list the (unseen) messages
+//	fetch [-mbox INBOX] [-o file] uid  write the message to stdout or file
+//	move [-mbox INBOX] uid dest        move the message to dest
+//	flag [-mbox INBOX] uid +flag|-flag...
+//	                                   set or clear flags
+//	loop [-mbox INBOX] [-pattern subject] [-outbox mbox] [-errbox mbox] [-rules file.sieve] command [args]
+//	                                   run the delivery loop, piping each message into command
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mxk/go-imap/imap"
+	"github.com/tgulacsi/imapclient"
+	"github.com/tgulacsi/imapclient/keyring"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Log is the logger.
+var Log = log15.New()
+
+func main() {
+	flagUsername := flag.String("u", os.Getenv("IMAP_USER"), "username (default $IMAP_USER)")
+	flagPassword := flag.String("p", os.Getenv("IMAP_PASSWORD"), "password (default $IMAP_PASSWORD)")
+	flagHost := flag.String("H", "localhost", "host")
+	flagPort := flag.Int("P", 143, "port")
+	flagVerbose := flag.Bool("v", false, "verbose logging")
+	flagDryRun := flag.Bool("n", false, "dry run: log the changes instead of executing them")
+	flagProgress := flag.Bool("progress", false, "print the download progress to stderr")
+	flagCleartext := flag.Bool("allow-cleartext", false, "allow sending the password over an unencrypted connection")
+	flagKeyring := flag.Bool("keyring", false, "read the password from the OS keyring if not given, store it there after a successful login otherwise")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	lvl := log15.LvlInfo
+	if *flagVerbose {
+		lvl = log15.LvlDebug
+	}
+	Log.SetHandler(log15.LvlFilterHandler(lvl, log15.StderrHandler))
+	imapclient.Log.SetHandler(log15.LvlFilterHandler(lvl, log15.StderrHandler))
+
+	commands := map[string]func(imapclient.Client, []string) error{
+		"folders": folders,
+		"list":    list,
+		"fetch":   fetch,
+		"move":    move,
+		"flag":    setFlags,
+		"loop":    loop,
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	password, store := *flagPassword, *flagKeyring && *flagPassword != ""
+	if *flagKeyring && password == "" {
+		var err error
+		if password, err = keyring.Password(*flagHost, *flagUsername); err != nil {
+			Log.Crit("keyring", "host", *flagHost, "username", *flagUsername, "error", err)
+			os.Exit(1)
+		}
+	}
+	// TLS iff port != 143, as with imapclient.NewClient
+	opts := []imapclient.Option{imapclient.WithPort(*flagPort), imapclient.WithAuth(*flagUsername, password), imapclient.WithoutTLS()}
+	if *flagPort != 143 {
+		opts[2] = imapclient.WithTLS(nil)
+	}
+	if *flagProgress {
+		opts = append(opts, imapclient.WithProgress(printProgress))
+	}
+	if *flagCleartext {
+		opts = append(opts, imapclient.WithAllowCleartext())
+	}
+	c := imapclient.NewClientWithOptions(*flagHost, opts...)
+	if *flagDryRun {
+		c = imapclient.DryRun(c)
+	}
+	if err := c.Connect(); err != nil {
+		Log.Crit("CONNECT", "error", err)
+		os.Exit(1)
+	}
+	if store {
+		if err := keyring.SetPassword(*flagHost, *flagUsername, password); err != nil {
+			Log.Warn("keyring", "host", *flagHost, "username", *flagUsername, "error", err)
+		}
+	}
+	err := cmd(c, flag.Args()[1:])
+	if closeErr := c.Close(true); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		Log.Error(flag.Arg(0), "error", err)
+		os.Exit(1)
+	}
+}
+
+// printProgress prints the progress of the download to stderr.
+func printProgress(p imapclient.Progress) {
+	if p.Total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%d/%d: %d/%d bytes (%d%%)", p.Message, p.Messages, p.Received, p.Total, 100*p.Received/p.Total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%d/%d: %d bytes", p.Message, p.Messages, p.Received)
+	}
+	if p.Message == p.Messages && (p.Total == 0 || p.Received >= p.Total) {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [global flags] <command> [command flags] [args]
+
+Commands: folders, list, fetch, move, flag, loop. Use "<command> -h" for their flags.
+
+Global flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func folders(c imapclient.Client, args []string) error {
+	fs := flag.NewFlagSet("folders", flag.ExitOnError)
+	fs.Parse(args)
+	pattern := "*"
+	if fs.NArg() > 0 {
+		pattern = fs.Arg(0)
+	}
+	mboxes, err := c.Mailboxes(pattern)
+	if err != nil {
+		return err
+	}
+	for _, mbox := range mboxes {
+		fmt.Println(mbox.Name)
+	}
+	return nil
+}
+
+func list(c imapclient.Client, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	mbox := fs.String("mbox", "INBOX", "mailbox")
+	all := fs.Bool("all", false, "list all, not just UNSEEN")
+	pattern := fs.String("pattern", "", "subject pattern")
+	asJSON := fs.Bool("json", false, "print the summaries (with envelope and body structure) as JSON")
+	fs.Parse(args)
+	if *asJSON {
+		uids, err := c.List(*mbox, *pattern, *all)
+		if err != nil {
+			return err
+		}
+		sums, err := imapclient.Summaries(c, *mbox, uids)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sums)
+	}
+	infos, err := c.ListWithInfo(*mbox, *pattern, *all)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		fmt.Printf("%d\t%s\t%d\t%s\t%s\n", info.UID, info.Date.Format("2006-01-02 15:04:05"), info.Size, info.From, info.Subject)
+	}
+	return nil
+}
+
+func fetch(c imapclient.Client, args []string) error {
+	fs := flag.NewFlagSet("fetch", flag.ExitOnError)
+	mbox := fs.String("mbox", "INBOX", "mailbox")
+	output := fs.String("o", "", "output file (default stdout)")
+	fs.Parse(args)
+	uid, err := uidArg(fs)
+	if err != nil {
+		return err
+	}
+	if err = selectMailbox(c, *mbox, uid); err != nil {
+		return err
+	}
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		fh, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		w = fh
+	}
+	_, err = c.ReadTo(w, uid)
+	return err
+}
+
+func move(c imapclient.Client, args []string) error {
+	fs := flag.NewFlagSet("move", flag.ExitOnError)
+	mbox := fs.String("mbox", "INBOX", "mailbox")
+	fs.Parse(args)
+	uid, err := uidArg(fs)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("destination mailbox is needed")
+	}
+	if err = selectMailbox(c, *mbox, uid); err != nil {
+		return err
+	}
+	return c.Move(uid, fs.Arg(1))
+}
+
+func setFlags(c imapclient.Client, args []string) error {
+	fs := flag.NewFlagSet("flag", flag.ExitOnError)
+	mbox := fs.String("mbox", "INBOX", "mailbox")
+	fs.Parse(args)
+	uid, err := uidArg(fs)
+	if err != nil {
+		return err
+	}
+	if err = selectMailbox(c, *mbox, uid); err != nil {
+		return err
+	}
+	for _, f := range fs.Args()[1:] {
+		set := !strings.HasPrefix(f, "-")
+		if err = c.SetFlag(uid, strings.TrimLeft(f, "+-"), set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loop(c imapclient.Client, args []string) error {
+	fs := flag.NewFlagSet("loop", flag.ExitOnError)
+	mbox := fs.String("mbox", "INBOX", "mailbox")
+	pattern := fs.String("pattern", "", "subject pattern")
+	outbox := fs.String("outbox", "", "mailbox for the delivered messages")
+	errbox := fs.String("errbox", "", "mailbox for the failed messages")
+	rulesFile := fs.String("rules", "", "Sieve script routing the messages (keep pipes into command)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("handler command is needed")
+	}
+	handler := fs.Args()
+	// the loop connects by itself
+	c.Close(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+	deliver := func(r io.ReadSeeker, uid uint32, hsh []byte) error {
+		cmd := exec.CommandContext(ctx, handler[0], handler[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = r, os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(),
+			"IMAP_MAILBOX="+*mbox,
+			"IMAP_UID="+strconv.FormatUint(uint64(uid), 10),
+			"IMAP_HASH="+hex.EncodeToString(hsh))
+		return cmd.Run()
+	}
+	l := imapclient.Loop{
+		Client: c, Inbox: *mbox, Pattern: *pattern, Outbox: *outbox, Errbox: *errbox,
+		KeepConnected: true,
+		Deliver:       deliver,
+	}
+	if *rulesFile != "" {
+		var err error
+		if l.Rules, err = imapclient.LoadSieve(*rulesFile, func(r io.ReadSeeker, info imapclient.DeliveryInfo) error {
+			return deliver(r, info.UID, info.Hash)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := l.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+func uidArg(fs *flag.FlagSet) (uint32, error) {
+	if fs.NArg() == 0 {
+		return 0, errors.New("UID is needed")
+	}
+	uid, err := strconv.ParseUint(fs.Arg(0), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad UID %q: %w", fs.Arg(0), err)
+	}
+	return uint32(uid), nil
+}
+
+// selectMailbox selects mbox, checking that the message with uid exists.
+func selectMailbox(c imapclient.Client, mbox string, uid uint32) error {
+	uids, err := c.Search(mbox, imapclient.SearchCriteria{
+		Raw: []imap.Field{imap.Field("UID"), imap.Field(strconv.FormatUint(uint64(uid), 10))}})
+	if err != nil {
+		return err
+	}
+	for _, u := range uids {
+		if u == uid {
+			return nil
+		}
+	}
+	return fmt.Errorf("no message with UID %d in %s", uid, mbox)
+}
@@ -0,0 +1,383 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads the accounts and the delivery loops of a daemon from
+// a YAML, TOML or JSON file, and builds the Clients and the Supervisor:
+//
+//	short_sleep: 1s
+//	long_sleep: 5m
+//	accounts:
+//	  support:
+//	    host: imap.example.com
+//	    port: 993
+//	    tls: tls
+//	    username: support@example.com
+//	    password_env: SUPPORT_PASSWORD
+//	loops:
+//	  - name: support-inbox
+//	    account: support
+//	    inbox: INBOX
+//	    outbox: Processed
+//	    errbox: Failed
+//	    use_idle: true
+//	    error_backoff: 30s
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tgulacsi/imapclient"
+	"github.com/tgulacsi/imapclient/keyring"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the accounts and the loops.
+type Config struct {
+	// ShortSleep and LongSleep override imapclient.ShortSleep and
+	// imapclient.LongSleep (the sleeps of the loops after a round with and
+	// without delivered messages), if not zero.
+	ShortSleep Duration `yaml:"short_sleep" toml:"short_sleep" json:"short_sleep"`
+	LongSleep  Duration `yaml:"long_sleep" toml:"long_sleep" json:"long_sleep"`
+	// Accounts are the accounts, by name.
+	Accounts map[string]Account `yaml:"accounts" toml:"accounts" json:"accounts"`
+	// Loops are the delivery loops.
+	Loops []Loop `yaml:"loops" toml:"loops" json:"loops"`
+}
+
+// Account is the configuration of a Client.
+type Account struct {
+	// URL is an IMAP URL (see imapclient.NewClientFromURL), instead of Host,
+	// Port, TLS, Username and Password.
+	URL  string `yaml:"url" toml:"url" json:"url"`
+	Host string `yaml:"host" toml:"host" json:"host"`
+	// Port is the port of the server - 993 with TLS "tls", 143 with "starttls"
+	// or "none", 993 falling back to 143 otherwise.
+	Port int `yaml:"port" toml:"port" json:"port"`
+	// TLS is "tls" (implicit TLS), "starttls" (required STARTTLS), "none"
+	// (plaintext), or empty (STARTTLS if the server supports it; TLS on port 993).
+	TLS string `yaml:"tls" toml:"tls" json:"tls"`
+	// AllowCleartext allows sending the password over an unencrypted
+	// connection (see imapclient.WithAllowCleartext).
+	AllowCleartext bool `yaml:"allow_cleartext" toml:"allow_cleartext" json:"allow_cleartext"`
+	// InsecureSkipVerify disables the verification of the server certificate
+	// (which is verified by default).
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify" toml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	// CAFile is the PEM file of the CA certificates to verify the server with,
+	// instead of the system roots.
+	CAFile string `yaml:"ca_file" toml:"ca_file" json:"ca_file"`
+	// MinTLS is the minimum TLS version: "1.0", "1.1", "1.2" (the default) or "1.3".
+	MinTLS string `yaml:"min_tls" toml:"min_tls" json:"min_tls"`
+	// ServerName is the name of SNI and of the certificate verification,
+	// if it differs from the host (connecting by IP address, for example).
+	ServerName string `yaml:"server_name" toml:"server_name" json:"server_name"`
+	// TOFU is the path of the file of the trusted-on-first-use server keys
+	// (see imapclient.WithTOFU), instead of verifying the certificates.
+	TOFU     string `yaml:"tofu" toml:"tofu" json:"tofu"`
+	Username string `yaml:"username" toml:"username" json:"username"`
+	// Password is the password; PasswordEnv (the name of an environment
+	// variable) or PasswordFile is read if it is empty.
+	Password     string `yaml:"password" toml:"password" json:"password"`
+	PasswordEnv  string `yaml:"password_env" toml:"password_env" json:"password_env"`
+	PasswordFile string `yaml:"password_file" toml:"password_file" json:"password_file"`
+	// Keyring reads the password from the OS keyring (see package keyring),
+	// if the above give none.
+	Keyring bool `yaml:"keyring" toml:"keyring" json:"keyring"`
+	// Timeout is the client timeout, imapclient.Timeout if zero.
+	Timeout Duration `yaml:"timeout" toml:"timeout" json:"timeout"`
+	// Retries is the number of reconnecting retries (see imapclient.WithRetry).
+	Retries int `yaml:"retries" toml:"retries" json:"retries"`
+}
+
+// Loop is the configuration of an imapclient.Loop; see its fields.
+type Loop struct {
+	// Name is the name of the loop, also passed to the deliver function of
+	// Config.Supervisor.
+	Name string `yaml:"name" toml:"name" json:"name"`
+	// Account is the name of the account.
+	Account   string `yaml:"account" toml:"account" json:"account"`
+	Inbox     string `yaml:"inbox" toml:"inbox" json:"inbox"`
+	Pattern   string `yaml:"pattern" toml:"pattern" json:"pattern"`
+	Outbox    string `yaml:"outbox" toml:"outbox" json:"outbox"`
+	Errbox    string `yaml:"errbox" toml:"errbox" json:"errbox"`
+	Rejectbox string `yaml:"rejectbox" toml:"rejectbox" json:"rejectbox"`
+	// Rules is the path of a Sieve script (see imapclient.LoadSieve).
+	Rules         string `yaml:"rules" toml:"rules" json:"rules"`
+	KeepConnected bool   `yaml:"keep_connected" toml:"keep_connected" json:"keep_connected"`
+	UseIdle       bool   `yaml:"use_idle" toml:"use_idle" json:"use_idle"`
+	Peek          bool   `yaml:"peek" toml:"peek" json:"peek"`
+	MaxAttempts   int    `yaml:"max_attempts" toml:"max_attempts" json:"max_attempts"`
+	// ErrorBackoff and MaxErrorBackoff are the Backoff and MaxBackoff of
+	// the ErrorBackoff of the loop.
+	ErrorBackoff    Duration `yaml:"error_backoff" toml:"error_backoff" json:"error_backoff"`
+	MaxErrorBackoff Duration `yaml:"max_error_backoff" toml:"max_error_backoff" json:"max_error_backoff"`
+}
+
+// Duration is a time.Duration, written as "30s" or "5m" in the files.
+type Duration time.Duration
+
+// UnmarshalText parses the duration with time.ParseDuration.
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = Duration(v)
+	return err
+}
+
+// MarshalText returns the duration as "1m30s".
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Load reads the configuration file, in the format of its extension:
+// .yaml / .yml, .toml or .json.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data, strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses the configuration in the format ("yaml", "yml", "toml" or "json"),
+// and checks it.
+func Parse(data []byte, format string) (*Config, error) {
+	var cfg Config
+	var err error
+	switch format {
+	case "yaml", "yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&cfg)
+	case "toml":
+		var md toml.MetaData
+		if md, err = toml.Decode(string(data), &cfg); err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) != 0 {
+				err = fmt.Errorf("unknown keys: %v", undecoded)
+			}
+		}
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&cfg)
+	default:
+		return nil, fmt.Errorf("unknown format %q (yaml, toml or json)", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, cfg.Check()
+}
+
+// Check checks that the accounts have hosts, and the loops have unique
+// names and existing accounts.
+func (cfg *Config) Check() error {
+	var errs []string
+	for name, a := range cfg.Accounts {
+		if a.URL == "" && a.Host == "" {
+			errs = append(errs, fmt.Sprintf("account %q: no host or url", name))
+		}
+		switch a.TLS {
+		case "", "tls", "starttls", "none":
+		default:
+			errs = append(errs, fmt.Sprintf("account %q: unknown tls %q (tls, starttls or none)", name, a.TLS))
+		}
+	}
+	names := make(map[string]bool, len(cfg.Loops))
+	for i, l := range cfg.Loops {
+		if l.Name == "" {
+			errs = append(errs, fmt.Sprintf("loop #%d: no name", i+1))
+		} else if names[l.Name] {
+			errs = append(errs, fmt.Sprintf("loop %q: duplicate name", l.Name))
+		}
+		names[l.Name] = true
+		if _, ok := cfg.Accounts[l.Account]; !ok {
+			errs = append(errs, fmt.Sprintf("loop %q: unknown account %q", l.Name, l.Account))
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13,
+}
+
+// Client returns a new (not connected) Client of the account.
+func (a Account) Client(opts ...imapclient.Option) (imapclient.Client, error) {
+	username, password := a.Username, a.Password
+	if password == "" && a.PasswordEnv != "" {
+		password = os.Getenv(a.PasswordEnv)
+	}
+	if password == "" && a.PasswordFile != "" {
+		b, err := os.ReadFile(a.PasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password = strings.TrimRight(string(b), "\r\n")
+	}
+	if password == "" && a.Keyring {
+		host := a.Host
+		if u, err := url.Parse(a.URL); err == nil && a.URL != "" {
+			if host = u.Hostname(); username == "" && u.User != nil {
+				username = u.User.Username()
+			}
+		}
+		var err error
+		if password, err = keyring.Password(host, username); err != nil {
+			return nil, err
+		}
+	}
+
+	// the server certificate is verified, unlike with imapclient.TLSConfig
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.InsecureSkipVerify}
+	if a.CAFile != "" {
+		pem, err := os.ReadFile(a.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", a.CAFile)
+		}
+	}
+	options := []imapclient.Option{imapclient.WithTLSConfig(tlsConfig)}
+	if a.MinTLS != "" {
+		version, ok := tlsVersions[a.MinTLS]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_tls %q (1.0, 1.1, 1.2 or 1.3)", a.MinTLS)
+		}
+		options = append(options, imapclient.WithTLSMinVersion(version))
+	}
+	if a.ServerName != "" {
+		options = append(options, imapclient.WithServerName(a.ServerName))
+	}
+	if a.TOFU != "" {
+		options = append(options, imapclient.WithTOFU(imapclient.NewFileCertStore(a.TOFU)))
+	}
+	switch {
+	case a.TLS == "tls", a.TLS == "" && a.Port == 993:
+		options = append(options, imapclient.WithTLS(tlsConfig))
+	case a.TLS == "starttls":
+		options = append(options, imapclient.WithRequireStartTLS())
+	case a.TLS == "none":
+		options = append(options, imapclient.WithoutTLS())
+	}
+	if a.AllowCleartext {
+		options = append(options, imapclient.WithAllowCleartext())
+	}
+	if a.Port != 0 {
+		options = append(options, imapclient.WithPort(a.Port))
+	}
+	if username != "" || password != "" {
+		options = append(options, imapclient.WithAuth(username, password))
+	}
+	if a.Timeout != 0 {
+		options = append(options, imapclient.WithTimeout(time.Duration(a.Timeout)))
+	}
+	if a.Retries > 0 {
+		policy := imapclient.DefaultRetryPolicy
+		policy.Retries = a.Retries
+		options = append(options, imapclient.WithRetry(policy))
+	}
+	options = append(options, opts...)
+	if a.URL != "" {
+		c, _, err := imapclient.NewClientFromURL(a.URL, options...)
+		return c, err
+	}
+	return imapclient.NewClientWithOptions(a.Host, options...), nil
+}
+
+// Clients returns a new (not connected) Client of each account, by name.
+func (cfg *Config) Clients(opts ...imapclient.Option) (map[string]imapclient.Client, error) {
+	clients := make(map[string]imapclient.Client, len(cfg.Accounts))
+	for name, a := range cfg.Accounts {
+		c, err := a.Client(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %w", name, err)
+		}
+		clients[name] = c
+	}
+	return clients, nil
+}
+
+// AccountManager returns an AccountManager with a new Client of each account.
+func (cfg *Config) AccountManager(opts ...imapclient.Option) (*imapclient.AccountManager, error) {
+	clients, err := cfg.Clients(opts...)
+	if err != nil {
+		return nil, err
+	}
+	m := imapclient.NewAccountManager()
+	for name, c := range clients {
+		if err = m.Add(name, c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Supervisor returns a Supervisor with the loops, each with its own Client,
+// delivering with deliver(loop name). Sets imapclient.ShortSleep and
+// imapclient.LongSleep, if they are configured.
+func (cfg *Config) Supervisor(deliver func(loop string) imapclient.MessageDeliverFunc, opts ...imapclient.Option) (*imapclient.Supervisor, error) {
+	if cfg.ShortSleep != 0 {
+		imapclient.ShortSleep = time.Duration(cfg.ShortSleep)
+	}
+	if cfg.LongSleep != 0 {
+		imapclient.LongSleep = time.Duration(cfg.LongSleep)
+	}
+	s := imapclient.NewSupervisor()
+	for _, lc := range cfg.Loops {
+		c, err := cfg.Accounts[lc.Account].Client(opts...)
+		if err != nil {
+			return nil, fmt.Errorf("loop %q: %w", lc.Name, err)
+		}
+		l := &imapclient.Loop{
+			Client: c, Inbox: lc.Inbox, Pattern: lc.Pattern, DeliverMessage: deliver(lc.Name),
+			Outbox: lc.Outbox, Errbox: lc.Errbox, Rejectbox: lc.Rejectbox,
+			KeepConnected: lc.KeepConnected, UseIdle: lc.UseIdle, Peek: lc.Peek,
+			MaxAttempts: lc.MaxAttempts,
+			ErrorBackoff: imapclient.RetryPolicy{
+				Backoff:    time.Duration(lc.ErrorBackoff),
+				MaxBackoff: time.Duration(lc.MaxErrorBackoff),
+				Jitter:     imapclient.ErrorBackoff.Jitter,
+			},
+		}
+		if lc.Rules != "" {
+			if l.Rules, err = imapclient.LoadSieve(lc.Rules, l.DeliverMessage); err != nil {
+				return nil, fmt.Errorf("loop %q: %w", lc.Name, err)
+			}
+		}
+		s.Add(lc.Name, l)
+	}
+	return s, nil
+}
@@ -41,7 +41,7 @@ func (a cramAuth) Next(challenge []byte) (response []byte, err error) {
 	h := hmac.New(md5.New, []byte(a.password))
 	h.Write(challenge)
 	n := len(a.username)
-	response = make([]byte, 0, len(a.username)+1+hex.EncodedLen(h.Size()))
+	response = make([]byte, n+1+hex.EncodedLen(h.Size()))
 	for i := 0; i < n; i++ {
 		response[i] = byte(a.username[i])
 	}
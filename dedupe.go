@@ -0,0 +1,124 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Deduper remembers the keys (Message-ID or content hash) of the delivered
+// messages, so the same message is not delivered twice.
+type Deduper interface {
+	// Seen reports whether key has been added already.
+	Seen(key string) (bool, error)
+	// Add records key.
+	Add(key string) error
+}
+
+// MemoryDeduper is an in-memory Deduper.
+type MemoryDeduper struct {
+	mu   sync.Mutex
+	keys map[string]struct{}
+}
+
+// NewMemoryDeduper returns a new, empty MemoryDeduper.
+func NewMemoryDeduper() *MemoryDeduper {
+	return &MemoryDeduper{keys: make(map[string]struct{})}
+}
+
+// Seen reports whether key has been added already.
+func (md *MemoryDeduper) Seen(key string) (bool, error) {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	_, ok := md.keys[key]
+	return ok, nil
+}
+
+// Add records key.
+func (md *MemoryDeduper) Add(key string) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	md.keys[key] = struct{}{}
+	return nil
+}
+
+// FileDeduper is a Deduper which appends the keys to a file, one per line,
+// and holds them in memory, too.
+type FileDeduper struct {
+	MemoryDeduper
+	fh *os.File
+}
+
+// NewFileDeduper opens (or creates) the file at path, and reads the keys in it.
+func NewFileDeduper(path string) (*FileDeduper, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fd := &FileDeduper{MemoryDeduper: MemoryDeduper{keys: make(map[string]struct{})}, fh: fh}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if key := scanner.Text(); key != "" {
+			fd.keys[key] = struct{}{}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Add records key, appending it to the file.
+func (fd *FileDeduper) Add(key string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if _, ok := fd.keys[key]; ok {
+		return nil
+	}
+	if _, err := fd.fh.WriteString(key + "\n"); err != nil {
+		return err
+	}
+	fd.keys[key] = struct{}{}
+	return nil
+}
+
+// Close closes the file.
+func (fd *FileDeduper) Close() error {
+	return fd.fh.Close()
+}
+
+// dedupeKey returns the Message-ID of the message, or its hash if it has none.
+func dedupeKey(r io.ReadSeeker, sum []byte) (string, error) {
+	var key string
+	if msg, err := mail.ReadMessage(r); err == nil {
+		key = strings.TrimSpace(msg.Header.Get("Message-Id"))
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if key == "" {
+		key = "hash:" + hex.EncodeToString(sum)
+	}
+	return key, nil
+}
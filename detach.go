@@ -0,0 +1,346 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Attachment describes a detached attachment.
+type Attachment struct {
+	// Filename and ContentType are from the header of the part.
+	Filename, ContentType string
+	// Size is the encoded size of the part.
+	Size int64
+}
+
+// BlobStore stores the detached attachments.
+type BlobStore interface {
+	// Put stores the decoded content of the attachment read from r,
+	// and returns the link to it, which replaces the attachment in the message.
+	Put(att Attachment, r io.Reader) (link string, err error)
+}
+
+// DirBlobStore is a BlobStore which stores the attachments in Dir,
+// named by the SHA-256 hash of their content (so each is stored only once).
+type DirBlobStore struct {
+	Dir string
+	// BaseURL is the prefix of the links; "file://" + Dir if empty.
+	BaseURL string
+}
+
+// Put stores the attachment in Dir.
+func (s DirBlobStore) Put(att Attachment, r io.Reader) (string, error) {
+	fh, err := os.CreateTemp(s.Dir, ".detach-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(fh.Name())
+	hsh := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fh, hsh), r)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(hsh.Sum(nil)) + strings.ToLower(filepath.Ext(filepath.Base(att.Filename)))
+	if err = os.Rename(fh.Name(), filepath.Join(s.Dir, name)); err != nil {
+		return "", err
+	}
+	base := s.BaseURL
+	if base == "" {
+		abs, err := filepath.Abs(s.Dir)
+		if err != nil {
+			return "", err
+		}
+		base = "file://" + filepath.ToSlash(abs)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + name, nil
+}
+
+// Detacher replaces the large attachments of the messages with links to
+// their copies in a BlobStore - to keep the mailboxes under their quota.
+type Detacher struct {
+	Store BlobStore
+	// MinSize is the encoded size of the smallest detached attachment - 1MiB if zero.
+	MinSize int64
+	// Stub returns the text which replaces the attachment, if not nil.
+	Stub func(att Attachment, link string) string
+}
+
+// Detach detaches the large attachments of the messages of mbox: each
+// message having such is appended again to mbox, with its flags, with the
+// attachments replaced by a text part with the link, and the original is
+// deleted (with UID EXPUNGE if the server supports UIDPLUS, just marked
+// deleted otherwise) - also when detaching a later message fails.
+// The new message keeps the internal date of the original.
+//
+// Returns the number of rewritten messages.
+func (d Detacher) Detach(c Client, mbox string, uids ...uint32) (n int, err error) {
+	if err = c.Select(mbox); err != nil {
+		return 0, err
+	}
+	infos, err := c.ListWithInfo(mbox, "", true)
+	if err != nil {
+		return 0, err
+	}
+	byUID := make(map[uint32]MessageInfo, len(infos))
+	for _, info := range infos {
+		byUID[info.UID] = info
+	}
+	var done []uint32
+	defer func() {
+		if len(done) == 0 {
+			return
+		}
+		n = len(done)
+		delErr := c.DeleteMany(done, true)
+		var notAvailable imap.NotAvailableError
+		if errors.As(delErr, &notAvailable) {
+			Log.Warn("detach: originals are marked deleted only", "mbox", mbox, "error", delErr)
+			delErr = nil
+		}
+		if err == nil {
+			err = delErr
+		}
+	}()
+	for _, uid := range uids {
+		info, ok := byUID[uid]
+		if !ok {
+			continue
+		}
+		body := NewSpool(SpoolMemoryLimit)
+		if _, err := c.ReadTo(body, uid); err != nil {
+			body.Close()
+			return len(done), err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			body.Close()
+			return len(done), err
+		}
+		var buf bytes.Buffer
+		atts, err := d.rewrite(&buf, body)
+		body.Close()
+		if err != nil {
+			Log.Error("detach", "mbox", mbox, "uid", uid, "error", err)
+			return len(done), err
+		}
+		if atts == 0 {
+			continue
+		}
+		keep := make([]string, 0, len(info.Flags))
+		for f := range info.Flags {
+			if f != `\Recent` && f != `\Deleted` {
+				keep = append(keep, f)
+			}
+		}
+		if _, err = c.Append(mbox, keep, info.InternalDate, bytes.NewReader(buf.Bytes())); err != nil {
+			Log.Error("Append", "mbox", mbox, "uid", uid, "error", err)
+			return len(done), err
+		}
+		Log.Info("detached", "mbox", mbox, "uid", uid, "attachments", atts)
+		done = append(done, uid)
+	}
+	return len(done), nil
+}
+
+func (d Detacher) minSize() int64 {
+	if d.MinSize > 0 {
+		return d.MinSize
+	}
+	return 1 << 20
+}
+
+// rewrite writes the message read from r to w, with the large attachments
+// replaced by stubs. Returns the number of the detached attachments.
+func (d Detacher) rewrite(w io.Writer, r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var head bytes.Buffer
+	for {
+		line, err := br.ReadSlice('\n')
+		head.Write(line)
+		if err != nil {
+			return 0, nil // no body
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(head.Bytes()))).ReadMIMEHeader()
+	if err != nil {
+		return 0, err
+	}
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return 0, nil
+	}
+	if _, err = w.Write(head.Bytes()); err != nil {
+		return 0, err
+	}
+	return d.multipart(w, br, params["boundary"])
+}
+
+// multipart rewrites the parts of a multipart body, recursively.
+func (d Detacher) multipart(w io.Writer, r io.Reader, boundary string) (int, error) {
+	mr := multipart.NewReader(r, boundary)
+	var n int
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, err = io.WriteString(w, "--"+boundary+"\r\n"); err != nil {
+			return n, err
+		}
+		mediaType, params, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+			if err = writeMIMEHeader(w, p.Header); err != nil {
+				return n, err
+			}
+			k, err := d.multipart(w, p, params["boundary"])
+			if n += k; err != nil {
+				return n, err
+			}
+		} else if k, err := d.part(w, p, mediaType); err != nil {
+			return n, err
+		} else {
+			n += k
+		}
+		if _, err = io.WriteString(w, "\r\n"); err != nil {
+			return n, err
+		}
+	}
+	_, err := io.WriteString(w, "--"+boundary+"--\r\n")
+	return n, err
+}
+
+// part writes the leaf part p, or its stub if it is a large attachment.
+// Returns 1 if the part is detached.
+func (d Detacher) part(w io.Writer, p *multipart.Part, mediaType string) (int, error) {
+	att := Attachment{Filename: partFilename(p.Header), ContentType: mediaType}
+	disposition, _, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+	if disposition != "attachment" && att.Filename == "" {
+		if err := writeMIMEHeader(w, p.Header); err != nil {
+			return 0, err
+		}
+		_, err := io.Copy(w, p)
+		return 0, err
+	}
+	body := NewSpool(SpoolMemoryLimit)
+	defer body.Close()
+	var err error
+	if att.Size, err = io.Copy(body, p); err != nil {
+		return 0, err
+	}
+	if _, err = body.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if att.Size < d.minSize() {
+		if err = writeMIMEHeader(w, p.Header); err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(w, body)
+		return 0, err
+	}
+
+	var content io.Reader = body
+	switch strings.ToLower(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		content = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		content = quotedprintable.NewReader(body)
+	}
+	link, err := d.Store.Put(att, content)
+	if err != nil {
+		return 0, err
+	}
+	text := fmt.Sprintf("The attachment %q (%s, %d bytes) has been detached, and is available at\r\n%s\r\n",
+		att.Filename, att.ContentType, att.Size, link)
+	if d.Stub != nil {
+		text = d.Stub(att, link)
+	}
+	stub := textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+		"Content-Disposition":       {"inline"},
+		"X-Detached-Link":           {link},
+	}
+	if err = writeMIMEHeader(w, stub); err != nil {
+		return 0, err
+	}
+	qw := quotedprintable.NewWriter(w)
+	if _, err = io.WriteString(qw, text); err != nil {
+		return 0, err
+	}
+	return 1, qw.Close()
+}
+
+// partFilename returns the (decoded) file name of the part, or "".
+func partFilename(hdr textproto.MIMEHeader) string {
+	var name string
+	if _, params, err := mime.ParseMediaType(hdr.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(hdr.Get("Content-Type")); err == nil {
+			name = params["name"]
+		}
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+// writeMIMEHeader writes the header, sorted by the keys, and the empty line.
+func writeMIMEHeader(w io.Writer, hdr textproto.MIMEHeader) error {
+	keys := make([]string, 0, len(hdr))
+	for k := range hdr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		for _, v := range hdr[k] {
+			buf.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Server is a candidate IMAP server found by Discover.
+type Server struct {
+	Host string
+	Port int
+	// TLS is true for implicit TLS (imaps), false for STARTTLS (imap).
+	TLS bool
+}
+
+// Options returns the options for connecting to the server.
+func (s Server) Options() []Option {
+	opts := []Option{WithPort(s.Port)}
+	if s.TLS {
+		return append(opts, WithTLS(nil))
+	}
+	return append(opts, WithRequireStartTLS())
+}
+
+func (s Server) String() string {
+	scheme := "imap"
+	if s.TLS {
+		scheme = "imaps"
+	}
+	return scheme + "://" + net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// Discover returns the candidate servers for the domain (or for the domain
+// of an e-mail address): the ones of the _imaps._tcp and _imap._tcp SRV
+// records (RFC 6186), in their order of preference, then the common guesses
+// imap.<domain> and mail.<domain>.
+//
+// The candidates are not checked; try them in order.
+func Discover(domain string) []Server {
+	if i := strings.LastIndexByte(domain, '@'); i >= 0 {
+		domain = domain[i+1:]
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	var servers []Server
+	seen := make(map[Server]bool)
+	add := func(s Server) {
+		if !seen[s] {
+			seen[s] = true
+			servers = append(servers, s)
+		}
+	}
+	for _, srv := range []struct {
+		service string
+		tls     bool
+	}{{"imaps", true}, {"imap", false}} {
+		_, addrs, err := net.LookupSRV(srv.service, "tcp", domain)
+		if err != nil {
+			Log.Debug("LookupSRV", "service", srv.service, "domain", domain, "error", err)
+			continue
+		}
+		for _, addr := range addrs {
+			// "." means that the service is not provided
+			if host := strings.TrimSuffix(addr.Target, "."); host != "" && addr.Port != 0 {
+				add(Server{Host: host, Port: int(addr.Port), TLS: srv.tls})
+			}
+		}
+	}
+	for _, prefix := range []string{"imap.", "mail."} {
+		add(Server{Host: prefix + domain, Port: 993, TLS: true})
+		add(Server{Host: prefix + domain, Port: 143})
+	}
+	return servers
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"io"
+	"time"
+)
+
+// DryRun returns a Client which reads through c, but only logs the mutating
+// commands (flag changes, moves, deletions, appends, expunges, mailbox
+// management and Close(true)) on Info level, and returns success without
+// executing them - for trying a DeliveryLoop configuration on a production
+// mailbox safely.
+//
+// As nothing is changed, the reads do not reflect the skipped changes:
+// for example, a moved message is listed again in its mailbox.
+func DryRun(c Client) Client {
+	return dryRun{Client: c}
+}
+
+type dryRun struct {
+	Client
+}
+
+func (d dryRun) log(op string, ctx ...interface{}) error {
+	Log.Info("dry run: "+op, append([]interface{}{"server", d.Client}, ctx...)...)
+	return nil
+}
+
+// Close closes the connection without committing, logging the skipped commit.
+func (d dryRun) Close(commit bool) error {
+	if commit {
+		d.log("Close", "commit", commit)
+	}
+	return d.Client.Close(false)
+}
+
+func (d dryRun) CreateMailbox(mbox string) error {
+	return d.log("CreateMailbox", "mbox", mbox)
+}
+func (d dryRun) DeleteMailbox(mbox string) error {
+	return d.log("DeleteMailbox", "mbox", mbox)
+}
+func (d dryRun) RenameMailbox(oldName, newName string) error {
+	return d.log("RenameMailbox", "old", oldName, "new", newName)
+}
+func (d dryRun) Subscribe(mbox string) error   { return d.log("Subscribe", "mbox", mbox) }
+func (d dryRun) Unsubscribe(mbox string) error { return d.log("Unsubscribe", "mbox", mbox) }
+
+func (d dryRun) SetFlag(msgID uint32, keyword string, st bool) error {
+	return d.log("SetFlag", "uid", msgID, "flag", keyword, "set", st)
+}
+func (d dryRun) SetFlagRegex(msgID uint32, regex string, st bool) error {
+	return d.log("SetFlagRegex", "uid", msgID, "regex", regex, "set", st)
+}
+func (d dryRun) SetFlags(uids []uint32, keyword string, st bool) error {
+	return d.log("SetFlags", "uids", uids, "flag", keyword, "set", st)
+}
+func (d dryRun) SetFlagsSilent(uids []uint32, keyword string, st bool) error {
+	return d.log("SetFlagsSilent", "uids", uids, "flag", keyword, "set", st)
+}
+func (d dryRun) ReplaceFlags(msgID uint32, flags []string) error {
+	return d.log("ReplaceFlags", "uid", msgID, "flags", flags)
+}
+func (d dryRun) MarkSeen(msgID uint32) error      { return d.log("MarkSeen", "uid", msgID) }
+func (d dryRun) MarkSeenAll(uids []uint32) error  { return d.log("MarkSeenAll", "uids", uids) }
+func (d dryRun) MarkUnseen(msgID uint32) error    { return d.log("MarkUnseen", "uid", msgID) }
+func (d dryRun) MarkDeleted(msgID uint32) error   { return d.log("MarkDeleted", "uid", msgID) }
+func (d dryRun) MarkUndeleted(msgID uint32) error { return d.log("MarkUndeleted", "uid", msgID) }
+func (d dryRun) MarkAnswered(msgID uint32) error  { return d.log("MarkAnswered", "uid", msgID) }
+func (d dryRun) MarkFlagged(msgID uint32) error   { return d.log("MarkFlagged", "uid", msgID) }
+func (d dryRun) MarkUnflagged(msgID uint32) error { return d.log("MarkUnflagged", "uid", msgID) }
+func (d dryRun) MarkDraft(msgID uint32) error     { return d.log("MarkDraft", "uid", msgID) }
+
+func (d dryRun) DeleteMany(uids []uint32, expunge bool) error {
+	return d.log("DeleteMany", "uids", uids, "expunge", expunge)
+}
+func (d dryRun) Delete(msgID uint32, permanent bool) error {
+	return d.log("Delete", "uid", msgID, "permanent", permanent)
+}
+func (d dryRun) Move(msgID uint32, mbox string) error {
+	return d.log("Move", "uid", msgID, "mbox", mbox)
+}
+func (d dryRun) MoveMany(uids []uint32, mbox string) error {
+	return d.log("MoveMany", "uids", uids, "mbox", mbox)
+}
+func (d dryRun) MoveToTrash(uids ...uint32) error { return d.log("MoveToTrash", "uids", uids) }
+func (d dryRun) MoveToJunk(uids ...uint32) error  { return d.log("MoveToJunk", "uids", uids) }
+
+// Append reads r, and returns 0 as UID.
+func (d dryRun) Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error) {
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return 0, err
+	}
+	return 0, d.log("Append", "mbox", mbox, "flags", flags, "date", date, "size", n)
+}
+
+func (d dryRun) Expunge(uids ...uint32) error { return d.log("Expunge", "uids", uids) }
+func (d dryRun) ExpungeAll() error            { return d.log("ExpungeAll") }
@@ -0,0 +1,171 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// MessageRef identifies a message of a mailbox.
+type MessageRef struct {
+	Mailbox string
+	UID     uint32
+}
+
+// Duplicate is a set of copies of the same message.
+type Duplicate struct {
+	// Key is the Message-ID and the size ("<id> size"), or the "hdr:"
+	// prefixed hash of the From, Date, Subject and size if there is no
+	// Message-ID - so a reused Message-ID does not make different
+	// messages duplicates.
+	Key string
+	// Original is the copy which is kept by DeleteDuplicates: the first one
+	// found, in the order of the mailboxes, then of the UIDs.
+	Original MessageRef
+	// Copies are the other copies.
+	Copies []MessageRef
+}
+
+// FindDuplicates indexes the not deleted messages of the mailboxes by
+// Message-ID and size - or, without Message-ID, by a hash of the From, Date,
+// Subject and size - and returns the messages present more than once,
+// across the mailboxes or within one.
+//
+// Without mailboxes, all the selectable mailboxes are indexed, except the
+// special-use (RFC 6154) \All, \Flagged, \Junk and \Trash ones: the virtual
+// mailboxes (such as Gmail's All Mail) hold a copy of every message, and
+// deleting that copy deletes the message everywhere.
+//
+// Only the FLAGS, RFC822.SIZE, INTERNALDATE and ENVELOPE of the messages
+// are fetched (see ListWithInfo), not the bodies.
+func FindDuplicates(c Client, mailboxes []string) ([]Duplicate, error) {
+	if len(mailboxes) == 0 {
+		mboxes, err := c.Mailboxes("*")
+		if err != nil {
+			return nil, err
+		}
+		for _, mbox := range mboxes {
+			if mbox.Selectable() && !skipDuplicatesMailbox(mbox) {
+				mailboxes = append(mailboxes, mbox.Name)
+			}
+		}
+	}
+	index := make(map[string]int)
+	var dups []Duplicate
+	for _, mbox := range mailboxes {
+		infos, err := c.ListWithInfo(mbox, "", true)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].UID < infos[j].UID })
+		for _, info := range infos {
+			key := duplicateKey(info)
+			ref := MessageRef{Mailbox: mbox, UID: info.UID}
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(dups)
+				dups = append(dups, Duplicate{Key: key, Original: ref})
+				continue
+			}
+			dups[i].Copies = append(dups[i].Copies, ref)
+		}
+	}
+	found := dups[:0]
+	for _, d := range dups {
+		if len(d.Copies) > 0 {
+			found = append(found, d)
+		}
+	}
+	return found, nil
+}
+
+// DeleteDuplicates deletes the copies (keeping the originals) of the
+// duplicates found by FindDuplicates, with one DeleteMany per mailbox,
+// and returns the number of messages deleted.
+//
+// If the server does not support UIDPLUS, the copies are just marked
+// \Deleted when expunge is true (see DeleteMany), which is not an error.
+func DeleteDuplicates(c Client, dups []Duplicate, expunge bool) (int, error) {
+	byMailbox := make(map[string][]uint32)
+	var mailboxes []string
+	for _, d := range dups {
+		for _, ref := range d.Copies {
+			if _, ok := byMailbox[ref.Mailbox]; !ok {
+				mailboxes = append(mailboxes, ref.Mailbox)
+			}
+			byMailbox[ref.Mailbox] = append(byMailbox[ref.Mailbox], ref.UID)
+		}
+	}
+	var n int
+	for _, mbox := range mailboxes {
+		uids := byMailbox[mbox]
+		if err := c.Select(mbox); err != nil {
+			return n, err
+		}
+		err := c.DeleteMany(uids, expunge)
+		var notAvailable imap.NotAvailableError
+		if errors.As(err, &notAvailable) {
+			Log.Warn("DeleteDuplicates", "mbox", mbox, "error", err)
+		} else if err != nil {
+			return n, err
+		}
+		Log.Info("DeleteDuplicates", "mbox", mbox, "deleted", len(uids))
+		n += len(uids)
+	}
+	return n, nil
+}
+
+// skipDuplicatesFlags are the special-use attributes of the mailboxes
+// not indexed by FindDuplicates by default.
+var skipDuplicatesFlags = []string{UseAll, UseFlagged, UseJunk, UseTrash}
+
+// skipDuplicatesMailbox reports whether mbox has one of skipDuplicatesFlags.
+func skipDuplicatesMailbox(mbox Mailbox) bool {
+	for attr, ok := range mbox.Attrs {
+		if !ok {
+			continue
+		}
+		for _, use := range skipDuplicatesFlags {
+			if strings.EqualFold(attr, use) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// duplicateKey returns the Message-ID and the size of the message, or the
+// hash of its From, Date, Subject and size if it has no Message-ID.
+func duplicateKey(info MessageInfo) string {
+	if id := strings.TrimSpace(info.MessageID); id != "" {
+		return id + " " + strconv.FormatUint(uint64(info.Size), 10)
+	}
+	h := sha256.New()
+	for _, s := range []string{info.From, info.Date.UTC().Format(time.RFC3339), info.Subject, strconv.FormatUint(uint64(info.Size), 10)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return "hdr:" + hex.EncodeToString(h.Sum(nil))
+}
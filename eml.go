@@ -0,0 +1,66 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ImportEML appends the messages of the .eml files at paths to mbox, with
+// the given flags. The Date header of each message (or the modification
+// time of the file, if it has no valid Date) becomes its internal date.
+//
+// Returns the number of the imported messages.
+func ImportEML(c Client, mbox string, paths []string, flags ...string) (int, error) {
+	for i, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return i, err
+		}
+		var date time.Time
+		if msg, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+			date, _ = msg.Header.Date()
+		}
+		if date.IsZero() {
+			if fi, err := os.Stat(path); err == nil {
+				date = fi.ModTime()
+			}
+		}
+		if _, err = c.Append(mbox, flags, date, bytes.NewReader(body)); err != nil {
+			Log.Error("Append", "mbox", mbox, "path", path, "error", err)
+			return i, err
+		}
+	}
+	return len(paths), nil
+}
+
+// ImportEMLGlob is like ImportEML, for the files matching the pattern
+// (see filepath.Glob); a directory means all the .eml files in it.
+func ImportEMLGlob(c Client, mbox, pattern string, flags ...string) (int, error) {
+	if fi, err := os.Stat(pattern); err == nil && fi.IsDir() {
+		pattern = filepath.Join(pattern, "*.eml")
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return 0, err
+	}
+	return ImportEML(c, mbox, paths, flags...)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// NewClientFromEnv returns a new (not connected) Client configured by the
+// environment variables IMAP_HOST, IMAP_PORT, IMAP_USERNAME, IMAP_PASSWORD
+// and IMAP_TLS, each prefixed with prefix (and "_", if prefix is not empty),
+// such as SUPPORT_IMAP_HOST for prefix "SUPPORT".
+//
+// IMAP_TLS is "tls" (or a true boolean), "starttls" (required STARTTLS),
+// "none" (or a false boolean) for plaintext, or empty for the defaults of
+// NewClientWithOptions (TLS on port 993, STARTTLS if supported on port 143).
+// The options are applied after the ones from the environment.
+func NewClientFromEnv(prefix string, opts ...Option) (Client, error) {
+	if prefix != "" && !strings.HasSuffix(prefix, "_") {
+		prefix += "_"
+	}
+	get := func(key string) string { return os.Getenv(prefix + "IMAP_" + key) }
+	host := get("HOST")
+	if host == "" {
+		return nil, fmt.Errorf("%sIMAP_HOST is not set", prefix)
+	}
+	var envOpts []Option
+	var port int
+	if s := get("PORT"); s != "" {
+		var err error
+		if port, err = strconv.Atoi(s); err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%sIMAP_PORT=%q: bad port", prefix, s)
+		}
+		envOpts = append(envOpts, WithPort(port))
+	}
+	switch s := strings.ToLower(get("TLS")); s {
+	case "":
+		if port == 993 {
+			envOpts = append(envOpts, WithTLS(nil))
+		}
+	case "starttls":
+		envOpts = append(envOpts, WithRequireStartTLS())
+	case "tls":
+		envOpts = append(envOpts, WithTLS(nil))
+	case "none":
+		envOpts = append(envOpts, WithoutTLS())
+	default:
+		useTLS, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%sIMAP_TLS=%q: not tls, starttls, none or a boolean", prefix, s)
+		}
+		if useTLS {
+			envOpts = append(envOpts, WithTLS(nil))
+		} else {
+			envOpts = append(envOpts, WithoutTLS())
+		}
+	}
+	if username, password := get("USERNAME"), get("PASSWORD"); username != "" || password != "" {
+		envOpts = append(envOpts, WithAuth(username, password))
+	}
+	return NewClientWithOptions(host, append(envOpts, opts...)...), nil
+}
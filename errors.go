@@ -0,0 +1,176 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// The kinds of errors, to be checked with errors.Is.
+var (
+	// ErrAuth means that the server rejected the credentials.
+	ErrAuth = errors.New("authentication failed")
+	// ErrTokenExpired means that the server rejected the OAuth2 token,
+	// usually because it has expired; it is an ErrAuth, too.
+	ErrTokenExpired = errors.New("token rejected")
+	// ErrConnection means that the connection is broken or could not be established.
+	ErrConnection = errors.New("connection error")
+	// ErrMailboxNotFound means that the mailbox does not exist.
+	ErrMailboxNotFound = errors.New("mailbox not found")
+	// ErrBadCharset means that the server does not support the charset of the search.
+	ErrBadCharset = errors.New("unsupported charset")
+	// ErrThrottled means that the server refused the command due to rate or
+	// connection limits; see RetryAfter for the interval it suggests.
+	ErrThrottled = errors.New("throttled")
+	// ErrReferral means that the server referred us to another server or
+	// mailbox (RFC 2221, RFC 2193); see Referral for the IMAP URL.
+	ErrReferral = errors.New("referral")
+)
+
+// Error is a classified error: errors.Is(err, err.Kind) holds, and the
+// underlying error (such as an imap.ResponseError) is available with errors.As.
+type Error struct {
+	// Op is the operation which failed, if known.
+	Op string
+	// Kind is one of the Err* kinds above.
+	Kind error
+	// Err is the underlying error.
+	Err error
+	// RetryAfter is the interval suggested by the server for ErrThrottled, if any.
+	RetryAfter time.Duration
+	// Referral is the IMAP URL of ErrReferral.
+	Referral string
+}
+
+func (e *Error) Error() string {
+	if e.Op == "" {
+		return e.Kind.Error() + ": " + e.Err.Error()
+	}
+	return e.Op + ": " + e.Kind.Error() + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of e.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind || target == ErrAuth && e.Kind == ErrTokenExpired
+}
+
+// classify returns err as an *Error of the kind recognized from it, or of
+// kind def if none is recognized. Nil, already classified and unrecognized
+// errors (with a nil def) are returned as is.
+func classify(op string, def, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	kind := kindOf(err)
+	if kind == nil {
+		if kind = def; kind == nil {
+			return err
+		}
+	}
+	e = &Error{Op: op, Kind: kind, Err: err}
+	switch kind {
+	case ErrThrottled:
+		e.RetryAfter = retryAfter(err.Error())
+	case ErrReferral:
+		e.Referral = referralURL(err)
+	}
+	return e
+}
+
+// RetryAfter returns the interval the server asked us to wait, if err is
+// ErrThrottled; zero otherwise.
+func RetryAfter(err error) time.Duration {
+	var e *Error
+	if errors.As(err, &e) && e.Kind == ErrThrottled {
+		return e.RetryAfter
+	}
+	return 0
+}
+
+var rRetryAfter = regexp.MustCompile(`(?i)(\d+)\s*(s|sec|secs|seconds?|m|min|mins|minutes?)\b`)
+
+// retryAfter parses the suggested interval from the text of a response,
+// such as "[THROTTLED] try again in 30 seconds".
+func retryAfter(text string) time.Duration {
+	m := rRetryAfter.FindStringSubmatch(text)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+	if strings.HasPrefix(strings.ToLower(m[2]), "m") {
+		return time.Duration(n) * time.Minute
+	}
+	return time.Duration(n) * time.Second
+}
+
+// kindOf returns the kind of err, based on the response code and text of
+// the server, or nil if it is not recognized.
+func kindOf(err error) error {
+	var rspErr imap.ResponseError
+	if errors.As(err, &rspErr) && rspErr.Response != nil {
+		switch strings.ToUpper(rspErr.Label) {
+		case "BADCHARSET":
+			return ErrBadCharset
+		case "AUTHENTICATIONFAILED", "AUTHORIZATIONFAILED", "EXPIRED":
+			return ErrAuth
+		case "NONEXISTENT", "TRYCREATE":
+			return ErrMailboxNotFound
+		case "REFERRAL":
+			return ErrReferral
+		case "THROTTLED", "TOOMANYCONNECTIONS", "LIMIT", "UNAVAILABLE", "INUSE":
+			return ErrThrottled
+		}
+		info := strings.ToLower(rspErr.Info)
+		for _, s := range []string{"throttl", "too many", "rate limit", "try again later", "try again in"} {
+			if strings.Contains(info, s) {
+				return ErrThrottled
+			}
+		}
+		if rspErr.Status == imap.BYE {
+			return ErrConnection
+		}
+		for _, s := range []string{"no such mailbox", "not exist", "doesn't exist", "unknown mailbox", "mailbox not found"} {
+			if strings.Contains(info, s) {
+				return ErrMailboxNotFound
+			}
+		}
+		return nil
+	}
+	if isConnError(err) {
+		return ErrConnection
+	}
+	if strings.Contains(err.Error(), "BADCHARSET") {
+		return ErrBadCharset
+	}
+	return nil
+}
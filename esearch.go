@@ -0,0 +1,235 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// ESearchClient is a Client which can return just the count, minimum or
+// maximum of the matching UIDs (RFC 4731).
+type ESearchClient interface {
+	Client
+	SearchExtended(mbox string, crit SearchCriteria, ret ...SearchReturn) (*ESearchResult, error)
+}
+
+// SearchReturn is a RETURN option of the extended search.
+type SearchReturn string
+
+// The extended search RETURN options.
+const (
+	ReturnMin   SearchReturn = "MIN"
+	ReturnMax   SearchReturn = "MAX"
+	ReturnCount SearchReturn = "COUNT"
+	ReturnAll   SearchReturn = "ALL"
+)
+
+// ESearchResult is the result of an extended search - only the requested
+// fields are set.
+type ESearchResult struct {
+	Min, Max, Count uint32
+	All             []uint32
+	// Partial is the requested page of the UIDs, see SearchPage.
+	Partial []uint32
+}
+
+// SearchExtended selects mbox, and returns the requested data (ALL if ret is empty)
+// of the UIDs of the messages matching crit.
+//
+// Uses UID SEARCH RETURN if the server supports ESEARCH, computes the
+// result from a plain search otherwise.
+func (c *client) SearchExtended(mbox string, crit SearchCriteria, ret ...SearchReturn) (*ESearchResult, error) {
+	c.enter()
+	defer c.leave()
+	if len(ret) == 0 {
+		ret = []SearchReturn{ReturnAll}
+	}
+	if !c.c.Caps["ESEARCH"] {
+		uids, err := c.Search(mbox, crit)
+		if err != nil {
+			return nil, err
+		}
+		return newESearchResult(uids, ret), nil
+	}
+
+	opts := make([]imap.Field, len(ret))
+	for i, r := range ret {
+		opts[i] = imap.Field(string(r))
+	}
+	return c.esearch("SearchExtended", mbox, crit, opts)
+}
+
+// esearch selects mbox, and issues UID SEARCH RETURN (opts).
+func (c *client) esearch(name, mbox string, crit SearchCriteria, opts []imap.Field) (*ESearchResult, error) {
+	var res *ESearchResult
+	err := c.retry(name, func() error {
+		if err := c.selectMailbox(mbox); err != nil {
+			return err
+		}
+		fields := []imap.Field{imap.Field("RETURN"), opts}
+		crit := c.within(crit)
+		if c.noUTF8 {
+			fields = append(fields, crit.fields(func(s string) imap.Field { return c.c.Quote(imap.UTF7Encode(s)) })...)
+		} else {
+			fields = append(fields, imap.Field("CHARSET"), imap.Field("UTF-8"))
+			fields = append(fields, crit.fields(func(s string) imap.Field { return c.c.Quote(s) })...)
+		}
+		cmd, err := c.wait(c.c.Send("UID SEARCH", fields...))
+		if err != nil {
+			return err
+		}
+		res = &ESearchResult{}
+		// without a correlator, only the responses to this command
+		for i, resp := range append(cmd.Data, c.c.Data...) {
+			if resp.Label != "ESEARCH" {
+				continue
+			}
+			if tag := esearchTag(resp.Fields[1:]); tag == cmd.Tag() || tag == "" && i < len(cmd.Data) {
+				parseESearch(res, resp.Fields[1:])
+			}
+		}
+		c.c.Data = nil
+		return nil
+	})
+	return res, err
+}
+
+// SearchPage returns limit UIDs of the messages of mbox matching crit
+// (in increasing order), starting at offset, and the number of all the
+// matching messages - for paging through the results.
+//
+// Uses UID SEARCH RETURN (PARTIAL) (RFC 9394) if the server supports it;
+// otherwise searches all the UIDs, and returns the requested page of them.
+func (c *client) SearchPage(mbox string, crit SearchCriteria, offset, limit int) ([]uint32, int, error) {
+	c.enter()
+	defer c.leave()
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("bad page offset=%d limit=%d", offset, limit)
+	}
+	if !c.c.Caps["PARTIAL"] || !c.c.Caps["ESEARCH"] {
+		uids, err := c.Search(mbox, crit)
+		if err != nil {
+			return nil, 0, err
+		}
+		uids, total := pageUIDs(uids, offset, limit)
+		return uids, total, nil
+	}
+	rng := strconv.Itoa(offset+1) + ":" + strconv.Itoa(offset+limit)
+	res, err := c.esearch("SearchPage", mbox, crit, []imap.Field{
+		imap.Field("PARTIAL"), imap.Field(rng), imap.Field(string(ReturnCount))})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(res.Partial, func(i, j int) bool { return res.Partial[i] < res.Partial[j] })
+	return res.Partial, int(res.Count), nil
+}
+
+// pageUIDs sorts the UIDs, and returns the requested page of them, and their number.
+func pageUIDs(uids []uint32, offset, limit int) ([]uint32, int) {
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	total := len(uids)
+	if offset >= total {
+		return nil, total
+	}
+	uids = uids[offset:]
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+	return uids, total
+}
+
+// parseESearch parses the ESEARCH response data: [(TAG "x")] [UID] (name value)*.
+func parseESearch(res *ESearchResult, fields []imap.Field) {
+	for i := 0; i < len(fields); i++ {
+		if imap.TypeOf(fields[i]) == imap.List {
+			continue
+		}
+		name := strings.ToUpper(imap.AsAtom(fields[i]))
+		if name == "UID" || i+1 >= len(fields) {
+			continue
+		}
+		i++
+		switch SearchReturn(name) {
+		case ReturnMin:
+			res.Min = imap.AsNumber(fields[i])
+		case ReturnMax:
+			res.Max = imap.AsNumber(fields[i])
+		case ReturnCount:
+			res.Count = imap.AsNumber(fields[i])
+		case ReturnAll:
+			res.All = append(res.All, asUIDs(fields[i])...)
+		case "PARTIAL":
+			// (range uid-set), the uid-set is NIL for an empty page
+			if part := imap.AsList(fields[i]); len(part) == 2 && !strings.EqualFold(imap.AsAtom(part[1]), "NIL") {
+				res.Partial = append(res.Partial, asUIDs(part[1])...)
+			}
+		}
+	}
+}
+
+// esearchTag returns the tag of the command an ESEARCH response
+// correlates to (the (TAG "x") search-correlator), if any.
+func esearchTag(fields []imap.Field) string {
+	if len(fields) == 0 || imap.TypeOf(fields[0]) != imap.List {
+		return ""
+	}
+	corr := imap.AsList(fields[0])
+	if len(corr) != 2 || !strings.EqualFold(imap.AsAtom(corr[0]), "TAG") {
+		return ""
+	}
+	return imap.AsString(corr[1])
+}
+
+// asUIDs returns the UIDs of a uid-set, which may be a single Number.
+func asUIDs(f imap.Field) []uint32 {
+	if imap.TypeOf(f) == imap.Number {
+		return []uint32{imap.AsNumber(f)}
+	}
+	return parseUIDSet(imap.AsAtom(f))
+}
+
+// newESearchResult computes the requested data from the UIDs.
+func newESearchResult(uids []uint32, ret []SearchReturn) *ESearchResult {
+	var lo, hi uint32
+	for i, uid := range uids {
+		if i == 0 || uid < lo {
+			lo = uid
+		}
+		if uid > hi {
+			hi = uid
+		}
+	}
+	res := &ESearchResult{}
+	for _, r := range ret {
+		switch r {
+		case ReturnMin:
+			res.Min = lo
+		case ReturnMax:
+			res.Max = hi
+		case ReturnCount:
+			res.Count = uint32(len(uids))
+		case ReturnAll:
+			res.All = uids
+		}
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"strconv"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+// The event types.
+const (
+	// EventConnected is sent when the connection (and the server greeting)
+	// is established, with the time it took as Duration.
+	EventConnected EventType = iota + 1
+	// EventAuthenticated is sent after a successful authentication (or PREAUTH).
+	EventAuthenticated
+	// EventCommandStarted is sent when a command has been sent.
+	EventCommandStarted
+	// EventCommandFinished is sent when a command has completed, with its
+	// Duration and error.
+	EventCommandFinished
+	// EventDisconnected is sent when the connection is closed or dropped.
+	EventDisconnected
+	// EventReconnecting is sent before reconnecting (see WithRetry), with
+	// the Attempt number and the error which caused it.
+	EventReconnecting
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "Connected"
+	case EventAuthenticated:
+		return "Authenticated"
+	case EventCommandStarted:
+		return "CommandStarted"
+	case EventCommandFinished:
+		return "CommandFinished"
+	case EventDisconnected:
+		return "Disconnected"
+	case EventReconnecting:
+		return "Reconnecting"
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Event is an operation event of a client, sent to the channel of WithEvents.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// Addr is the host:port of the server.
+	Addr string
+	// Command is the name of the command, such as "UID FETCH".
+	Command  string
+	Duration time.Duration
+	// Attempt is the number of the reconnect attempt, from 1.
+	Attempt int
+	Err     error
+}
+
+// WithEvents makes the client send its operation events to ch, for dashboards
+// and alerting. The events are sent without blocking: they are dropped if ch
+// is full, so it should be buffered, and drained continuously.
+func WithEvents(ch chan<- Event) Option {
+	return func(c *client) { c.events = ch }
+}
+
+// emit sends the event to the events channel, if there is room in it.
+func (c *client) emit(e Event) {
+	if c.events == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Addr = c.host + ":" + strconv.Itoa(c.port)
+	select {
+	case c.events <- e:
+	default:
+	}
+}
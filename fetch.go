@@ -0,0 +1,183 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+var (
+	// FetchBatchSize is the maximum number of messages FetchMany fetches in one UID FETCH.
+	FetchBatchSize = 100
+
+	// ReadChunkSize is the size of the partial fetches of ReadTo - 1MiB by default.
+	// Zero means fetching the whole message at once.
+	ReadChunkSize = 1 << 20
+)
+
+// FetchMany reads the messages identified by uids, in batches of FetchBatchSize,
+// calling fn with each message body as it arrives.
+// With WithPipelining, the batches are fetched with concurrent commands.
+//
+// If fn returns an error, the rest of the messages are skipped, and that error is returned.
+// fn must not call the methods of the Client, as the fetch is still in progress.
+func (c *client) FetchMany(uids []uint32, fn func(uid uint32, r io.Reader) error) error {
+	c.enter()
+	defer c.leave()
+	fn = c.progressFetch(len(uids), fn)
+	if c.pipelining > 1 {
+		return c.fetchManyPipelined(uids, fn)
+	}
+	batch := FetchBatchSize
+	if batch <= 0 {
+		batch = len(uids)
+	}
+	for len(uids) > 0 {
+		n := batch
+		if n > len(uids) {
+			n = len(uids)
+		}
+		pending := make(map[uint32]bool, n)
+		for _, uid := range uids[:n] {
+			pending[uid] = true
+		}
+		uids = uids[n:]
+
+		var fnErr error
+		err := c.retry("FetchMany", func() error {
+			// after a reconnect, fetch only the not yet delivered messages
+			set := getSeqSet()
+			defer putSeqSet(set)
+			for uid := range pending {
+				set.AddNum(uid)
+			}
+			return c.fetch(set, []string{"BODY.PEEK[]"}, func(resp *imap.Response) error {
+				if fnErr != nil {
+					return nil
+				}
+				info := resp.MessageInfo()
+				delete(pending, info.UID)
+				fnErr = fn(info.UID, bytes.NewReader(imap.AsBytes(info.Attrs["BODY[]"])))
+				return nil
+			})
+		})
+		if fnErr != nil {
+			return fnErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seqSetPool holds the sequence sets of the single message commands,
+// which would otherwise be allocated for every fetch or store.
+var seqSetPool = sync.Pool{New: func() interface{} { return &imap.SeqSet{} }}
+
+// getSeqSet returns a sequence set of uids from seqSetPool.
+// It must be returned with putSeqSet, once the command has completed.
+func getSeqSet(uids ...uint32) *imap.SeqSet {
+	set := seqSetPool.Get().(*imap.SeqSet)
+	set.AddNum(uids...)
+	return set
+}
+
+// putSeqSet clears set, and puts it back into seqSetPool.
+func putSeqSet(set *imap.SeqSet) {
+	set.Clear()
+	seqSetPool.Put(set)
+}
+
+// partialItem appends the BODY.PEEK[]<offset.length> fetch item to buf.
+func partialItem(buf []byte, offset, length int64) []byte {
+	buf = append(buf, "BODY.PEEK[]<"...)
+	buf = strconv.AppendInt(buf, offset, 10)
+	buf = append(buf, '.')
+	buf = strconv.AppendInt(buf, length, 10)
+	return append(buf, '>')
+}
+
+// bodyWriter is the LiteralReader of ReadTo, which writes the literals
+// to w straight from the connection, instead of reading them into memory.
+type bodyWriter struct {
+	w io.Writer
+	// n is the number of bytes written to w.
+	n int64
+	// err is the first error of w - the rest of the literals are discarded,
+	// to keep the connection in sync.
+	err error
+}
+
+// ReadLiteral copies the literal to the underlying writer.
+func (b *bodyWriter) ReadLiteral(r io.Reader, i imap.LiteralInfo) (imap.Literal, error) {
+	if _, err := io.CopyN(b, r, int64(i.Len)); err != nil {
+		return nil, err
+	}
+	return writtenLiteral(i), nil
+}
+
+func (b *bodyWriter) Write(p []byte) (int, error) {
+	if b.err == nil {
+		var n int
+		n, b.err = b.w.Write(p)
+		b.n += int64(n)
+	}
+	return len(p), nil
+}
+
+// writtenLiteral is a literal which has already been written out by bodyWriter.
+type writtenLiteral imap.LiteralInfo
+
+func (l writtenLiteral) WriteTo(w io.Writer) (int64, error) { return 0, nil }
+func (l writtenLiteral) Info() imap.LiteralInfo             { return imap.LiteralInfo(l) }
+
+// fetch issues UID FETCH, and calls fn with every response as it arrives.
+func (c *client) fetch(set *imap.SeqSet, items []string, fn func(*imap.Response) error) error {
+	cmd, err := c.c.UIDFetch(set, items...)
+	if err != nil {
+		return classify("Fetch", nil, err)
+	}
+
+	return c.intercept(cmd.Name(true), func() error {
+		for cmd.InProgress() {
+			// wait for server response
+			if err = c.c.Recv(c.readTimeout()); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return classify("Fetch", ErrConnection, err)
+			}
+			// Process data.
+			for _, resp := range cmd.Data {
+				if err = fn(resp); err != nil {
+					return err
+				}
+			}
+			cmd.Data = nil
+		}
+
+		// Check command completion status.
+		_, err = cmd.Result(imap.OK)
+		return classify("Fetch", nil, err)
+	})
+}
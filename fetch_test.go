@@ -0,0 +1,69 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// benchBody is a message of 64KiB.
+var benchBody = "Subject: bench\r\n\r\n" + strings.Repeat(strings.Repeat("x", 78)+"\r\n", 64<<10/80)
+
+func BenchmarkReadTo(b *testing.B) {
+	c, _ := newFakeClient(b, 1, benchBody)
+	if err := c.Select("INBOX"); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(benchBody)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.ReadTo(io.Discard, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetFlags(b *testing.B) {
+	c, _ := newFakeClient(b, 1, benchBody)
+	if err := c.Select("INBOX"); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.GetFlags(1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSetFlag(b *testing.B) {
+	c, _ := newFakeClient(b, 1, benchBody)
+	if err := c.Select("INBOX"); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.SetFlag(1, `\Seen`, i%2 == 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Predicate reports whether a message, given by its header and size,
+// satisfies a condition.
+type Predicate func(hdr textproto.MIMEHeader, size uint32) bool
+
+// Filter accepts the messages satisfying all its predicates - for rejecting
+// messages by their header, before downloading their body.
+type Filter []Predicate
+
+// Accept reports whether the message satisfies all the predicates of f.
+func (f Filter) Accept(hdr textproto.MIMEHeader, size uint32) bool {
+	for _, p := range f {
+		if !p(hdr, size) {
+			return false
+		}
+	}
+	return true
+}
+
+// HeaderMatches is satisfied if the header field key matches re.
+func HeaderMatches(key string, re *regexp.Regexp) Predicate {
+	return func(hdr textproto.MIMEHeader, _ uint32) bool {
+		return re.MatchString(hdr.Get(key))
+	}
+}
+
+// FromDomains is satisfied if the From address is of one of the domains
+// (case insensitive).
+func FromDomains(domains ...string) Predicate {
+	allowed := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		allowed[strings.ToLower(strings.TrimPrefix(d, "@"))] = true
+	}
+	return func(hdr textproto.MIMEHeader, _ uint32) bool {
+		addr, err := mail.ParseAddress(hdr.Get("From"))
+		if err != nil {
+			return false
+		}
+		i := strings.LastIndexByte(addr.Address, '@')
+		return i >= 0 && allowed[strings.ToLower(addr.Address[i+1:])]
+	}
+}
+
+// HasAttachment is satisfied if the message may have an attachment, as
+// judged from the header alone: its Content-Type is multipart/mixed, or
+// neither text nor multipart.
+func HasAttachment() Predicate {
+	return func(hdr textproto.MIMEHeader, _ uint32) bool {
+		mediaType, _, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+		if err != nil {
+			return false
+		}
+		return mediaType == "multipart/mixed" ||
+			!strings.HasPrefix(mediaType, "text/") && !strings.HasPrefix(mediaType, "multipart/")
+	}
+}
+
+// LargerThan is satisfied if the message is larger than size bytes.
+func LargerThan(size uint32) Predicate {
+	return func(_ textproto.MIMEHeader, n uint32) bool { return n > size }
+}
+
+// Not negates p: Not(LargerThan(10<<20)) rejects the messages above 10MiB.
+func Not(p Predicate) Predicate {
+	return func(hdr textproto.MIMEHeader, size uint32) bool { return !p(hdr, size) }
+}
+
+// filter reports whether the message is accepted by the Filter of the loop,
+// fetching only its header and size.
+func (l *Loop) filter(c Client, uid uint32) (bool, error) {
+	if len(l.Filter) == 0 {
+		return true, nil
+	}
+	hdr, err := c.GetHeaders(uid)
+	if err != nil {
+		return false, err
+	}
+	size, err := c.GetSize(uid)
+	if err != nil {
+		return false, err
+	}
+	return l.Filter.Accept(hdr, size), nil
+}
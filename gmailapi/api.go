@@ -0,0 +1,235 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gmailapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/imapclient"
+)
+
+var (
+	// BaseURL is the endpoint of the Gmail API.
+	BaseURL = "https://gmail.googleapis.com/gmail/v1"
+
+	// HTTPClient is the client of the API requests - http.DefaultClient by default.
+	HTTPClient = http.DefaultClient
+)
+
+// apiError is an error response of the API.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Status  string `json:"status"`
+	Errors  []struct {
+		Reason string `json:"reason"`
+	} `json:"errors"`
+}
+
+func (e *apiError) Error() string {
+	return strconv.Itoa(e.Code) + " " + e.Status + ": " + e.Message
+}
+
+// label is a label resource.
+type label struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	MessagesTotal  uint32 `json:"messagesTotal"`
+	MessagesUnread uint32 `json:"messagesUnread"`
+}
+
+// message is a message resource, in minimal, metadata or raw format.
+type message struct {
+	ID           string   `json:"id"`
+	LabelIDs     []string `json:"labelIds"`
+	InternalDate string   `json:"internalDate"`
+	SizeEstimate uint32   `json:"sizeEstimate"`
+	Raw          string   `json:"raw"`
+	Payload      struct {
+		Headers []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+	} `json:"payload"`
+}
+
+// internalDate returns the internal date (epoch milliseconds) of the message.
+func (m *message) internalDate() time.Time {
+	ms, err := strconv.ParseInt(m.InternalDate, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
+// request calls the API, and returns the response if its status is 2xx.
+// The path is under the user.
+func (c *client) request(method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	user := c.user
+	if user == "" {
+		user = "me"
+	}
+	u := BaseURL + "/users/" + url.PathEscape(user) + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+	token, err := c.tokens.Token()
+	if err != nil {
+		return nil, &imapclient.Error{Op: method, Kind: imapclient.ErrTokenExpired, Err: err}
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.logger.Debug("request", "method", method, "url", u)
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, &imapclient.Error{Op: method, Kind: imapclient.ErrConnection, Err: err}
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Error apiError `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+	if e.Error.Code == 0 {
+		e.Error.Code = resp.StatusCode
+	}
+	return nil, classify(method+" "+path, resp, &e.Error)
+}
+
+// classify returns the API error as an *imapclient.Error, if its kind is known.
+func classify(op string, resp *http.Response, err *apiError) error {
+	ce := &imapclient.Error{Op: op, Err: err}
+	throttled := err.Code == http.StatusTooManyRequests || err.Code == http.StatusServiceUnavailable
+	for _, e := range err.Errors {
+		throttled = throttled || strings.HasSuffix(e.Reason, "RateLimitExceeded") || e.Reason == "rateLimitExceeded"
+	}
+	switch {
+	case throttled:
+		ce.Kind = imapclient.ErrThrottled
+		if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+			ce.RetryAfter = time.Duration(s) * time.Second
+		}
+	case err.Code == http.StatusUnauthorized:
+		ce.Kind = imapclient.ErrTokenExpired
+	case err.Code == http.StatusForbidden:
+		ce.Kind = imapclient.ErrAuth
+	case err.Code >= 500:
+		ce.Kind = imapclient.ErrConnection
+	default:
+		return err
+	}
+	return ce
+}
+
+// call calls the API with the JSON body (if not nil), and decodes the JSON
+// response into out (if not nil).
+func (c *client) call(method, path string, query url.Values, body, out interface{}) error {
+	resp, err := c.request(method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// listIDs returns the ids of the messages with the label, matching the query q.
+func (c *client) listIDs(labelID, q string) ([]string, error) {
+	query := url.Values{"maxResults": {"500"}, "includeSpamTrash": {"true"}}
+	if labelID != "" {
+		query.Set("labelIds", labelID)
+	}
+	if q != "" {
+		query.Set("q", q)
+	}
+	var ids []string
+	for {
+		var page struct {
+			Messages []struct {
+				ID string `json:"id"`
+			} `json:"messages"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := c.call("GET", "/messages", query, nil, &page); err != nil {
+			return ids, err
+		}
+		for _, m := range page.Messages {
+			ids = append(ids, m.ID)
+		}
+		if page.NextPageToken == "" {
+			return ids, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// metadata returns the message in metadata format, with the given headers
+// (all of them if none is given).
+func (c *client) metadata(id string, headers ...string) (*message, error) {
+	query := url.Values{"format": {"metadata"}}
+	if len(headers) != 0 {
+		query["metadataHeaders"] = headers
+	}
+	var m message
+	if err := c.call("GET", messagePath(id), query, nil, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// modify adds and removes the labels of the message.
+func (c *client) modify(id string, add, remove []string) error {
+	body := map[string][]string{}
+	if len(add) != 0 {
+		body["addLabelIds"] = add
+	}
+	if len(remove) != 0 {
+		body["removeLabelIds"] = remove
+	}
+	return c.call("POST", messagePath(id)+"/modify", nil, body, nil)
+}
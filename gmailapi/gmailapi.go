@@ -0,0 +1,1316 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gmailapi implements imapclient.Client over the Gmail REST API, for
+// the Workspace domains where IMAP is administratively disabled.
+//
+// The mailboxes are the labels (INBOX, SENT, DRAFT, TRASH, SPAM, STARRED and
+// the user labels), plus ALL for all the messages; the UIDs are assigned to
+// the message ids in the session, in the order of the internal dates, thus
+// UIDVALIDITY changes with every Connect.
+//
+// \Seen is the lack of UNREAD, \Flagged is STARRED, \Draft is DRAFT
+// (read-only), the keywords are the user labels; \Deleted and \Answered are
+// kept in memory for the session only. Expunging moves the \Deleted messages
+// to the Trash (deletes them for good in TRASH), as deleting needs the
+// full https://mail.google.com/ scope; the gmail.modify scope is enough otherwise.
+package gmailapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	"github.com/tgulacsi/imapclient"
+)
+
+const (
+	// Inbox is the name of the inbox label.
+	Inbox = "INBOX"
+	// All is the name of the mailbox of all the messages (no label).
+	All = "ALL"
+)
+
+// systemLabels are the system labels shown as mailboxes, with their special use.
+var systemLabels = map[string]string{
+	"INBOX":   "",
+	"SENT":    imapclient.UseSent,
+	"DRAFT":   imapclient.UseDrafts,
+	"TRASH":   imapclient.UseTrash,
+	"SPAM":    imapclient.UseJunk,
+	"STARRED": imapclient.UseFlagged,
+}
+
+var (
+	errNotConnected = errors.New("not connected")
+	errNoLabel      = errors.New("no such label")
+)
+
+var _ = imapclient.Client((*client)(nil))
+
+type client struct {
+	user   string
+	tokens imapclient.TokenSource
+	logger imapclient.Logger
+
+	mu          sync.Mutex
+	connected   bool
+	labels      map[string]*label // by name
+	labelNames  map[string]string // by id
+	uids        map[string]uint32
+	ids         map[uint32]string
+	next        uint32
+	local       map[uint32]imap.FlagSet // \Deleted and \Answered
+	uidValidity uint32
+	selected    string
+	logMask     imap.LogMask
+}
+
+// NewClient returns a new (not connected) Client for the mailbox of user
+// (an email address, "me" or "" for the authenticated user), authenticating
+// with the OAuth2 access tokens of tokens.
+func NewClient(user string, tokens imapclient.TokenSource) imapclient.Client {
+	return &client{user: user, tokens: tokens, logger: imapclient.Log}
+}
+
+// String returns the user.
+func (c *client) String() string {
+	return "gmail:" + c.user
+}
+
+// Connect checks the access to the mailbox, and starts a new session.
+func (c *client) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.call("GET", "/profile", nil, nil, nil); err != nil {
+		return err
+	}
+	c.connected, c.labels, c.selected = true, nil, ""
+	c.uids, c.ids, c.next = make(map[string]uint32), make(map[uint32]string), 0
+	c.local = make(map[uint32]imap.FlagSet)
+	c.uidValidity = uint32(time.Now().Unix())
+	return nil
+}
+
+// Close expunges the \Deleted messages iff commit is true, and ends the session.
+func (c *client) Close(commit bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return nil
+	}
+	var err error
+	if commit {
+		err = c.expunge(c.deleted())
+	}
+	c.connected, c.selected = false, ""
+	return err
+}
+
+// uid returns the UID of the message id, assigning the next one to a new id.
+func (c *client) uid(id string) uint32 {
+	if uid, ok := c.uids[id]; ok {
+		return uid
+	}
+	c.next++
+	c.uids[id], c.ids[c.next] = c.next, id
+	return c.next
+}
+
+// id returns the message id of the UID.
+func (c *client) id(uid uint32) (string, error) {
+	if !c.connected {
+		return "", errNotConnected
+	}
+	if id, ok := c.ids[uid]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("unknown UID %d", uid)
+}
+
+func messagePath(id string) string {
+	return "/messages/" + url.PathEscape(id)
+}
+
+// loadLabels reads the labels, if not read yet.
+func (c *client) loadLabels() error {
+	if !c.connected {
+		return errNotConnected
+	}
+	if c.labels != nil {
+		return nil
+	}
+	var resp struct {
+		Labels []*label `json:"labels"`
+	}
+	if err := c.call("GET", "/labels", nil, nil, &resp); err != nil {
+		return err
+	}
+	c.labels = make(map[string]*label, len(resp.Labels))
+	c.labelNames = make(map[string]string, len(resp.Labels))
+	for _, l := range resp.Labels {
+		if _, ok := systemLabels[l.ID]; l.Type == "system" && !ok {
+			continue
+		}
+		if l.Type == "system" {
+			l.Name = l.ID
+		}
+		c.labels[l.Name] = l
+		c.labelNames[l.ID] = l.Name
+	}
+	return nil
+}
+
+// label returns the label of the mailbox; nil for All.
+func (c *client) label(op, mbox string) (*label, error) {
+	if err := c.loadLabels(); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(mbox, All) {
+		return nil, nil
+	}
+	if _, ok := systemLabels[strings.ToUpper(mbox)]; ok {
+		mbox = strings.ToUpper(mbox)
+	}
+	if l := c.labels[mbox]; l != nil {
+		return l, nil
+	}
+	return nil, &imapclient.Error{Op: op, Kind: imapclient.ErrMailboxNotFound, Err: fmt.Errorf("%q: %w", mbox, errNoLabel)}
+}
+
+// selectLabel returns the label of mbox, and makes it the selected one.
+func (c *client) selectLabel(op, mbox string) (*label, error) {
+	l, err := c.label(op, mbox)
+	if err != nil {
+		return nil, err
+	}
+	c.selected = All
+	if l != nil {
+		c.selected = l.Name
+	}
+	return l, nil
+}
+
+// flags returns the flags of the message.
+func (c *client) flags(uid uint32, m *message) imap.FlagSet {
+	flags := make(imap.FlagSet, len(m.LabelIDs)+2)
+	for f := range c.local[uid] {
+		flags[f] = true
+	}
+	flags[`\Seen`] = true
+	for _, id := range m.LabelIDs {
+		switch id {
+		case "UNREAD":
+			delete(flags, `\Seen`)
+		case "STARRED":
+			flags[`\Flagged`] = true
+		case "DRAFT":
+			flags[`\Draft`] = true
+		default:
+			if l := c.labels[c.labelNames[id]]; l != nil && l.Type == "user" {
+				flags[l.Name] = true
+			}
+		}
+	}
+	return flags
+}
+
+// deleted returns the UIDs of the \Deleted messages.
+func (c *client) deleted() []uint32 {
+	var uids []uint32
+	for uid, flags := range c.local {
+		if flags[`\Deleted`] {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// found is a message found by search.
+type found struct {
+	uid uint32
+	msg *message
+}
+
+// infoHeaders are the headers read for the message summaries.
+var infoHeaders = []string{"Subject", "From", "Date", "Message-Id"}
+
+// search returns the messages of mbox matching crit, in the order of the internal dates.
+//
+// The \Seen, \Flagged and date conditions are sent as query, the rest is
+// evaluated on the client side: all the headers or the raw message are read
+// only for the header and body conditions.
+func (c *client) search(mbox string, crit imapclient.SearchCriteria) ([]found, error) {
+	l, err := c.selectLabel("Search", mbox)
+	if err != nil {
+		return nil, err
+	}
+	crit = withoutWithin(crit, time.Now())
+	var q []string
+	for _, x := range []struct {
+		flags         []string
+		seen, starred string
+	}{{crit.WithFlags, "is:read", "is:starred"}, {crit.WithoutFlags, "is:unread", "-is:starred"}} {
+		for _, f := range x.flags {
+			switch f {
+			case `\Seen`:
+				q = append(q, x.seen)
+			case `\Flagged`:
+				q = append(q, x.starred)
+			}
+		}
+	}
+	if !crit.Since.IsZero() {
+		q = append(q, "after:"+strconv.FormatInt(day(crit.Since).Unix()-1, 10))
+	}
+	if !crit.Before.IsZero() {
+		q = append(q, "before:"+strconv.FormatInt(day(crit.Before).Unix(), 10))
+	}
+	var labelID string
+	if l != nil {
+		labelID = l.ID
+	}
+	ids, err := c.listIDs(labelID, strings.Join(q, " "))
+	if err != nil {
+		return nil, err
+	}
+
+	rest := crit
+	rest.WithFlags, rest.WithoutFlags, rest.Larger, rest.Smaller = nil, nil, 0, 0
+	headers := infoHeaders
+	if rest.NeedsHeader() {
+		headers = nil
+	}
+	msgs := make([]*message, 0, len(ids))
+	for _, id := range ids {
+		m, err := c.metadata(id, headers...)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].internalDate().Before(msgs[j].internalDate()) })
+
+	var res []found
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		uid := c.uid(m.ID)
+		flags := c.flags(uid, m)
+		if !crit.MatchFlags(flags, m.SizeEstimate) {
+			continue
+		}
+		var raw []byte
+		if rest.NeedsBody() {
+			buf.Reset()
+			if _, err = c.readTo(&buf, m.ID); err != nil {
+				return res, err
+			}
+			raw = buf.Bytes()
+		} else if rest.NeedsHeader() {
+			raw = rawHeader(m.header())
+		}
+		if !rest.Match(raw, flags, m.internalDate()) {
+			continue
+		}
+		res = append(res, found{uid: uid, msg: m})
+	}
+	return res, nil
+}
+
+// header returns the headers of the message in metadata format.
+func (m *message) header() textproto.MIMEHeader {
+	hdr := make(textproto.MIMEHeader, len(m.Payload.Headers))
+	for _, h := range m.Payload.Headers {
+		hdr.Add(h.Name, h.Value)
+	}
+	return hdr
+}
+
+// withoutWithin converts Younger and Older to Since and Before.
+func withoutWithin(crit imapclient.SearchCriteria, now time.Time) imapclient.SearchCriteria {
+	if crit.Younger > 0 {
+		if since := now.Add(-crit.Younger); crit.Since.IsZero() || since.After(crit.Since) {
+			crit.Since = since
+		}
+		crit.Younger = 0
+	}
+	if crit.Older > 0 {
+		if before := now.Add(-crit.Older); crit.Before.IsZero() || before.Before(crit.Before) {
+			crit.Before = before
+		}
+		crit.Older = 0
+	}
+	return crit
+}
+
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// rawHeader returns the header in RFC 5322 form, with the terminating empty line.
+func rawHeader(hdr textproto.MIMEHeader) []byte {
+	var buf bytes.Buffer
+	for k, vv := range hdr {
+		for _, v := range vv {
+			buf.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func uidsOf(res []found) []uint32 {
+	uids := make([]uint32, len(res))
+	for i, f := range res {
+		uids[i] = f.uid
+	}
+	return uids
+}
+
+func (c *client) searchUIDs(mbox string, crit imapclient.SearchCriteria) ([]uint32, error) {
+	res, err := c.search(mbox, crit)
+	return uidsOf(res), err
+}
+
+func listCriteria(pattern string, all bool) imapclient.SearchCriteria {
+	crit := imapclient.SearchCriteria{Subject: pattern}
+	if all {
+		crit.WithoutFlags = []string{`\Deleted`}
+	} else {
+		crit.WithoutFlags = []string{`\Seen`}
+	}
+	return crit
+}
+
+// List returns the UIDs of the messages whose subject contains pattern -
+// the not deleted ones iff all is true, the unread ones otherwise.
+func (c *client) List(mbox, pattern string, all bool) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.searchUIDs(mbox, listCriteria(pattern, all))
+}
+
+// ListWithInfo is like List, but returns the summaries of the messages.
+func (c *client) ListWithInfo(mbox, pattern string, all bool) ([]imapclient.MessageInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, err := c.search(mbox, listCriteria(pattern, all))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]imapclient.MessageInfo, len(res))
+	for i, f := range res {
+		hdr := mail.Header(f.msg.header())
+		infos[i] = imapclient.MessageInfo{UID: f.uid, Subject: hdr.Get("Subject"), From: hdr.Get("From"),
+			Size: f.msg.SizeEstimate, Flags: c.flags(f.uid, f.msg), InternalDate: f.msg.internalDate(),
+			MessageID: hdr.Get("Message-Id")}
+		infos[i].Date, _ = hdr.Date()
+	}
+	return infos, nil
+}
+
+// ListIter calls fn with the matching UIDs in imapclient.ListPageSize pages.
+func (c *client) ListIter(mbox, pattern string, all bool, fn func(uids []uint32) error) error {
+	c.mu.Lock()
+	uids, err := c.searchUIDs(mbox, listCriteria(pattern, all))
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	size := imapclient.ListPageSize
+	if size <= 0 {
+		size = len(uids)
+	}
+	for len(uids) > 0 {
+		n := size
+		if n > len(uids) {
+			n = len(uids)
+		}
+		if err := fn(uids[:n:n]); err != nil {
+			return err
+		}
+		uids = uids[n:]
+	}
+	return nil
+}
+
+// ListSince lists the not deleted messages with an internal date on or after the day of since.
+func (c *client) ListSince(mbox string, since time.Time) ([]uint32, error) {
+	return c.ListBetween(mbox, since, time.Time{})
+}
+
+// ListBetween lists the not deleted messages with an internal date on or
+// after the day of from, and before the day of to.
+func (c *client) ListBetween(mbox string, from, to time.Time) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.searchUIDs(mbox, imapclient.SearchCriteria{Since: from, Before: to, WithoutFlags: []string{`\Deleted`}})
+}
+
+// ListNewer lists the messages with UID above lastUID.
+func (c *client) ListNewer(mbox string, lastUID uint32) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uids, err := c.searchUIDs(mbox, imapclient.SearchCriteria{})
+	filtered := uids[:0]
+	for _, uid := range uids {
+		if uid > lastUID {
+			filtered = append(filtered, uid)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i] < filtered[j] })
+	return filtered, err
+}
+
+func (c *client) mailboxes(pattern string) ([]imapclient.Mailbox, error) {
+	if err := c.loadLabels(); err != nil {
+		return nil, err
+	}
+	var mboxes []imapclient.Mailbox
+	if imapclient.MatchMailbox(pattern, All, imapclient.PathSeparator) {
+		mboxes = append(mboxes, imapclient.Mailbox{Name: All, Delim: imapclient.PathSeparator,
+			Attrs: imap.NewFlagSet(imapclient.UseAll, `\HasNoChildren`)})
+	}
+	for name, l := range c.labels {
+		if !imapclient.MatchMailbox(pattern, name, imapclient.PathSeparator) {
+			continue
+		}
+		attrs := make(imap.FlagSet, 1)
+		if use := systemLabels[l.ID]; l.Type == "system" && use != "" {
+			attrs[use] = true
+		}
+		mboxes = append(mboxes, imapclient.Mailbox{Name: name, Delim: imapclient.PathSeparator, Attrs: attrs})
+	}
+	sort.Slice(mboxes, func(i, j int) bool { return mboxes[i].Name < mboxes[j].Name })
+	return mboxes, nil
+}
+
+// Mailboxes returns the labels matching pattern.
+func (c *client) Mailboxes(pattern string) ([]imapclient.Mailbox, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mailboxes(pattern)
+}
+
+// MailboxTree returns the tree of the labels.
+func (c *client) MailboxTree() (*imapclient.MailboxTree, error) {
+	mboxes, err := c.Mailboxes("*")
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.NewMailboxTree(mboxes), nil
+}
+
+// MailboxesStatus returns the labels matching pattern, with their counters.
+func (c *client) MailboxesStatus(pattern string) ([]imapclient.Mailbox, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mboxes, err := c.mailboxes(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range mboxes {
+		if mboxes[i].Status, err = c.status(m.Name); err != nil {
+			return nil, err
+		}
+	}
+	return mboxes, nil
+}
+
+// SubscribedMailboxes returns all the labels, as Gmail has no subscriptions.
+func (c *client) SubscribedMailboxes() ([]imapclient.Mailbox, error) {
+	return c.Mailboxes("*")
+}
+
+// CreateMailbox creates the label, and its missing parents.
+func (c *client) CreateMailbox(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.create(mbox)
+	return err
+}
+
+// create returns the label of mbox, creating it (and its parents) if needed.
+func (c *client) create(mbox string) (*label, error) {
+	if l, err := c.label("Create", mbox); err == nil || !errors.Is(err, imapclient.ErrMailboxNotFound) {
+		return l, err
+	}
+	if i := strings.LastIndex(mbox, imapclient.PathSeparator); i >= 0 {
+		if _, err := c.create(mbox[:i]); err != nil {
+			return nil, err
+		}
+	}
+	var l label
+	if err := c.call("POST", "/labels", nil, map[string]string{"name": mbox,
+		"labelListVisibility": "labelShow", "messageListVisibility": "show"}, &l); err != nil {
+		return nil, err
+	}
+	c.labels[l.Name], c.labelNames[l.ID] = &l, l.Name
+	return &l, nil
+}
+
+// DeleteMailbox deletes the user label (the messages are kept).
+func (c *client) DeleteMailbox(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, err := c.userLabel("DeleteMailbox", mbox)
+	if err != nil {
+		return err
+	}
+	err = c.call("DELETE", "/labels/"+url.PathEscape(l.ID), nil, nil, nil)
+	c.labels = nil
+	if c.selected == l.Name {
+		c.selected = ""
+	}
+	return err
+}
+
+// userLabel returns the label of mbox, which must be a user label.
+func (c *client) userLabel(op, mbox string) (*label, error) {
+	l, err := c.label(op, mbox)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil || l.Type != "user" {
+		return nil, fmt.Errorf("%s: %q is a system label", op, mbox)
+	}
+	return l, nil
+}
+
+// RenameMailbox renames the user label.
+func (c *client) RenameMailbox(oldName, newName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, err := c.userLabel("RenameMailbox", oldName)
+	if err != nil {
+		return err
+	}
+	if i := strings.LastIndex(newName, imapclient.PathSeparator); i >= 0 {
+		if _, err = c.create(newName[:i]); err != nil {
+			return err
+		}
+	}
+	err = c.call("PATCH", "/labels/"+url.PathEscape(l.ID), nil, map[string]string{"name": newName}, nil)
+	c.labels = nil
+	if c.selected == l.Name {
+		c.selected = ""
+	}
+	return err
+}
+
+// Subscribe checks that the label exists, as Gmail has no subscriptions.
+func (c *client) Subscribe(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.label("Subscribe", mbox)
+	return err
+}
+
+// Unsubscribe checks that the label exists, as Gmail has no subscriptions.
+func (c *client) Unsubscribe(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.label("Unsubscribe", mbox)
+	return err
+}
+
+// Status returns the counters of the label.
+func (c *client) Status(mbox string) (*imap.MailboxStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status(mbox)
+}
+
+func (c *client) status(mbox string) (*imap.MailboxStatus, error) {
+	l, err := c.label("Status", mbox)
+	if err != nil {
+		return nil, err
+	}
+	st := &imap.MailboxStatus{Name: All, UIDNext: c.next + 1, UIDValidity: c.uidValidity,
+		Flags: imap.NewFlagSet(`\Seen`, `\Answered`, `\Flagged`, `\Deleted`, `\Draft`), PermFlags: permFlags()}
+	if l == nil {
+		var profile struct {
+			MessagesTotal uint32 `json:"messagesTotal"`
+		}
+		if err = c.call("GET", "/profile", nil, nil, &profile); err != nil {
+			return nil, err
+		}
+		unread, err := c.listIDs("", "is:unread")
+		if err != nil {
+			return nil, err
+		}
+		st.Messages, st.Unseen = profile.MessagesTotal, uint32(len(unread))
+		return st, nil
+	}
+	var fresh label
+	if err = c.call("GET", "/labels/"+url.PathEscape(l.ID), nil, nil, &fresh); err != nil {
+		return nil, err
+	}
+	st.Name, st.Messages, st.Unseen = l.Name, fresh.MessagesTotal, fresh.MessagesUnread
+	return st, nil
+}
+
+// MessageCount returns the number of messages with the label.
+func (c *client) MessageCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Messages), nil
+}
+
+// UnreadCount returns the number of unread messages with the label.
+func (c *client) UnreadCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Unseen), nil
+}
+
+// Select makes mbox the selected label.
+func (c *client) Select(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.selectLabel("Select", mbox)
+	return err
+}
+
+// Selected returns the name of the selected label.
+func (c *client) Selected() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.selected
+}
+
+// Search returns the UIDs of the messages matching crit, in the order of
+// the internal dates. Raw search keys are ignored.
+func (c *client) Search(mbox string, crit imapclient.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.searchUIDs(mbox, crit)
+}
+
+// SearchPage returns the requested page of the UIDs matching crit, and their number.
+func (c *client) SearchPage(mbox string, crit imapclient.SearchCriteria, offset, limit int) ([]uint32, int, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("bad page offset=%d limit=%d", offset, limit)
+	}
+	uids, err := c.Search(mbox, crit)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	total := len(uids)
+	if offset >= total {
+		return nil, total, nil
+	}
+	uids = uids[offset:]
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+	return uids, total, nil
+}
+
+// Sort returns the UIDs of the messages matching search, ordered by the criteria.
+func (c *client) Sort(mbox string, criteria []imapclient.SortKey, search imapclient.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, err := c.search(mbox, search)
+	if err != nil {
+		return nil, err
+	}
+	needHeader := false
+	for _, k := range criteria {
+		needHeader = needHeader || k.Field != imapclient.SortArrival && k.Field != imapclient.SortSize
+	}
+	msgs := make([]imapclient.SortMessage, len(res))
+	for i, f := range res {
+		msgs[i] = imapclient.SortMessage{UID: f.uid, InternalDate: f.msg.internalDate(), Size: f.msg.SizeEstimate}
+		if needHeader {
+			m, err := c.metadata(f.msg.ID, "Date", "Subject", "From", "To", "Cc")
+			if err != nil {
+				return nil, err
+			}
+			msgs[i].Header = mail.Header(m.header())
+		}
+	}
+	return imapclient.SortMessages(msgs, criteria), nil
+}
+
+// ReadTo writes the raw message to w.
+func (c *client) ReadTo(w io.Writer, msgID uint32) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.id(msgID)
+	if err != nil {
+		return 0, err
+	}
+	return c.readTo(w, id)
+}
+
+func (c *client) readTo(w io.Writer, id string) (int64, error) {
+	var m message
+	if err := c.call("GET", messagePath(id), url.Values{"format": {"raw"}}, nil, &m); err != nil {
+		return 0, err
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(m.Raw, "="))
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(raw)
+	return int64(n), err
+}
+
+// FetchMany calls fn with the raw content of each message, in the order of uids.
+func (c *client) FetchMany(uids []uint32, fn func(uid uint32, r io.Reader) error) error {
+	var buf bytes.Buffer
+	for _, uid := range uids {
+		buf.Reset()
+		if _, err := c.ReadTo(&buf, uid); err != nil {
+			return err
+		}
+		if err := fn(uid, bytes.NewReader(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get returns the message in metadata format, with the given headers only.
+func (c *client) get(msgID uint32, headers ...string) (string, *message, error) {
+	id, err := c.id(msgID)
+	if err != nil {
+		return "", nil, err
+	}
+	if headers == nil {
+		headers = []string{"Date"}
+	}
+	m, err := c.metadata(id, headers...)
+	return id, m, err
+}
+
+// GetFlags returns the flags of the message.
+func (c *client) GetFlags(msgID uint32) (imap.FlagSet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadLabels(); err != nil {
+		return nil, err
+	}
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return c.flags(msgID, m), nil
+}
+
+// GetSize returns the estimated size of the message.
+func (c *client) GetSize(msgID uint32) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return 0, err
+	}
+	return m.SizeEstimate, nil
+}
+
+// GetHeaders returns the header of the message.
+func (c *client) GetHeaders(msgID uint32) (textproto.MIMEHeader, error) {
+	return c.FetchHeaderFields(msgID, nil)
+}
+
+// FetchHeaderFields returns the given fields of the header of the message.
+func (c *client) FetchHeaderFields(msgID uint32, fields []string) (textproto.MIMEHeader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.id(msgID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := c.metadata(id, fields...)
+	if err != nil {
+		return nil, err
+	}
+	return m.header(), nil
+}
+
+// GetEnvelope returns the envelope built from the header of the message.
+func (c *client) GetEnvelope(msgID uint32) (*imapclient.Envelope, error) {
+	hdr, err := c.FetchHeaderFields(msgID, []string{"Date", "Subject", "From", "Sender", "Reply-To",
+		"To", "Cc", "Bcc", "In-Reply-To", "Message-Id"})
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.HeaderEnvelope(mail.Header(hdr)), nil
+}
+
+// ListKeywords returns the user labels of the message, sorted.
+func (c *client) ListKeywords(msgID uint32) ([]string, error) {
+	flags, err := c.GetFlags(msgID)
+	if err != nil {
+		return nil, err
+	}
+	kws := make([]string, 0, len(flags))
+	for f := range flags {
+		if !strings.HasPrefix(f, `\`) {
+			kws = append(kws, f)
+		}
+	}
+	sort.Strings(kws)
+	return kws, nil
+}
+
+// PermanentFlags returns \Seen, \Flagged and `\*` (user labels).
+func (c *client) PermanentFlags(mbox string) (imap.FlagSet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.label("PermanentFlags", mbox); err != nil {
+		return nil, err
+	}
+	return permFlags(), nil
+}
+
+func permFlags() imap.FlagSet {
+	return imap.NewFlagSet(`\Seen`, `\Flagged`, `\*`)
+}
+
+// SetFlag sets (or unsets) the flag on the message.
+func (c *client) SetFlag(msgID uint32, keyword string, st bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setFlag(msgID, keyword, st)
+}
+
+func (c *client) setFlag(msgID uint32, keyword string, st bool) error {
+	id, err := c.id(msgID)
+	if err != nil {
+		return err
+	}
+	var labelID string
+	switch keyword {
+	case `\Seen`:
+		// \Seen is the lack of UNREAD
+		labelID, st = "UNREAD", !st
+	case `\Flagged`:
+		labelID = "STARRED"
+	case `\Deleted`, `\Answered`:
+		if c.local[msgID] == nil {
+			c.local[msgID] = make(imap.FlagSet)
+		}
+		if st {
+			c.local[msgID][keyword] = true
+		} else {
+			delete(c.local[msgID], keyword)
+		}
+		return nil
+	case `\Draft`, `\Recent`:
+		return imap.NotAvailableError(keyword)
+	default:
+		var l *label
+		if st {
+			l, err = c.create(keyword)
+		} else if l, err = c.label("SetFlag", keyword); errors.Is(err, imapclient.ErrMailboxNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		labelID = l.ID
+	}
+	if st {
+		return c.modify(id, []string{labelID}, nil)
+	}
+	return c.modify(id, nil, []string{labelID})
+}
+
+// SetFlagRegex sets (or unsets) the flags of the message matching regex.
+func (c *client) SetFlagRegex(msgID uint32, regex string, st bool) error {
+	rex, err := regexp.Compile(regex)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err = c.loadLabels(); err != nil {
+		return err
+	}
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return err
+	}
+	for flag := range c.flags(msgID, m) {
+		if rex.MatchString(flag) {
+			if err := c.setFlag(msgID, flag, st); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetFlags sets (or unsets) the flag on the messages.
+func (c *client) SetFlags(uids []uint32, keyword string, st bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.setFlag(uid, keyword, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFlagsSilent is SetFlags.
+func (c *client) SetFlagsSilent(uids []uint32, keyword string, st bool) error {
+	return c.SetFlags(uids, keyword, st)
+}
+
+// ReplaceFlags replaces the flags of the message; \Draft is left as is.
+func (c *client) ReplaceFlags(msgID uint32, flags []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.loadLabels(); err != nil {
+		return err
+	}
+	id, m, err := c.get(msgID)
+	if err != nil {
+		return err
+	}
+	set := imap.NewFlagSet(flags...)
+	var add, remove []string
+	if set[`\Seen`] {
+		remove = append(remove, "UNREAD")
+	} else {
+		add = append(add, "UNREAD")
+	}
+	if set[`\Flagged`] {
+		add = append(add, "STARRED")
+	} else {
+		remove = append(remove, "STARRED")
+	}
+	local := make(imap.FlagSet)
+	for f := range set {
+		switch f {
+		case `\Deleted`, `\Answered`:
+			local[f] = true
+		case `\Seen`, `\Flagged`, `\Draft`, `\Recent`:
+		default:
+			l, err := c.create(f)
+			if err != nil {
+				return err
+			}
+			add = append(add, l.ID)
+		}
+	}
+	for kw := range c.flags(msgID, m) {
+		if !strings.HasPrefix(kw, `\`) && !set[kw] {
+			remove = append(remove, c.labels[kw].ID)
+		}
+	}
+	if err = c.modify(id, add, remove); err != nil {
+		return err
+	}
+	c.local[msgID] = local
+	return nil
+}
+
+// MarkSeen sets \Seen (removes UNREAD) on the message.
+func (c *client) MarkSeen(msgID uint32) error { return c.SetFlag(msgID, `\Seen`, true) }
+
+// MarkSeenAll sets \Seen (removes UNREAD) on the messages.
+func (c *client) MarkSeenAll(uids []uint32) error { return c.SetFlags(uids, `\Seen`, true) }
+
+// MarkUnseen unsets \Seen (adds UNREAD) on the message.
+func (c *client) MarkUnseen(msgID uint32) error { return c.SetFlag(msgID, `\Seen`, false) }
+
+// MarkDeleted sets \Deleted on the message: it is expunged on Close(true).
+func (c *client) MarkDeleted(msgID uint32) error { return c.SetFlag(msgID, `\Deleted`, true) }
+
+// MarkUndeleted unsets \Deleted on the message.
+func (c *client) MarkUndeleted(msgID uint32) error { return c.SetFlag(msgID, `\Deleted`, false) }
+
+// MarkAnswered sets \Answered on the message, for this session.
+func (c *client) MarkAnswered(msgID uint32) error { return c.SetFlag(msgID, `\Answered`, true) }
+
+// MarkFlagged stars the message.
+func (c *client) MarkFlagged(msgID uint32) error { return c.SetFlag(msgID, `\Flagged`, true) }
+
+// MarkUnflagged unstars the message.
+func (c *client) MarkUnflagged(msgID uint32) error { return c.SetFlag(msgID, `\Flagged`, false) }
+
+// MarkDraft returns imap.NotAvailableError, as DRAFT cannot be set.
+func (c *client) MarkDraft(msgID uint32) error { return c.SetFlag(msgID, `\Draft`, true) }
+
+// DeleteMany sets \Deleted on the messages, and expunges them if expunge is true.
+func (c *client) DeleteMany(uids []uint32, expunge bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.setFlag(uid, `\Deleted`, true); err != nil {
+			return err
+		}
+	}
+	if !expunge {
+		return nil
+	}
+	return c.expunge(uids)
+}
+
+// Delete deletes the message for good if permanent (or it is in the Trash),
+// moves it to the Trash otherwise.
+func (c *client) Delete(msgID uint32, permanent bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.id(msgID)
+	if err != nil {
+		return err
+	}
+	if permanent || c.selected == "TRASH" {
+		err = c.call("DELETE", messagePath(id), nil, nil, nil)
+	} else {
+		err = c.call("POST", messagePath(id)+"/trash", nil, nil, nil)
+	}
+	if err == nil {
+		c.forget(msgID)
+	}
+	return err
+}
+
+// forget drops the UID.
+func (c *client) forget(uid uint32) {
+	delete(c.uids, c.ids[uid])
+	delete(c.ids, uid)
+	delete(c.local, uid)
+}
+
+// Move moves the message to mbox (creating it if needed): replaces the label
+// of the selected mailbox with the label of mbox.
+func (c *client) Move(msgID uint32, mbox string) error {
+	return c.MoveMany([]uint32{msgID}, mbox)
+}
+
+// MoveMany moves the messages to mbox (creating it if needed): replaces the
+// label of the selected mailbox with the label of mbox.
+func (c *client) MoveMany(uids []uint32, mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dest, err := c.create(mbox)
+	if err != nil {
+		return err
+	}
+	return c.moveMany(uids, dest)
+}
+
+// moveMany moves the messages to dest (All if nil).
+func (c *client) moveMany(uids []uint32, dest *label) error {
+	var add, remove []string
+	if dest != nil {
+		add = []string{dest.ID}
+	}
+	if l := c.labels[c.selected]; l != nil && (dest == nil || l.ID != dest.ID) {
+		remove = []string{l.ID}
+	}
+	for _, uid := range uids {
+		id, err := c.id(uid)
+		if err != nil {
+			return err
+		}
+		if dest != nil && dest.ID == "TRASH" {
+			err = c.call("POST", messagePath(id)+"/trash", nil, nil, nil)
+		} else {
+			err = c.modify(id, add, remove)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SpecialUse returns the name of the (system) label of the special use,
+// ALL for imapclient.UseAll.
+func (c *client) SpecialUse(use string) (string, error) {
+	if use == imapclient.UseAll {
+		return All, nil
+	}
+	for id, u := range systemLabels {
+		if u != "" && u == use {
+			return id, nil
+		}
+	}
+	return "", &imapclient.Error{Op: "SpecialUse", Kind: imapclient.ErrMailboxNotFound, Err: fmt.Errorf("no %s mailbox", use)}
+}
+
+// MoveToTrash moves the messages to the Trash.
+func (c *client) MoveToTrash(uids ...uint32) error {
+	return c.moveToSpecial(imapclient.UseTrash, uids)
+}
+
+// MoveToJunk moves the messages to Spam.
+func (c *client) MoveToJunk(uids ...uint32) error {
+	return c.moveToSpecial(imapclient.UseJunk, uids)
+}
+
+func (c *client) moveToSpecial(use string, uids []uint32) error {
+	name, err := c.SpecialUse(use)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, err := c.label("Move", name)
+	if err != nil {
+		return err
+	}
+	return c.moveMany(uids, l)
+}
+
+// Append inserts the message with the label of mbox (creating it if needed),
+// and returns its UID. The internal date is the Date header if date is zero,
+// the time of the insertion otherwise, as the API cannot set it.
+func (c *client) Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, err := c.create(mbox)
+	if err != nil {
+		return 0, err
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	set := imap.NewFlagSet(flags...)
+	var labelIDs []string
+	if l != nil {
+		labelIDs = append(labelIDs, l.ID)
+	}
+	if !set[`\Seen`] {
+		labelIDs = append(labelIDs, "UNREAD")
+	}
+	if set[`\Flagged`] {
+		labelIDs = append(labelIDs, "STARRED")
+	}
+	for f := range set {
+		if !strings.HasPrefix(f, `\`) {
+			kw, err := c.create(f)
+			if err != nil {
+				return 0, err
+			}
+			labelIDs = append(labelIDs, kw.ID)
+		}
+	}
+	query := url.Values{"internalDateSource": {"receivedTime"}}
+	if date.IsZero() {
+		query.Set("internalDateSource", "dateHeader")
+	}
+	var m message
+	if err = c.call("POST", "/messages", query, map[string]interface{}{
+		"raw": base64.URLEncoding.EncodeToString(raw), "labelIds": labelIDs}, &m); err != nil {
+		return 0, err
+	}
+	uid := c.uid(m.ID)
+	if set[`\Deleted`] || set[`\Answered`] {
+		c.local[uid] = make(imap.FlagSet)
+		for _, f := range []string{`\Deleted`, `\Answered`} {
+			if set[f] {
+				c.local[uid][f] = true
+			}
+		}
+	}
+	return uid, nil
+}
+
+// Expunge expunges those of the messages which are \Deleted - none without UIDs.
+func (c *client) Expunge(uids ...uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var del []uint32
+	for _, uid := range uids {
+		if c.local[uid][`\Deleted`] {
+			del = append(del, uid)
+		}
+	}
+	return c.expunge(del)
+}
+
+// ExpungeAll expunges all the \Deleted messages.
+func (c *client) ExpungeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expunge(c.deleted())
+}
+
+// expunge moves the messages to the Trash, or deletes them if TRASH is selected.
+func (c *client) expunge(uids []uint32) error {
+	for _, uid := range uids {
+		id, err := c.id(uid)
+		if err != nil {
+			return err
+		}
+		if c.selected == "TRASH" {
+			err = c.call("DELETE", messagePath(id), nil, nil, nil)
+		} else {
+			err = c.call("POST", messagePath(id)+"/trash", nil, nil, nil)
+		}
+		if err != nil {
+			return err
+		}
+		c.forget(uid)
+	}
+	return nil
+}
+
+// Check returns an error if not connected: there is nothing to checkpoint.
+func (c *client) Check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return errNotConnected
+	}
+	return nil
+}
+
+// SetLogMask just stores the mask: the requests are logged on Debug level.
+func (c *client) SetLogMask(mask imap.LogMask) imap.LogMask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.logMask
+	c.logMask = mask
+	return old
+}
+
+// Capabilities returns an empty map: the Gmail API has no IMAP capabilities.
+func (c *client) Capabilities() map[string]bool { return map[string]bool{} }
+
+// Supports returns false: the Gmail API has no IMAP capabilities.
+func (c *client) Supports(capability string) bool { return false }
+
+// Compressed returns false.
+func (c *client) Compressed() bool { return false }
@@ -0,0 +1,250 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package graph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/imapclient"
+)
+
+var (
+	// BaseURL is the endpoint of the Microsoft Graph API.
+	BaseURL = "https://graph.microsoft.com/v1.0"
+
+	// HTTPClient is the client of the API requests - http.DefaultClient by default.
+	HTTPClient = http.DefaultClient
+)
+
+// apiError is an error response of the API.
+type apiError struct {
+	Status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Code + ": " + e.Message
+}
+
+// folder is a mailFolder resource.
+type folder struct {
+	ID               string `json:"id"`
+	DisplayName      string `json:"displayName"`
+	ParentFolderID   string `json:"parentFolderId"`
+	ChildFolderCount int    `json:"childFolderCount"`
+	TotalItemCount   uint32 `json:"totalItemCount"`
+	UnreadItemCount  uint32 `json:"unreadItemCount"`
+}
+
+// message is a message resource, with the selected properties only.
+type message struct {
+	ID                string    `json:"id"`
+	Subject           string    `json:"subject"`
+	From              *address  `json:"from"`
+	ReceivedDateTime  time.Time `json:"receivedDateTime"`
+	SentDateTime      time.Time `json:"sentDateTime"`
+	IsRead            bool      `json:"isRead"`
+	IsDraft           bool      `json:"isDraft"`
+	Categories        []string  `json:"categories"`
+	InternetMessageID string    `json:"internetMessageId"`
+	Flag              struct {
+		FlagStatus string `json:"flagStatus"`
+	} `json:"flag"`
+	Headers []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"internetMessageHeaders"`
+	Props []struct {
+		ID    string `json:"id"`
+		Value string `json:"value"`
+	} `json:"singleValueExtendedProperties"`
+}
+
+type address struct {
+	EmailAddress struct {
+		Name    string `json:"name"`
+		Address string `json:"address"`
+	} `json:"emailAddress"`
+}
+
+// sizeProp is the extended property of the message size (PidTagMessageSize).
+const sizeProp = "Integer 0x0E08"
+
+// messageSelect are the properties of a message listing.
+var messageSelect = url.Values{
+	"$select": {"id,subject,from,receivedDateTime,sentDateTime,isRead,isDraft,categories,internetMessageId,flag"},
+	"$expand": {"singleValueExtendedProperties($filter=id eq '" + sizeProp + "')"},
+}
+
+// size returns the size of the message, from the extended property.
+func (m *message) size() uint32 {
+	for _, p := range m.Props {
+		// the id comes back as "Integer 0xe08"
+		var tag uint64
+		if _, err := fmt.Sscanf(strings.ToLower(p.ID), "integer 0x%x", &tag); err == nil && tag == 0x0E08 {
+			n, _ := strconv.ParseUint(p.Value, 10, 32)
+			return uint32(n)
+		}
+	}
+	return 0
+}
+
+// userPath returns the path of the mailbox owner: "/me" or "/users/{user}".
+func (c *client) userPath() string {
+	if c.user == "" || c.user == "me" {
+		return "/me"
+	}
+	return "/users/" + url.PathEscape(c.user)
+}
+
+// request calls the API, and returns the response if its status is 2xx.
+// Relative paths are under the user; absolute URLs (next links) are used as is.
+func (c *client) request(method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	u := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		u = BaseURL + c.userPath() + path
+	}
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	token, err := c.tokens.Token()
+	if err != nil {
+		return nil, &imapclient.Error{Op: method, Kind: imapclient.ErrTokenExpired, Err: err}
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	// the ids stay the same when the message is moved
+	req.Header.Set("Prefer", `IdType="ImmutableId"`)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	c.logger.Debug("request", "method", method, "url", u)
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return nil, &imapclient.Error{Op: method, Kind: imapclient.ErrConnection, Err: err}
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Error apiError `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+	e.Error.Status = resp.StatusCode
+	return nil, classify(method+" "+path, resp, &e.Error)
+}
+
+// classify returns the API error as an *imapclient.Error, if its kind is known.
+func classify(op string, resp *http.Response, err *apiError) error {
+	ce := &imapclient.Error{Op: op, Err: err}
+	switch err.Status {
+	case http.StatusUnauthorized:
+		ce.Kind = imapclient.ErrTokenExpired
+	case http.StatusForbidden:
+		ce.Kind = imapclient.ErrAuth
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		ce.Kind = imapclient.ErrThrottled
+		if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+			ce.RetryAfter = time.Duration(s) * time.Second
+		}
+	default:
+		if err.Status >= 500 {
+			ce.Kind = imapclient.ErrConnection
+		} else {
+			return err
+		}
+	}
+	return ce
+}
+
+// call calls the API with the JSON body (if not nil), and decodes the JSON response into out (if not nil).
+func (c *client) call(method, path string, query url.Values, body, out interface{}) error {
+	var r io.Reader
+	var contentType string
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r, contentType = bytes.NewReader(b), "application/json"
+	}
+	resp, err := c.request(method, path, query, contentType, r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// list calls fn with each page of the collection, following the next links.
+func (c *client) list(path string, query url.Values, fn func(raw json.RawMessage) error) error {
+	for path != "" {
+		var page struct {
+			Value    []json.RawMessage `json:"value"`
+			NextLink string            `json:"@odata.nextLink"`
+		}
+		if err := c.call("GET", path, query, nil, &page); err != nil {
+			return err
+		}
+		for _, raw := range page.Value {
+			if err := fn(raw); err != nil {
+				return err
+			}
+		}
+		// the next link contains the query
+		path, query = page.NextLink, nil
+	}
+	return nil
+}
+
+// listMessages calls fn with the messages of the folder, matching filter (if not empty).
+func (c *client) listMessages(folderID, filter string, fn func(*message) error) error {
+	q := url.Values{"$top": {"100"}}
+	for k, v := range messageSelect {
+		q[k] = v
+	}
+	if filter != "" {
+		q.Set("$filter", filter)
+	}
+	return c.list("/mailFolders/"+url.PathEscape(folderID)+"/messages", q, func(raw json.RawMessage) error {
+		var m message
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		return fn(&m)
+	})
+}
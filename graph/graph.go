@@ -0,0 +1,1269 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package graph implements imapclient.Client over the Microsoft Graph mail
+// API, for the Office365 tenants which disable IMAP.
+//
+// The mailboxes are the mail folders, named by their display name path
+// (joined with imapclient.PathSeparator), the inbox being INBOX.
+// The UIDs are assigned to the (immutable) message ids in the session, in the
+// order of receiving, thus UIDVALIDITY changes with every Connect.
+//
+// \Seen and \Flagged are the isRead and flag properties, keywords are
+// categories, \Draft is isDraft (read-only); \Deleted and \Answered are kept
+// in memory for the session only. The \Deleted messages are deleted on
+// Close(true), Expunge or ExpungeAll.
+package graph
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	"github.com/tgulacsi/imapclient"
+)
+
+// Inbox is the name of the inbox folder.
+const Inbox = "INBOX"
+
+// wellKnown maps the special uses to the well-known folder names.
+var wellKnown = map[string]string{
+	imapclient.UseArchive: "archive",
+	imapclient.UseDrafts:  "drafts",
+	imapclient.UseJunk:    "junkemail",
+	imapclient.UseSent:    "sentitems",
+	imapclient.UseTrash:   "deleteditems",
+}
+
+var (
+	errNotConnected = errors.New("not connected")
+	errNoFolder     = errors.New("no such folder")
+)
+
+var _ = imapclient.Client((*client)(nil))
+
+type client struct {
+	user   string
+	tokens imapclient.TokenSource
+	logger imapclient.Logger
+
+	mu          sync.Mutex
+	connected   bool
+	folders     map[string]*mailbox // by name
+	uids        map[string]uint32
+	ids         map[uint32]string
+	next        uint32
+	local       map[uint32]imap.FlagSet // \Deleted and \Answered
+	uidValidity uint32
+	selected    string
+	logMask     imap.LogMask
+}
+
+// mailbox is a folder with its name and special use.
+type mailbox struct {
+	folder
+	name, use string
+}
+
+// NewClient returns a new (not connected) Client for the mailbox of user
+// (a user principal name or id, "me" or "" for the signed-in user),
+// authenticating with the OAuth2 access tokens of tokens
+// (with Mail.ReadWrite permission).
+func NewClient(user string, tokens imapclient.TokenSource) imapclient.Client {
+	return &client{user: user, tokens: tokens, logger: imapclient.Log}
+}
+
+// String returns the user.
+func (c *client) String() string {
+	return "graph:" + c.user
+}
+
+// Connect checks the access to the inbox, and starts a new session.
+func (c *client) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var f folder
+	if err := c.call("GET", "/mailFolders/inbox", url.Values{"$select": {"id"}}, nil, &f); err != nil {
+		return err
+	}
+	c.connected, c.folders, c.selected = true, nil, ""
+	c.uids, c.ids, c.next = make(map[string]uint32), make(map[uint32]string), 0
+	c.local = make(map[uint32]imap.FlagSet)
+	c.uidValidity = uint32(time.Now().Unix())
+	return nil
+}
+
+// Close deletes the \Deleted messages iff commit is true, and ends the session.
+func (c *client) Close(commit bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return nil
+	}
+	var err error
+	if commit {
+		err = c.expunge(c.deleted())
+	}
+	c.connected, c.selected = false, ""
+	return err
+}
+
+// uid returns the UID of the message id, assigning the next one to a new id.
+func (c *client) uid(id string) uint32 {
+	if uid, ok := c.uids[id]; ok {
+		return uid
+	}
+	c.next++
+	c.uids[id], c.ids[c.next] = c.next, id
+	return c.next
+}
+
+// id returns the message id of the UID.
+func (c *client) id(uid uint32) (string, error) {
+	if !c.connected {
+		return "", errNotConnected
+	}
+	if id, ok := c.ids[uid]; ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("unknown UID %d", uid)
+}
+
+func (c *client) messagePath(id string) string {
+	return "/messages/" + url.PathEscape(id)
+}
+
+// loadFolders reads the folder hierarchy, if not read yet.
+func (c *client) loadFolders() error {
+	if !c.connected {
+		return errNotConnected
+	}
+	if c.folders != nil {
+		return nil
+	}
+	uses := make(map[string]string, len(wellKnown)+1)
+	for use, name := range wellKnown {
+		var f folder
+		if err := c.call("GET", "/mailFolders/"+name, url.Values{"$select": {"id"}}, nil, &f); err == nil {
+			uses[f.ID] = use
+		}
+	}
+	var inbox folder
+	if err := c.call("GET", "/mailFolders/inbox", url.Values{"$select": {"id"}}, nil, &inbox); err != nil {
+		return err
+	}
+	folders := make(map[string]*mailbox)
+	var walk func(path, prefix string) error
+	walk = func(path, prefix string) error {
+		var children []*mailbox
+		if err := c.list(path, url.Values{"$top": {"100"}}, func(raw json.RawMessage) error {
+			m := &mailbox{}
+			if err := json.Unmarshal(raw, &m.folder); err != nil {
+				return err
+			}
+			if m.name = prefix + m.DisplayName; m.ID == inbox.ID {
+				m.name = Inbox
+			}
+			m.use = uses[m.ID]
+			folders[m.name] = m
+			children = append(children, m)
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, m := range children {
+			if m.ChildFolderCount > 0 {
+				if err := walk("/mailFolders/"+url.PathEscape(m.ID)+"/childFolders", m.name+imapclient.PathSeparator); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk("/mailFolders", ""); err != nil {
+		return err
+	}
+	c.folders = folders
+	return nil
+}
+
+// folder returns the folder of the mailbox.
+func (c *client) folder(op, mbox string) (*mailbox, error) {
+	if err := c.loadFolders(); err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(mbox, Inbox) {
+		mbox = Inbox
+	}
+	if m := c.folders[mbox]; m != nil {
+		return m, nil
+	}
+	return nil, &imapclient.Error{Op: op, Kind: imapclient.ErrMailboxNotFound, Err: fmt.Errorf("%q: %w", mbox, errNoFolder)}
+}
+
+// selectFolder returns the folder of mbox, and makes it the selected one.
+func (c *client) selectFolder(op, mbox string) (*mailbox, error) {
+	m, err := c.folder(op, mbox)
+	if err != nil {
+		return nil, err
+	}
+	c.selected = m.name
+	return m, nil
+}
+
+// flags returns the flags of the message.
+func (c *client) flags(uid uint32, m *message) imap.FlagSet {
+	flags := make(imap.FlagSet, len(m.Categories)+2)
+	for f := range c.local[uid] {
+		flags[f] = true
+	}
+	if m.IsRead {
+		flags[`\Seen`] = true
+	}
+	if m.IsDraft {
+		flags[`\Draft`] = true
+	}
+	if m.Flag.FlagStatus == "flagged" {
+		flags[`\Flagged`] = true
+	}
+	for _, cat := range m.Categories {
+		flags[cat] = true
+	}
+	return flags
+}
+
+// deleted returns the UIDs of the \Deleted messages.
+func (c *client) deleted() []uint32 {
+	var uids []uint32
+	for uid, flags := range c.local {
+		if flags[`\Deleted`] {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// found is a message found by search.
+type found struct {
+	uid uint32
+	msg *message
+}
+
+// search returns the messages of mbox matching crit, in the order of receiving.
+//
+// The isRead and date conditions are sent as $filter, the rest is evaluated
+// on the client side: the headers or the MIME content are read only for the
+// header and body conditions.
+func (c *client) search(mbox string, crit imapclient.SearchCriteria) ([]found, error) {
+	f, err := c.selectFolder("Search", mbox)
+	if err != nil {
+		return nil, err
+	}
+	crit = withoutWithin(crit, time.Now())
+	var filters []string
+	for _, fl := range crit.WithFlags {
+		if fl == `\Seen` {
+			filters = append(filters, "isRead eq true")
+		}
+	}
+	for _, fl := range crit.WithoutFlags {
+		if fl == `\Seen` {
+			filters = append(filters, "isRead eq false")
+		}
+	}
+	if !crit.Since.IsZero() {
+		filters = append(filters, "receivedDateTime ge "+day(crit.Since).Format(time.RFC3339))
+	}
+	if !crit.Before.IsZero() {
+		filters = append(filters, "receivedDateTime lt "+day(crit.Before).Format(time.RFC3339))
+	}
+	var msgs []*message
+	if err = c.listMessages(f.ID, strings.Join(filters, " and "), func(m *message) error {
+		msgs = append(msgs, m)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(msgs, func(i, j int) bool { return msgs[i].ReceivedDateTime.Before(msgs[j].ReceivedDateTime) })
+
+	rest := crit
+	rest.WithFlags, rest.WithoutFlags, rest.Larger, rest.Smaller = nil, nil, 0, 0
+	var res []found
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		uid := c.uid(m.ID)
+		flags := c.flags(uid, m)
+		if !crit.MatchFlags(flags, m.size()) {
+			continue
+		}
+		var raw []byte
+		if rest.NeedsBody() {
+			buf.Reset()
+			if _, err = c.readTo(&buf, m.ID); err != nil {
+				return res, err
+			}
+			raw = buf.Bytes()
+		} else if rest.NeedsHeader() {
+			hdr, err := c.header(m.ID)
+			if err != nil {
+				return res, err
+			}
+			raw = rawHeader(hdr)
+		}
+		if !rest.Match(raw, flags, m.ReceivedDateTime) {
+			continue
+		}
+		res = append(res, found{uid: uid, msg: m})
+	}
+	return res, nil
+}
+
+// withoutWithin converts Younger and Older to Since and Before.
+func withoutWithin(crit imapclient.SearchCriteria, now time.Time) imapclient.SearchCriteria {
+	if crit.Younger > 0 {
+		if since := now.Add(-crit.Younger); crit.Since.IsZero() || since.After(crit.Since) {
+			crit.Since = since
+		}
+		crit.Younger = 0
+	}
+	if crit.Older > 0 {
+		if before := now.Add(-crit.Older); crit.Before.IsZero() || before.Before(crit.Before) {
+			crit.Before = before
+		}
+		crit.Older = 0
+	}
+	return crit
+}
+
+func day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// rawHeader returns the header in RFC 5322 form, with the terminating empty line.
+func rawHeader(hdr textproto.MIMEHeader) []byte {
+	var buf bytes.Buffer
+	for k, vv := range hdr {
+		for _, v := range vv {
+			buf.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+func uidsOf(res []found) []uint32 {
+	uids := make([]uint32, len(res))
+	for i, f := range res {
+		uids[i] = f.uid
+	}
+	return uids
+}
+
+func (c *client) searchUIDs(mbox string, crit imapclient.SearchCriteria) ([]uint32, error) {
+	res, err := c.search(mbox, crit)
+	return uidsOf(res), err
+}
+
+func listCriteria(pattern string, all bool) imapclient.SearchCriteria {
+	crit := imapclient.SearchCriteria{Subject: pattern}
+	if all {
+		crit.WithoutFlags = []string{`\Deleted`}
+	} else {
+		crit.WithoutFlags = []string{`\Seen`}
+	}
+	return crit
+}
+
+// List returns the UIDs of the messages whose subject contains pattern -
+// the not deleted ones iff all is true, the unread ones otherwise.
+func (c *client) List(mbox, pattern string, all bool) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.searchUIDs(mbox, listCriteria(pattern, all))
+}
+
+// ListWithInfo is like List, but returns the summaries of the messages.
+func (c *client) ListWithInfo(mbox, pattern string, all bool) ([]imapclient.MessageInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, err := c.search(mbox, listCriteria(pattern, all))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]imapclient.MessageInfo, len(res))
+	for i, f := range res {
+		m := f.msg
+		infos[i] = imapclient.MessageInfo{UID: f.uid, Subject: m.Subject, Date: m.SentDateTime,
+			Size: m.size(), Flags: c.flags(f.uid, m), InternalDate: m.ReceivedDateTime, MessageID: m.InternetMessageID}
+		if m.From != nil {
+			infos[i].From = (&mail.Address{Name: m.From.EmailAddress.Name, Address: m.From.EmailAddress.Address}).String()
+		}
+	}
+	return infos, nil
+}
+
+// ListIter calls fn with the matching UIDs in imapclient.ListPageSize pages.
+func (c *client) ListIter(mbox, pattern string, all bool, fn func(uids []uint32) error) error {
+	c.mu.Lock()
+	uids, err := c.searchUIDs(mbox, listCriteria(pattern, all))
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	size := imapclient.ListPageSize
+	if size <= 0 {
+		size = len(uids)
+	}
+	for len(uids) > 0 {
+		n := size
+		if n > len(uids) {
+			n = len(uids)
+		}
+		if err := fn(uids[:n:n]); err != nil {
+			return err
+		}
+		uids = uids[n:]
+	}
+	return nil
+}
+
+// ListSince lists the not deleted messages received on or after the day of since.
+func (c *client) ListSince(mbox string, since time.Time) ([]uint32, error) {
+	return c.ListBetween(mbox, since, time.Time{})
+}
+
+// ListBetween lists the not deleted messages received on or after the day
+// of from, and before the day of to.
+func (c *client) ListBetween(mbox string, from, to time.Time) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.searchUIDs(mbox, imapclient.SearchCriteria{Since: from, Before: to, WithoutFlags: []string{`\Deleted`}})
+}
+
+// ListNewer lists the messages with UID above lastUID.
+func (c *client) ListNewer(mbox string, lastUID uint32) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uids, err := c.searchUIDs(mbox, imapclient.SearchCriteria{})
+	filtered := uids[:0]
+	for _, uid := range uids {
+		if uid > lastUID {
+			filtered = append(filtered, uid)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i] < filtered[j] })
+	return filtered, err
+}
+
+// mailboxInfo returns the folder as a Mailbox, with its special-use attribute.
+func (m *mailbox) mailboxInfo() imapclient.Mailbox {
+	attrs := make(imap.FlagSet, 2)
+	if m.ChildFolderCount > 0 {
+		attrs[`\HasChildren`] = true
+	} else {
+		attrs[`\HasNoChildren`] = true
+	}
+	if m.use != "" {
+		attrs[m.use] = true
+	}
+	return imapclient.Mailbox{Name: m.name, Delim: imapclient.PathSeparator, Attrs: attrs}
+}
+
+func (c *client) mailboxes(pattern string) ([]imapclient.Mailbox, error) {
+	if err := c.loadFolders(); err != nil {
+		return nil, err
+	}
+	var mboxes []imapclient.Mailbox
+	for name, m := range c.folders {
+		if imapclient.MatchMailbox(pattern, name, imapclient.PathSeparator) {
+			mboxes = append(mboxes, m.mailboxInfo())
+		}
+	}
+	sort.Slice(mboxes, func(i, j int) bool { return mboxes[i].Name < mboxes[j].Name })
+	return mboxes, nil
+}
+
+// Mailboxes returns the folders matching pattern.
+func (c *client) Mailboxes(pattern string) ([]imapclient.Mailbox, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mailboxes(pattern)
+}
+
+// MailboxTree returns the tree of the folders.
+func (c *client) MailboxTree() (*imapclient.MailboxTree, error) {
+	mboxes, err := c.Mailboxes("*")
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.NewMailboxTree(mboxes), nil
+}
+
+// MailboxesStatus returns the folders matching pattern, with their counters.
+func (c *client) MailboxesStatus(pattern string) ([]imapclient.Mailbox, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.folders = nil // fresh counters
+	mboxes, err := c.mailboxes(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range mboxes {
+		mboxes[i].Status = c.status(c.folders[m.Name])
+	}
+	return mboxes, nil
+}
+
+// SubscribedMailboxes returns all the folders, as Graph has no subscriptions.
+func (c *client) SubscribedMailboxes() ([]imapclient.Mailbox, error) {
+	return c.Mailboxes("*")
+}
+
+// CreateMailbox creates the folder, and its missing parents.
+func (c *client) CreateMailbox(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.create(mbox)
+	return err
+}
+
+// create returns the folder of mbox, creating it (and its parents) if needed.
+func (c *client) create(mbox string) (*mailbox, error) {
+	if err := c.loadFolders(); err != nil {
+		return nil, err
+	}
+	if m, err := c.folder("Create", mbox); err == nil {
+		return m, nil
+	}
+	path := "/mailFolders"
+	name := mbox
+	if i := strings.LastIndex(mbox, imapclient.PathSeparator); i >= 0 {
+		parent, err := c.create(mbox[:i])
+		if err != nil {
+			return nil, err
+		}
+		path += "/" + url.PathEscape(parent.ID) + "/childFolders"
+		name = mbox[i+len(imapclient.PathSeparator):]
+		parent.ChildFolderCount++
+	}
+	m := &mailbox{name: mbox}
+	if err := c.call("POST", path, nil, map[string]string{"displayName": name}, &m.folder); err != nil {
+		return nil, err
+	}
+	c.folders[mbox] = m
+	return m, nil
+}
+
+// DeleteMailbox deletes the folder (with its messages and subfolders).
+func (c *client) DeleteMailbox(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.folder("DeleteMailbox", mbox)
+	if err != nil {
+		return err
+	}
+	err = c.call("DELETE", "/mailFolders/"+url.PathEscape(m.ID), nil, nil, nil)
+	c.folders = nil
+	if c.selected == m.name {
+		c.selected = ""
+	}
+	return err
+}
+
+// RenameMailbox renames the folder, moving it under the new parent if needed.
+func (c *client) RenameMailbox(oldName, newName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.folder("RenameMailbox", oldName)
+	if err != nil {
+		return err
+	}
+	oldParent, newParent, name := "", "", newName
+	if i := strings.LastIndex(m.name, imapclient.PathSeparator); i >= 0 {
+		oldParent = m.name[:i]
+	}
+	if i := strings.LastIndex(newName, imapclient.PathSeparator); i >= 0 {
+		newParent, name = newName[:i], newName[i+len(imapclient.PathSeparator):]
+	}
+	defer func() { c.folders = nil }()
+	path := "/mailFolders/" + url.PathEscape(m.ID)
+	if newParent != oldParent {
+		dest := "msgfolderroot"
+		if newParent != "" {
+			p, err := c.create(newParent)
+			if err != nil {
+				return err
+			}
+			dest = p.ID
+		}
+		if err = c.call("POST", path+"/move", nil, map[string]string{"destinationId": dest}, nil); err != nil {
+			return err
+		}
+	}
+	if c.selected == m.name {
+		c.selected = ""
+	}
+	return c.call("PATCH", path, nil, map[string]string{"displayName": name}, nil)
+}
+
+// Subscribe checks that the folder exists, as Graph has no subscriptions.
+func (c *client) Subscribe(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.folder("Subscribe", mbox)
+	return err
+}
+
+// Unsubscribe checks that the folder exists, as Graph has no subscriptions.
+func (c *client) Unsubscribe(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.folder("Unsubscribe", mbox)
+	return err
+}
+
+// Status returns the counters of the folder.
+func (c *client) Status(mbox string) (*imap.MailboxStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.folder("Status", mbox)
+	if err != nil {
+		return nil, err
+	}
+	var f folder
+	if err = c.call("GET", "/mailFolders/"+url.PathEscape(m.ID), nil, nil, &f); err != nil {
+		return nil, err
+	}
+	m.TotalItemCount, m.UnreadItemCount = f.TotalItemCount, f.UnreadItemCount
+	return c.status(m), nil
+}
+
+func (c *client) status(m *mailbox) *imap.MailboxStatus {
+	return &imap.MailboxStatus{Name: m.name, Messages: m.TotalItemCount, Unseen: m.UnreadItemCount,
+		UIDNext: c.next + 1, UIDValidity: c.uidValidity,
+		Flags: imap.NewFlagSet(`\Seen`, `\Answered`, `\Flagged`, `\Deleted`, `\Draft`), PermFlags: permFlags()}
+}
+
+// MessageCount returns the number of messages in the folder.
+func (c *client) MessageCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Messages), nil
+}
+
+// UnreadCount returns the number of unread messages in the folder.
+func (c *client) UnreadCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Unseen), nil
+}
+
+// Select makes mbox the selected folder.
+func (c *client) Select(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.selectFolder("Select", mbox)
+	return err
+}
+
+// Selected returns the name of the selected folder.
+func (c *client) Selected() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.selected
+}
+
+// Search returns the UIDs of the messages matching crit, in the order of
+// receiving. Raw search keys are ignored.
+func (c *client) Search(mbox string, crit imapclient.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.searchUIDs(mbox, crit)
+}
+
+// SearchPage returns the requested page of the UIDs matching crit, and their number.
+func (c *client) SearchPage(mbox string, crit imapclient.SearchCriteria, offset, limit int) ([]uint32, int, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("bad page offset=%d limit=%d", offset, limit)
+	}
+	uids, err := c.Search(mbox, crit)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	total := len(uids)
+	if offset >= total {
+		return nil, total, nil
+	}
+	uids = uids[offset:]
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+	return uids, total, nil
+}
+
+// Sort returns the UIDs of the messages matching search, ordered by the
+// criteria. The headers are read only if a criterion needs them.
+func (c *client) Sort(mbox string, criteria []imapclient.SortKey, search imapclient.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res, err := c.search(mbox, search)
+	if err != nil {
+		return nil, err
+	}
+	needHeader := false
+	for _, k := range criteria {
+		needHeader = needHeader || k.Field != imapclient.SortArrival && k.Field != imapclient.SortSize
+	}
+	msgs := make([]imapclient.SortMessage, len(res))
+	for i, f := range res {
+		msgs[i] = imapclient.SortMessage{UID: f.uid, InternalDate: f.msg.ReceivedDateTime, Size: f.msg.size()}
+		if needHeader {
+			hdr, err := c.header(f.msg.ID)
+			if err != nil {
+				return nil, err
+			}
+			msgs[i].Header = mail.Header(hdr)
+		}
+	}
+	return imapclient.SortMessages(msgs, criteria), nil
+}
+
+// ReadTo writes the MIME content of the message to w.
+func (c *client) ReadTo(w io.Writer, msgID uint32) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.id(msgID)
+	if err != nil {
+		return 0, err
+	}
+	return c.readTo(w, id)
+}
+
+func (c *client) readTo(w io.Writer, id string) (int64, error) {
+	resp, err := c.request("GET", c.messagePath(id)+"/$value", nil, "", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// FetchMany calls fn with the MIME content of each message, in the order of uids.
+func (c *client) FetchMany(uids []uint32, fn func(uid uint32, r io.Reader) error) error {
+	var buf bytes.Buffer
+	for _, uid := range uids {
+		buf.Reset()
+		if _, err := c.ReadTo(&buf, uid); err != nil {
+			return err
+		}
+		if err := fn(uid, bytes.NewReader(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// get returns the message with the listing properties.
+func (c *client) get(msgID uint32) (string, *message, error) {
+	id, err := c.id(msgID)
+	if err != nil {
+		return "", nil, err
+	}
+	var m message
+	if err = c.call("GET", c.messagePath(id), messageSelect, nil, &m); err != nil {
+		return id, nil, err
+	}
+	return id, &m, nil
+}
+
+// GetFlags returns the flags of the message.
+func (c *client) GetFlags(msgID uint32) (imap.FlagSet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return c.flags(msgID, m), nil
+}
+
+// GetSize returns the size of the message.
+func (c *client) GetSize(msgID uint32) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return 0, err
+	}
+	return m.size(), nil
+}
+
+// header returns the internet message headers of the message.
+func (c *client) header(id string) (textproto.MIMEHeader, error) {
+	var m message
+	if err := c.call("GET", c.messagePath(id), url.Values{"$select": {"internetMessageHeaders"}}, nil, &m); err != nil {
+		return nil, err
+	}
+	hdr := make(textproto.MIMEHeader, len(m.Headers))
+	for _, h := range m.Headers {
+		hdr.Add(h.Name, h.Value)
+	}
+	return hdr, nil
+}
+
+// GetHeaders returns the internet message headers of the message.
+func (c *client) GetHeaders(msgID uint32) (textproto.MIMEHeader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.id(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return c.header(id)
+}
+
+// FetchHeaderFields returns the given fields of the header of the message.
+func (c *client) FetchHeaderFields(msgID uint32, fields []string) (textproto.MIMEHeader, error) {
+	hdr, err := c.GetHeaders(msgID)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make(textproto.MIMEHeader, len(fields))
+	for _, f := range fields {
+		k := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(f))
+		if vv, ok := hdr[k]; ok {
+			filtered[k] = vv
+		}
+	}
+	return filtered, nil
+}
+
+// GetEnvelope returns the envelope built from the header of the message.
+func (c *client) GetEnvelope(msgID uint32) (*imapclient.Envelope, error) {
+	hdr, err := c.GetHeaders(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.HeaderEnvelope(mail.Header(hdr)), nil
+}
+
+// ListKeywords returns the categories of the message, sorted.
+func (c *client) ListKeywords(msgID uint32) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return nil, err
+	}
+	kws := append([]string(nil), m.Categories...)
+	sort.Strings(kws)
+	return kws, nil
+}
+
+// PermanentFlags returns \Seen, \Flagged and `\*` (categories).
+func (c *client) PermanentFlags(mbox string) (imap.FlagSet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.folder("PermanentFlags", mbox); err != nil {
+		return nil, err
+	}
+	return permFlags(), nil
+}
+
+func permFlags() imap.FlagSet {
+	return imap.NewFlagSet(`\Seen`, `\Flagged`, `\*`)
+}
+
+// SetFlag sets (or unsets) the flag on the message.
+func (c *client) SetFlag(msgID uint32, keyword string, st bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setFlag(msgID, keyword, st)
+}
+
+func (c *client) setFlag(msgID uint32, keyword string, st bool) error {
+	id, err := c.id(msgID)
+	if err != nil {
+		return err
+	}
+	switch keyword {
+	case `\Seen`:
+		return c.call("PATCH", c.messagePath(id), nil, map[string]bool{"isRead": st}, nil)
+	case `\Flagged`:
+		return c.call("PATCH", c.messagePath(id), nil, flagPatch(st), nil)
+	case `\Deleted`, `\Answered`:
+		if c.local[msgID] == nil {
+			c.local[msgID] = make(imap.FlagSet)
+		}
+		if st {
+			c.local[msgID][keyword] = true
+		} else {
+			delete(c.local[msgID], keyword)
+		}
+		return nil
+	case `\Draft`, `\Recent`:
+		return imap.NotAvailableError(keyword)
+	}
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return err
+	}
+	cats := make([]string, 0, len(m.Categories)+1)
+	for _, cat := range m.Categories {
+		if cat != keyword {
+			cats = append(cats, cat)
+		}
+	}
+	if st {
+		cats = append(cats, keyword)
+	}
+	return c.call("PATCH", c.messagePath(id), nil, map[string][]string{"categories": cats}, nil)
+}
+
+func flagPatch(st bool) map[string]interface{} {
+	status := "notFlagged"
+	if st {
+		status = "flagged"
+	}
+	return map[string]interface{}{"flag": map[string]string{"flagStatus": status}}
+}
+
+// SetFlagRegex sets (or unsets) the flags of the message matching regex.
+func (c *client) SetFlagRegex(msgID uint32, regex string, st bool) error {
+	rex, err := regexp.Compile(regex)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, m, err := c.get(msgID)
+	if err != nil {
+		return err
+	}
+	for flag := range c.flags(msgID, m) {
+		if rex.MatchString(flag) {
+			if err := c.setFlag(msgID, flag, st); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetFlags sets (or unsets) the flag on the messages.
+func (c *client) SetFlags(uids []uint32, keyword string, st bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.setFlag(uid, keyword, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFlagsSilent is SetFlags.
+func (c *client) SetFlagsSilent(uids []uint32, keyword string, st bool) error {
+	return c.SetFlags(uids, keyword, st)
+}
+
+// ReplaceFlags replaces the flags of the message; \Draft is left as is.
+func (c *client) ReplaceFlags(msgID uint32, flags []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, err := c.id(msgID)
+	if err != nil {
+		return err
+	}
+	set := imap.NewFlagSet(flags...)
+	patch := flagPatch(set[`\Flagged`])
+	patch["isRead"] = set[`\Seen`]
+	cats := []string{}
+	local := make(imap.FlagSet)
+	for f := range set {
+		switch f {
+		case `\Deleted`, `\Answered`:
+			local[f] = true
+		case `\Seen`, `\Flagged`, `\Draft`, `\Recent`:
+		default:
+			cats = append(cats, f)
+		}
+	}
+	sort.Strings(cats)
+	patch["categories"] = cats
+	if err = c.call("PATCH", c.messagePath(id), nil, patch, nil); err != nil {
+		return err
+	}
+	c.local[msgID] = local
+	return nil
+}
+
+// MarkSeen sets \Seen (isRead) on the message.
+func (c *client) MarkSeen(msgID uint32) error { return c.SetFlag(msgID, `\Seen`, true) }
+
+// MarkSeenAll sets \Seen (isRead) on the messages.
+func (c *client) MarkSeenAll(uids []uint32) error { return c.SetFlags(uids, `\Seen`, true) }
+
+// MarkUnseen unsets \Seen (isRead) on the message.
+func (c *client) MarkUnseen(msgID uint32) error { return c.SetFlag(msgID, `\Seen`, false) }
+
+// MarkDeleted sets \Deleted on the message: it is deleted on Close(true).
+func (c *client) MarkDeleted(msgID uint32) error { return c.SetFlag(msgID, `\Deleted`, true) }
+
+// MarkUndeleted unsets \Deleted on the message.
+func (c *client) MarkUndeleted(msgID uint32) error { return c.SetFlag(msgID, `\Deleted`, false) }
+
+// MarkAnswered sets \Answered on the message, for this session.
+func (c *client) MarkAnswered(msgID uint32) error { return c.SetFlag(msgID, `\Answered`, true) }
+
+// MarkFlagged flags the message.
+func (c *client) MarkFlagged(msgID uint32) error { return c.SetFlag(msgID, `\Flagged`, true) }
+
+// MarkUnflagged unflags the message.
+func (c *client) MarkUnflagged(msgID uint32) error { return c.SetFlag(msgID, `\Flagged`, false) }
+
+// MarkDraft returns imap.NotAvailableError, as isDraft is read-only.
+func (c *client) MarkDraft(msgID uint32) error { return c.SetFlag(msgID, `\Draft`, true) }
+
+// DeleteMany sets \Deleted on the messages, and deletes them if expunge is true.
+func (c *client) DeleteMany(uids []uint32, expunge bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.setFlag(uid, `\Deleted`, true); err != nil {
+			return err
+		}
+	}
+	if !expunge {
+		return nil
+	}
+	return c.expunge(uids)
+}
+
+// Delete deletes the message if permanent (or it is in the Deleted Items),
+// moves it to the Deleted Items otherwise.
+func (c *client) Delete(msgID uint32, permanent bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if permanent {
+		return c.expunge([]uint32{msgID})
+	}
+	trash, err := c.specialUse(imapclient.UseTrash)
+	if err != nil {
+		return err
+	}
+	if trash.name == c.selected {
+		return c.expunge([]uint32{msgID})
+	}
+	return c.moveMany([]uint32{msgID}, trash)
+}
+
+// Move moves the message to mbox, creating it if needed.
+func (c *client) Move(msgID uint32, mbox string) error {
+	return c.MoveMany([]uint32{msgID}, mbox)
+}
+
+// MoveMany moves the messages to mbox, creating it if needed.
+func (c *client) MoveMany(uids []uint32, mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.create(mbox)
+	if err != nil {
+		return err
+	}
+	return c.moveMany(uids, m)
+}
+
+func (c *client) moveMany(uids []uint32, dest *mailbox) error {
+	for _, uid := range uids {
+		id, err := c.id(uid)
+		if err != nil {
+			return err
+		}
+		var moved message
+		if err = c.call("POST", c.messagePath(id)+"/move", nil, map[string]string{"destinationId": dest.ID}, &moved); err != nil {
+			return err
+		}
+		if moved.ID != "" && moved.ID != id {
+			delete(c.uids, id)
+			c.uids[moved.ID], c.ids[uid] = uid, moved.ID
+		}
+	}
+	return nil
+}
+
+func (c *client) specialUse(use string) (*mailbox, error) {
+	if err := c.loadFolders(); err != nil {
+		return nil, err
+	}
+	for _, m := range c.folders {
+		if m.use == use {
+			return m, nil
+		}
+	}
+	return nil, &imapclient.Error{Op: "SpecialUse", Kind: imapclient.ErrMailboxNotFound, Err: fmt.Errorf("no %s mailbox", use)}
+}
+
+// SpecialUse returns the name of the well-known folder of the special use
+// (such as imapclient.UseTrash for the Deleted Items).
+func (c *client) SpecialUse(use string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.specialUse(use)
+	if err != nil {
+		return "", err
+	}
+	return m.name, nil
+}
+
+// MoveToTrash moves the messages to the Deleted Items.
+func (c *client) MoveToTrash(uids ...uint32) error {
+	return c.moveToSpecial(imapclient.UseTrash, uids)
+}
+
+// MoveToJunk moves the messages to the Junk Email.
+func (c *client) MoveToJunk(uids ...uint32) error {
+	return c.moveToSpecial(imapclient.UseJunk, uids)
+}
+
+func (c *client) moveToSpecial(use string, uids []uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.specialUse(use)
+	if err != nil {
+		return err
+	}
+	return c.moveMany(uids, m)
+}
+
+// Append creates the message in mbox from its MIME content, and returns its UID.
+//
+// Graph creates the messages uploaded in MIME format as drafts.
+func (c *client) Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, err := c.create(mbox)
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	if _, err = io.Copy(enc, r); err != nil {
+		return 0, err
+	}
+	enc.Close()
+	resp, err := c.request("POST", "/mailFolders/"+url.PathEscape(m.ID)+"/messages", nil, "text/plain", &buf)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var created message
+	if err = json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return 0, err
+	}
+	uid := c.uid(created.ID)
+	for _, f := range flags {
+		if f == `\Draft` || f == `\Recent` {
+			continue
+		}
+		if err = c.setFlag(uid, f, true); err != nil {
+			return uid, err
+		}
+	}
+	return uid, nil
+}
+
+// Expunge deletes those of the messages which are \Deleted - none without UIDs.
+func (c *client) Expunge(uids ...uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var del []uint32
+	for _, uid := range uids {
+		if c.local[uid][`\Deleted`] {
+			del = append(del, uid)
+		}
+	}
+	return c.expunge(del)
+}
+
+// ExpungeAll deletes all the \Deleted messages.
+func (c *client) ExpungeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expunge(c.deleted())
+}
+
+func (c *client) expunge(uids []uint32) error {
+	for _, uid := range uids {
+		id, err := c.id(uid)
+		if err != nil {
+			return err
+		}
+		if err = c.call("DELETE", c.messagePath(id), nil, nil, nil); err != nil {
+			return err
+		}
+		delete(c.local, uid)
+		delete(c.ids, uid)
+		delete(c.uids, id)
+	}
+	return nil
+}
+
+// Check returns an error if not connected: there is nothing to checkpoint.
+func (c *client) Check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return errNotConnected
+	}
+	return nil
+}
+
+// SetLogMask just stores the mask: the requests are logged on Debug level.
+func (c *client) SetLogMask(mask imap.LogMask) imap.LogMask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.logMask
+	c.logMask = mask
+	return old
+}
+
+// Capabilities returns an empty map: Graph has no IMAP capabilities.
+func (c *client) Capabilities() map[string]bool { return map[string]bool{} }
+
+// Supports returns false: Graph has no IMAP capabilities.
+func (c *client) Supports(capability string) bool { return false }
+
+// Compressed returns false.
+func (c *client) Compressed() bool { return false }
@@ -0,0 +1,143 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// GetHeaders returns the parsed header of the message, fetching only
+// BODY.PEEK[HEADER] - for filtering and routing decisions (List-Id,
+// X-Spam-Status, Auto-Submitted) without downloading the body.
+func (c *client) GetHeaders(msgID uint32) (textproto.MIMEHeader, error) {
+	return c.fetchHeader("GetHeaders", msgID, "BODY.PEEK[HEADER]")
+}
+
+// FetchHeaderFields returns the given fields of the header of the message,
+// fetching only BODY.PEEK[HEADER.FIELDS (...)] - a few hundred bytes if
+// just Message-ID and Subject are needed.
+func (c *client) FetchHeaderFields(msgID uint32, fields []string) (textproto.MIMEHeader, error) {
+	if len(fields) == 0 {
+		return textproto.MIMEHeader{}, nil
+	}
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f == "" || strings.ContainsAny(f, " ()[]\"\r\n") {
+			return nil, fmt.Errorf("bad header field name %q", f)
+		}
+		names = append(names, strings.ToUpper(f))
+	}
+	return c.fetchHeader("FetchHeaderFields", msgID,
+		"BODY.PEEK[HEADER.FIELDS ("+strings.Join(names, " ")+")]")
+}
+
+// fetchHeaderFieldsMany returns the given fields of the headers of the
+// messages, with one UID FETCH.
+func (c *client) fetchHeaderFieldsMany(uids []uint32, fields []string) (map[uint32]textproto.MIMEHeader, error) {
+	headers := make(map[uint32]textproto.MIMEHeader, len(uids))
+	if len(uids) == 0 {
+		return headers, nil
+	}
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = strings.ToUpper(f)
+	}
+	c.enter()
+	defer c.leave()
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+	err := c.retry("FetchHeaderFields", func() error {
+		return c.fetch(set, []string{"BODY.PEEK[HEADER.FIELDS (" + strings.Join(names, " ") + ")]"}, func(resp *imap.Response) error {
+			info := resp.MessageInfo()
+			if info.UID == 0 {
+				return nil
+			}
+			hdr, err := parseHeader(headerSection(info.Attrs))
+			if err != nil {
+				return err
+			}
+			headers[info.UID] = hdr
+			return nil
+		})
+	})
+	return headers, err
+}
+
+// filterHeader returns the given fields of hdr.
+func filterHeader(hdr textproto.MIMEHeader, fields []string) textproto.MIMEHeader {
+	filtered := make(textproto.MIMEHeader, len(fields))
+	for _, f := range fields {
+		k := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(f))
+		if v, ok := hdr[k]; ok {
+			filtered[k] = v
+		}
+	}
+	return filtered
+}
+
+// fetchHeader fetches the header section item of the message, and parses it.
+func (c *client) fetchHeader(name string, msgID uint32, item string) (textproto.MIMEHeader, error) {
+	c.enter()
+	defer c.leave()
+	set := &imap.SeqSet{}
+	set.AddNum(msgID)
+	var raw []byte
+	found := false
+	err := c.retry(name, func() error {
+		return c.fetch(set, []string{item}, func(resp *imap.Response) error {
+			if info := resp.MessageInfo(); info.UID == msgID {
+				raw, found = headerSection(info.Attrs), true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, &imap.ProtocolError{Info: "no header for UID " + strconv.FormatUint(uint64(msgID), 10)}
+	}
+	return parseHeader(raw)
+}
+
+// headerSection returns the BODY[HEADER...] attribute.
+func headerSection(attrs imap.FieldMap) []byte {
+	for k, f := range attrs {
+		if strings.HasPrefix(k, "BODY[HEADER") {
+			return imap.AsBytes(f)
+		}
+	}
+	return nil
+}
+
+// parseHeader parses the header block (which may be followed by the body).
+func parseHeader(raw []byte) (textproto.MIMEHeader, error) {
+	hdr, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err == io.EOF {
+		// no terminating empty line
+		err = nil
+	}
+	return hdr, err
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// HealthClient is a Client whose connection can be checked without a
+// mailbox operation - for supervisors and health probes.
+type HealthClient interface {
+	Client
+	Ping() error
+	State() imap.ConnState
+}
+
+var _ = HealthClient((*client)(nil))
+
+var errNotConnected = errors.New("not connected")
+
+// State returns the state of the connection: imap.Closed if not connected.
+func (c *client) State() imap.ConnState {
+	c.enter()
+	defer c.leave()
+	if c.c == nil {
+		return imap.Closed
+	}
+	return c.c.State()
+}
+
+// Ping sends NOOP, and returns an ErrConnection error if the connection is
+// not alive, an ErrAuth error if it is not authenticated.
+// It never reconnects, even with WithRetry.
+func (c *client) Ping() error {
+	c.enter()
+	defer c.leave()
+	if err := c.checkState(); err != nil {
+		return err
+	}
+	if _, err := c.wait(c.c.Noop()); err != nil {
+		return classify("Ping", ErrConnection, err)
+	}
+	return c.checkState()
+}
+
+// checkState returns an error if the client is not in the authenticated or selected state.
+func (c *client) checkState() error {
+	if c.c == nil {
+		return &Error{Op: "Ping", Kind: ErrConnection, Err: errNotConnected}
+	}
+	switch st := c.c.State(); st {
+	case imap.Auth, imap.Selected:
+		return nil
+	case imap.Login:
+		return &Error{Op: "Ping", Kind: ErrAuth, Err: errors.New("not authenticated")}
+	default:
+		return &Error{Op: "Ping", Kind: ErrConnection, Err: errNotConnected}
+	}
+}
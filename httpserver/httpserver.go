@@ -0,0 +1,276 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package httpserver exposes the mailboxes of an imapclient.Pool over
+// a small REST API, so that scripts and non-Go services can reuse its
+// authenticated connections:
+//
+//	GET  /mailboxes[?pattern=*]                    the mailboxes
+//	GET  /mailboxes/{mbox}/messages[?all=1&pattern=subject]
+//	                                               the summaries of the (unseen) messages
+//	GET  /mailboxes/{mbox}/messages/{uid}          the raw message (message/rfc822)
+//	POST /mailboxes/{mbox}/messages/{uid}/move     move it: {"to": "Archive"}
+//	POST /mailboxes/{mbox}/messages/{uid}/flags    set or clear flags: {"set": ["\\Seen"], "clear": ["$Junk"]}
+//
+// The mailbox names are path-escaped (so "a/b" is "a%2Fb"). Every request must
+// have the "Authorization: Bearer <token>" header. The errors are returned
+// as {"error": "..."} JSON objects.
+package httpserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/imapclient"
+)
+
+// Server is the http.Handler of the REST API.
+type Server struct {
+	// Pool provides the connections.
+	Pool *imapclient.Pool
+	// Token is the bearer token of the requests; must not be empty.
+	Token string
+}
+
+// New returns a Server using the connections of pool, authorized with token.
+func New(pool *imapclient.Pool, token string) *Server {
+	return &Server{Pool: pool, Token: token}
+}
+
+// mailbox is the JSON representation of an imapclient.Mailbox.
+type mailbox struct {
+	Name  string   `json:"name"`
+	Delim string   `json:"delim,omitempty"`
+	Attrs []string `json:"attrs,omitempty"`
+}
+
+// ServeHTTP routes the request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imapclient"`)
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	var segments []string
+	for _, seg := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		segments = append(segments, seg)
+	}
+	if len(segments) == 0 || segments[0] != "mailboxes" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	var uid uint32
+	if len(segments) >= 4 {
+		n, err := strconv.ParseUint(segments[3], 10, 32)
+		if err != nil || n == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("bad UID "+strconv.Quote(segments[3])))
+			return
+		}
+		uid = uint32(n)
+	}
+	switch {
+	case len(segments) == 1 && r.Method == "GET":
+		s.mailboxes(w, r)
+	case len(segments) == 3 && segments[2] == "messages" && r.Method == "GET":
+		s.messages(w, r, segments[1])
+	case len(segments) == 4 && segments[2] == "messages" && r.Method == "GET":
+		s.message(w, segments[1], uid)
+	case len(segments) == 5 && segments[2] == "messages" && segments[4] == "move" && r.Method == "POST":
+		s.move(w, r, segments[1], uid)
+	case len(segments) == 5 && segments[2] == "messages" && segments[4] == "flags" && r.Method == "POST":
+		s.flags(w, r, segments[1], uid)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// authorized reports whether the request has the bearer token.
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if s.Token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Token)) == 1
+}
+
+func (s *Server) mailboxes(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("pattern")
+	if pattern == "" {
+		pattern = "*"
+	}
+	var mboxes []imapclient.Mailbox
+	if err := s.Pool.Do(func(c imapclient.Client) error {
+		var err error
+		mboxes, err = c.Mailboxes(pattern)
+		return err
+	}); err != nil {
+		writeClientError(w, err)
+		return
+	}
+	res := make([]mailbox, 0, len(mboxes))
+	for _, m := range mboxes {
+		mb := mailbox{Name: m.Name, Delim: m.Delim}
+		for a := range m.Attrs {
+			mb.Attrs = append(mb.Attrs, a)
+		}
+		sort.Strings(mb.Attrs)
+		res = append(res, mb)
+	}
+	writeJSON(w, res)
+}
+
+func (s *Server) messages(w http.ResponseWriter, r *http.Request, mbox string) {
+	q := r.URL.Query()
+	all, _ := strconv.ParseBool(q.Get("all"))
+	var sums []imapclient.MessageSummary
+	if err := s.Pool.Do(func(c imapclient.Client) error {
+		uids, err := c.List(mbox, q.Get("pattern"), all)
+		if err != nil {
+			return err
+		}
+		sums, err = imapclient.Summaries(c, mbox, uids)
+		return err
+	}); err != nil {
+		writeClientError(w, err)
+		return
+	}
+	if sums == nil {
+		sums = []imapclient.MessageSummary{}
+	}
+	writeJSON(w, sums)
+}
+
+func (s *Server) message(w http.ResponseWriter, mbox string, uid uint32) {
+	body := imapclient.NewSpool(imapclient.SpoolMemoryLimit)
+	defer body.Close()
+	var size int64
+	if err := s.Pool.Do(func(c imapclient.Client) error {
+		if err := c.Select(mbox); err != nil {
+			return err
+		}
+		var err error
+		size, err = c.ReadTo(body, uid)
+		return err
+	}); err != nil {
+		writeClientError(w, err)
+		return
+	}
+	if size == 0 {
+		writeError(w, http.StatusNotFound, errors.New("no message with UID "+strconv.FormatUint(uint64(uid), 10)))
+		return
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	io.Copy(w, body)
+}
+
+func (s *Server) move(w http.ResponseWriter, r *http.Request, mbox string, uid uint32) {
+	var req struct {
+		To string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.To == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`body must be {"to": "mailbox"}`))
+		return
+	}
+	if err := s.Pool.Do(func(c imapclient.Client) error {
+		if err := c.Select(mbox); err != nil {
+			return err
+		}
+		return c.Move(uid, req.To)
+	}); err != nil {
+		writeClientError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) flags(w http.ResponseWriter, r *http.Request, mbox string, uid uint32) {
+	var req struct {
+		Set   []string `json:"set"`
+		Clear []string `json:"clear"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Pool.Do(func(c imapclient.Client) error {
+		if err := c.Select(mbox); err != nil {
+			return err
+		}
+		for _, f := range req.Set {
+			if err := c.SetFlag(uid, f, true); err != nil {
+				return err
+			}
+		}
+		for _, f := range req.Clear {
+			if err := c.SetFlag(uid, f, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		writeClientError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// writeClientError writes the error of the Client, with the status code of its kind.
+func writeClientError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, imapclient.ErrMailboxNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, imapclient.ErrThrottled):
+		code = http.StatusServiceUnavailable
+		if d := imapclient.RetryAfter(err); d > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((d+time.Second-1)/time.Second)))
+		}
+	case errors.Is(err, imapclient.ErrAuth), errors.Is(err, imapclient.ErrConnection),
+		errors.Is(err, imapclient.ErrPoolClosed):
+		code = http.StatusBadGateway
+	}
+	writeError(w, code, err)
+}
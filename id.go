@@ -0,0 +1,85 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"sort"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// DefaultID is the client identification sent by WithID(nil).
+var DefaultID = map[string]string{"name": "imapclient", "vendor": "github.com/tgulacsi/imapclient"}
+
+// IDClient is a Client which can identify itself with the ID command (RFC 2971).
+type IDClient interface {
+	Client
+	SendID(fields map[string]string) (map[string]string, error)
+}
+
+// WithID makes Connect send the client identification after login, if
+// the server supports ID. A nil fields means DefaultID.
+func WithID(fields map[string]string) Option {
+	if fields == nil {
+		fields = DefaultID
+	}
+	return func(c *client) { c.id = fields }
+}
+
+// SendID sends the client identification, and returns the server's.
+//
+// Returns imap.NotAvailableError if the server does not support ID.
+func (c *client) SendID(fields map[string]string) (map[string]string, error) {
+	c.enter()
+	defer c.leave()
+	return c.sendID(fields)
+}
+
+func (c *client) sendID(fields map[string]string) (map[string]string, error) {
+	if !c.c.Caps["ID"] {
+		return nil, imap.NotAvailableError("ID")
+	}
+	var arg imap.Field
+	if len(fields) > 0 {
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		list := make([]imap.Field, 0, 2*len(keys))
+		for _, k := range keys {
+			list = append(list, c.c.Quote(k), c.c.Quote(fields[k]))
+		}
+		arg = list
+	}
+	cmd, err := c.wait(c.c.Send("ID", arg))
+	if err != nil {
+		return nil, err
+	}
+	server := make(map[string]string)
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if resp.Label != "ID" || len(resp.Fields) < 2 {
+			continue
+		}
+		list := imap.AsList(resp.Fields[1])
+		for i := 0; i+1 < len(list); i += 2 {
+			server[imap.AsString(list[i])] = imap.AsString(list[i+1])
+		}
+	}
+	c.c.Data = nil
+	return server, nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// IdleTimeout is the maximum time spent in one IDLE command before it is
+// reissued - 29 minutes by default, as RFC 2177 recommends.
+var IdleTimeout = 29 * time.Minute
+
+// idlePoll is how often Idle checks its stop channel.
+const idlePoll = time.Second
+
+// IdleClient is a Client which can wait for server notifications with IDLE.
+type IdleClient interface {
+	Client
+	Idle(mbox string, events chan<- IdleEvent, stop <-chan struct{}) error
+}
+
+// IdleEvent is a notification received while idling.
+type IdleEvent struct {
+	// Type is EXISTS, RECENT, EXPUNGE or FETCH.
+	Type string
+	// Num is the number of (recent) messages for EXISTS (RECENT), the message sequence number otherwise.
+	Num uint32
+	// Flags are the new flags of the message for FETCH.
+	Flags imap.FlagSet
+}
+
+// Idle selects mbox and waits in IDLE, sending the EXISTS, RECENT, EXPUNGE and FETCH
+// notifications to events, till stop is closed.
+//
+// Returns imap.NotAvailableError if the server does not advertise IDLE.
+func (c *client) Idle(mbox string, events chan<- IdleEvent, stop <-chan struct{}) error {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["IDLE"] {
+		return imap.NotAvailableError("IDLE")
+	}
+	if err := c.selectMailbox(mbox); err != nil {
+		return err
+	}
+	c.c.Data = nil
+
+	for {
+		if _, err := c.c.Idle(); err != nil {
+			return err
+		}
+		stopped, err := c.idleWait(events, stop)
+		if _, termErr := c.wait(c.c.IdleTerm()); err == nil {
+			err = termErr
+		}
+		if err != nil || stopped {
+			return err
+		}
+	}
+}
+
+// idleWait receives the notifications of one IDLE command, for at most the idle timeout.
+// Returns true iff stop has been closed.
+func (c *client) idleWait(events chan<- IdleEvent, stop <-chan struct{}) (bool, error) {
+	deadline := time.Now().Add(c.idleTimeout())
+	for time.Now().Before(deadline) {
+		select {
+		case <-stop:
+			return true, nil
+		default:
+		}
+		if err := c.c.Recv(idlePoll); err != nil && err != imap.ErrTimeout {
+			return false, err
+		}
+		for _, rsp := range c.c.Data {
+			ev, ok := newIdleEvent(rsp)
+			if !ok {
+				continue
+			}
+			select {
+			case events <- ev:
+			case <-stop:
+				c.c.Data = nil
+				return true, nil
+			}
+		}
+		c.c.Data = nil
+	}
+	return false, nil
+}
+
+func newIdleEvent(rsp *imap.Response) (IdleEvent, bool) {
+	if rsp.Type != imap.Data || len(rsp.Fields) == 0 {
+		return IdleEvent{}, false
+	}
+	switch rsp.Label {
+	case "EXISTS", "RECENT", "EXPUNGE":
+		return IdleEvent{Type: rsp.Label, Num: imap.AsNumber(rsp.Fields[0])}, true
+	case "FETCH":
+		info := rsp.MessageInfo()
+		return IdleEvent{Type: rsp.Label, Num: info.Seq, Flags: info.Flags}, true
+	}
+	return IdleEvent{}, false
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"mime"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// MessageInfo is the summary of a message.
+type MessageInfo struct {
+	UID          uint32
+	Subject      string
+	From         string
+	Date         time.Time
+	Size         uint32
+	Flags        imap.FlagSet
+	InternalDate time.Time
+	MessageID    string
+}
+
+// ListWithInfo is like List, but returns the summaries of the messages,
+// fetched in one UID FETCH.
+func (c *client) ListWithInfo(mbox, pattern string, all bool) ([]MessageInfo, error) {
+	c.enter()
+	defer c.leave()
+	uids, err := c.List(mbox, pattern, all)
+	if err != nil || len(uids) == 0 {
+		return nil, err
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+
+	var cmd *imap.Command
+	if err = c.retry("ListWithInfo", func() error {
+		var err error
+		cmd, err = c.wait(c.c.UIDFetch(set, "FLAGS", "RFC822.SIZE", "INTERNALDATE", "ENVELOPE"))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	infos := make([]MessageInfo, 0, len(cmd.Data))
+	for _, resp := range cmd.Data {
+		mi := resp.MessageInfo()
+		if mi == nil {
+			continue
+		}
+		info := MessageInfo{UID: mi.UID, Size: mi.Size, Flags: mi.Flags, InternalDate: mi.InternalDate}
+		if env := imap.AsList(mi.Attrs["ENVELOPE"]); len(env) >= 3 {
+			info.Date, _ = mail.ParseDate(imap.AsString(env[0]))
+			info.Subject = decodeWords(imap.AsString(env[1]))
+			if from := envelopeAddresses(env[2]); len(from) > 0 {
+				info.From = from[0].String()
+			}
+			if len(env) >= 10 {
+				info.MessageID = imap.AsString(env[9])
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// envelopeAddresses parses an ENVELOPE address list:
+// ((name adl mailbox host) ...).
+func envelopeAddresses(f imap.Field) []*mail.Address {
+	var addrs []*mail.Address
+	for _, a := range imap.AsList(f) {
+		parts := imap.AsList(a)
+		if len(parts) < 4 {
+			continue
+		}
+		addr := imap.AsString(parts[2])
+		if host := imap.AsString(parts[3]); host != "" {
+			addr += "@" + host
+		}
+		addrs = append(addrs, &mail.Address{Name: decodeWords(imap.AsString(parts[0])), Address: addr})
+	}
+	return addrs
+}
+
+// Envelope is the parsed ENVELOPE of a message, with the RFC 2047
+// encoded-words of Subject and the names decoded to UTF-8.
+type Envelope struct {
+	Date                               time.Time
+	Subject                            string
+	From, Sender, ReplyTo, To, Cc, Bcc []*mail.Address
+	InReplyTo, MessageID               string
+}
+
+// GetEnvelope returns the envelope of the message, fetching only its ENVELOPE.
+func (c *client) GetEnvelope(msgID uint32) (*Envelope, error) {
+	c.enter()
+	defer c.leave()
+	set := &imap.SeqSet{}
+	set.AddNum(msgID)
+	var env *Envelope
+	err := c.retry("GetEnvelope", func() error {
+		return c.fetch(set, []string{"ENVELOPE"}, func(resp *imap.Response) error {
+			if info := resp.MessageInfo(); info.UID == msgID {
+				env = parseEnvelope(info.Attrs["ENVELOPE"])
+			}
+			return nil
+		})
+	})
+	if err == nil && env == nil {
+		err = &imap.ProtocolError{Info: "no ENVELOPE for UID " + strconv.FormatUint(uint64(msgID), 10)}
+	}
+	return env, err
+}
+
+// parseEnvelope parses the ENVELOPE list:
+// (date subject from sender reply-to to cc bcc in-reply-to message-id).
+func parseEnvelope(f imap.Field) *Envelope {
+	var env Envelope
+	fields := imap.AsList(f)
+	if len(fields) < 10 {
+		return &env
+	}
+	env.Date, _ = mail.ParseDate(imap.AsString(fields[0]))
+	env.Subject = decodeWords(imap.AsString(fields[1]))
+	env.From = envelopeAddresses(fields[2])
+	env.Sender = envelopeAddresses(fields[3])
+	env.ReplyTo = envelopeAddresses(fields[4])
+	env.To = envelopeAddresses(fields[5])
+	env.Cc = envelopeAddresses(fields[6])
+	env.Bcc = envelopeAddresses(fields[7])
+	env.InReplyTo = imap.AsString(fields[8])
+	env.MessageID = imap.AsString(fields[9])
+	return &env
+}
+
+// decodeWords decodes the RFC 2047 encoded-words of s, returning s as is
+// if it cannot be decoded (such as with an unknown charset).
+func decodeWords(s string) string {
+	var dec mime.WordDecoder
+	if d, err := dec.DecodeHeader(s); err == nil {
+		return d
+	}
+	return s
+}
+
+// HeaderEnvelope returns the envelope built from the header, as the server
+// builds ENVELOPE - for Client implementations without ENVELOPE.
+func HeaderEnvelope(h mail.Header) *Envelope {
+	env := &Envelope{
+		Subject:   decodeWords(h.Get("Subject")),
+		InReplyTo: h.Get("In-Reply-To"),
+		MessageID: h.Get("Message-Id"),
+	}
+	env.Date, _ = h.Date()
+	env.From, _ = h.AddressList("From")
+	env.Sender, _ = h.AddressList("Sender")
+	env.ReplyTo, _ = h.AddressList("Reply-To")
+	env.To, _ = h.AddressList("To")
+	env.Cc, _ = h.AddressList("Cc")
+	env.Bcc, _ = h.AddressList("Bcc")
+	// as the server does, by RFC 3501 7.4.2
+	if env.Sender == nil {
+		env.Sender = env.From
+	}
+	if env.ReplyTo == nil {
+		env.ReplyTo = env.From
+	}
+	return env
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// ListPageSize is the number of messages searched at once by ListIter - 1000 by default.
+var ListPageSize = 1000
+
+// ListIter is like List, but calls fn with the matching UIDs page by page
+// (in increasing order), as soon as each page is searched: the first
+// messages of a huge mailbox can be processed before the rest is searched.
+//
+// The pages are UID ranges of ListPageSize messages, fixed at the start,
+// so expunging (or moving) messages in fn does not skip any message.
+// fn may use the client; the iteration stops at the first error of fn.
+func (c *client) ListIter(mbox, pattern string, all bool, fn func(uids []uint32) error) error {
+	bounds, err := c.pageBounds(mbox)
+	if err != nil || len(bounds) == 0 {
+		return err
+	}
+	for i, lo := range bounds {
+		rng := strconv.FormatUint(uint64(lo), 10) + ":"
+		if i+1 < len(bounds) {
+			rng += strconv.FormatUint(uint64(bounds[i+1]-1), 10)
+		} else {
+			rng += "*"
+		}
+		crit := listCriteria(pattern, all)
+		crit.Raw = append(crit.Raw, imap.Field("UID"), imap.Field(rng))
+		uids, err := c.Search(mbox, crit)
+		if err != nil {
+			return err
+		}
+		// n:* matches the last message even if its UID is below n
+		page := uids[:0]
+		for _, uid := range uids {
+			if uid >= lo {
+				page = append(page, uid)
+			}
+		}
+		if len(page) == 0 {
+			continue
+		}
+		sort.Slice(page, func(i, j int) bool { return page[i] < page[j] })
+		if err = fn(page); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageBounds selects mbox, and returns the UIDs of every ListPageSize-th message,
+// the first UIDs of the pages, with one FETCH.
+func (c *client) pageBounds(mbox string) ([]uint32, error) {
+	c.enter()
+	defer c.leave()
+	if err := c.selectMailbox(mbox); err != nil {
+		return nil, err
+	}
+	if c.c.Mailbox == nil || c.c.Mailbox.Messages == 0 {
+		return nil, nil
+	}
+	size := ListPageSize
+	if size <= 0 {
+		size = int(c.c.Mailbox.Messages)
+	}
+	set := &imap.SeqSet{}
+	for seq := uint32(1); seq <= c.c.Mailbox.Messages; seq += uint32(size) {
+		set.AddNum(seq)
+	}
+	var bounds []uint32
+	err := c.retry("ListIter", func() error {
+		bounds = bounds[:0]
+		cmd, err := c.wait(c.c.Fetch(set, "UID"))
+		if err != nil {
+			return err
+		}
+		for _, resp := range cmd.Data {
+			if info := resp.MessageInfo(); info != nil && info.UID != 0 {
+				bounds = append(bounds, info.UID)
+			}
+		}
+		return nil
+	})
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return bounds, err
+}
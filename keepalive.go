@@ -0,0 +1,163 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// WithKeepAlive makes the client send a NOOP in the background, whenever it
+// has not been used for the given interval, so servers with aggressive
+// inactivity timeouts don't drop a long-lived connection.
+func WithKeepAlive(interval time.Duration) Option {
+	return func(c *client) { c.keepAlive = interval }
+}
+
+// WithIdleLogout makes the client log out in the background, whenever it
+// has not been used for the given period, freeing the connection slot on the
+// server; the next method call reconnects (and selects the mailbox again)
+// transparently, so a Client can be held for a long time.
+func WithIdleLogout(period time.Duration) Option {
+	return func(c *client) { c.idleLogout = period }
+}
+
+// enter marks the start of a method using the connection, excluding the
+// keepalive goroutine. The Client is used by one goroutine at a time, so
+// nested calls just increase the depth.
+//
+// The connection is reestablished if it has been logged out by WithIdleLogout.
+func (c *client) enter() {
+	if c.lock() {
+		c.wakeUp()
+	}
+}
+
+// lock is enter without reconnecting, for Connect and Close.
+// It reports whether the lock has been taken, by the outermost call.
+func (c *client) lock() bool {
+	if atomic.AddInt32(&c.depth, 1) == 1 {
+		c.mu.Lock()
+		return true
+	}
+	return false
+}
+
+// leave marks the end of a method started with enter.
+func (c *client) leave() {
+	if atomic.AddInt32(&c.depth, -1) == 0 {
+		c.lastUsed = time.Now()
+		c.mu.Unlock()
+	}
+}
+
+// startKeepAlive starts the keepalive and idle logout goroutines for the
+// current connection, stopping the previous ones.
+func (c *client) startKeepAlive() {
+	c.stopKeepAlive()
+	if c.keepAlive <= 0 && c.idleLogout <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	c.keepAliveStop = stop
+	if c.keepAlive > 0 {
+		go c.keepAliveLoop(c.c, stop)
+	}
+	if c.idleLogout > 0 {
+		go c.idleLogoutLoop(c.c, stop)
+	}
+}
+
+// stopKeepAlive stops the keepalive and idle logout goroutines, if running.
+func (c *client) stopKeepAlive() {
+	if c.keepAliveStop != nil {
+		close(c.keepAliveStop)
+		c.keepAliveStop = nil
+	}
+}
+
+func (c *client) keepAliveLoop(ic *imap.Client, stop <-chan struct{}) {
+	ticker := time.NewTicker(c.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		if c.c == ic && time.Since(c.lastUsed) >= c.keepAlive {
+			if _, err := c.wait(ic.Noop()); err != nil {
+				c.logger.Warn("keepalive", "error", err)
+			}
+			c.lastUsed = time.Now()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// idleLogoutLoop logs out, once the client has not been used for idleLogout.
+func (c *client) idleLogoutLoop(ic *imap.Client, stop <-chan struct{}) {
+	for {
+		c.mu.Lock()
+		if c.c != ic {
+			c.mu.Unlock()
+			return
+		}
+		idle := time.Since(c.lastUsed)
+		if idle >= c.idleLogout {
+			c.logger.Info("idle logout", "idle", idle)
+			c.stopKeepAlive()
+			if _, err := c.wait(ic.Logout(c.readTimeout())); err != nil {
+				c.logger.Warn("idle logout", "error", err)
+			}
+			c.loggedOut = true
+			c.emit(Event{Type: EventDisconnected})
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(c.idleLogout - idle):
+		}
+	}
+}
+
+// wakeUp connects again (and selects the mailbox), if the connection has been
+// logged out by WithIdleLogout. If that fails, the logged out connection is
+// kept, so the method fails, and the next one tries again.
+func (c *client) wakeUp() {
+	if !c.loggedOut {
+		return
+	}
+	ic := c.c
+	c.c, c.loggedOut = nil, false
+	err := c.Connect()
+	if err == nil && c.selected != "" {
+		_, err = c.wait(c.c.Select(c.selected, false))
+	}
+	if err != nil {
+		c.logger.Error("reconnect after idle logout", "error", err)
+		if c.c == nil {
+			c.c, c.loggedOut = ic, true
+		}
+	}
+}
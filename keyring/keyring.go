@@ -0,0 +1,66 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package keyring keeps the IMAP passwords in the OS keyring (macOS
+// Keychain, Secret Service on Linux, Windows Credential Manager), keyed by
+// the host and the user name - for the CLI and desktop tools.
+package keyring
+
+import (
+	"errors"
+
+	"github.com/tgulacsi/imapclient"
+	gokeyring "github.com/zalando/go-keyring"
+)
+
+// ErrNotFound is returned when the keyring has no password for the account.
+var ErrNotFound = errors.New("password not found in the keyring")
+
+// service returns the keyring service name of the host.
+func service(host string) string { return "imapclient:" + host }
+
+// Password returns the password of username at host from the keyring.
+func Password(host, username string) (string, error) {
+	password, err := gokeyring.Get(service(host), username)
+	if errors.Is(err, gokeyring.ErrNotFound) {
+		return "", ErrNotFound
+	}
+	return password, err
+}
+
+// SetPassword stores the password of username at host in the keyring.
+func SetPassword(host, username, password string) error {
+	return gokeyring.Set(service(host), username, password)
+}
+
+// DeletePassword deletes the password of username at host from the keyring.
+func DeletePassword(host, username string) error {
+	err := gokeyring.Delete(service(host), username)
+	if errors.Is(err, gokeyring.ErrNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Auth returns the imapclient.WithAuth option with the password of
+// username at host from the keyring.
+func Auth(host, username string) (imapclient.Option, error) {
+	password, err := Password(host, username)
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.WithAuth(username, password), nil
+}
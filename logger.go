@@ -0,0 +1,99 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"log"
+	"strings"
+)
+
+// Logger is the structured logger of a client, with alternating key-value
+// pairs in ctx. Both log15.Logger and *slog.Logger implement it.
+type Logger interface {
+	Debug(msg string, ctx ...interface{})
+	Info(msg string, ctx ...interface{})
+	Warn(msg string, ctx ...interface{})
+	Error(msg string, ctx ...interface{})
+}
+
+// stdLog returns a *log.Logger which writes to logger on Debug level,
+// for the protocol log of imap.Client - with the credentials of LOGIN and
+// AUTHENTICATE (and its continuations) redacted.
+func stdLog(logger Logger) *log.Logger {
+	return log.New(&logWriter{Logger: logger}, "", 0)
+}
+
+type logWriter struct {
+	Logger
+	redactor
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\r\n")
+	switch {
+	case strings.HasPrefix(line, serverPrefix):
+		w.serverLine(line[len(serverPrefix):])
+	case strings.HasPrefix(line, clientPrefix):
+		line = clientPrefix + w.clientLine(line[len(clientPrefix):])
+	case strings.HasPrefix(line, "* "), strings.HasPrefix(line, "+ "):
+		w.serverLine(line)
+	default:
+		line = w.clientLine(line)
+	}
+	w.Debug(line)
+	return len(p), nil
+}
+
+// redactor redacts the credentials from the protocol lines.
+type redactor struct {
+	tag string // tag of the authentication command in progress
+}
+
+// clientLine returns the client line, with the credentials redacted: the
+// arguments of LOGIN, the initial response of AUTHENTICATE, and every line
+// till the completion of these commands.
+func (r *redactor) clientLine(line string) string {
+	if r.tag != "" {
+		if strings.HasPrefix(line, r.tag+" ") { // the completion, logged unprefixed
+			r.tag = ""
+			return line
+		}
+		return redacted
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return line
+	}
+	switch strings.ToUpper(fields[1]) {
+	case "LOGIN":
+		r.tag = fields[0]
+		return fields[0] + " " + fields[1] + " " + redacted
+	case "AUTHENTICATE":
+		r.tag = fields[0]
+		if len(fields) > 3 { // initial response
+			return strings.Join(fields[:3], " ") + " " + redacted
+		}
+	}
+	return line
+}
+
+// serverLine tracks the completion of the authentication command.
+func (r *redactor) serverLine(line string) {
+	if r.tag != "" && strings.HasPrefix(line, r.tag+" ") {
+		r.tag = ""
+	}
+}
@@ -17,19 +17,31 @@ limitations under the License.
 package imapclient
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
 	"io"
+	"net/mail"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/tgulacsi/go/temp"
+	"github.com/mxk/go-imap/imap"
 )
 
 var (
 	// ShortSleep is the duration which ised for sleep after successful delivery.
 	ShortSleep = 1 * time.Second
-	// LongSleep is the duration which used for sleep between errors and if the inbox is empty.
+	// LongSleep is the duration which used for sleep if the inbox is empty.
 	LongSleep = 5 * time.Minute
+	// ErrorBackoff is the sleep after the failed rounds of the loops, doubled
+	// after each consecutive failure, and reset after a successful round -
+	// 30 seconds up to 5 minutes, with ±20% jitter by default.
+	// Its Retries is ignored.
+	ErrorBackoff = RetryPolicy{Backoff: 30 * time.Second, MaxBackoff: 5 * time.Minute, Jitter: 0.2}
 )
 
 // DeliveryLoop periodically checks the inbox for mails with the specified pattern
@@ -40,99 +52,776 @@ var (
 // is not empty, then moved to outbox.
 //
 // deliver is called with the message, where X-UID and X-SHA1 are set.
+//
+// The loop stops when closeCh is closed.
 func DeliveryLoop(c Client, inbox, pattern string, deliver DeliverFunc, outbox, errbox string, closeCh <-chan struct{}) {
-	if inbox == "" {
-		inbox = "INBOX"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for range closeCh {
+		}
+		cancel()
+	}()
+	DeliveryLoopContext(ctx, c, inbox, pattern, deliver, outbox, errbox)
+}
+
+// DeliveryLoopContext is like DeliveryLoop, but stops promptly when ctx is
+// cancelled - while sleeping, or between two messages.
+func DeliveryLoopContext(ctx context.Context, c Client, inbox, pattern string, deliver DeliverFunc, outbox, errbox string) {
+	l := Loop{Client: c, Inbox: inbox, Pattern: pattern, Deliver: deliver, Outbox: outbox, Errbox: errbox, Hash: sha1.New}
+	l.Run(ctx)
+}
+
+// DeliverOne does one round of message reading and delivery. Does not loop.
+// Returns the number of messages delivered.
+func DeliverOne(c Client, inbox, pattern string, deliver DeliverFunc, outbox, errbox string) (int, error) {
+	l := Loop{Client: c, Inbox: inbox, Pattern: pattern, Deliver: deliver, Outbox: outbox, Errbox: errbox, Hash: sha1.New}
+	return l.One(context.Background())
+}
+
+// DeliverFunc is the type for message delivery.
+//
+// r is the message data, uid is the IMAP server sent message UID, sha1 is the message's hash
+// (SHA-1 with DeliveryLoop and DeliverOne, see Loop.Hash otherwise).
+type DeliverFunc func(r io.ReadSeeker, uid uint32, sha1 []byte) error
+
+// MessageDeliverFunc is the type for message delivery, with the metadata of the message.
+type MessageDeliverFunc func(r io.ReadSeeker, info DeliveryInfo) error
+
+// TxDeliverFunc is the type for two-phase message delivery: it stages the
+// message, and returns the commit function, which acknowledges (makes
+// persistent) the delivery. An error from either means a failed delivery.
+// commit is called after r is closed.
+type TxDeliverFunc func(r io.ReadSeeker, info DeliveryInfo) (commit func() error, err error)
+
+// DeliverySemantics is the ordering of the commit of a TxDeliverFunc and
+// marking the message as seen (and moving it).
+type DeliverySemantics int
+
+const (
+	// AtLeastOnce commits, then marks the message as seen:
+	// a crash in between delivers the message again.
+	AtLeastOnce = DeliverySemantics(iota)
+	// AtMostOnce marks the message as seen, then commits:
+	// a crash (or a failed commit) in between loses the message.
+	AtMostOnce
+)
+
+// DeliveryInfo is the metadata of a message to be delivered.
+type DeliveryInfo struct {
+	// Mailbox is the name of the mailbox, UIDValidity is its UIDVALIDITY
+	// (zero if unknown): UIDValidity+UID identify the message in the mailbox.
+	Mailbox     string
+	UIDValidity uint32
+	UID         uint32
+	// Size is the size of the message.
+	Size int64
+	// Hash is the hash of the message, computed by Loop.Hash.
+	Hash []byte
+	// From, Subject, Date and MessageID are parsed from the header.
+	From, Subject, MessageID string
+	Date                     time.Time
+	// Flags are the flags of the message before the delivery.
+	Flags []string
+}
+
+// deliveryInfo fills the metadata of the message from its header and flags.
+func deliveryInfo(c Client, r io.ReadSeeker, info DeliveryInfo) (DeliveryInfo, error) {
+	if msg, err := mail.ReadMessage(r); err == nil {
+		info.From = msg.Header.Get("From")
+		info.Subject = msg.Header.Get("Subject")
+		info.MessageID = msg.Header.Get("Message-Id")
+		info.Date, _ = msg.Header.Date()
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return info, err
 	}
+	flags, err := c.GetFlags(info.UID)
+	if err != nil {
+		Log.Warn("GetFlags", "uid", info.UID, "error", err)
+	}
+	for f := range flags {
+		info.Flags = append(info.Flags, f)
+	}
+	sort.Strings(info.Flags)
+	return info, nil
+}
+
+// Loop is a configurable delivery loop; see DeliveryLoop for its working.
+type Loop struct {
+	// Client is the connection to the server.
+	Client Client
+	// Inbox is the mailbox to read - "INBOX" by default.
+	Inbox string
+	// Pattern is the substring to search in the subject; empty means any.
+	Pattern string
+	// Deliver is called with each message.
+	Deliver DeliverFunc
+	// DeliverMessage is called with each message and its metadata,
+	// instead of Deliver, if not nil.
+	DeliverMessage MessageDeliverFunc
+	// DeliverTx is called with each message and its metadata, instead of
+	// Deliver and DeliverMessage, if not nil; its commit is ordered by Semantics.
+	DeliverTx TxDeliverFunc
+	// Semantics is the delivery semantics of DeliverTx - AtLeastOnce by default.
+	Semantics DeliverySemantics
+	// Hash returns the hash of the messages - sha256.New by default.
+	Hash func() hash.Hash
+	// Checkpointer, if not nil, stores the last processed UID of Inbox,
+	// and only the messages above it are searched: the messages are
+	// processed at least once, even if they are not marked as seen.
+	Checkpointer Checkpointer
+	// Deduper, if not nil, is consulted before the delivery: a message whose
+	// Message-ID (or hash, if it has none) has been delivered already is not
+	// delivered again, just marked as seen and moved to Outbox.
+	Deduper Deduper
+	// MaxAttempts, if positive, is the number of failed deliveries of a
+	// message (counted in a $DeliverAttempts-N keyword) before it is given
+	// up: then OnDeadLetter is called, and the message is moved to Errbox,
+	// or just marked as seen if Errbox is empty.
+	// With the zero MaxAttempts, a failed message is moved to Errbox
+	// immediately, and is retried in the next round if Errbox is empty.
+	MaxAttempts int
+	// OnDeadLetter is called with the message given up, and the last error.
+	OnDeadLetter func(info DeliveryInfo, err error)
+	// OnFetched, OnDelivered, OnDeliverError and OnMoved are called, if not
+	// nil, after a message is fetched, delivered, failed to be delivered,
+	// or moved to an other mailbox, respectively; for metrics or auditing.
+	OnFetched, OnDelivered, OnDeliverError, OnMoved func(LoopEvent)
+	// NewBuffer returns the buffer for the body of the message, if not nil;
+	// NewSpool(SpoolMemoryLimit) is used otherwise.
+	NewBuffer func(uid uint32) (BodyBuffer, error)
+	// Rules route the messages: the first matching rule is applied
+	// (instead of Deliver / DeliverMessage and Outbox). The messages not
+	// matching any rule are delivered as without rules.
+	// Pattern still restricts the searched messages.
+	Rules []Rule
+	// Scanner, if not nil, scans the messages before the delivery (and before
+	// Spam): the messages with a positive verdict are handled by ScanAction,
+	// without delivery. A failed scan is retried in the next round.
+	Scanner Scanner
+	// ScanAction is the handling of the positive verdicts - Quarantine by default.
+	ScanAction ScanAction
+	// Quarantine is the mailbox of the messages quarantined by Scanner.
+	Quarantine string
+	// Spam, if not nil, classifies the messages before the delivery: the spam
+	// is moved to the Junk mailbox with MarkSpam, without delivery.
+	// A failed check is logged, and the message is delivered.
+	Spam SpamClassifier
+	// Filter, if not empty, is applied to the header and size of each
+	// message before its body is fetched: the rejected messages are
+	// marked as seen and moved to Rejectbox (if not empty), without delivery.
+	Filter Filter
+	// Rejectbox is the mailbox of the messages rejected by Filter.
+	Rejectbox string
+	// Outbox is the mailbox to move the delivered messages to, if not empty.
+	Outbox string
+	// Errbox is the mailbox to move the failed messages to, if not empty.
+	Errbox string
+	// Peek makes the loop never set \Seen, for inboxes read by humans, too:
+	// the processed messages are flagged with PeekKeyword instead, and the
+	// messages already having it are skipped (wherever "seen" is written above,
+	// read "flagged with PeekKeyword").
+	Peek bool
+	// PeekKeyword is the keyword of the processed messages with Peek -
+	// "$Processed" by default.
+	PeekKeyword string
+
+	// KeepConnected keeps the connection open between the rounds,
+	// reconnecting only after an error, instead of connecting and logging
+	// out in every round. The messages moved or dropped in a round are
+	// expunged at its end, if the server supports UIDPLUS (otherwise at the
+	// logout).
+	KeepConnected bool
+	// UseIdle waits in IDLE on the inbox instead of sleeping LongSleep,
+	// starting the next round as soon as a new message arrives.
+	// Implies KeepConnected. Falls back to sleeping if the client or
+	// the server does not support IDLE.
+	UseIdle bool
+	// Drain makes a round cancelled by ctx finish the message being
+	// delivered, skip the rest, flush the flag changes with Check, and
+	// close the connection cleanly (even with KeepConnected) - calling
+	// OnDrained with the number of delivered and skipped messages.
+	Drain bool
+	// OnDrained is called after a drained round, if not nil.
+	OnDrained func(delivered, left int)
+	// ErrorBackoff is the sleep after the failed rounds, instead of
+	// the package-level ErrorBackoff, if its Backoff is positive.
+	ErrorBackoff RetryPolicy
+
+	connected, noIdle bool
+	failures          int                    // consecutive failed rounds
+	report            func(n int, err error) // for Supervisor
+	// removed are the UIDs moved or dropped in the round, expunged at its end with KeepConnected.
+	removed []uint32
+}
+
+// Run calls One repeatedly, sleeping ShortSleep after a round with delivered
+// messages, backing off after a failed one (see ErrorBackoff), and sleeping
+// LongSleep otherwise, till ctx is cancelled.
+// Returns ctx.Err().
+func (l *Loop) Run(ctx context.Context) error {
+	defer l.disconnect()
 	for {
-		n, err := one(c, inbox, pattern, deliver, outbox, errbox)
+		n, err := l.One(ctx)
 		if err != nil {
 			Log.Error("DeliveryLoop one round", "n", n, "error", err)
 		} else {
 			Log.Info("DeliveryLoop one round", "n", n)
 		}
-		select {
-		case _, ok := <-closeCh:
-			if !ok { //channel is closed
-				return
-			}
-		default:
+		if l.report != nil {
+			l.report(n, err)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
 
+		sleep := LongSleep
 		if err != nil {
-			time.Sleep(LongSleep)
+			sleep = l.errorBackoff().backoff(l.failures)
+			if l.failures < 16 { // 2**16 times Backoff is long enough
+				l.failures++
+			}
+			if d := RetryAfter(err); d > sleep {
+				sleep = d
+			}
+		} else if l.failures = 0; n > 0 {
+			sleep = ShortSleep
+		} else if l.UseIdle && !l.noIdle {
+			if !l.idle(ctx, sleep) {
+				return ctx.Err()
+			}
 			continue
 		}
-		if n > 0 {
-			time.Sleep(ShortSleep)
-		} else {
-			time.Sleep(LongSleep)
+		if !sleepContext(ctx, sleep) {
+			return ctx.Err()
 		}
-		continue
 	}
 }
 
-// DeliverOne does one round of message reading and delivery. Does not loop.
-// Returns the number of messages delivered.
-func DeliverOne(c Client, inbox, pattern string, deliver DeliverFunc, outbox, errbox string) (int, error) {
+func (l *Loop) errorBackoff() RetryPolicy {
+	if l.ErrorBackoff.Backoff > 0 {
+		return l.ErrorBackoff
+	}
+	return ErrorBackoff
+}
+
+// sleepContext sleeps for d, and reports whether it was not interrupted by ctx.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// idle waits in IDLE on the inbox for a new message, for at most d.
+// Reports whether it was not interrupted by ctx.
+func (l *Loop) idle(ctx context.Context, d time.Duration) bool {
+	ic, ok := l.Client.(IdleClient)
+	if !ok {
+		l.noIdle = true
+		return sleepContext(ctx, d)
+	}
+	if err := l.connect(); err != nil {
+		return sleepContext(ctx, d)
+	}
+	inbox := l.Inbox
 	if inbox == "" {
 		inbox = "INBOX"
 	}
-	return one(c, inbox, pattern, deliver, outbox, errbox)
+	events := make(chan IdleEvent, 16)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- ic.Idle(inbox, events, stop) }()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	interrupted := false
+wait:
+	for {
+		select {
+		case <-ctx.Done():
+			interrupted = true
+			break wait
+		case <-t.C:
+			break wait
+		case ev := <-events:
+			if ev.Type == "EXISTS" {
+				Log.Debug("IDLE", "inbox", inbox, "exists", ev.Num)
+				break wait
+			}
+		case err := <-done:
+			var notAvailable imap.NotAvailableError
+			if errors.As(err, &notAvailable) {
+				l.noIdle = true
+			} else {
+				Log.Error("IDLE", "inbox", inbox, "error", err)
+				l.disconnect()
+			}
+			return sleepContext(ctx, d-time.Since(start))
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		Log.Error("IDLE", "inbox", inbox, "error", err)
+		l.disconnect()
+	}
+	return !interrupted
 }
 
-// DeliverFunc is the type for message delivery.
-//
-// r is the message data, uid is the IMAP server sent message UID, sha1 is the message's sha1 hash.
-type DeliverFunc func(r io.ReadSeeker, uid uint32, sha1 []byte) error
+// connect connects the client, if not connected already.
+func (l *Loop) connect() error {
+	if l.connected {
+		return nil
+	}
+	if err := l.Client.Connect(); err != nil {
+		Log.Error("Connecting", "server", l.Client, "error", err)
+		return err
+	}
+	l.connected = true
+	return nil
+}
+
+// disconnect closes the connection, if connected.
+func (l *Loop) disconnect() {
+	if l.connected {
+		l.connected = false
+		l.Client.Close(true)
+	}
+}
 
-func one(c Client, inbox, pattern string, deliver DeliverFunc, outbox, errbox string) (int, error) {
-	if err := c.Connect(); err != nil {
-		Log.Error("Connecting", "server", c, "error", err)
+// One does one round of message reading and delivery.
+// Returns the number of messages delivered.
+func (l *Loop) One(ctx context.Context) (int, error) {
+	if err := l.connect(); err != nil {
 		return 0, err
 	}
-	defer c.Close(true)
+	n, err := l.one(ctx)
+	if err != nil || !(l.KeepConnected || l.UseIdle) {
+		l.disconnect()
+	} else {
+		l.expunge()
+	}
+	l.removed = l.removed[:0]
+	return n, err
+}
 
-	uids, err := c.List(inbox, pattern, outbox != "" && errbox != "")
+// expunge removes the messages moved (without MOVE, copied and flagged
+// \Deleted) or dropped in the round from the inbox, when the connection
+// is kept open - with UID EXPUNGE, so the \Deleted messages of the other
+// sessions are kept. Without UIDPLUS, they are left to the logout.
+func (l *Loop) expunge() {
+	if len(l.removed) == 0 {
+		return
+	}
+	inbox := l.Inbox
+	if inbox == "" {
+		inbox = "INBOX"
+	}
+	if err := l.Client.Select(inbox); err != nil {
+		Log.Warn("Select", "inbox", inbox, "error", err)
+		return
+	}
+	err := l.Client.Expunge(l.removed...)
+	var notAvailable imap.NotAvailableError
+	if errors.As(err, &notAvailable) {
+		Log.Debug("Expunge: left to the logout", "inbox", inbox, "n", len(l.removed), "error", err)
+	} else if err != nil {
+		Log.Warn("Expunge", "inbox", inbox, "n", len(l.removed), "error", err)
+	}
+}
+
+// list returns the UIDs to be processed in ascending order, all above after if not zero.
+func (l *Loop) list(c Client, inbox string, after uint32) ([]uint32, error) {
+	all := l.Outbox != "" && l.Errbox != ""
+	if after == 0 {
+		uids, err := c.Search(inbox, l.criteria(all))
+		sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+		return uids, err
+	}
+	uids, err := c.Search(inbox, newerCriteria(l.criteria(all), after))
+	if err != nil {
+		return nil, err
+	}
+	return uidsAbove(uids, after), nil
+}
+
+func (l *Loop) one(ctx context.Context) (int, error) {
+	c, inbox, outbox, errbox := l.Client, l.Inbox, l.Outbox, l.Errbox
+	if inbox == "" {
+		inbox = "INBOX"
+	}
+
+	all := outbox != "" && errbox != ""
+	var uidValidity uint32
+	if st, err := c.Status(inbox); err != nil {
+		Log.Warn("Status", "server", c, "inbox", inbox, "error", err)
+	} else if uidValidity = st.UIDValidity; (all || l.Peek) && st.Messages == 0 || !all && !l.Peek && st.Unseen == 0 {
+		Log.Debug("Status", "server", c, "inbox", inbox, "messages", st.Messages, "unseen", st.Unseen)
+		return 0, nil
+	}
+
+	var cp Checkpoint
+	if l.Checkpointer != nil {
+		var err error
+		if cp, err = l.Checkpointer.Load(inbox); err != nil {
+			Log.Error("Load checkpoint", "inbox", inbox, "error", err)
+			return 0, err
+		}
+		if uidValidity != 0 && cp.UIDValidity != uidValidity {
+			if cp.UID != 0 {
+				Log.Warn("UIDVALIDITY changed, checkpoint reset", "inbox", inbox, "old", cp.UIDValidity, "new", uidValidity)
+			}
+			cp = Checkpoint{UIDValidity: uidValidity}
+		}
+	}
+	uids, err := l.list(c, inbox, cp.UID)
 	if err != nil {
 		Log.Error("List", "server", c, "inbox", inbox, "error", err)
 		return 0, err
 	}
+	// the checkpoint can advance till the first unprocessed message
+	advance := l.Checkpointer != nil
+	processed := func(uid uint32) {
+		if !advance {
+			return
+		}
+		cp.UID = uid
+		if err := l.Checkpointer.Save(inbox, cp); err != nil {
+			Log.Error("Save checkpoint", "inbox", inbox, "uid", uid, "error", err)
+			advance = false
+		}
+	}
 
 	var n int
-	hsh := sha1.New()
-	for _, uid := range uids {
+	newHash := l.Hash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	hsh := newHash()
+	for i, uid := range uids {
+		if err = ctx.Err(); err != nil {
+			if l.Drain {
+				l.drain(c, n, len(uids)-i)
+			}
+			return n, err
+		}
+		if ok, err := l.filter(c, uid); err != nil {
+			Log.Error("filter", "uid", uid, "error", err)
+			advance = false
+			continue
+		} else if !ok {
+			Log.Info("rejected", "uid", uid)
+			l.finish(c, DeliveryInfo{Mailbox: inbox, UIDValidity: uidValidity, UID: uid}, l.Rejectbox)
+			processed(uid)
+			continue
+		}
 		hsh.Reset()
-		body := temp.NewMemorySlurper(strconv.FormatUint(uint64(uid), 10))
-		if _, err = c.ReadTo(io.MultiWriter(body, hsh), uid); err != nil {
+		body, err := l.newBuffer(uid)
+		if err != nil {
+			Log.Error("buffer", "uid", uid, "error", err)
+			return n, err
+		}
+		start := time.Now()
+		size, err := c.ReadTo(io.MultiWriter(body, hsh), uid)
+		if err != nil {
 			Log.Error("Read", "uid", uid, "error", err)
+			body.Close()
+			advance = false
 			continue
 		}
+		info := DeliveryInfo{Mailbox: inbox, UIDValidity: uidValidity, UID: uid, Size: size, Hash: hsh.Sum(nil)}
+		l.hook(l.OnFetched, LoopEvent{Mailbox: inbox, UID: uid, Size: size, Duration: time.Since(start)})
 
-		err = deliver(body, uid, hsh.Sum(nil))
+		var key string
+		if l.Deduper != nil {
+			if key, err = dedupeKey(body, hsh.Sum(nil)); err != nil {
+				Log.Error("dedupe", "uid", uid, "error", err)
+				body.Close()
+				advance = false
+				continue
+			}
+			if seen, err := l.Deduper.Seen(key); err != nil {
+				Log.Warn("dedupe", "uid", uid, "key", key, "error", err)
+			} else if seen {
+				Log.Info("duplicate", "uid", uid, "key", key)
+				body.Close()
+				l.finish(c, info, l.Outbox)
+				processed(uid)
+				continue
+			}
+		}
+
+		if verdict, err := l.scan(body); err != nil {
+			Log.Error("scan", "uid", uid, "error", err)
+			body.Close()
+			advance = false
+			continue
+		} else if verdict.Positive {
+			Log.Warn("scan", "uid", uid, "verdict", verdict.Reason)
+			body.Close()
+			l.quarantine(c, info, verdict)
+			processed(uid)
+			continue
+		}
+
+		if l.isSpam(uid, body) {
+			Log.Info("spam", "uid", uid)
+			body.Close()
+			if err = MarkSpam(c, uid); err != nil {
+				Log.Error("mark spam", "uid", uid, "error", err)
+				advance = false
+			} else {
+				processed(uid)
+			}
+			continue
+		}
+
+		var rule *Rule
+		if len(l.Rules) > 0 {
+			if rule, err = matchRules(l.Rules, body); err != nil {
+				Log.Error("rules", "uid", uid, "error", err)
+				body.Close()
+				advance = false
+				continue
+			}
+			if rule != nil && rule.Drop {
+				Log.Info("drop", "uid", uid, "rule", rule.Name)
+				body.Close()
+				if err = c.MarkDeleted(uid); err != nil {
+					Log.Error("mark deleted", "uid", uid, "error", err)
+					advance = false
+				} else {
+					l.removed = append(l.removed, uid)
+					processed(uid)
+				}
+				continue
+			}
+		}
+
+		delivered := true
+		var commit func() error
+		start = time.Now()
+		switch {
+		case rule != nil && rule.Deliver == nil:
+			delivered = false
+		case rule != nil:
+			err = deliverMessage(c, body, info, rule.Deliver)
+		case l.DeliverTx != nil:
+			if info, err = deliveryInfo(c, body, info); err == nil {
+				commit, err = l.DeliverTx(body, info)
+			}
+		case l.DeliverMessage != nil:
+			err = deliverMessage(c, body, info, l.DeliverMessage)
+		default:
+			err = l.Deliver(body, uid, info.Hash)
+		}
 		body.Close()
+		if err == nil && commit != nil && l.Semantics == AtLeastOnce {
+			err, commit = commit(), nil
+		}
 		if err != nil {
 			Log.Error("deliver", "uid", uid, "error", err)
-			if errbox != "" {
-				if err = c.Move(uid, errbox); err != nil {
-					Log.Error("move", "uid", uid, "errbox", errbox, "error", err)
-				}
+			l.hook(l.OnDeliverError, LoopEvent{Mailbox: inbox, UID: uid, Size: size, Duration: time.Since(start), Err: err})
+			if l.failed(c, info, err) {
+				processed(uid)
+			} else {
+				advance = false
 			}
 			continue
 		}
-		n++
+		if delivered {
+			n++
+			l.hook(l.OnDelivered, LoopEvent{Mailbox: inbox, UID: uid, Size: size, Duration: time.Since(start)})
+		}
+		if l.Deduper != nil {
+			if err = l.Deduper.Add(key); err != nil {
+				Log.Error("dedupe", "uid", uid, "key", key, "error", err)
+			}
+		}
+		processed(uid)
+		moveTo := l.Outbox
+		if rule != nil {
+			Log.Debug("rule", "uid", uid, "rule", rule.Name)
+			if rule.Flag != "" {
+				if err = c.SetFlag(uid, rule.Flag, true); err != nil {
+					Log.Error("set flag", "uid", uid, "flag", rule.Flag, "error", err)
+				}
+			}
+			if rule.MoveTo != "" {
+				moveTo = rule.MoveTo
+			}
+		}
+		l.finish(c, info, moveTo)
+		if commit != nil {
+			if err = commit(); err != nil {
+				Log.Error("commit", "uid", uid, "error", err)
+				if l.OnDeadLetter != nil {
+					l.OnDeadLetter(info, err)
+				}
+			}
+		}
+	}
 
-		if err = c.MarkSeen(uid); err != nil {
+	return n, nil
+}
+
+// drain flushes the flag changes of a round cancelled with left messages
+// skipped, and reports it; the caller closes the connection.
+func (l *Loop) drain(c Client, delivered, left int) {
+	Log.Info("drain", "server", c, "delivered", delivered, "left", left)
+	if err := c.Check(); err != nil {
+		Log.Warn("drain", "server", c, "error", err)
+	}
+	if l.OnDrained != nil {
+		l.OnDrained(delivered, left)
+	}
+}
+
+// attemptsPrefix is the prefix of the keyword counting the failed delivery attempts.
+const attemptsPrefix = "$DeliverAttempts-"
+
+// failed handles the failed delivery of a message: counts the attempts,
+// and moves the message to Errbox if the limit is reached.
+// Reports whether the message is done with.
+func (l *Loop) failed(c Client, info DeliveryInfo, deliverErr error) bool {
+	uid := info.UID
+	if l.MaxAttempts > 1 {
+		var attempts int
+		var old string
+		flags, err := c.GetFlags(uid)
+		if err != nil {
+			Log.Warn("GetFlags", "uid", uid, "error", err)
+		}
+		for f := range flags {
+			if strings.HasPrefix(f, attemptsPrefix) {
+				if n, err := strconv.Atoi(f[len(attemptsPrefix):]); err == nil && n > attempts {
+					attempts, old = n, f
+				}
+			}
+		}
+		if attempts++; attempts < l.MaxAttempts {
+			err = c.SetFlag(uid, attemptsPrefix+strconv.Itoa(attempts), true)
+			if err == nil && old != "" {
+				err = c.SetFlag(uid, old, false)
+			}
+			if err == nil {
+				Log.Info("deliver", "uid", uid, "attempts", attempts, "max", l.MaxAttempts)
+				return false
+			}
+			Log.Error("count attempts", "uid", uid, "error", err)
+		}
+	}
+	if l.MaxAttempts <= 0 && l.Errbox == "" {
+		return false
+	}
+	if l.OnDeadLetter != nil {
+		l.OnDeadLetter(info, deliverErr)
+	}
+	if l.Errbox == "" {
+		if err := l.markSeen(c, uid); err != nil {
 			Log.Error("mark seen", "uid", uid, "error", err)
+			return false
 		}
+		return true
+	}
+	if err := l.move(c, info, l.Errbox); err != nil {
+		Log.Error("move", "uid", uid, "errbox", l.Errbox, "error", err)
+		return false
+	}
+	return true
+}
 
-		if outbox != "" {
-			if err = c.Move(uid, outbox); err != nil {
-				Log.Error("move", "uid", uid, "outbox", outbox, "error", err)
-				continue
+func (l *Loop) newBuffer(uid uint32) (BodyBuffer, error) {
+	if l.NewBuffer != nil {
+		return l.NewBuffer(uid)
+	}
+	return NewSpool(SpoolMemoryLimit), nil
+}
+
+// finish marks the delivered message as seen, and moves it to outbox.
+func (l *Loop) finish(c Client, info DeliveryInfo, outbox string) {
+	if err := l.markSeen(c, info.UID); err != nil {
+		Log.Error("mark seen", "uid", info.UID, "error", err)
+	}
+
+	if outbox != "" {
+		if err := l.move(c, info, outbox); err != nil {
+			Log.Error("move", "uid", info.UID, "outbox", outbox, "error", err)
+		}
+	}
+}
+
+// markSeen marks the message as seen - or flags it with PeekKeyword with Peek.
+func (l *Loop) markSeen(c Client, uid uint32) error {
+	if !l.Peek {
+		return c.MarkSeen(uid)
+	}
+	return c.SetFlag(uid, l.peekKeyword(), true)
+}
+
+func (l *Loop) peekKeyword() string {
+	if l.PeekKeyword != "" {
+		return l.PeekKeyword
+	}
+	return "$Processed"
+}
+
+// criteria returns the search criteria of the messages to be processed:
+// those of List, with PeekKeyword instead of \Seen with Peek.
+func (l *Loop) criteria(all bool) SearchCriteria {
+	crit := listCriteria(l.Pattern, all)
+	if l.Peek && !all {
+		for i, f := range crit.WithoutFlags {
+			if f == `\Seen` {
+				crit.WithoutFlags[i] = l.peekKeyword()
 			}
 		}
 	}
+	return crit
+}
 
-	return n, nil
+// move moves the message to the mailbox, calling OnMoved on success.
+func (l *Loop) move(c Client, info DeliveryInfo, mbox string) error {
+	start := time.Now()
+	if err := c.Move(info.UID, mbox); err != nil {
+		return err
+	}
+	l.removed = append(l.removed, info.UID)
+	l.hook(l.OnMoved, LoopEvent{Mailbox: info.Mailbox, UID: info.UID, Size: info.Size, Duration: time.Since(start), Target: mbox})
+	return nil
+}
+
+// LoopEvent is the argument of the lifecycle hooks of Loop.
+type LoopEvent struct {
+	// Mailbox and UID identify the message, Size is its size.
+	Mailbox string
+	UID     uint32
+	Size    int64
+	// Duration is the duration of the fetch, the delivery or the move.
+	Duration time.Duration
+	// Target is the destination mailbox of OnMoved.
+	Target string
+	// Err is the error of OnDeliverError.
+	Err error
+}
+
+func (l *Loop) hook(fn func(LoopEvent), ev LoopEvent) {
+	if fn != nil {
+		fn(ev)
+	}
+}
+
+// deliverMessage calls deliver with the message and its metadata.
+func deliverMessage(c Client, body io.ReadSeeker, info DeliveryInfo, deliver MessageDeliverFunc) error {
+	info, err := deliveryInfo(c, body, info)
+	if err != nil {
+		return err
+	}
+	return deliver(body, info)
 }
@@ -0,0 +1,364 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Mailbox is a mailbox as returned by LIST.
+type Mailbox struct {
+	// Name is the full name of the mailbox.
+	Name string
+	// Delim is the hierarchy delimiter, empty if the server has no hierarchy.
+	Delim string
+	// Attrs are the mailbox attributes, such as \Noselect or \HasChildren.
+	Attrs imap.FlagSet
+	// Status holds the counters, set by MailboxesStatus only.
+	Status *imap.MailboxStatus
+}
+
+// Selectable reports whether the mailbox can be selected (has no \Noselect attribute).
+func (m Mailbox) Selectable() bool {
+	return !m.Attrs[`\Noselect`] && !m.Attrs[`\NonExistent`]
+}
+
+// Mailboxes lists the mailboxes matching the LIST pattern ("*" matches
+// everything, "%" everything but the hierarchy delimiter).
+// An empty pattern lists all mailboxes.
+func (c *client) Mailboxes(pattern string) ([]Mailbox, error) {
+	c.enter()
+	defer c.leave()
+	if pattern == "" {
+		pattern = "*"
+	}
+	var cmd *imap.Command
+	err := c.retry("Mailboxes", func() error {
+		var err error
+		cmd, err = c.wait(c.c.List("", pattern))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	mboxes := make([]Mailbox, 0, len(cmd.Data))
+	for _, resp := range cmd.Data {
+		info := resp.MailboxInfo()
+		if info == nil {
+			continue
+		}
+		mboxes = append(mboxes, Mailbox{Name: info.Name, Delim: info.Delim, Attrs: info.Attrs})
+	}
+	return mboxes, nil
+}
+
+// SubscribedMailboxes returns the subscribed mailboxes, with
+// LIST (SUBSCRIBED) if the server supports LIST-EXTENDED, LSUB otherwise.
+// A subscribed mailbox may not exist (\NonExistent).
+func (c *client) SubscribedMailboxes() ([]Mailbox, error) {
+	c.enter()
+	defer c.leave()
+	var cmd *imap.Command
+	err := c.retry("SubscribedMailboxes", func() error {
+		var err error
+		if c.c.Caps["LIST-EXTENDED"] {
+			cmd, err = c.wait(c.c.Send("LIST", []imap.Field{imap.Field("SUBSCRIBED")}, c.c.Quote(""), c.c.Quote("*")))
+		} else {
+			cmd, err = c.wait(c.c.LSub("", "*"))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mboxes []Mailbox
+	for _, resp := range cmd.Data {
+		if info := resp.MailboxInfo(); info != nil {
+			mboxes = append(mboxes, Mailbox{Name: info.Name, Delim: info.Delim, Attrs: info.Attrs})
+		}
+	}
+	return mboxes, nil
+}
+
+// MailboxesStatus is like Mailboxes, but also returns the MESSAGES and
+// UNSEEN counters of the selectable mailboxes, in Mailbox.Status.
+//
+// Uses LIST ... RETURN (STATUS (MESSAGES UNSEEN)) (RFC 5819) - one round-trip -
+// if the server supports LIST-STATUS, a STATUS per mailbox otherwise.
+func (c *client) MailboxesStatus(pattern string) ([]Mailbox, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["LIST-STATUS"] {
+		mboxes, err := c.Mailboxes(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for i, m := range mboxes {
+			if !m.Selectable() {
+				continue
+			}
+			if mboxes[i].Status, err = c.Status(m.Name); err != nil {
+				return mboxes, err
+			}
+		}
+		return mboxes, nil
+	}
+	if pattern == "" {
+		pattern = "*"
+	}
+	var cmd *imap.Command
+	err := c.retry("MailboxesStatus", func() error {
+		var err error
+		cmd, err = c.wait(c.c.Send("LIST", c.c.Quote(""), c.mailboxName(pattern),
+			imap.Field("RETURN"), []imap.Field{imap.Field("STATUS"),
+				[]imap.Field{imap.Field("MESSAGES"), imap.Field("UNSEEN")}}))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mboxes []Mailbox
+	statuses := make(map[string]*imap.MailboxStatus)
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if info := resp.MailboxInfo(); info != nil {
+			mboxes = append(mboxes, Mailbox{Name: info.Name, Delim: info.Delim, Attrs: info.Attrs})
+		} else if st := resp.MailboxStatus(); st != nil {
+			statuses[st.Name] = st
+		}
+	}
+	c.c.Data = nil
+	for i, m := range mboxes {
+		mboxes[i].Status = statuses[m.Name]
+	}
+	return mboxes, nil
+}
+
+// MatchMailbox reports whether the name matches the LIST pattern ("*"
+// matches everything, "%" everything but delim) - for Client implementations
+// without LIST.
+func MatchMailbox(pattern, name, delim string) bool {
+	if pattern == "" {
+		return true
+	}
+	notDelim := "."
+	if delim != "" {
+		notDelim = "[^" + regexp.QuoteMeta(delim) + "]"
+	}
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		subs := strings.Split(part, "%")
+		for j, sub := range subs {
+			subs[j] = regexp.QuoteMeta(sub)
+		}
+		parts[i] = strings.Join(subs, notDelim+"*")
+	}
+	rex, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	return err == nil && rex.MatchString(name)
+}
+
+// CreateMailbox creates the mailbox - PathSeparator in mbox is replaced by
+// the hierarchy delimiter of the server. The superior levels are not created
+// by this one CREATE: RFC 3501 says the server SHOULD create them, but some
+// servers do not - call CreateMailbox for each level for those.
+func (c *client) CreateMailbox(mbox string) error {
+	c.enter()
+	defer c.leave()
+	mbox = c.serverName(mbox)
+	if _, err := c.wait(c.c.Create(mbox)); err != nil {
+		return err
+	}
+	c.setCreated(mbox, true)
+	return nil
+}
+
+// DeleteMailbox deletes the mailbox.
+func (c *client) DeleteMailbox(mbox string) error {
+	c.enter()
+	defer c.leave()
+	mbox = c.serverName(mbox)
+	if _, err := c.wait(c.c.Delete(mbox)); err != nil {
+		return err
+	}
+	c.setCreated(mbox, false)
+	if c.selected == mbox {
+		c.selected = ""
+	}
+	return nil
+}
+
+// RenameMailbox renames the mailbox from oldName to newName.
+func (c *client) RenameMailbox(oldName, newName string) error {
+	c.enter()
+	defer c.leave()
+	oldName, newName = c.serverName(oldName), c.serverName(newName)
+	if _, err := c.wait(c.c.Rename(oldName, newName)); err != nil {
+		return err
+	}
+	c.setCreated(oldName, false)
+	c.setCreated(newName, true)
+	if c.selected == oldName {
+		c.selected = ""
+	}
+	return nil
+}
+
+// Select selects mbox (unless it is selected already), for the operations
+// working on the selected mailbox: ReadTo, FetchMany, GetFlags, SetFlag,
+// MarkSeen, Move, Expunge and the like.
+//
+// The operations naming a mailbox (List, Search, Sort, Idle...) select it
+// themselves, so interleaving them across mailboxes is safe; but the first
+// group works on the mailbox selected last.
+func (c *client) Select(mbox string) error {
+	c.enter()
+	defer c.leave()
+	return c.selectMailbox(mbox)
+}
+
+// Selected returns the name of the selected mailbox, or "".
+func (c *client) Selected() string {
+	c.enter()
+	defer c.leave()
+	return c.selected
+}
+
+// serverName returns the name of mbox at the server: with PathSeparator
+// replaced by the hierarchy delimiter, in the personal namespace (see
+// personalName). All the methods naming a mailbox map the name with it.
+func (c *client) serverName(mbox string) string {
+	return c.personalName(c.serverPath(mbox))
+}
+
+// mailboxName returns the mailbox name argument, modified UTF-7 encoded -
+// as go-imap sends the mailbox names of its own commands.
+func (c *client) mailboxName(mbox string) imap.Field {
+	return c.c.Quote(imap.UTF7Encode(mbox))
+}
+
+// selectMailbox selects mbox read-write, skipping the SELECT if it is
+// selected already.
+func (c *client) selectMailbox(mbox string) error {
+	mbox = c.serverName(mbox)
+	if c.selected == mbox && c.c.State() == imap.Selected &&
+		c.c.Mailbox != nil && !c.c.Mailbox.ReadOnly {
+		return nil
+	}
+	if _, err := c.wait(c.c.Select(mbox, false)); err != nil {
+		c.selected = ""
+		return err
+	}
+	c.selected = mbox
+	return nil
+}
+
+// Subscribe adds the mailbox to the subscribed ones.
+func (c *client) Subscribe(mbox string) error {
+	c.enter()
+	defer c.leave()
+	_, err := c.wait(c.c.Subscribe(c.serverName(mbox)))
+	return err
+}
+
+// Unsubscribe removes the mailbox from the subscribed ones.
+func (c *client) Unsubscribe(mbox string) error {
+	c.enter()
+	defer c.leave()
+	_, err := c.wait(c.c.Unsubscribe(c.serverName(mbox)))
+	return err
+}
+
+// setCreated records whether the mailbox exists, for Move.
+func (c *client) setCreated(mbox string, exists bool) {
+	for i, k := range c.created {
+		if k == mbox {
+			if !exists {
+				c.created = append(c.created[:i], c.created[i+1:]...)
+			}
+			return
+		}
+	}
+	if exists {
+		c.created = append(c.created, mbox)
+	}
+}
+
+// Status returns the MESSAGES, RECENT, UNSEEN, UIDNEXT and UIDVALIDITY counters
+// of the mailbox, without selecting it.
+func (c *client) Status(mbox string) (*imap.MailboxStatus, error) {
+	c.enter()
+	defer c.leave()
+	mbox = c.serverName(mbox)
+	var cmd *imap.Command
+	err := c.retry("Status", func() error {
+		var err error
+		cmd, err = c.wait(c.c.Status(mbox, "MESSAGES", "RECENT", "UNSEEN", "UIDNEXT", "UIDVALIDITY"))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range cmd.Data {
+		if st := resp.MailboxStatus(); st != nil {
+			return st, nil
+		}
+	}
+	return nil, &imap.ProtocolError{Info: "no STATUS response for " + mbox}
+}
+
+// MessageCount returns the number of messages in mbox, with STATUS.
+func (c *client) MessageCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Messages), nil
+}
+
+// UnreadCount returns the number of messages without \Seen in mbox, with STATUS.
+func (c *client) UnreadCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Unseen), nil
+}
+
+// PermanentFlags selects mbox, and returns its PERMANENTFLAGS: the flags
+// which can be changed permanently. `\*` means that new keywords can be
+// created, too - see CanStore.
+func (c *client) PermanentFlags(mbox string) (imap.FlagSet, error) {
+	c.enter()
+	defer c.leave()
+	if err := c.selectMailbox(mbox); err != nil {
+		return nil, err
+	}
+	if c.c.Mailbox == nil {
+		return nil, nil
+	}
+	return c.c.Mailbox.PermFlags, nil
+}
+
+// CanStore reports whether flag persists in a mailbox with the given PERMANENTFLAGS.
+func CanStore(permFlags imap.FlagSet, flag string) bool {
+	if permFlags[flag] {
+		return true
+	}
+	return permFlags[`\*`] && !strings.HasPrefix(flag, `\`)
+}
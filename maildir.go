@@ -0,0 +1,174 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// maildirFlags maps the IMAP flags to the Maildir info flags.
+var maildirFlags = map[string]byte{
+	`\Draft`:     'D',
+	`\Flagged`:   'F',
+	`$Forwarded`: 'P',
+	`\Answered`:  'R',
+	`\Seen`:      'S',
+	`\Deleted`:   'T',
+}
+
+// ExportMaildir writes the (not expunged) messages of mbox into the Maildir
+// at dir (creating its tmp, new and cur subdirectories if needed).
+// The messages with flags go into cur, with the flags in the info suffix
+// (":2,FS"), the others go into new.
+//
+// The file names contain the UID (",U=uid"), and the UIDVALIDITY of mbox
+// is stored in dir/.uidvalidity, so a repeated export of the same mailbox
+// skips the messages exported already.
+//
+// Returns the number of the exported messages.
+func ExportMaildir(c Client, mbox, dir string) (int, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return 0, err
+		}
+	}
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	exported := make(map[uint32]bool)
+	uvFn := filepath.Join(dir, ".uidvalidity")
+	uidValidity := strconv.FormatUint(uint64(st.UIDValidity), 10)
+	if b, err := os.ReadFile(uvFn); err == nil && strings.TrimSpace(string(b)) == uidValidity {
+		if exported, err = maildirUIDs(dir); err != nil {
+			return 0, err
+		}
+	}
+	if err = writeFileAtomic(uvFn, []byte(uidValidity+"\n")); err != nil {
+		return 0, err
+	}
+
+	uids, err := c.Search(mbox, SearchCriteria{})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, uid := range uids {
+		if exported[uid] {
+			continue
+		}
+		flags, err := c.GetFlags(uid)
+		if err != nil {
+			return n, err
+		}
+		if err = exportMaildirMessage(c, dir, uid, flags); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+var maildirSeq uint32
+
+// maildirName returns a unique file name for the Maildir.
+func maildirName(uid uint32) string {
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+	now := time.Now()
+	return strconv.FormatInt(now.Unix(), 10) +
+		".M" + strconv.Itoa(now.Nanosecond()/1000) +
+		"P" + strconv.Itoa(os.Getpid()) +
+		"Q" + strconv.FormatUint(uint64(atomic.AddUint32(&maildirSeq, 1)), 10) +
+		"." + host + ",U=" + strconv.FormatUint(uint64(uid), 10)
+}
+
+// maildirInfo returns the info suffix for the flags, or "" if no flag maps to Maildir.
+func maildirInfo(flags imap.FlagSet) string {
+	var fs []byte
+	for f, ok := range flags {
+		if c := maildirFlags[f]; ok && c != 0 {
+			fs = append(fs, c)
+		}
+	}
+	if len(fs) == 0 {
+		return ""
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i] < fs[j] })
+	return ":2," + string(fs)
+}
+
+// exportMaildirMessage writes the message into tmp, then moves it into new or cur.
+func exportMaildirMessage(c Client, dir string, uid uint32, flags imap.FlagSet) error {
+	name := maildirName(uid)
+	tmp := filepath.Join(dir, "tmp", name)
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = c.ReadTo(fh, uid); err == nil {
+		err = fh.Sync()
+	}
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	dst := filepath.Join(dir, "new", name)
+	if info := maildirInfo(flags); info != "" {
+		dst = filepath.Join(dir, "cur", name+info)
+	}
+	return os.Rename(tmp, dst)
+}
+
+var rMaildirUID = regexp.MustCompile(`,U=([0-9]+)`)
+
+// maildirUIDs returns the UIDs of the messages in the new and cur subdirectories of dir.
+func maildirUIDs(dir string) (map[uint32]bool, error) {
+	uids := make(map[uint32]bool)
+	for _, sub := range []string{"new", "cur"} {
+		dh, err := os.Open(filepath.Join(dir, sub))
+		if err != nil {
+			return nil, err
+		}
+		names, err := dh.Readdirnames(-1)
+		dh.Close()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		for _, name := range names {
+			if m := rMaildirUID.FindStringSubmatch(name); m != nil {
+				if uid, err := strconv.ParseUint(m[1], 10, 32); err == nil {
+					uids[uint32(uid)] = true
+				}
+			}
+		}
+	}
+	return uids, nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import "time"
+
+// CommandFunc waits for the completion of the IMAP command name
+// (such as "UID FETCH"), and returns its error.
+type CommandFunc func(name string) error
+
+// Middleware wraps the execution of the IMAP commands, for timing, logging
+// or fault injection in tests: it may act before and after calling next,
+// replace its error, or return an error without calling next at all.
+//
+// The command has already been sent when the middleware is called, so calling
+// next again does not resend it; a connection error returned by the chain makes
+// WithRetry reconnect and resend the idempotent commands, as a real one would.
+type Middleware func(next CommandFunc) CommandFunc
+
+// WithMiddleware adds the middlewares around the execution of each command,
+// the first one being the outermost. The pipelined commands of WithPipelining
+// are wrapped as one, sending included.
+func WithMiddleware(middlewares ...Middleware) Option {
+	return func(c *client) { c.middlewares = append(c.middlewares, middlewares...) }
+}
+
+// intercept calls fn, the execution of the command name, through the middlewares,
+// and sends its events (see WithEvents).
+func (c *client) intercept(name string, fn func() error) error {
+	if len(c.middlewares) == 0 && c.events == nil {
+		return fn()
+	}
+	next := CommandFunc(func(string) error { return fn() })
+	for i := len(c.middlewares) - 1; i >= 0; i-- {
+		next = c.middlewares[i](next)
+	}
+	c.emit(Event{Type: EventCommandStarted, Command: name})
+	start := time.Now()
+	err := next(name)
+	c.emit(Event{Type: EventCommandFinished, Command: name, Duration: time.Since(start), Err: err})
+	return err
+}
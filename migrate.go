@@ -0,0 +1,165 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MigrateOptions are the options of Migrate.
+type MigrateOptions struct {
+	// Mailboxes are the patterns (see Client.Mailboxes) of the mailboxes
+	// to migrate - all ("*") if empty.
+	Mailboxes []string
+	// Rename returns the destination name of a source mailbox, if not nil
+	// (for example to change the hierarchy delimiter).
+	Rename func(name string) string
+	// Progress is called after each message, if not nil.
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress is the progress of Migrate.
+type MigrateProgress struct {
+	// Mailbox is the source mailbox being migrated.
+	Mailbox string
+	// Done of Total messages of Mailbox are done, Skipped of them were present already.
+	Done, Total, Skipped int
+}
+
+// MigrateResult is the summary of Migrate.
+type MigrateResult struct {
+	Mailboxes, Copied, Skipped int
+}
+
+// Migrate copies the mailboxes and their (not deleted) messages from src
+// to dst, preserving the flags and the internal dates. The messages which
+// are present in the destination mailbox already (by Message-ID, or by
+// content hash if there is no Message-ID) are skipped, so an interrupted
+// migration can be restarted.
+func Migrate(src, dst Client, opts MigrateOptions) (MigrateResult, error) {
+	var res MigrateResult
+	patterns := opts.Mailboxes
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		mboxes, err := src.Mailboxes(pattern)
+		if err != nil {
+			return res, err
+		}
+		for _, mbox := range mboxes {
+			if seen[mbox.Name] || !mbox.Selectable() {
+				continue
+			}
+			seen[mbox.Name] = true
+			dstName := mbox.Name
+			if opts.Rename != nil {
+				dstName = opts.Rename(mbox.Name)
+			}
+			copied, skipped, err := migrateMailbox(src, dst, mbox.Name, dstName, opts.Progress)
+			res.Copied += copied
+			res.Skipped += skipped
+			if err != nil {
+				return res, err
+			}
+			res.Mailboxes++
+		}
+	}
+	return res, nil
+}
+
+func migrateMailbox(src, dst Client, srcName, dstName string, progress func(MigrateProgress)) (copied, skipped int, err error) {
+	if err = dst.CreateMailbox(dstName); err != nil {
+		Log.Debug("CreateMailbox", "mbox", dstName, "error", err)
+	}
+	present, err := messageKeys(dst, dstName)
+	if err != nil {
+		return 0, 0, err
+	}
+	infos, err := src.ListWithInfo(srcName, "", true)
+	if err != nil {
+		return 0, 0, err
+	}
+	var buf bytes.Buffer
+	for i, info := range infos {
+		buf.Reset()
+		key := messageKey(info.MessageID, nil)
+		if info.MessageID == "" || !present[key] {
+			if _, err = src.ReadTo(&buf, info.UID); err != nil {
+				return copied, skipped, err
+			}
+			key = messageKey(info.MessageID, buf.Bytes())
+		}
+		if present[key] {
+			skipped++
+		} else {
+			if _, err = dst.Append(dstName, appendFlags(info.Flags), info.InternalDate, bytes.NewReader(buf.Bytes())); err != nil {
+				return copied, skipped, err
+			}
+			present[key] = true
+			copied++
+		}
+		if progress != nil {
+			progress(MigrateProgress{Mailbox: srcName, Done: i + 1, Total: len(infos), Skipped: skipped})
+		}
+	}
+	return copied, skipped, nil
+}
+
+// messageKeys returns the keys (see messageKey) of the messages of mbox.
+func messageKeys(c Client, mbox string) (map[string]bool, error) {
+	infos, err := c.ListWithInfo(mbox, "", true)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool, len(infos))
+	var buf bytes.Buffer
+	for _, info := range infos {
+		if info.MessageID == "" {
+			buf.Reset()
+			if _, err = c.ReadTo(&buf, info.UID); err != nil {
+				return nil, err
+			}
+		}
+		keys[messageKey(info.MessageID, buf.Bytes())] = true
+	}
+	return keys, nil
+}
+
+// messageKey returns the Message-ID, or the SHA-256 hash of the body if there is no Message-ID.
+func messageKey(messageID string, body []byte) string {
+	if messageID = strings.TrimSpace(messageID); messageID != "" {
+		return messageID
+	}
+	sum := sha256.Sum256(body)
+	return "hash:" + hex.EncodeToString(sum[:])
+}
+
+// appendFlags returns the flags which can be set by APPEND.
+func appendFlags(flags map[string]bool) []string {
+	fs := make([]string, 0, len(flags))
+	for f, ok := range flags {
+		if ok && f != `\Recent` {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
@@ -0,0 +1,1065 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// MockMessage is a message stored in a MockClient.
+type MockMessage struct {
+	UID          uint32
+	Body         []byte
+	Flags        imap.FlagSet
+	InternalDate time.Time
+}
+
+// MockCall is a recorded method call of a MockClient.
+type MockCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// MockClient is an in-memory Client, for testing DeliverFuncs
+// and DeliveryLoop configurations without a live IMAP server.
+//
+// Every method call is recorded in Calls, and returns Errors[method]
+// if it is set.
+type MockClient struct {
+	// Messages holds the messages, by mailbox name.
+	Messages map[string][]*MockMessage
+	// Errors holds the errors to be returned, by method name.
+	Errors map[string]error
+	// Calls is the list of method calls, in order.
+	Calls []MockCall
+
+	// Subscribed holds the subscribed mailbox names.
+	Subscribed map[string]bool
+	// Caps are the capabilities returned by Capabilities.
+	Caps map[string]bool
+	// PermFlags are the flags returned by PermanentFlags - `\*` (everything) if nil.
+	PermFlags imap.FlagSet
+
+	mu       sync.Mutex
+	selected string
+	nextUID  uint32
+}
+
+var (
+	errMockNotFound   = errors.New("no such message")
+	errMockNoMailbox  = &Error{Kind: ErrMailboxNotFound, Err: errors.New("no such mailbox")}
+	errMockMboxExists = errors.New("mailbox already exists")
+)
+
+// NewMockClient returns a new, empty MockClient.
+func NewMockClient() *MockClient {
+	return &MockClient{
+		Messages:   make(map[string][]*MockMessage),
+		Errors:     make(map[string]error),
+		Subscribed: make(map[string]bool),
+		Caps:       map[string]bool{"IMAP4REV1": true},
+	}
+}
+
+// AddMessage appends a message with the given flags to mbox, and returns its UID.
+func (m *MockClient) AddMessage(mbox string, body []byte, flags ...string) uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.add(mbox, body, imap.NewFlagSet(flags...))
+}
+
+func (m *MockClient) add(mbox string, body []byte, flags imap.FlagSet) uint32 {
+	if flags == nil {
+		flags = make(imap.FlagSet)
+	}
+	m.nextUID++
+	m.Messages[mbox] = append(m.Messages[mbox],
+		&MockMessage{UID: m.nextUID, Body: body, Flags: flags, InternalDate: time.Now()})
+	return m.nextUID
+}
+
+// call records the call and returns the injected error, if any.
+func (m *MockClient) call(method string, args ...interface{}) error {
+	m.Calls = append(m.Calls, MockCall{Method: method, Args: args})
+	return m.Errors[method]
+}
+
+// message returns the message with the given UID from the selected mailbox.
+func (m *MockClient) message(msgID uint32) (*MockMessage, error) {
+	for _, msg := range m.Messages[m.selected] {
+		if msg.UID == msgID {
+			return msg, nil
+		}
+	}
+	return nil, errMockNotFound
+}
+
+// String returns "mock".
+func (m *MockClient) String() string {
+	return "mock"
+}
+
+// Connect records the call.
+func (m *MockClient) Connect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.call("Connect")
+}
+
+// Close removes the \Deleted messages from the selected mailbox iff commit is true.
+func (m *MockClient) Close(commit bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Close", commit); err != nil {
+		return err
+	}
+	if commit {
+		m.expunge(func(*MockMessage) bool { return true })
+	}
+	m.selected = ""
+	return nil
+}
+
+// List selects mbox and returns the UIDs of the messages whose subject
+// contains pattern - the not deleted ones iff all is true, the unseen ones otherwise.
+func (m *MockClient) List(mbox, pattern string, all bool) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("List", mbox, pattern, all); err != nil {
+		return nil, err
+	}
+	return m.search(mbox, listCriteria(pattern, all)), nil
+}
+
+// ListSince returns the UIDs of the not deleted messages of mbox
+// with an internal date on or after the day of since.
+func (m *MockClient) ListSince(mbox string, since time.Time) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListSince", mbox, since); err != nil {
+		return nil, err
+	}
+	return m.search(mbox, betweenCriteria(since, time.Time{})), nil
+}
+
+// ListBetween returns the UIDs of the not deleted messages of mbox
+// with an internal date on or after the day of from, and before the day of to.
+func (m *MockClient) ListBetween(mbox string, from, to time.Time) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListBetween", mbox, from, to); err != nil {
+		return nil, err
+	}
+	return m.search(mbox, betweenCriteria(from, to)), nil
+}
+
+// ListNewer lists the messages of mbox with UID above lastUID.
+func (m *MockClient) ListNewer(mbox string, lastUID uint32) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListNewer", mbox, lastUID); err != nil {
+		return nil, err
+	}
+	return uidsAbove(m.search(mbox, SearchCriteria{}), lastUID), nil
+}
+
+// ListWithInfo is like List, but returns the summaries of the messages.
+func (m *MockClient) ListWithInfo(mbox, pattern string, all bool) ([]MessageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListWithInfo", mbox, pattern, all); err != nil {
+		return nil, err
+	}
+	var infos []MessageInfo
+	for _, uid := range m.search(mbox, listCriteria(pattern, all)) {
+		msg, _ := m.message(uid)
+		info := MessageInfo{UID: uid, Size: uint32(len(msg.Body)), Flags: copyFlags(msg.Flags), InternalDate: msg.InternalDate}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(msg.Body)); err == nil {
+			info.Subject = parsed.Header.Get("Subject")
+			info.From = parsed.Header.Get("From")
+			info.Date, _ = parsed.Header.Date()
+			info.MessageID = parsed.Header.Get("Message-Id")
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ListIter calls fn with the matching UIDs in ListPageSize pages.
+func (m *MockClient) ListIter(mbox, pattern string, all bool, fn func(uids []uint32) error) error {
+	m.mu.Lock()
+	if err := m.call("ListIter", mbox, pattern, all); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	uids := m.search(mbox, listCriteria(pattern, all))
+	m.mu.Unlock()
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	size := ListPageSize
+	if size <= 0 {
+		size = len(uids)
+	}
+	for len(uids) > 0 {
+		n := size
+		if n > len(uids) {
+			n = len(uids)
+		}
+		if err := fn(uids[:n:n]); err != nil {
+			return err
+		}
+		uids = uids[n:]
+	}
+	return nil
+}
+
+// Search selects mbox and returns the UIDs of the messages matching crit.
+// Raw search keys are ignored.
+func (m *MockClient) Search(mbox string, crit SearchCriteria) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Search", mbox, crit); err != nil {
+		return nil, err
+	}
+	return m.search(mbox, crit), nil
+}
+
+// SearchPage returns the requested page of the UIDs matching crit, and their number.
+func (m *MockClient) SearchPage(mbox string, crit SearchCriteria, offset, limit int) ([]uint32, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SearchPage", mbox, crit, offset, limit); err != nil {
+		return nil, 0, err
+	}
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("bad page offset=%d limit=%d", offset, limit)
+	}
+	uids, total := pageUIDs(m.search(mbox, crit), offset, limit)
+	return uids, total, nil
+}
+
+// Sort selects mbox and returns the UIDs of the messages matching search,
+// ordered by the criteria.
+func (m *MockClient) Sort(mbox string, criteria []SortKey, search SearchCriteria) ([]uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Sort", mbox, criteria, search); err != nil {
+		return nil, err
+	}
+	uids := m.search(mbox, search)
+	msgs := make([]SortMessage, 0, len(uids))
+	for _, uid := range uids {
+		msg, _ := m.message(uid)
+		sm := SortMessage{UID: uid, InternalDate: msg.InternalDate, Size: uint32(len(msg.Body))}
+		if parsed, err := mail.ReadMessage(bytes.NewReader(msg.Body)); err == nil {
+			sm.Header = parsed.Header
+		}
+		msgs = append(msgs, sm)
+	}
+	return SortMessages(msgs, criteria), nil
+}
+
+func (m *MockClient) search(mbox string, crit SearchCriteria) []uint32 {
+	m.selected = mbox
+	var uids []uint32
+	for _, msg := range m.Messages[mbox] {
+		if crit.Match(msg.Body, msg.Flags, msg.InternalDate) {
+			uids = append(uids, msg.UID)
+		}
+	}
+	return uids
+}
+
+// mockDelim is the hierarchy delimiter of the MockClient.
+const mockDelim = "/"
+
+// Mailboxes returns the mailboxes matching pattern.
+func (m *MockClient) Mailboxes(pattern string) ([]Mailbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Mailboxes", pattern); err != nil {
+		return nil, err
+	}
+	var mboxes []Mailbox
+	for name := range m.Messages {
+		if MatchMailbox(pattern, name, mockDelim) {
+			mboxes = append(mboxes, Mailbox{Name: name, Delim: mockDelim, Attrs: make(imap.FlagSet)})
+		}
+	}
+	return mboxes, nil
+}
+
+// SubscribedMailboxes returns the mailboxes in Subscribed, sorted.
+func (m *MockClient) SubscribedMailboxes() ([]Mailbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SubscribedMailboxes"); err != nil {
+		return nil, err
+	}
+	var mboxes []Mailbox
+	for name, ok := range m.Subscribed {
+		if !ok {
+			continue
+		}
+		attrs := imap.NewFlagSet(`\Subscribed`)
+		if _, exists := m.Messages[name]; !exists {
+			attrs[`\NonExistent`] = true
+		}
+		mboxes = append(mboxes, Mailbox{Name: name, Delim: mockDelim, Attrs: attrs})
+	}
+	sort.Slice(mboxes, func(i, j int) bool { return mboxes[i].Name < mboxes[j].Name })
+	return mboxes, nil
+}
+
+// MailboxesStatus is Mailboxes, with the counters of the mailboxes.
+func (m *MockClient) MailboxesStatus(pattern string) ([]Mailbox, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("MailboxesStatus", pattern); err != nil {
+		return nil, err
+	}
+	var mboxes []Mailbox
+	for name := range m.Messages {
+		if MatchMailbox(pattern, name, mockDelim) {
+			mboxes = append(mboxes, Mailbox{Name: name, Delim: mockDelim, Attrs: make(imap.FlagSet), Status: m.status(name)})
+		}
+	}
+	return mboxes, nil
+}
+
+// MailboxTree returns the tree of the mailboxes.
+func (m *MockClient) MailboxTree() (*MailboxTree, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("MailboxTree"); err != nil {
+		return nil, err
+	}
+	mboxes := make([]Mailbox, 0, len(m.Messages))
+	for name := range m.Messages {
+		mboxes = append(mboxes, Mailbox{Name: name, Delim: mockDelim, Attrs: make(imap.FlagSet)})
+	}
+	t := NewMailboxTree(mboxes)
+	t.Delim = mockDelim
+	return t, nil
+}
+
+// CreateMailbox creates an empty mailbox.
+func (m *MockClient) CreateMailbox(mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("CreateMailbox", mbox); err != nil {
+		return err
+	}
+	if _, ok := m.Messages[mbox]; ok {
+		return errMockMboxExists
+	}
+	m.Messages[mbox] = nil
+	return nil
+}
+
+// DeleteMailbox deletes the mailbox with all its messages.
+func (m *MockClient) DeleteMailbox(mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("DeleteMailbox", mbox); err != nil {
+		return err
+	}
+	if _, ok := m.Messages[mbox]; !ok {
+		return errMockNoMailbox
+	}
+	delete(m.Messages, mbox)
+	return nil
+}
+
+// RenameMailbox renames the mailbox.
+func (m *MockClient) RenameMailbox(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("RenameMailbox", oldName, newName); err != nil {
+		return err
+	}
+	msgs, ok := m.Messages[oldName]
+	if !ok {
+		return errMockNoMailbox
+	}
+	if _, ok = m.Messages[newName]; ok {
+		return errMockMboxExists
+	}
+	delete(m.Messages, oldName)
+	m.Messages[newName] = msgs
+	return nil
+}
+
+// Subscribe adds the mailbox to Subscribed.
+func (m *MockClient) Subscribe(mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Subscribe", mbox); err != nil {
+		return err
+	}
+	m.Subscribed[mbox] = true
+	return nil
+}
+
+// Unsubscribe removes the mailbox from Subscribed.
+func (m *MockClient) Unsubscribe(mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Unsubscribe", mbox); err != nil {
+		return err
+	}
+	delete(m.Subscribed, mbox)
+	return nil
+}
+
+// Select selects the existing mbox.
+func (m *MockClient) Select(mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Select", mbox); err != nil {
+		return err
+	}
+	if _, ok := m.Messages[mbox]; !ok {
+		return errMockNoMailbox
+	}
+	m.selected = mbox
+	return nil
+}
+
+// Selected returns the selected mailbox.
+func (m *MockClient) Selected() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.selected
+}
+
+// Status returns the counters of the mailbox.
+func (m *MockClient) Status(mbox string) (*imap.MailboxStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Status", mbox); err != nil {
+		return nil, err
+	}
+	if _, ok := m.Messages[mbox]; !ok {
+		return nil, errMockNoMailbox
+	}
+	return m.status(mbox), nil
+}
+
+// status returns the counters of the existing mailbox.
+func (m *MockClient) status(mbox string) *imap.MailboxStatus {
+	msgs := m.Messages[mbox]
+	st := &imap.MailboxStatus{Name: mbox, Messages: uint32(len(msgs)), UIDNext: m.nextUID + 1, UIDValidity: 1}
+	for _, msg := range msgs {
+		if msg.Flags[`\Recent`] {
+			st.Recent++
+		}
+		if !msg.Flags[`\Seen`] {
+			st.Unseen++
+		}
+	}
+	return st
+}
+
+// MessageCount returns the number of messages in mbox.
+func (m *MockClient) MessageCount(mbox string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("MessageCount", mbox); err != nil {
+		return 0, err
+	}
+	msgs, ok := m.Messages[mbox]
+	if !ok {
+		return 0, errMockNoMailbox
+	}
+	return len(msgs), nil
+}
+
+// UnreadCount returns the number of messages without \Seen in mbox.
+func (m *MockClient) UnreadCount(mbox string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("UnreadCount", mbox); err != nil {
+		return 0, err
+	}
+	msgs, ok := m.Messages[mbox]
+	if !ok {
+		return 0, errMockNoMailbox
+	}
+	n := 0
+	for _, msg := range msgs {
+		if !msg.Flags[`\Seen`] {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ReadTo writes the body of the message into w.
+func (m *MockClient) ReadTo(w io.Writer, msgID uint32) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ReadTo", msgID); err != nil {
+		return 0, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(msg.Body)
+	return int64(n), err
+}
+
+// FetchMany calls fn with the body of each message.
+func (m *MockClient) FetchMany(uids []uint32, fn func(uid uint32, r io.Reader) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("FetchMany", uids); err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		msg, err := m.message(uid)
+		if err != nil {
+			continue
+		}
+		if err = fn(uid, bytes.NewReader(msg.Body)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFlags returns the flags of the message.
+func (m *MockClient) GetFlags(msgID uint32) (imap.FlagSet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("GetFlags", msgID); err != nil {
+		return nil, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return copyFlags(msg.Flags), nil
+}
+
+// GetSize returns the length of the body of the message.
+func (m *MockClient) GetSize(msgID uint32) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("GetSize", msgID); err != nil {
+		return 0, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(len(msg.Body)), nil
+}
+
+// GetHeaders returns the parsed header of the message.
+func (m *MockClient) GetHeaders(msgID uint32) (textproto.MIMEHeader, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("GetHeaders", msgID); err != nil {
+		return nil, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return parseHeader(msg.Body)
+}
+
+// FetchHeaderFields returns the given fields of the header of the message.
+func (m *MockClient) FetchHeaderFields(msgID uint32, fields []string) (textproto.MIMEHeader, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("FetchHeaderFields", msgID, fields); err != nil {
+		return nil, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return nil, err
+	}
+	hdr, err := parseHeader(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return filterHeader(hdr, fields), nil
+}
+
+// GetEnvelope returns the envelope parsed from the header of the message.
+func (m *MockClient) GetEnvelope(msgID uint32) (*Envelope, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("GetEnvelope", msgID); err != nil {
+		return nil, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(msg.Body))
+	if err != nil {
+		return nil, err
+	}
+	return HeaderEnvelope(parsed.Header), nil
+}
+
+// ListKeywords returns the non-system flags of the message, sorted.
+func (m *MockClient) ListKeywords(msgID uint32) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ListKeywords", msgID); err != nil {
+		return nil, err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return keywords(msg.Flags), nil
+}
+
+// PermanentFlags selects mbox, and returns PermFlags.
+func (m *MockClient) PermanentFlags(mbox string) (imap.FlagSet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("PermanentFlags", mbox); err != nil {
+		return nil, err
+	}
+	if _, ok := m.Messages[mbox]; !ok {
+		return nil, errMockNoMailbox
+	}
+	m.selected = mbox
+	if m.PermFlags == nil {
+		return imap.NewFlagSet(`\*`), nil
+	}
+	return copyFlags(m.PermFlags), nil
+}
+
+func copyFlags(flags imap.FlagSet) imap.FlagSet {
+	c := make(imap.FlagSet, len(flags))
+	for k, v := range flags {
+		c[k] = v
+	}
+	return c
+}
+
+// SetFlag sets (or unsets) the keyword on the message.
+func (m *MockClient) SetFlag(msgID uint32, keyword string, st bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SetFlag", msgID, keyword, st); err != nil {
+		return err
+	}
+	return m.setFlag(msgID, keyword, st)
+}
+
+func (m *MockClient) setFlag(msgID uint32, keyword string, st bool) error {
+	msg, err := m.message(msgID)
+	if err != nil {
+		return err
+	}
+	if st {
+		msg.Flags[keyword] = true
+	} else {
+		delete(msg.Flags, keyword)
+	}
+	return nil
+}
+
+// SetFlags sets (or unsets) the keyword on the messages of the selected
+// mailbox - the missing UIDs are ignored, as by UID STORE.
+func (m *MockClient) SetFlags(uids []uint32, keyword string, st bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SetFlags", uids, keyword, st); err != nil {
+		return err
+	}
+	m.setFlags(uids, keyword, st)
+	return nil
+}
+
+// ReplaceFlags sets the flags of the message to exactly flags (except \Recent).
+func (m *MockClient) ReplaceFlags(msgID uint32, flags []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ReplaceFlags", msgID, flags); err != nil {
+		return err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return err
+	}
+	recent := msg.Flags[`\Recent`]
+	msg.Flags = imap.NewFlagSet(flags...)
+	delete(msg.Flags, `\Recent`)
+	if recent {
+		msg.Flags[`\Recent`] = true
+	}
+	return nil
+}
+
+// SetFlagsSilent is SetFlags - the mock does not echo anything, anyway.
+func (m *MockClient) SetFlagsSilent(uids []uint32, keyword string, st bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SetFlagsSilent", uids, keyword, st); err != nil {
+		return err
+	}
+	m.setFlags(uids, keyword, st)
+	return nil
+}
+
+// MarkSeenAll sets \Seen on the messages.
+func (m *MockClient) MarkSeenAll(uids []uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("MarkSeenAll", uids); err != nil {
+		return err
+	}
+	m.setFlags(uids, `\Seen`, true)
+	return nil
+}
+
+func (m *MockClient) setFlags(uids []uint32, keyword string, st bool) {
+	for _, uid := range uids {
+		_ = m.setFlag(uid, keyword, st)
+	}
+}
+
+// SetFlagRegex sets (or unsets) the flags of the message matching regex.
+func (m *MockClient) SetFlagRegex(msgID uint32, regex string, st bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SetFlagRegex", msgID, regex, st); err != nil {
+		return err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return err
+	}
+	rex := regexp.MustCompile(regex)
+	for flag := range msg.Flags {
+		if rex.MatchString(flag) {
+			if err := m.setFlag(msgID, flag, st); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MarkSeen sets \Seen on the message.
+func (m *MockClient) MarkSeen(msgID uint32) error {
+	return m.mark("MarkSeen", msgID, `\Seen`, true)
+}
+
+// MarkUnseen removes \Seen from the message.
+func (m *MockClient) MarkUnseen(msgID uint32) error {
+	return m.mark("MarkUnseen", msgID, `\Seen`, false)
+}
+
+// MarkDeleted sets \Deleted on the message.
+func (m *MockClient) MarkDeleted(msgID uint32) error {
+	return m.mark("MarkDeleted", msgID, `\Deleted`, true)
+}
+
+// MarkUndeleted removes \Deleted from the message.
+func (m *MockClient) MarkUndeleted(msgID uint32) error {
+	return m.mark("MarkUndeleted", msgID, `\Deleted`, false)
+}
+
+// MarkAnswered sets \Answered on the message.
+func (m *MockClient) MarkAnswered(msgID uint32) error {
+	return m.mark("MarkAnswered", msgID, `\Answered`, true)
+}
+
+// MarkFlagged sets \Flagged on the message.
+func (m *MockClient) MarkFlagged(msgID uint32) error {
+	return m.mark("MarkFlagged", msgID, `\Flagged`, true)
+}
+
+// MarkUnflagged removes \Flagged from the message.
+func (m *MockClient) MarkUnflagged(msgID uint32) error {
+	return m.mark("MarkUnflagged", msgID, `\Flagged`, false)
+}
+
+// MarkDraft sets \Draft on the message.
+func (m *MockClient) MarkDraft(msgID uint32) error {
+	return m.mark("MarkDraft", msgID, `\Draft`, true)
+}
+
+// Delete removes the message if permanent (or it is in the Trash),
+// moves it to the Trash otherwise.
+func (m *MockClient) Delete(msgID uint32, permanent bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Delete", msgID, permanent); err != nil {
+		return err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return err
+	}
+	if !permanent {
+		trash, err := m.specialUse(UseTrash)
+		if err != nil {
+			return err
+		}
+		if trash != m.selected {
+			m.moveMany([]uint32{msgID}, trash)
+			return nil
+		}
+	}
+	msg.Flags[`\Deleted`] = true
+	m.expunge(func(mm *MockMessage) bool { return mm == msg })
+	return nil
+}
+
+// DeleteMany sets \Deleted on the messages, and removes them if expunge is true.
+func (m *MockClient) DeleteMany(uids []uint32, expunge bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("DeleteMany", uids, expunge); err != nil {
+		return err
+	}
+	m.setFlags(uids, `\Deleted`, true)
+	if expunge {
+		m.expunge(func(msg *MockMessage) bool {
+			for _, uid := range uids {
+				if uid == msg.UID {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	return nil
+}
+
+func (m *MockClient) mark(method string, msgID uint32, keyword string, st bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(method, msgID); err != nil {
+		return err
+	}
+	return m.setFlag(msgID, keyword, st)
+}
+
+// Move copies the message to mbox (with a new UID), and marks the original deleted.
+func (m *MockClient) Move(msgID uint32, mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Move", msgID, mbox); err != nil {
+		return err
+	}
+	msg, err := m.message(msgID)
+	if err != nil {
+		return err
+	}
+	m.add(mbox, msg.Body, copyFlags(msg.Flags))
+	return m.setFlag(msgID, `\Deleted`, true)
+}
+
+// MoveMany copies the messages of the selected mailbox to mbox (with new UIDs),
+// and marks the originals deleted - the missing UIDs are ignored.
+func (m *MockClient) MoveMany(uids []uint32, mbox string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("MoveMany", uids, mbox); err != nil {
+		return err
+	}
+	m.moveMany(uids, mbox)
+	return nil
+}
+
+func (m *MockClient) moveMany(uids []uint32, mbox string) {
+	for _, uid := range uids {
+		if msg, err := m.message(uid); err == nil {
+			m.add(mbox, msg.Body, copyFlags(msg.Flags))
+			msg.Flags[`\Deleted`] = true
+		}
+	}
+}
+
+// SpecialUse returns the mailbox of the special use, by SpecialUseNames.
+func (m *MockClient) SpecialUse(use string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("SpecialUse", use); err != nil {
+		return "", err
+	}
+	return m.specialUse(use)
+}
+
+func (m *MockClient) specialUse(use string) (string, error) {
+	mboxes := make([]Mailbox, 0, len(m.Messages))
+	for name := range m.Messages {
+		mboxes = append(mboxes, Mailbox{Name: name, Delim: mockDelim, Attrs: make(imap.FlagSet)})
+	}
+	sort.Slice(mboxes, func(i, j int) bool { return mboxes[i].Name < mboxes[j].Name })
+	name, ok := findSpecialUse(use, mboxes)
+	if !ok {
+		return "", errMockNoMailbox
+	}
+	return name, nil
+}
+
+// MoveToTrash moves the messages to the Trash mailbox.
+func (m *MockClient) MoveToTrash(uids ...uint32) error {
+	return m.moveToSpecial("MoveToTrash", UseTrash, uids)
+}
+
+// MoveToJunk moves the messages to the Junk mailbox.
+func (m *MockClient) MoveToJunk(uids ...uint32) error {
+	return m.moveToSpecial("MoveToJunk", UseJunk, uids)
+}
+
+func (m *MockClient) moveToSpecial(method, use string, uids []uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call(method, uids); err != nil {
+		return err
+	}
+	mbox, err := m.specialUse(use)
+	if err != nil {
+		return err
+	}
+	m.moveMany(uids, mbox)
+	return nil
+}
+
+// Append appends the message to the existing mbox, and returns its UID.
+func (m *MockClient) Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Append", mbox, flags, date); err != nil {
+		return 0, err
+	}
+	if _, ok := m.Messages[mbox]; !ok {
+		return 0, errMockNoMailbox
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	uid := m.add(mbox, body, imap.NewFlagSet(flags...))
+	if !date.IsZero() {
+		msgs := m.Messages[mbox]
+		msgs[len(msgs)-1].InternalDate = date
+	}
+	return uid, nil
+}
+
+// Expunge removes the given \Deleted messages from the selected mailbox.
+func (m *MockClient) Expunge(uids ...uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("Expunge", uids); err != nil {
+		return err
+	}
+	m.expunge(func(msg *MockMessage) bool {
+		for _, uid := range uids {
+			if uid == msg.UID {
+				return true
+			}
+		}
+		return false
+	})
+	return nil
+}
+
+// ExpungeAll removes the \Deleted messages of the selected mailbox.
+func (m *MockClient) ExpungeAll() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.call("ExpungeAll"); err != nil {
+		return err
+	}
+	m.expunge(func(*MockMessage) bool { return true })
+	return nil
+}
+
+// Check records the call.
+func (m *MockClient) Check() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.call("Check")
+}
+
+// expunge removes the \Deleted messages from the selected mailbox, for which
+// match returns true.
+func (m *MockClient) expunge(match func(*MockMessage) bool) {
+	if _, ok := m.Messages[m.selected]; !ok {
+		return
+	}
+	msgs := m.Messages[m.selected][:0]
+	for _, msg := range m.Messages[m.selected] {
+		if !msg.Flags[`\Deleted`] || !match(msg) {
+			msgs = append(msgs, msg)
+		}
+	}
+	m.Messages[m.selected] = msgs
+}
+
+// SetLogMask records the call and returns mask.
+func (m *MockClient) SetLogMask(mask imap.LogMask) imap.LogMask {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.call("SetLogMask", mask)
+	return mask
+}
+
+// Capabilities returns a copy of Caps.
+func (m *MockClient) Capabilities() map[string]bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.call("Capabilities")
+	caps := make(map[string]bool, len(m.Caps))
+	for k, v := range m.Caps {
+		caps[k] = v
+	}
+	return caps
+}
+
+// Compressed returns false.
+func (m *MockClient) Compressed() bool {
+	return false
+}
+
+// Supports reports whether Caps contains the capability.
+func (m *MockClient) Supports(capability string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.call("Supports", capability)
+	return m.Caps[strings.ToUpper(capability)]
+}
+
+var _ = Client((*MockClient)(nil))
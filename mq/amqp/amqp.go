@@ -0,0 +1,81 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package amqp publishes the messages of an imapclient.Loop to an AMQP 0-9-1
+// (RabbitMQ) exchange, with publisher confirms.
+//
+//	p, err := amqp.New(ch, "mail", "inbox")
+//	l := imapclient.Loop{Client: c, DeliverMessage: imapclient.PublishDeliverFunc(p)}
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/tgulacsi/imapclient"
+)
+
+var _ imapclient.Publisher = (*Publisher)(nil)
+
+// Publisher is an imapclient.Publisher publishing to an AMQP exchange.
+type Publisher struct {
+	// Channel must be in confirm mode (see New).
+	Channel *amqp091.Channel
+	// Exchange and RoutingKey are the destination of the messages.
+	Exchange, RoutingKey string
+	// Mandatory makes the broker return the unroutable messages.
+	Mandatory bool
+}
+
+// New puts ch into confirm mode, and returns a Publisher using it.
+func New(ch *amqp091.Channel, exchange, routingKey string) (*Publisher, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("confirm mode: %w", err)
+	}
+	return &Publisher{Channel: ch, Exchange: exchange, RoutingKey: routingKey}, nil
+}
+
+// Publish publishes the message as persistent message/rfc822, with
+// imapclient.MessageHeaders as headers and imapclient.MessageKey as
+// the message id, and waits for the confirm of the broker.
+func (p *Publisher) Publish(ctx context.Context, body []byte, info imapclient.DeliveryInfo) error {
+	headers := make(amqp091.Table)
+	for k, v := range imapclient.MessageHeaders(info) {
+		headers[k] = v
+	}
+	msg := amqp091.Publishing{
+		Headers:      headers,
+		ContentType:  "message/rfc822",
+		DeliveryMode: amqp091.Persistent,
+		MessageId:    imapclient.MessageKey(info),
+		Timestamp:    time.Now(),
+		Body:         body,
+	}
+	dc, err := p.Channel.PublishWithDeferredConfirmWithContext(ctx, p.Exchange, p.RoutingKey, p.Mandatory, false, msg)
+	if err != nil {
+		return err
+	}
+	ok, err := dc.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("publish uid %d to %q: nacked by the broker", info.UID, p.Exchange)
+	}
+	return nil
+}
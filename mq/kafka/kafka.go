@@ -0,0 +1,62 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kafka publishes the messages of an imapclient.Loop to a Kafka topic.
+//
+//	p := kafka.New([]string{"localhost:9092"}, "mail")
+//	defer p.Close()
+//	l := imapclient.Loop{Client: c, DeliverMessage: imapclient.PublishDeliverFunc(p)}
+package kafka
+
+import (
+	"context"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/tgulacsi/imapclient"
+)
+
+var _ imapclient.Publisher = (*Publisher)(nil)
+
+// Publisher is an imapclient.Publisher writing to a Kafka topic.
+type Publisher struct {
+	// Writer is the writer of the topic: it must be synchronous (not Async),
+	// so WriteMessages returns after the acknowledgement of the brokers.
+	Writer *kafkago.Writer
+}
+
+// New returns a Publisher writing to topic, waiting for the acknowledgement
+// of all the in-sync replicas, and partitioning by imapclient.MessageKey.
+func New(brokers []string, topic string) *Publisher {
+	return &Publisher{Writer: &kafkago.Writer{
+		Addr:         kafkago.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafkago.Hash{},
+		RequiredAcks: kafkago.RequireAll,
+	}}
+}
+
+// Publish writes the message, with imapclient.MessageHeaders as headers,
+// keyed by imapclient.MessageKey.
+func (p *Publisher) Publish(ctx context.Context, body []byte, info imapclient.DeliveryInfo) error {
+	msg := kafkago.Message{Key: []byte(imapclient.MessageKey(info)), Value: body}
+	for k, v := range imapclient.MessageHeaders(info) {
+		msg.Headers = append(msg.Headers, kafkago.Header{Key: k, Value: []byte(v)})
+	}
+	return p.Writer.WriteMessages(ctx, msg)
+}
+
+// Close closes the Writer.
+func (p *Publisher) Close() error { return p.Writer.Close() }
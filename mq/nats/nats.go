@@ -0,0 +1,56 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nats publishes the messages of an imapclient.Loop to a NATS
+// JetStream subject.
+//
+//	js, err := nc.JetStream()
+//	l := imapclient.Loop{Client: c, DeliverMessage: imapclient.PublishDeliverFunc(nats.New(js, "mail.inbox"))}
+package nats
+
+import (
+	"context"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/tgulacsi/imapclient"
+)
+
+var _ imapclient.Publisher = (*Publisher)(nil)
+
+// Publisher is an imapclient.Publisher publishing to a JetStream subject.
+type Publisher struct {
+	JetStream natsgo.JetStreamContext
+	Subject   string
+}
+
+// New returns a Publisher publishing to subject with js.
+func New(js natsgo.JetStreamContext, subject string) *Publisher {
+	return &Publisher{JetStream: js, Subject: subject}
+}
+
+// Publish publishes the message, with imapclient.MessageHeaders as headers,
+// and waits for the acknowledgement of the stream. imapclient.MessageKey is
+// the Nats-Msg-Id, so the stream drops the messages published again
+// (after a crash before marking them seen) within its duplicate window.
+func (p *Publisher) Publish(ctx context.Context, body []byte, info imapclient.DeliveryInfo) error {
+	msg := natsgo.NewMsg(p.Subject)
+	for k, v := range imapclient.MessageHeaders(info) {
+		msg.Header.Set(k, v)
+	}
+	msg.Data = body
+	_, err := p.JetStream.PublishMsg(msg, natsgo.MsgId(imapclient.MessageKey(info)), natsgo.Context(ctx))
+	return err
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// NamespaceClient is a Client which can list the namespaces (RFC 2342).
+type NamespaceClient interface {
+	Client
+	Namespaces() (*Namespaces, error)
+}
+
+// Namespace is a mailbox name prefix with its hierarchy delimiter.
+type Namespace struct {
+	Prefix, Delim string
+}
+
+// Namespaces are the personal, other users' and shared namespaces of the server.
+type Namespaces struct {
+	Personal, Other, Shared []Namespace
+}
+
+// Namespaces returns the namespaces of the server.
+//
+// Returns imap.NotAvailableError if the server does not support NAMESPACE.
+func (c *client) Namespaces() (*Namespaces, error) {
+	c.enter()
+	defer c.leave()
+	return c.namespaces()
+}
+
+func (c *client) namespaces() (*Namespaces, error) {
+	if c.ns != nil {
+		return c.ns, nil
+	}
+	if !c.c.Caps["NAMESPACE"] {
+		return nil, imap.NotAvailableError("NAMESPACE")
+	}
+	cmd, err := c.wait(c.c.Send("NAMESPACE"))
+	if err != nil {
+		return nil, err
+	}
+	ns := &Namespaces{}
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if resp.Label != "NAMESPACE" || len(resp.Fields) < 4 {
+			continue
+		}
+		ns.Personal = parseNamespaces(resp.Fields[1])
+		ns.Other = parseNamespaces(resp.Fields[2])
+		ns.Shared = parseNamespaces(resp.Fields[3])
+	}
+	c.c.Data = nil
+	c.ns = ns
+	return ns, nil
+}
+
+// parseNamespaces parses a namespace list: (("prefix" "delim") ...) or NIL.
+func parseNamespaces(f imap.Field) []Namespace {
+	var nss []Namespace
+	for _, item := range imap.AsList(f) {
+		parts := imap.AsList(item)
+		if len(parts) < 2 {
+			continue
+		}
+		nss = append(nss, Namespace{Prefix: imap.AsString(parts[0]), Delim: imap.AsString(parts[1])})
+	}
+	return nss
+}
+
+// personalName returns mbox prefixed with the personal namespace,
+// unless it is INBOX, or is in a namespace already.
+func (c *client) personalName(mbox string) string {
+	if strings.EqualFold(mbox, "INBOX") {
+		return mbox
+	}
+	ns, err := c.namespaces()
+	if err != nil || len(ns.Personal) == 0 || ns.Personal[0].Prefix == "" {
+		return mbox
+	}
+	for _, list := range [][]Namespace{ns.Personal, ns.Other, ns.Shared} {
+		for _, n := range list {
+			if n.Prefix != "" && strings.HasPrefix(mbox, n.Prefix) {
+				return mbox
+			}
+		}
+	}
+	return ns.Personal[0].Prefix + mbox
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// TokenSource returns a valid OAuth2 access token.
+//
+// It is called on every Connect (so on every reconnect, too), thus it
+// should refresh the token when needed. If the server rejects the token,
+// Connect returns ErrTokenExpired.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenSourceFunc is an adapter to use ordinary functions as TokenSource.
+type TokenSourceFunc func() (string, error)
+
+// Token calls f().
+func (f TokenSourceFunc) Token() (string, error) {
+	return f()
+}
+
+// WithTokenSource makes the client authenticate with XOAUTH2 or OAUTHBEARER,
+// using a fresh token from tokens on every Connect.
+func WithTokenSource(username string, tokens TokenSource) Option {
+	return func(c *client) {
+		c.username = username
+		c.tokens = tokens
+	}
+}
+
+// NewClientOAuth returns a new (not connected) Client, which authenticates
+// with XOAUTH2 or OAUTHBEARER, using a fresh token from tokens on every Connect.
+func NewClientOAuth(host string, port int, username string, tokens TokenSource) Client {
+	c := NewClient(host, port, username, "").(*client)
+	c.tokens = tokens
+	return c
+}
+
+type xoauth2Auth struct {
+	username, token string
+}
+
+// XOAuth2Auth returns an imap.SASL usable for XOAUTH2 (Gmail, Office365) authentication.
+func XOAuth2Auth(username, token string) imap.SASL {
+	return xoauth2Auth{username: username, token: token}
+}
+
+func (a xoauth2Auth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next answers the JSON error challenge with an empty response, as required
+// to receive the final NO.
+func (a xoauth2Auth) Next(challenge []byte) (response []byte, err error) {
+	return []byte{}, nil
+}
+
+type oauthBearerAuth struct {
+	username, token, host string
+	port                  int
+}
+
+// OAuthBearerAuth returns an imap.SASL usable for OAUTHBEARER (RFC 7628) authentication.
+func OAuthBearerAuth(username, token, host string, port int) imap.SASL {
+	return oauthBearerAuth{username: username, token: token, host: host, port: port}
+}
+
+func (a oauthBearerAuth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	ir = []byte("n,a=" + scramName(a.username) + ",\x01host=" + a.host + "\x01port=" + strconv.Itoa(a.port) +
+		"\x01auth=Bearer " + a.token + "\x01\x01")
+	return "OAUTHBEARER", ir, nil
+}
+
+// Next answers the error challenge with the dummy response of RFC 7628 3.2.3.
+func (a oauthBearerAuth) Next(challenge []byte) (response []byte, err error) {
+	return []byte{1}, nil
+}
+
+// oauth authenticates with a fresh token: with the standard OAUTHBEARER if
+// advertised, with XOAUTH2 otherwise.
+func (c *client) oauth() error {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+	a := XOAuth2Auth(c.username, token)
+	if c.c.Caps["AUTH=OAUTHBEARER"] {
+		a = OAuthBearerAuth(c.username, token, c.host, c.port)
+	}
+	if _, err = c.c.Auth(a); err != nil {
+		c.logger.Error("Authenticate", "username", c.username, "capabilities", c.c.Caps, "error", err)
+		var rspErr imap.ResponseError
+		if errors.As(err, &rspErr) && rspErr.Response != nil && rspErr.Status == imap.NO {
+			return &Error{Op: "Authenticate", Kind: ErrTokenExpired, Err: err}
+		}
+		return err
+	}
+	return nil
+}
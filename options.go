@@ -0,0 +1,224 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"compress/flate"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// Option is a configuration option of NewClientWithOptions.
+type Option func(*client)
+
+// NewClientWithOptions returns a new (not connected) Client, configured by the options.
+//
+// Without options, the client connects to port 993 with implicit TLS, falling
+// back to port 143 (upgraded with STARTTLS if the server supports it) if 993
+// cannot be connected to. WithTLS defaults to port 993, WithoutTLS and
+// WithRequireStartTLS to port 143. On a given port, TLS is implicit unless the
+// port is 143 (see WithTLS and WithoutTLS); STARTTLS is tried on port 143.
+// The package-level Timeout and TLSConfig are used unless overridden by the
+// respective options.
+func NewClientWithOptions(host string, opts ...Option) Client {
+	c := &client{host: host, tls: maybeTLS, logger: Log}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.port == 0 {
+		switch {
+		case c.tls == forceTLS:
+			c.port = 993
+		case c.tls == noTLS || c.requireStartTLS:
+			c.port = 143
+		}
+	}
+	return c
+}
+
+// NewClientFromConn returns a new (not connected) Client, which uses the
+// already established conn (an stunnel or SSH tunnel, or a preauthenticated
+// pipe from an MDA) on Connect, instead of dialing.
+//
+// Connect skips STARTTLS and authentication if the server greets with PREAUTH.
+// The connection is treated as encrypted if it is a *tls.Conn, or WithTLS is given.
+// As conn can be used only once, reconnecting (see WithRetry) is not possible,
+// the second Connect returns ErrConnHandedOver.
+func NewClientFromConn(conn net.Conn, opts ...Option) Client {
+	var host string
+	if addr := conn.RemoteAddr(); addr != nil {
+		host, _, _ = net.SplitHostPort(addr.String())
+	}
+	c := NewClientWithOptions(host, opts...).(*client)
+	c.preConn, c.fromConn = conn, true
+	return c
+}
+
+// ErrConnHandedOver is returned by Connect when the connection handed over
+// to NewClientFromConn has already been used.
+var ErrConnHandedOver = errors.New("the connection handed over has already been used")
+
+// WithPort sets the port to connect to.
+func WithPort(port int) Option {
+	return func(c *client) { c.port = port }
+}
+
+// WithTLS forces TLS, with the given config (TLSConfig if nil).
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *client) {
+		c.tls = forceTLS
+		c.tlsConfig = cfg
+	}
+}
+
+// WithTLSConfig sets the TLS config of both TLS and STARTTLS (instead of
+// TLSConfig), without changing whether TLS is used.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *client) { c.tlsConfig = cfg }
+}
+
+// WithoutTLS forces a plaintext connection.
+func WithoutTLS() Option {
+	return func(c *client) { c.tls = noTLS }
+}
+
+// Dialer dials the network connections to the server - *net.Dialer implements it.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DialerFunc is an adapter to use ordinary functions as Dialer.
+type DialerFunc func(network, addr string) (net.Conn, error)
+
+// Dial calls f(network, addr).
+func (f DialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+// WithDialer sets the Dialer used by Connect, instead of net.DialTimeout
+// with the connect timeout. TLS is still done by the client.
+func WithDialer(d Dialer) Option {
+	return func(c *client) { c.dialer = d }
+}
+
+// ErrNoStartTLS is returned by Connect if STARTTLS is required, but the server does not support it.
+var ErrNoStartTLS = errors.New("STARTTLS is required, but not supported by the server")
+
+// WithRequireStartTLS makes Connect abort (before sending any credentials)
+// if a plaintext connection cannot be upgraded with STARTTLS.
+func WithRequireStartTLS() Option {
+	return func(c *client) { c.requireStartTLS = true }
+}
+
+// AuthRefusedError is returned by Connect if the client refuses to authenticate,
+// before sending the credentials.
+type AuthRefusedError struct {
+	// Reason tells why the authentication was refused.
+	Reason string
+	// Err is the error of the last SASL mechanism tried, if any.
+	Err error
+}
+
+func (e *AuthRefusedError) Error() string {
+	if e.Err == nil {
+		return "authentication refused: " + e.Reason
+	}
+	return "authentication refused: " + e.Reason + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error of the last SASL mechanism tried.
+func (e *AuthRefusedError) Unwrap() error { return e.Err }
+
+// WithAllowCleartext allows sending the password over an unencrypted
+// connection, with LOGIN or a plaintext SASL mechanism (PLAIN, LOGIN),
+// which Connect refuses by default.
+func WithAllowCleartext() Option {
+	return func(c *client) { c.allowCleartext = true }
+}
+
+// WithTimeout sets the client timeout, instead of Timeout.
+// It is the default of the connect and read timeouts.
+func WithTimeout(d time.Duration) Option {
+	return func(c *client) { c.timeout = d }
+}
+
+// WithConnectTimeout sets the timeout of dialing, the server greeting
+// (see WithGreetingTimeout) and authentication.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(c *client) { c.timeouts.connect = d }
+}
+
+// WithGreetingTimeout sets the time to wait for the server greeting (and
+// the implicit TLS handshake) after dialing, instead of the connect timeout,
+// or GreetingTimeout.
+func WithGreetingTimeout(d time.Duration) Option {
+	return func(c *client) { c.timeouts.greeting = d }
+}
+
+// WithConnectRetries makes Connect retry a failed dial n times, sleeping
+// backoff (doubled after each attempt) in between, instead of ConnectRetries
+// and ConnectBackoff.
+func WithConnectRetries(n int, backoff time.Duration) Option {
+	return func(c *client) { c.retries = &dialRetries{n: n, backoff: backoff} }
+}
+
+// WithReadTimeout sets the maximum time to wait for a server response,
+// in the command and Logout receive loops.
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *client) { c.timeouts.read = d }
+}
+
+// WithIdleTimeout sets the maximum time spent in one IDLE command, instead of IdleTimeout.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *client) { c.timeouts.idle = d }
+}
+
+// WithLogger sets the logger of the client, instead of Log.
+// Any Logger can be used, such as a *slog.Logger.
+func WithLogger(logger Logger) Option {
+	return func(c *client) { c.logger = logger }
+}
+
+// WithLogMask sets the imap.LogMask of the protocol log of the client, which
+// is written to its logger on Debug level, with the credentials redacted.
+func WithLogMask(mask imap.LogMask) Option {
+	return func(c *client) { c.logMask, c.logMaskSet = mask, true }
+}
+
+// WithAuth sets the username and password used for authentication.
+func WithAuth(username, password string) Option {
+	return func(c *client) { c.username, c.password = username, password }
+}
+
+// WithoutCompression disables COMPRESS=DEFLATE.
+func WithoutCompression() Option {
+	return func(c *client) { c.noCompress = true }
+}
+
+// WithCompression sets the deflate level of COMPRESS=DEFLATE -
+// flate.BestSpeed (1) to flate.BestCompression (9); CompressLevel by default.
+// flate.NoCompression (0) disables compression, as WithoutCompression.
+func WithCompression(level int) Option {
+	return func(c *client) {
+		c.noCompress = level == flate.NoCompression
+		c.compressLevel = level
+	}
+}
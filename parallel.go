@@ -0,0 +1,92 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"sort"
+	"sync"
+)
+
+// ScanParallel splits the not deleted messages of mbox into n ranges of
+// consecutive UIDs, and calls fn with each range, concurrently, on its own
+// connection of the pool (with mbox selected) - n is p.Size() if not positive.
+//
+// fn returns the UIDs it has found (for example the messages failing an audit),
+// and ScanParallel returns them merged, in increasing order.
+// All the ranges are processed even if some fail; the first error is returned.
+func (p *Pool) ScanParallel(mbox string, n int, fn func(c Client, uids []uint32) ([]uint32, error)) ([]uint32, error) {
+	var uids []uint32
+	if err := p.Do(func(c Client) error {
+		var err error
+		uids, err = c.List(mbox, "", true)
+		return err
+	}); err != nil || len(uids) == 0 {
+		return nil, err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	shards := splitUIDs(uids, n, p.Size())
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		found    []uint32
+		firstErr error
+	)
+	for _, shard := range shards {
+		wg.Add(1)
+		go func(shard []uint32) {
+			defer wg.Done()
+			err := p.Do(func(c Client) error {
+				if err := c.Select(mbox); err != nil {
+					return err
+				}
+				res, err := fn(c, shard)
+				mu.Lock()
+				found = append(found, res...)
+				mu.Unlock()
+				return err
+			})
+			if err != nil {
+				Log.Error("ScanParallel", "mbox", mbox, "first", shard[0], "last", shard[len(shard)-1], "error", err)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(shard)
+	}
+	wg.Wait()
+	sort.Slice(found, func(i, j int) bool { return found[i] < found[j] })
+	return found, firstErr
+}
+
+// splitUIDs splits the sorted uids into n (size if n is not positive)
+// ranges of nearly equal length.
+func splitUIDs(uids []uint32, n, size int) [][]uint32 {
+	if n <= 0 {
+		n = size
+	}
+	if n > len(uids) {
+		n = len(uids)
+	}
+	shards := make([][]uint32, 0, n)
+	for i := 0; i < n; i++ {
+		shards = append(shards, uids[i*len(uids)/n:(i+1)*len(uids)/n])
+	}
+	return shards
+}
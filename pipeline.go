@@ -0,0 +1,179 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"io"
+	"sort"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// WithPipelining makes FetchMany and UpdateFlags issue up to depth commands
+// before reading their responses, instead of waiting for the completion of
+// each command before sending the next one - cutting the total latency on
+// high-RTT connections. A depth below 2 disables pipelining (the default).
+func WithPipelining(depth int) Option {
+	return func(c *client) { c.pipelining = depth }
+}
+
+// FlagUpdate is a flag change of some messages, for UpdateFlags.
+type FlagUpdate struct {
+	UIDs    []uint32
+	Keyword string
+	// Set adds the flag if true, removes it otherwise.
+	Set bool
+}
+
+// FlagUpdater is a Client which can apply many flag changes at once.
+type FlagUpdater interface {
+	Client
+	UpdateFlags(updates []FlagUpdate) error
+}
+
+var _ = FlagUpdater((*client)(nil))
+
+// UpdateFlags applies the flag changes with silent UID STOREs - pipelined
+// with WithPipelining, one after the other otherwise.
+func (c *client) UpdateFlags(updates []FlagUpdate) error {
+	c.enter()
+	defer c.leave()
+	sets := make([]*imap.SeqSet, 0, len(updates))
+	items := make([]FlagUpdate, 0, len(updates))
+	for _, u := range updates {
+		if len(u.UIDs) == 0 {
+			continue
+		}
+		set := &imap.SeqSet{}
+		set.AddNum(u.UIDs...)
+		sets, items = append(sets, set), append(items, u)
+	}
+	return c.retry("UpdateFlags", func() error {
+		return c.pipeline("UID STORE", len(items), func(i int) (*imap.Command, error) {
+			item := "+FLAGS.SILENT"
+			if !items[i].Set {
+				item = "-FLAGS.SILENT"
+			}
+			return c.c.UIDStore(sets[i], item, imap.Field(items[i].Keyword))
+		}, nil)
+	})
+}
+
+// fetchManyPipelined is FetchMany with the batches fetched by pipelined UID FETCHes.
+func (c *client) fetchManyPipelined(uids []uint32, fn func(uid uint32, r io.Reader) error) error {
+	pending := make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		pending[uid] = true
+	}
+	var fnErr error
+	err := c.retry("FetchMany", func() error {
+		// after a reconnect, fetch only the not yet delivered messages
+		rest := make([]uint32, 0, len(pending))
+		for uid := range pending {
+			rest = append(rest, uid)
+		}
+		sort.Slice(rest, func(i, j int) bool { return rest[i] < rest[j] })
+		batch := FetchBatchSize
+		if batch <= 0 {
+			batch = len(rest)
+		}
+		var sets []*imap.SeqSet
+		for len(rest) > 0 {
+			n := batch
+			if n > len(rest) {
+				n = len(rest)
+			}
+			set := &imap.SeqSet{}
+			set.AddNum(rest[:n]...)
+			sets, rest = append(sets, set), rest[n:]
+		}
+		return c.pipeline("UID FETCH", len(sets), func(i int) (*imap.Command, error) {
+			return c.c.UIDFetch(sets[i], "BODY.PEEK[]")
+		}, func(resp *imap.Response) error {
+			if resp.Label != "FETCH" {
+				return nil
+			}
+			info := resp.MessageInfo()
+			if !pending[info.UID] {
+				return nil
+			}
+			delete(pending, info.UID)
+			if fnErr = fn(info.UID, bytes.NewReader(imap.AsBytes(info.Attrs["BODY[]"]))); fnErr != nil {
+				return fnErr
+			}
+			return nil
+		})
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// pipeline sends n commands name with send (the i-th by send(i)), keeping at most
+// c.pipelining (at least one) of them in progress, and calls fn (if not nil)
+// with their data responses as they arrive.
+//
+// After the first error, no more commands are sent, but the ones in
+// progress are waited for. The first error is returned.
+func (c *client) pipeline(name string, n int, send func(i int) (*imap.Command, error), fn func(*imap.Response) error) error {
+	return c.intercept(name, func() error { return c.pipelineCommands(n, send, fn) })
+}
+
+func (c *client) pipelineCommands(n int, send func(i int) (*imap.Command, error), fn func(*imap.Response) error) error {
+	depth := c.pipelining
+	if depth < 1 {
+		depth = 1
+	}
+	var firstErr error
+	inflight := make([]*imap.Command, 0, depth)
+	for next := 0; ; {
+		for ; next < n && len(inflight) < depth && firstErr == nil; next++ {
+			cmd, err := send(next)
+			if err != nil {
+				firstErr = classify("", nil, err)
+				break
+			}
+			inflight = append(inflight, cmd)
+		}
+		kept := inflight[:0]
+		for _, cmd := range inflight {
+			for _, resp := range cmd.Data {
+				if fn != nil && firstErr == nil {
+					firstErr = fn(resp)
+				}
+			}
+			cmd.Data = nil
+			if cmd.InProgress() {
+				kept = append(kept, cmd)
+			} else if _, err := cmd.Result(imap.OK); err != nil && firstErr == nil {
+				firstErr = classify("", nil, err)
+			}
+		}
+		inflight = kept
+		if len(inflight) == 0 {
+			if next >= n || firstErr != nil {
+				return firstErr
+			}
+			continue
+		}
+		if err := c.c.Recv(c.readTimeout()); err != nil {
+			return classify("", ErrConnection, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPoolClosed is returned by Pool.Get after Pool.Close.
+var ErrPoolClosed = errors.New("pool is closed")
+
+// Pool maintains at most Size authenticated connections to the same account,
+// and hands them out for concurrent use - each Client is used by one goroutine at a time.
+type Pool struct {
+	newClient func() Client
+	sem       chan struct{}
+	idle      chan Client
+	// done is closed by Close, waking up the waiting Gets
+	done chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewPool returns a Pool of at most size connections, created by newClient
+// (which should return a not connected Client, such as NewClient).
+func NewPool(size int, newClient func() Client) *Pool {
+	if size <= 0 {
+		size = 1
+	}
+	return &Pool{
+		newClient: newClient,
+		sem:       make(chan struct{}, size),
+		idle:      make(chan Client, size),
+		done:      make(chan struct{}),
+	}
+}
+
+// Size returns the maximum number of connections.
+func (p *Pool) Size() int {
+	return cap(p.sem)
+}
+
+// Get returns an idle connection, or connects a new one if there are less
+// than Size connections - waits for a Put otherwise.
+//
+// Returns ErrPoolClosed if the pool is closed, also while waiting.
+func (p *Pool) Get() (Client, error) {
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+	select {
+	case c := <-p.idle:
+		return p.got(c)
+	default:
+	}
+	select {
+	case c := <-p.idle:
+		return p.got(c)
+	case p.sem <- struct{}{}:
+	case <-p.done:
+		return nil, ErrPoolClosed
+	}
+	if p.isClosed() {
+		<-p.sem
+		return nil, ErrPoolClosed
+	}
+	c := p.newClient()
+	if err := c.Connect(); err != nil {
+		<-p.sem
+		return nil, err
+	}
+	return c, nil
+}
+
+// got returns the idle connection c, closing it if the pool has been closed meanwhile.
+func (p *Pool) got(c Client) (Client, error) {
+	if p.isClosed() {
+		p.Discard(c)
+		return nil, ErrPoolClosed
+	}
+	return c, nil
+}
+
+// Put gives back the connection got from Get.
+func (p *Pool) Put(c Client) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.Discard(c)
+		return
+	}
+	// does not block: there are at most Size connections
+	p.idle <- c
+	p.mu.Unlock()
+}
+
+// Discard closes the (possibly broken) connection got from Get,
+// making room for a new one.
+func (p *Pool) Discard(c Client) {
+	if err := c.Close(false); err != nil {
+		Log.Warn("Discard", "client", c, "error", err)
+	}
+	<-p.sem
+}
+
+// Do calls fn with a connection from the pool. The connection is discarded
+// if fn returns a connection error, and given back otherwise.
+func (p *Pool) Do(fn func(Client) error) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	if isConnError(err) {
+		p.Discard(c)
+	} else {
+		p.Put(c)
+	}
+	return err
+}
+
+// Close closes the idle connections; the ones in use are closed when given back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+	var firstErr error
+	for {
+		select {
+		case c := <-p.idle:
+			if err := c.Close(false); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			<-p.sem
+		default:
+			return firstErr
+		}
+	}
+}
+
+func (p *Pool) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conn is a POP3 (RFC 1939) protocol connection.
+type conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	// greeting is the text of the server greeting, with the APOP timestamp.
+	greeting string
+	caps     map[string]bool
+	isTLS    bool
+}
+
+// respError is a -ERR response of the server.
+type respError struct {
+	Cmd, Info string
+}
+
+func (e *respError) Error() string {
+	return e.Cmd + ": -ERR " + e.Info
+}
+
+// code returns the extended response code (RFC 2449), such as "AUTH" or "IN-USE".
+func (e *respError) code() string {
+	if !strings.HasPrefix(e.Info, "[") {
+		return ""
+	}
+	if i := strings.IndexByte(e.Info, ']'); i > 0 {
+		return strings.ToUpper(e.Info[1:i])
+	}
+	return ""
+}
+
+func newConn(nc net.Conn, timeout time.Duration) (*conn, error) {
+	c := &conn{nc: nc, r: bufio.NewReader(nc), timeout: timeout}
+	_, isTLS := nc.(*tls.Conn)
+	c.isTLS = isTLS
+	c.deadline()
+	greeting, err := c.status("greeting")
+	if err != nil {
+		return nil, err
+	}
+	c.greeting = greeting
+	return c, nil
+}
+
+func (c *conn) deadline() {
+	if c.timeout > 0 {
+		c.nc.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// status reads a status response line, returning its text after +OK.
+func (c *conn) status(cmd string) (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	switch {
+	case strings.HasPrefix(line, "+OK"):
+		return strings.TrimSpace(line[3:]), nil
+	case strings.HasPrefix(line, "-ERR"):
+		return "", &respError{Cmd: cmd, Info: strings.TrimSpace(line[4:])}
+	}
+	return "", fmt.Errorf("%s: bad response %q", cmd, line)
+}
+
+// cmd sends the command, and returns the text of the status response.
+func (c *conn) cmd(name string, args ...string) (string, error) {
+	c.deadline()
+	line := name
+	if len(args) != 0 {
+		line += " " + strings.Join(args, " ")
+	}
+	if _, err := io.WriteString(c.nc, line+"\r\n"); err != nil {
+		return "", err
+	}
+	return c.status(name)
+}
+
+// multi sends the command, and copies its multi-line response, dot-unstuffed
+// and with CRLF line endings, to w.
+func (c *conn) multi(w io.Writer, name string, args ...string) (int64, error) {
+	if _, err := c.cmd(name, args...); err != nil {
+		return 0, err
+	}
+	var n int64
+	var werr error
+	write := func(p []byte) {
+		if werr == nil {
+			_, werr = w.Write(p)
+		}
+		n += int64(len(p))
+	}
+	mid := false // in the middle of a long line
+	for {
+		c.deadline()
+		line, err := c.r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !mid && line[0] == '.' {
+				line = line[1:]
+			}
+			write(line)
+			mid = true
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if !mid {
+			if bytes.Equal(line, []byte(".\r\n")) || bytes.Equal(line, []byte(".\n")) {
+				return n, werr
+			}
+			if line[0] == '.' {
+				line = line[1:]
+			}
+		}
+		mid = false
+		if line = bytes.TrimRight(line, "\r\n"); len(line) != 0 {
+			write(line)
+		}
+		write(crlf)
+	}
+}
+
+var crlf = []byte("\r\n")
+
+// lines sends the command, and returns the lines of its multi-line response.
+func (c *conn) lines(name string, args ...string) ([]string, error) {
+	var buf bytes.Buffer
+	if _, err := c.multi(&buf, name, args...); err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n"), nil
+}
+
+// capa reads the capabilities (RFC 2449); servers without CAPA have none.
+func (c *conn) capa() {
+	c.caps = make(map[string]bool)
+	lines, err := c.lines("CAPA")
+	if err != nil {
+		return
+	}
+	for _, line := range lines {
+		if f := strings.Fields(line); len(f) != 0 {
+			c.caps[strings.ToUpper(f[0])] = true
+		}
+	}
+}
+
+// startTLS upgrades the connection with STLS (RFC 2595).
+func (c *conn) startTLS(config *tls.Config) error {
+	if _, err := c.cmd("STLS"); err != nil {
+		return err
+	}
+	tc := tls.Client(c.nc, config)
+	c.deadline()
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.nc, c.r, c.isTLS = tc, bufio.NewReader(tc), true
+	c.capa()
+	return nil
+}
+
+// login authenticates with APOP if the server offers it on an unencrypted
+// connection, USER and PASS otherwise.
+func (c *conn) login(username, password string) error {
+	if !c.isTLS {
+		if i, j := strings.IndexByte(c.greeting, '<'), strings.LastIndexByte(c.greeting, '>'); i >= 0 && j > i {
+			sum := md5.Sum([]byte(c.greeting[i:j+1] + password))
+			_, err := c.cmd("APOP", username, hex.EncodeToString(sum[:]))
+			return err
+		}
+	}
+	if _, err := c.cmd("USER", username); err != nil {
+		return err
+	}
+	_, err := c.cmd("PASS", password)
+	return err
+}
+
+// list returns the sizes of the messages, by message number.
+func (c *conn) list() (map[uint32]uint32, error) {
+	lines, err := c.lines("LIST")
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[uint32]uint32, len(lines))
+	for _, line := range lines {
+		num, size, err := parsePair(line)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseUint(size, 10, 32)
+		if err != nil {
+			continue
+		}
+		sizes[num] = uint32(n)
+	}
+	return sizes, nil
+}
+
+// parsePair parses a "msgnum value" scan listing line.
+func parsePair(line string) (uint32, string, error) {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return 0, "", errors.New("bad scan listing " + strconv.Quote(line))
+	}
+	num, err := strconv.ParseUint(f[0], 10, 32)
+	return uint32(num), f[1], err
+}
+
+func num(n uint32) string {
+	return strconv.FormatUint(uint64(n), 10)
+}
+
+// quit ends the session - the server removes the DELEted messages.
+func (c *conn) quit() error {
+	_, err := c.cmd("QUIT")
+	if cerr := c.nc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
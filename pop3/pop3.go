@@ -0,0 +1,953 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pop3 implements imapclient.Client over POP3 (RFC 1939), for the
+// providers which do not offer IMAP, so a DeliveryLoop can drain them.
+//
+// POP3 has only one mailbox (INBOX), and no flags: the flags are kept in
+// memory for the session only, and the UIDs are the message numbers of the
+// session (UIDVALIDITY changes with every Connect). The \Deleted messages are
+// removed on Close(true), Expunge or ExpungeAll.
+//
+// As the flags do not survive the session, marking a message \Seen (or
+// moving a seen message out of INBOX) marks it \Deleted, too: the messages
+// delivered by a DeliveryLoop are removed on its Close(true), instead of
+// being delivered again in the next round.
+package pop3
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+	"github.com/tgulacsi/imapclient"
+)
+
+// Inbox is the only mailbox of a POP3 server.
+const Inbox = "INBOX"
+
+var errNotConnected = errors.New("not connected")
+
+var _ = imapclient.Client((*client)(nil))
+
+type client struct {
+	host, username, password string
+	port                     int
+	logger                   imapclient.Logger
+
+	mu          sync.Mutex
+	c           *conn
+	sizes       map[uint32]uint32
+	flags       map[uint32]imap.FlagSet
+	uidValidity uint32
+	selected    string
+	logMask     imap.LogMask
+}
+
+// NewClient returns a new (not connected) POP3 Client, using TLS from the
+// start iff port is 995 (the default), with STLS if the server supports it otherwise.
+func NewClient(host string, port int, username, password string) imapclient.Client {
+	if port == 0 {
+		port = 995
+	}
+	return &client{host: host, port: port, username: username, password: password, logger: imapclient.Log}
+}
+
+// String returns the connection parameters.
+func (c *client) String() string {
+	return "pop3://" + c.username + "@" + c.host + ":" + strconv.Itoa(c.port)
+}
+
+// Connect to the server, and log in.
+func (c *client) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c != nil {
+		c.c.nc.Close()
+		c.c = nil
+	}
+	addr := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	d := &net.Dialer{Timeout: imapclient.Timeout}
+	var nc net.Conn
+	var err error
+	if c.port == 995 {
+		nc, err = tls.DialWithDialer(d, "tcp", addr, c.tlsConfig())
+	} else {
+		nc, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return classify("Connect", imapclient.ErrConnection, err)
+	}
+	pc, err := newConn(nc, imapclient.Timeout)
+	if err != nil {
+		nc.Close()
+		return classify("Connect", imapclient.ErrConnection, err)
+	}
+	c.logger.Debug("Server says", "hello", pc.greeting)
+	pc.capa()
+	if !pc.isTLS && pc.caps["STLS"] {
+		if err = pc.startTLS(c.tlsConfig()); err != nil {
+			nc.Close()
+			return classify("STLS", imapclient.ErrConnection, err)
+		}
+	}
+	if err = pc.login(c.username, c.password); err != nil {
+		pc.nc.Close()
+		return classify("Login", imapclient.ErrAuth, err)
+	}
+	if c.sizes, err = pc.list(); err != nil {
+		pc.nc.Close()
+		return classify("LIST", imapclient.ErrConnection, err)
+	}
+	c.flags = make(map[uint32]imap.FlagSet, len(c.sizes))
+	for num := range c.sizes {
+		c.flags[num] = make(imap.FlagSet)
+	}
+	c.uidValidity = uint32(time.Now().Unix())
+	c.c, c.selected = pc, ""
+	return nil
+}
+
+func (c *client) tlsConfig() *tls.Config {
+	config := imapclient.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = c.host
+	}
+	return config
+}
+
+// classify returns err as an *imapclient.Error, of kind def if it is not
+// recognized from the extended response code (RFC 2449).
+func classify(op string, def, err error) error {
+	if err == nil {
+		return nil
+	}
+	kind := def
+	var re *respError
+	if errors.As(err, &re) {
+		switch re.code() {
+		case "AUTH":
+			kind = imapclient.ErrAuth
+		case "IN-USE", "LOGIN-DELAY", "SYS/TEMP":
+			kind = imapclient.ErrThrottled
+		}
+	} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		kind = imapclient.ErrConnection
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		kind = imapclient.ErrConnection
+	}
+	if kind == nil {
+		return err
+	}
+	return &imapclient.Error{Op: op, Kind: kind, Err: err}
+}
+
+// Close removes the \Deleted messages iff commit is true, then logs out.
+// With commit false, the messages removed by Expunge are kept, too.
+func (c *client) Close(commit bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		return nil
+	}
+	var err error
+	if commit {
+		err = c.expunge(c.deleted())
+	} else {
+		_, err = c.c.cmd("RSET")
+	}
+	if qerr := c.c.quit(); err == nil {
+		err = qerr
+	}
+	c.c, c.selected = nil, ""
+	return classify("Close", nil, err)
+}
+
+// check returns an error if mbox is not INBOX or the client is not connected.
+func (c *client) check(op, mbox string) error {
+	if !strings.EqualFold(mbox, Inbox) {
+		return notFound(op, mbox)
+	}
+	if c.c == nil {
+		return errNotConnected
+	}
+	c.selected = Inbox
+	return nil
+}
+
+func notFound(op, mbox string) error {
+	return &imapclient.Error{Op: op, Kind: imapclient.ErrMailboxNotFound,
+		Err: fmt.Errorf("%q: POP3 has only %s", mbox, Inbox)}
+}
+
+// message returns an error if the message does not exist.
+func (c *client) message(msgID uint32) error {
+	if c.c == nil {
+		return errNotConnected
+	}
+	if _, ok := c.sizes[msgID]; !ok {
+		return fmt.Errorf("no message %d", msgID)
+	}
+	return nil
+}
+
+// uids returns the message numbers, in ascending order.
+func (c *client) uids() []uint32 {
+	uids := make([]uint32, 0, len(c.sizes))
+	for num := range c.sizes {
+		uids = append(uids, num)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+// deleted returns the numbers of the \Deleted messages.
+func (c *client) deleted() []uint32 {
+	var uids []uint32
+	for _, num := range c.uids() {
+		if c.flags[num][`\Deleted`] {
+			uids = append(uids, num)
+		}
+	}
+	return uids
+}
+
+// List returns the UIDs of the messages whose subject contains pattern -
+// the not deleted ones iff all is true, the unseen ones otherwise.
+func (c *client) List(mbox, pattern string, all bool) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.search(mbox, listCriteria(pattern, all))
+}
+
+func listCriteria(pattern string, all bool) imapclient.SearchCriteria {
+	crit := imapclient.SearchCriteria{Subject: pattern}
+	if all {
+		crit.WithoutFlags = []string{`\Deleted`}
+	} else {
+		crit.WithoutFlags = []string{`\Seen`}
+	}
+	return crit
+}
+
+// ListWithInfo is like List, but returns the summaries of the messages,
+// read from their headers with TOP.
+func (c *client) ListWithInfo(mbox, pattern string, all bool) ([]imapclient.MessageInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uids, err := c.search(mbox, listCriteria(pattern, all))
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]imapclient.MessageInfo, 0, len(uids))
+	for _, uid := range uids {
+		hdr, err := c.header(uid)
+		if err != nil {
+			return infos, err
+		}
+		info := imapclient.MessageInfo{UID: uid, Size: c.sizes[uid], Flags: copyFlags(c.flags[uid]),
+			Subject: hdr.Get("Subject"), From: hdr.Get("From"), MessageID: hdr.Get("Message-Id")}
+		info.Date, _ = hdr.Date()
+		info.InternalDate = info.Date
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ListIter calls fn with the matching UIDs in imapclient.ListPageSize pages.
+func (c *client) ListIter(mbox, pattern string, all bool, fn func(uids []uint32) error) error {
+	c.mu.Lock()
+	uids, err := c.search(mbox, listCriteria(pattern, all))
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	size := imapclient.ListPageSize
+	if size <= 0 {
+		size = len(uids)
+	}
+	for len(uids) > 0 {
+		n := size
+		if n > len(uids) {
+			n = len(uids)
+		}
+		if err := fn(uids[:n:n]); err != nil {
+			return err
+		}
+		uids = uids[n:]
+	}
+	return nil
+}
+
+// ListSince lists the not deleted messages with a Date on or after the day of since.
+func (c *client) ListSince(mbox string, since time.Time) ([]uint32, error) {
+	return c.ListBetween(mbox, since, time.Time{})
+}
+
+// ListBetween lists the not deleted messages with a Date on or after the day
+// of from, and before the day of to.
+func (c *client) ListBetween(mbox string, from, to time.Time) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.search(mbox, imapclient.SearchCriteria{Since: from, Before: to, WithoutFlags: []string{`\Deleted`}})
+}
+
+// ListNewer lists the messages with UID above lastUID.
+func (c *client) ListNewer(mbox string, lastUID uint32) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("ListNewer", mbox); err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, uid := range c.uids() {
+		if uid > lastUID {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// inbox returns INBOX as a Mailbox.
+func (c *client) inbox() imapclient.Mailbox {
+	return imapclient.Mailbox{Name: Inbox, Attrs: imap.NewFlagSet(`\HasNoChildren`)}
+}
+
+// Mailboxes returns INBOX, if it matches pattern.
+func (c *client) Mailboxes(pattern string) ([]imapclient.Mailbox, error) {
+	if !imapclient.MatchMailbox(pattern, Inbox, "") {
+		return nil, nil
+	}
+	return []imapclient.Mailbox{c.inbox()}, nil
+}
+
+// MailboxTree returns the tree of INBOX.
+func (c *client) MailboxTree() (*imapclient.MailboxTree, error) {
+	return imapclient.NewMailboxTree([]imapclient.Mailbox{c.inbox()}), nil
+}
+
+// MailboxesStatus returns INBOX with its Status, if it matches pattern.
+func (c *client) MailboxesStatus(pattern string) ([]imapclient.Mailbox, error) {
+	mboxes, err := c.Mailboxes(pattern)
+	if err != nil || len(mboxes) == 0 {
+		return mboxes, err
+	}
+	if mboxes[0].Status, err = c.Status(Inbox); err != nil {
+		return nil, err
+	}
+	return mboxes, nil
+}
+
+// SubscribedMailboxes returns INBOX.
+func (c *client) SubscribedMailboxes() ([]imapclient.Mailbox, error) {
+	return []imapclient.Mailbox{c.inbox()}, nil
+}
+
+// CreateMailbox returns imap.NotAvailableError, as POP3 has only INBOX.
+func (c *client) CreateMailbox(mbox string) error {
+	if strings.EqualFold(mbox, Inbox) {
+		return nil
+	}
+	return imap.NotAvailableError("CREATE")
+}
+
+// DeleteMailbox returns imap.NotAvailableError, as POP3 has only INBOX.
+func (c *client) DeleteMailbox(mbox string) error {
+	return imap.NotAvailableError("DELETE")
+}
+
+// RenameMailbox returns imap.NotAvailableError, as POP3 has only INBOX.
+func (c *client) RenameMailbox(oldName, newName string) error {
+	return imap.NotAvailableError("RENAME")
+}
+
+// Subscribe succeeds for INBOX only.
+func (c *client) Subscribe(mbox string) error {
+	if !strings.EqualFold(mbox, Inbox) {
+		return notFound("Subscribe", mbox)
+	}
+	return nil
+}
+
+// Unsubscribe succeeds for INBOX only, without effect.
+func (c *client) Unsubscribe(mbox string) error {
+	if !strings.EqualFold(mbox, Inbox) {
+		return notFound("Unsubscribe", mbox)
+	}
+	return nil
+}
+
+// Status returns the counters of INBOX - unseen are the messages not read
+// in this session.
+func (c *client) Status(mbox string) (*imap.MailboxStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("Status", mbox); err != nil {
+		return nil, err
+	}
+	return c.status(), nil
+}
+
+func (c *client) status() *imap.MailboxStatus {
+	st := &imap.MailboxStatus{Name: Inbox, Messages: uint32(len(c.sizes)), UIDNext: 1, UIDValidity: c.uidValidity,
+		Flags: imap.NewFlagSet(`\Seen`, `\Answered`, `\Flagged`, `\Deleted`, `\Draft`), PermFlags: c.permFlags()}
+	for num := range c.sizes {
+		if !c.flags[num][`\Seen`] {
+			st.Unseen++
+		}
+		if num >= st.UIDNext {
+			st.UIDNext = num + 1
+		}
+	}
+	return st
+}
+
+// MessageCount returns the number of messages.
+func (c *client) MessageCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Messages), nil
+}
+
+// UnreadCount returns the number of messages not read in this session.
+func (c *client) UnreadCount(mbox string) (int, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return 0, err
+	}
+	return int(st.Unseen), nil
+}
+
+// Select selects mbox, which must be INBOX.
+func (c *client) Select(mbox string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.check("Select", mbox)
+}
+
+// Selected returns INBOX after the first mailbox operation, "" before.
+func (c *client) Selected() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.selected
+}
+
+// Search returns the UIDs of the messages matching crit, evaluated on the
+// client side: the header (with TOP) or the whole message (with RETR) is
+// read only if crit has conditions other than flags and size.
+// Raw search keys are ignored.
+func (c *client) Search(mbox string, crit imapclient.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.search(mbox, crit)
+}
+
+func (c *client) search(mbox string, crit imapclient.SearchCriteria) ([]uint32, error) {
+	if err := c.check("Search", mbox); err != nil {
+		return nil, err
+	}
+	// the header fields and the Date (instead of the internal date) need the header
+	rest := crit
+	rest.WithFlags, rest.WithoutFlags, rest.Larger, rest.Smaller = nil, nil, 0, 0
+	needBody := crit.NeedsBody()
+	needHeader := crit.NeedsHeader() || !crit.Since.IsZero() || !crit.Before.IsZero() ||
+		crit.Younger != 0 || crit.Older != 0
+	var uids []uint32
+	var buf bytes.Buffer
+	for _, uid := range c.uids() {
+		flags := c.flags[uid]
+		if !crit.MatchFlags(flags, c.sizes[uid]) {
+			continue
+		}
+		if needHeader {
+			buf.Reset()
+			var err error
+			if needBody {
+				_, err = c.c.multi(&buf, "RETR", num(uid))
+			} else {
+				_, err = c.c.multi(&buf, "TOP", num(uid), "0")
+			}
+			if err != nil {
+				return uids, classify("Search", nil, err)
+			}
+			var date time.Time
+			if msg, err := mail.ReadMessage(bytes.NewReader(buf.Bytes())); err == nil {
+				date, _ = msg.Header.Date()
+			}
+			if !rest.Match(buf.Bytes(), flags, date) {
+				continue
+			}
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// SearchPage returns the requested page of the UIDs matching crit, and their number.
+func (c *client) SearchPage(mbox string, crit imapclient.SearchCriteria, offset, limit int) ([]uint32, int, error) {
+	if offset < 0 || limit <= 0 {
+		return nil, 0, fmt.Errorf("bad page offset=%d limit=%d", offset, limit)
+	}
+	uids, err := c.Search(mbox, crit)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(uids)
+	if offset >= total {
+		return nil, total, nil
+	}
+	uids = uids[offset:]
+	if len(uids) > limit {
+		uids = uids[:limit]
+	}
+	return uids, total, nil
+}
+
+// Sort returns the UIDs of the messages matching search, ordered by the
+// criteria, reading the headers with TOP. The arrival is the Date header.
+func (c *client) Sort(mbox string, criteria []imapclient.SortKey, search imapclient.SearchCriteria) ([]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	uids, err := c.search(mbox, search)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]imapclient.SortMessage, 0, len(uids))
+	for _, uid := range uids {
+		hdr, err := c.header(uid)
+		if err != nil {
+			return nil, err
+		}
+		sm := imapclient.SortMessage{UID: uid, Size: c.sizes[uid], Header: hdr}
+		sm.InternalDate, _ = hdr.Date()
+		msgs = append(msgs, sm)
+	}
+	return imapclient.SortMessages(msgs, criteria), nil
+}
+
+// ReadTo writes the message to w with RETR.
+func (c *client) ReadTo(w io.Writer, msgID uint32) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readTo(w, msgID)
+}
+
+func (c *client) readTo(w io.Writer, msgID uint32) (int64, error) {
+	if err := c.message(msgID); err != nil {
+		return 0, err
+	}
+	n, err := c.c.multi(w, "RETR", num(msgID))
+	if err != nil {
+		return n, classify("ReadTo", nil, err)
+	}
+	return n, nil
+}
+
+// FetchMany calls fn with the body of each message, in the order of uids.
+func (c *client) FetchMany(uids []uint32, fn func(uid uint32, r io.Reader) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var buf bytes.Buffer
+	for _, uid := range uids {
+		buf.Reset()
+		if _, err := c.readTo(&buf, uid); err != nil {
+			return err
+		}
+		if err := fn(uid, bytes.NewReader(buf.Bytes())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetFlags returns the flags of the message, set in this session.
+func (c *client) GetFlags(msgID uint32) (imap.FlagSet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.message(msgID); err != nil {
+		return nil, err
+	}
+	return copyFlags(c.flags[msgID]), nil
+}
+
+func copyFlags(flags imap.FlagSet) imap.FlagSet {
+	cp := make(imap.FlagSet, len(flags))
+	for f, ok := range flags {
+		if ok {
+			cp[f] = true
+		}
+	}
+	return cp
+}
+
+// GetSize returns the size of the message, as listed by LIST.
+func (c *client) GetSize(msgID uint32) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.message(msgID); err != nil {
+		return 0, err
+	}
+	return c.sizes[msgID], nil
+}
+
+// header reads the header of the message with TOP.
+func (c *client) header(msgID uint32) (mail.Header, error) {
+	if err := c.message(msgID); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := c.c.multi(&buf, "TOP", num(msgID), "0"); err != nil {
+		return nil, classify("TOP", nil, err)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\r\n\r\n")) {
+		buf.WriteString("\r\n")
+	}
+	msg, err := mail.ReadMessage(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
+
+// GetHeaders returns the parsed header of the message, read with TOP.
+func (c *client) GetHeaders(msgID uint32) (textproto.MIMEHeader, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hdr, err := c.header(msgID)
+	return textproto.MIMEHeader(hdr), err
+}
+
+// FetchHeaderFields returns the given fields of the header of the message.
+func (c *client) FetchHeaderFields(msgID uint32, fields []string) (textproto.MIMEHeader, error) {
+	hdr, err := c.GetHeaders(msgID)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make(textproto.MIMEHeader, len(fields))
+	for _, f := range fields {
+		k := textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(f))
+		if vv, ok := hdr[k]; ok {
+			filtered[k] = vv
+		}
+	}
+	return filtered, nil
+}
+
+// GetEnvelope returns the envelope built from the header of the message.
+func (c *client) GetEnvelope(msgID uint32) (*imapclient.Envelope, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hdr, err := c.header(msgID)
+	if err != nil {
+		return nil, err
+	}
+	return imapclient.HeaderEnvelope(hdr), nil
+}
+
+// ListKeywords returns the keywords of the message set in this session, sorted.
+func (c *client) ListKeywords(msgID uint32) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.message(msgID); err != nil {
+		return nil, err
+	}
+	kws := make([]string, 0, len(c.flags[msgID]))
+	for f, ok := range c.flags[msgID] {
+		if ok && !strings.HasPrefix(f, `\`) {
+			kws = append(kws, f)
+		}
+	}
+	sort.Strings(kws)
+	return kws, nil
+}
+
+// PermanentFlags returns \Deleted only: the other flags are lost on Close.
+func (c *client) PermanentFlags(mbox string) (imap.FlagSet, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.check("PermanentFlags", mbox); err != nil {
+		return nil, err
+	}
+	return c.permFlags(), nil
+}
+
+func (c *client) permFlags() imap.FlagSet {
+	return imap.NewFlagSet(`\Deleted`)
+}
+
+// SetFlag sets (or unsets) the flag on the message, for this session.
+func (c *client) SetFlag(msgID uint32, keyword string, st bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setFlag(msgID, keyword, st)
+}
+
+func (c *client) setFlag(msgID uint32, keyword string, st bool) error {
+	if err := c.message(msgID); err != nil {
+		return err
+	}
+	if st {
+		c.flags[msgID][keyword] = true
+	} else {
+		delete(c.flags[msgID], keyword)
+	}
+	if keyword == `\Seen` { // seen means downloaded: removed on commit
+		c.setFlag(msgID, `\Deleted`, st)
+	}
+	return nil
+}
+
+// SetFlagRegex sets (or unsets) the flags of the message matching regex.
+func (c *client) SetFlagRegex(msgID uint32, regex string, st bool) error {
+	rex, err := regexp.Compile(regex)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.message(msgID); err != nil {
+		return err
+	}
+	for flag := range c.flags[msgID] {
+		if rex.MatchString(flag) {
+			c.setFlag(msgID, flag, st)
+		}
+	}
+	return nil
+}
+
+// SetFlags sets (or unsets) the flag on the messages.
+func (c *client) SetFlags(uids []uint32, keyword string, st bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.setFlag(uid, keyword, st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetFlagsSilent is SetFlags.
+func (c *client) SetFlagsSilent(uids []uint32, keyword string, st bool) error {
+	return c.SetFlags(uids, keyword, st)
+}
+
+// ReplaceFlags replaces the flags of the message.
+func (c *client) ReplaceFlags(msgID uint32, flags []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.message(msgID); err != nil {
+		return err
+	}
+	c.flags[msgID] = imap.NewFlagSet(flags...)
+	return nil
+}
+
+// MarkSeen sets \Seen (and \Deleted) on the message.
+func (c *client) MarkSeen(msgID uint32) error { return c.SetFlag(msgID, `\Seen`, true) }
+
+// MarkSeenAll sets \Seen (and \Deleted) on the messages.
+func (c *client) MarkSeenAll(uids []uint32) error { return c.SetFlags(uids, `\Seen`, true) }
+
+// MarkUnseen unsets \Seen (and \Deleted) on the message.
+func (c *client) MarkUnseen(msgID uint32) error { return c.SetFlag(msgID, `\Seen`, false) }
+
+// MarkDeleted sets \Deleted on the message: it is removed on Close(true).
+func (c *client) MarkDeleted(msgID uint32) error { return c.SetFlag(msgID, `\Deleted`, true) }
+
+// MarkUndeleted unsets \Deleted on the message.
+func (c *client) MarkUndeleted(msgID uint32) error { return c.SetFlag(msgID, `\Deleted`, false) }
+
+// MarkAnswered sets \Answered on the message.
+func (c *client) MarkAnswered(msgID uint32) error { return c.SetFlag(msgID, `\Answered`, true) }
+
+// MarkFlagged sets \Flagged on the message.
+func (c *client) MarkFlagged(msgID uint32) error { return c.SetFlag(msgID, `\Flagged`, true) }
+
+// MarkUnflagged unsets \Flagged on the message.
+func (c *client) MarkUnflagged(msgID uint32) error { return c.SetFlag(msgID, `\Flagged`, false) }
+
+// MarkDraft sets \Draft on the message.
+func (c *client) MarkDraft(msgID uint32) error { return c.SetFlag(msgID, `\Draft`, true) }
+
+// DeleteMany sets \Deleted on the messages, and removes them with DELE if expunge is true.
+func (c *client) DeleteMany(uids []uint32, expunge bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.setFlag(uid, `\Deleted`, true); err != nil {
+			return err
+		}
+	}
+	if !expunge {
+		return nil
+	}
+	return c.expunge(uids)
+}
+
+// Delete removes the message with DELE if permanent, sets \Deleted on it
+// otherwise - POP3 has no Trash.
+func (c *client) Delete(msgID uint32, permanent bool) error {
+	return c.DeleteMany([]uint32{msgID}, permanent)
+}
+
+// Move is MoveMany of one message.
+func (c *client) Move(msgID uint32, mbox string) error {
+	return c.MoveMany([]uint32{msgID}, mbox)
+}
+
+// MoveMany marks the (seen, so downloaded) messages \Deleted, as POP3 has
+// only INBOX: they are removed on Close(true), like the Outbox of a
+// DeliveryLoop. Moving an unseen message out of INBOX returns an
+// ErrMailboxNotFound error, so it is kept; moving to INBOX is a no-op.
+func (c *client) MoveMany(uids []uint32, mbox string) error {
+	if strings.EqualFold(mbox, Inbox) {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, uid := range uids {
+		if err := c.message(uid); err != nil {
+			return err
+		}
+		if !c.flags[uid][`\Seen`] {
+			return notFound("Move", mbox)
+		}
+	}
+	for _, uid := range uids {
+		c.setFlag(uid, `\Deleted`, true)
+	}
+	return nil
+}
+
+// SpecialUse returns an ErrMailboxNotFound error, as POP3 has only INBOX.
+func (c *client) SpecialUse(use string) (string, error) {
+	return "", &imapclient.Error{Op: "SpecialUse", Kind: imapclient.ErrMailboxNotFound,
+		Err: errors.New("no " + use + " mailbox in POP3")}
+}
+
+// MoveToTrash returns an ErrMailboxNotFound error, as POP3 has no Trash.
+func (c *client) MoveToTrash(uids ...uint32) error {
+	_, err := c.SpecialUse(imapclient.UseTrash)
+	return err
+}
+
+// MoveToJunk returns an ErrMailboxNotFound error, as POP3 has no Junk.
+func (c *client) MoveToJunk(uids ...uint32) error {
+	_, err := c.SpecialUse(imapclient.UseJunk)
+	return err
+}
+
+// Append returns imap.NotAvailableError: POP3 cannot store messages.
+func (c *client) Append(mbox string, flags []string, date time.Time, r io.Reader) (uint32, error) {
+	return 0, imap.NotAvailableError("APPEND")
+}
+
+// Expunge removes the messages with DELE, or the \Deleted ones if no UID is given.
+func (c *client) Expunge(uids ...uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		return errNotConnected
+	}
+	if len(uids) == 0 {
+		uids = c.deleted()
+	}
+	return c.expunge(uids)
+}
+
+// ExpungeAll removes all the \Deleted messages with DELE.
+func (c *client) ExpungeAll() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		return errNotConnected
+	}
+	return c.expunge(c.deleted())
+}
+
+func (c *client) expunge(uids []uint32) error {
+	for _, uid := range uids {
+		if err := c.message(uid); err != nil {
+			return err
+		}
+		if _, err := c.c.cmd("DELE", num(uid)); err != nil {
+			return classify("DELE", nil, err)
+		}
+		delete(c.sizes, uid)
+		delete(c.flags, uid)
+	}
+	return nil
+}
+
+// Check sends a NOOP.
+func (c *client) Check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		return errNotConnected
+	}
+	_, err := c.c.cmd("NOOP")
+	return classify("NOOP", nil, err)
+}
+
+// SetLogMask just stores the mask: there is no protocol log.
+func (c *client) SetLogMask(mask imap.LogMask) imap.LogMask {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.logMask
+	c.logMask = mask
+	return old
+}
+
+// Capabilities returns the capabilities listed by CAPA, after Connect.
+func (c *client) Capabilities() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.c == nil {
+		return nil
+	}
+	caps := make(map[string]bool, len(c.c.caps))
+	for k, v := range c.c.caps {
+		caps[k] = v
+	}
+	return caps
+}
+
+// Supports reports whether the server listed the capability with CAPA.
+func (c *client) Supports(capability string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.c != nil && c.c.caps[strings.ToUpper(capability)]
+}
+
+// Compressed returns false: POP3 has no compression.
+func (c *client) Compressed() bool { return false }
@@ -0,0 +1,68 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"io"
+)
+
+// Progress is the state of a transfer, reported to the WithProgress callback.
+type Progress struct {
+	// UID is the message being transferred.
+	UID uint32
+	// Received is the number of bytes received of the message,
+	// Total is its size (RFC822.SIZE) - zero if unknown.
+	Received, Total int64
+	// Message is the (1-based) index of the message, Messages is the
+	// number of messages requested by FetchMany (1 with ReadTo).
+	Message, Messages int
+}
+
+// WithProgress makes ReadTo call fn after each chunk (see ReadChunkSize) of
+// the message, and FetchMany after each message - for progress bars, and for
+// detecting stalled transfers earlier than the read timeout.
+// fn is called synchronously, so it must be quick, and must not call the Client.
+func WithProgress(fn func(Progress)) Option {
+	return func(c *client) { c.progress = fn }
+}
+
+// reportProgress calls the progress callback, if set.
+func (c *client) reportProgress(p Progress) {
+	if c.progress != nil {
+		c.progress(p)
+	}
+}
+
+// progressFetch wraps the callback of FetchMany of n messages, to report the
+// progress after each message.
+func (c *client) progressFetch(n int, fn func(uid uint32, r io.Reader) error) func(uid uint32, r io.Reader) error {
+	if c.progress == nil {
+		return fn
+	}
+	var done int
+	return func(uid uint32, r io.Reader) error {
+		err := fn(uid, r)
+		done++
+		var size int64
+		if br, ok := r.(*bytes.Reader); ok {
+			size = br.Size()
+		}
+		c.reportProgress(Progress{UID: uid, Received: size, Total: size, Message: done, Messages: n})
+		return err
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithProxy connects through the given proxy: socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port (HTTP CONNECT).
+func WithProxy(u *url.URL) Option {
+	return func(c *client) { c.proxy = u }
+}
+
+// WithProxyFromEnvironment connects through the proxy specified in the
+// ALL_PROXY (or all_proxy) environment variable, unless the host is
+// listed in NO_PROXY (or no_proxy).
+func WithProxyFromEnvironment() Option {
+	return func(c *client) { c.proxyFromEnv = true }
+}
+
+// proxyFromEnvironment returns the proxy URL for host from the environment,
+// or nil if no proxy should be used.
+func proxyFromEnvironment(host string) (*url.URL, error) {
+	proxy := getenvAny("ALL_PROXY", "all_proxy")
+	if proxy == "" {
+		return nil, nil
+	}
+	for _, np := range strings.Split(getenvAny("NO_PROXY", "no_proxy"), ",") {
+		if np = strings.TrimSpace(np); np == "" {
+			continue
+		}
+		if np == "*" || host == strings.TrimPrefix(np, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(np, ".")) {
+			return nil, nil
+		}
+	}
+	return url.Parse(proxy)
+}
+
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// proxyDialer dials through a SOCKS5 or HTTP CONNECT proxy.
+type proxyDialer struct {
+	proxy   *url.URL
+	forward Dialer
+	timeout time.Duration
+}
+
+// Dial connects to the proxy with the forward Dialer, and asks it to connect to addr.
+func (d proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	proxyAddr := d.proxy.Host
+	if d.proxy.Port() == "" {
+		switch d.proxy.Scheme {
+		case "socks5", "socks5h":
+			proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "1080")
+		case "http":
+			proxyAddr = net.JoinHostPort(d.proxy.Hostname(), "80")
+		}
+	}
+	raw, err := d.forward.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if d.timeout > 0 {
+		raw.SetDeadline(time.Now().Add(d.timeout))
+	}
+	conn := raw
+	switch d.proxy.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(raw, d.proxy.User, addr)
+	case "http":
+		conn, err = httpConnect(raw, d.proxy.User, addr)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %q", d.proxy.Scheme)
+	}
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Connect does the RFC 1928 handshake, with RFC 1929 username/password
+// authentication if user is not nil.
+func socks5Connect(conn net.Conn, user *url.Userinfo, addr string) error {
+	host, portS, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portS, 10, 16)
+	if err != nil {
+		return err
+	}
+	if len(host) > 255 {
+		return errors.New("socks5: host name too long")
+	}
+
+	method := byte(0x00) // no authentication
+	if user != nil {
+		method = 0x02 // username/password
+	}
+	if _, err = conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != 5 || resp[1] != method {
+		return fmt.Errorf("socks5: authentication method %d refused", method)
+	}
+	if user != nil {
+		password, _ := user.Password()
+		username := user.Username()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		req := append([]byte{1, byte(len(username))}, username...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, resp[:]); err != nil {
+			return err
+		}
+		if resp[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	req := append([]byte{5, 1, 0, 3, byte(len(host))}, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	var hdr [4]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != 0 {
+		return fmt.Errorf("socks5: connect to %s failed with code %d", addr, hdr[1])
+	}
+	var skip int
+	switch hdr[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err = io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", hdr[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+// httpConnect asks the HTTP proxy to CONNECT to addr.
+func httpConnect(conn net.Conn, user *url.Userinfo, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 { // the server greeting may already be here
+		return bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn which reads through a bufio.Reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
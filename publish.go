@@ -0,0 +1,86 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Publisher publishes the messages to a message broker; see the mq/kafka,
+// mq/amqp and mq/nats packages for the implementations.
+type Publisher interface {
+	// Publish returns after the broker has confirmed (persisted) the message.
+	Publish(ctx context.Context, body []byte, info DeliveryInfo) error
+}
+
+// PublishTimeout is the timeout of the publishing of one message by
+// PublishDeliverFunc, including the broker confirm - 30 seconds by default.
+var PublishTimeout = 30 * time.Second
+
+// PublishDeliverFunc returns a MessageDeliverFunc (for Loop.DeliverMessage),
+// which publishes the messages with p: as Publish returns only after the
+// broker has confirmed the message, it is marked as seen (acknowledged on
+// the IMAP side) only when the broker has it.
+func PublishDeliverFunc(p Publisher) MessageDeliverFunc {
+	return func(r io.ReadSeeker, info DeliveryInfo) error {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+		defer cancel()
+		return p.Publish(ctx, body, info)
+	}
+}
+
+// MessageHeaders returns the metadata of the message as broker message
+// headers: Imap-Mailbox, Imap-Uidvalidity, Imap-Uid, Message-Hash (hex),
+// Message-Id, From, Subject and Date (RFC 3339); the empty ones are omitted.
+func MessageHeaders(info DeliveryInfo) map[string]string {
+	hdr := map[string]string{"Imap-Uid": strconv.FormatUint(uint64(info.UID), 10)}
+	for k, v := range map[string]string{
+		"Imap-Mailbox": info.Mailbox,
+		"Message-Hash": hex.EncodeToString(info.Hash),
+		"Message-Id":   info.MessageID,
+		"From":         info.From,
+		"Subject":      info.Subject,
+	} {
+		if v != "" {
+			hdr[k] = v
+		}
+	}
+	if info.UIDValidity != 0 {
+		hdr["Imap-Uidvalidity"] = strconv.FormatUint(uint64(info.UIDValidity), 10)
+	}
+	if !info.Date.IsZero() {
+		hdr["Date"] = info.Date.Format(time.RFC3339)
+	}
+	return hdr
+}
+
+// MessageKey returns the partitioning / deduplication key of the message:
+// its Message-ID, or its hash (hex) if it has none.
+func MessageKey(info DeliveryInfo) string {
+	if info.MessageID != "" {
+		return info.MessageID
+	}
+	return hex.EncodeToString(info.Hash)
+}
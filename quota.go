@@ -0,0 +1,110 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// QuotaClient is a Client which can query the quotas (RFC 2087).
+type QuotaClient interface {
+	Client
+	GetQuota(root string) ([]Quota, error)
+	GetQuotaRoot(mbox string) (map[string][]Quota, error)
+}
+
+// Quota is the usage and limit of a resource, such as STORAGE (in KiB)
+// or MESSAGE (number of messages).
+type Quota struct {
+	Resource     string
+	Usage, Limit uint64
+}
+
+// Ratio returns Usage/Limit, 0 if there is no limit.
+func (q Quota) Ratio() float64 {
+	if q.Limit == 0 {
+		return 0
+	}
+	return float64(q.Usage) / float64(q.Limit)
+}
+
+// GetQuota returns the resource usages and limits of the quota root.
+//
+// Returns imap.NotAvailableError if the server does not support QUOTA.
+func (c *client) GetQuota(root string) ([]Quota, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["QUOTA"] {
+		return nil, imap.NotAvailableError("QUOTA")
+	}
+	cmd, err := c.wait(c.c.Send("GETQUOTA", c.c.Quote(root)))
+	if err != nil {
+		return nil, err
+	}
+	quotas := parseQuotas(append(cmd.Data, c.c.Data...))
+	c.c.Data = nil
+	return quotas[root], nil
+}
+
+// GetQuotaRoot returns the quotas of the quota roots of mbox, by root name.
+//
+// Returns imap.NotAvailableError if the server does not support QUOTA.
+func (c *client) GetQuotaRoot(mbox string) (map[string][]Quota, error) {
+	c.enter()
+	defer c.leave()
+	if !c.c.Caps["QUOTA"] {
+		return nil, imap.NotAvailableError("QUOTA")
+	}
+	cmd, err := c.wait(c.c.Send("GETQUOTAROOT", c.mailboxName(mbox)))
+	if err != nil {
+		return nil, err
+	}
+	quotas := parseQuotas(append(cmd.Data, c.c.Data...))
+	c.c.Data = nil
+	return quotas, nil
+}
+
+// parseQuotas parses the QUOTA responses: QUOTA root (resource usage limit ...).
+func parseQuotas(resps []*imap.Response) map[string][]Quota {
+	quotas := make(map[string][]Quota)
+	for _, resp := range resps {
+		switch resp.Label {
+		case "QUOTAROOT":
+			for i := 2; i < len(resp.Fields); i++ {
+				if root := imap.AsString(resp.Fields[i]); quotas[root] == nil {
+					quotas[root] = []Quota{}
+				}
+			}
+		case "QUOTA":
+			if len(resp.Fields) < 3 {
+				continue
+			}
+			root := imap.AsString(resp.Fields[1])
+			list := imap.AsList(resp.Fields[2])
+			for i := 0; i+2 < len(list); i += 3 {
+				quotas[root] = append(quotas[root], Quota{
+					Resource: strings.ToUpper(imap.AsAtom(list[i])),
+					Usage:    asUint64(list[i+1]),
+					Limit:    asUint64(list[i+2]),
+				})
+			}
+		}
+	}
+	return quotas
+}
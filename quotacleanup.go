@@ -0,0 +1,140 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// CleanupStrategy orders the messages removed by a QuotaPolicy.
+type CleanupStrategy int
+
+const (
+	// OldestFirst removes the messages with the oldest internal date first.
+	OldestFirst = CleanupStrategy(iota)
+	// LargestFirst removes the largest messages first.
+	LargestFirst
+)
+
+// QuotaPolicy is a rule of an ArchiveLoop: when the STORAGE usage of the
+// quota root of the first of Mailboxes exceeds High (of the limit),
+// messages of Mailboxes are removed in the order of Strategy, till the
+// usage drops below Low.
+type QuotaPolicy struct {
+	// Name identifies the policy in the logs and the reports.
+	Name string
+	// Mailboxes are the mailboxes to remove messages from.
+	Mailboxes []string
+	// High and Low are the high- and the low-water marks, as ratios
+	// of the limit (like 0.9 and 0.8).
+	High, Low float64
+	Strategy  CleanupStrategy
+	// MoveTo is the mailbox to move the messages to instead of deleting
+	// them - which must be under an other quota root.
+	MoveTo string
+}
+
+// errNoStorageQuota is returned by a QuotaPolicy if the server has no STORAGE quota for the mailbox.
+var errNoStorageQuota = errors.New("no STORAGE quota")
+
+// applyQuota applies the quota policy.
+func (a *ArchiveLoop) applyQuota(p QuotaPolicy) ([]ArchiveReport, error) {
+	if len(p.Mailboxes) == 0 {
+		return nil, nil
+	}
+	qc, ok := a.Client.(QuotaClient)
+	if !ok {
+		return nil, imap.NotAvailableError("QUOTA")
+	}
+	roots, err := qc.GetQuotaRoot(p.Mailboxes[0])
+	if err != nil {
+		return nil, err
+	}
+	var storage *Quota
+	for _, quotas := range roots {
+		for i, q := range quotas {
+			if q.Resource == "STORAGE" && q.Limit != 0 && (storage == nil || q.Ratio() > storage.Ratio()) {
+				storage = &quotas[i]
+			}
+		}
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("%s: %w", p.Mailboxes[0], errNoStorageQuota)
+	}
+	Log.Debug("quota", "policy", p.Name, "usage", storage.Usage, "limit", storage.Limit)
+	if storage.Ratio() <= p.High {
+		return nil, nil
+	}
+	// STORAGE is in KiB
+	need := int64(storage.Usage)*1024 - int64(p.Low*float64(storage.Limit)*1024)
+
+	type candidate struct {
+		mbox string
+		MessageInfo
+	}
+	var candidates []candidate
+	for _, mbox := range p.Mailboxes {
+		infos, err := a.Client.ListWithInfo(mbox, "", true)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			candidates = append(candidates, candidate{mbox: mbox, MessageInfo: info})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if p.Strategy == LargestFirst {
+			return candidates[i].Size > candidates[j].Size
+		}
+		return candidates[i].InternalDate.Before(candidates[j].InternalDate)
+	})
+	byMailbox := make(map[string]*ArchiveReport, len(p.Mailboxes))
+	for _, c := range candidates {
+		if need <= 0 {
+			break
+		}
+		r := byMailbox[c.mbox]
+		if r == nil {
+			r = &ArchiveReport{Policy: p.Name, Mailbox: c.mbox, Target: p.MoveTo, DryRun: a.DryRun}
+			byMailbox[c.mbox] = r
+		}
+		r.UIDs = append(r.UIDs, c.UID)
+		r.Size += int64(c.Size)
+		need -= int64(c.Size)
+	}
+
+	var reports []ArchiveReport
+	for _, mbox := range p.Mailboxes {
+		r := byMailbox[mbox]
+		if r == nil {
+			continue
+		}
+		sort.Slice(r.UIDs, func(i, j int) bool { return r.UIDs[i] < r.UIDs[j] })
+		if err = a.Client.Select(mbox); err != nil {
+			return reports, err
+		}
+		reports = append(reports, *r)
+		if err = a.remove(*r); err != nil {
+			return reports, err
+		}
+	}
+	return reports, nil
+}
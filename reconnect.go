@@ -0,0 +1,157 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// RetryPolicy configures the retrying of idempotent commands (search, fetch,
+// flag store, status, list) on timeouts and dropped connections.
+type RetryPolicy struct {
+	// Retries is the maximal number of retries of a command.
+	Retries int
+	// Backoff is the sleep before the first retry, doubled before each next one.
+	Backoff time.Duration
+	// MaxBackoff caps the sleep between the retries, if not zero.
+	MaxBackoff time.Duration
+	// Jitter randomizes each sleep by up to ±Jitter of it (0.2 is ±20%),
+	// so that many clients do not retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is a sensible RetryPolicy for WithRetry:
+// 3 retries, backing off from 1 second up to 30 seconds.
+var DefaultRetryPolicy = RetryPolicy{Retries: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+
+// WithRetry makes the client reconnect - re-dial, re-authenticate and
+// re-select the previously selected mailbox - when an idempotent command
+// fails with a timeout or a dropped connection, and retry that command,
+// as configured by policy.
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *client) { c.retryPolicy = policy }
+}
+
+// WithReconnect is WithRetry with retries retries and no backoff.
+func WithReconnect(retries int) Option {
+	return WithRetry(RetryPolicy{Retries: retries})
+}
+
+// ThrottleBackoff is the sleep after a throttled response, if the server
+// does not suggest an interval - 30 seconds by default.
+var ThrottleBackoff = 30 * time.Second
+
+// throttleBackoff returns the interval to wait after the throttled err.
+func throttleBackoff(err error) time.Duration {
+	if d := RetryAfter(err); d > 0 {
+		return d
+	}
+	return ThrottleBackoff
+}
+
+// backoff returns the sleep before the (zero-based) i-th retry.
+func (p RetryPolicy) backoff(i int) time.Duration {
+	d := p.Backoff
+	for ; i > 0 && d > 0 && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i-- {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 && d > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// isConnError reports whether err means that the connection is unusable.
+func isConnError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrConnection) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, imap.ErrTimeout) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var rspErr imap.ResponseError
+	return errors.As(err, &rspErr) && rspErr.Response != nil && rspErr.Status == imap.BYE
+}
+
+// retry calls fn, and while it fails with a connection error, backs off,
+// reconnects and calls it again - as configured by WithRetry.
+// A throttled command is retried after the interval suggested by the server
+// (or ThrottleBackoff), and reconnects only if the connection was dropped.
+func (c *client) retry(name string, fn func() error) error {
+	err := fn()
+	for i := 0; i < c.retryPolicy.Retries && (isConnError(err) || errors.Is(err, ErrThrottled)); i++ {
+		backoff := c.retryPolicy.backoff(i)
+		if errors.Is(err, ErrThrottled) {
+			if d := throttleBackoff(err); d > backoff {
+				backoff = d
+			}
+		}
+		c.logger.Warn("reconnect", "command", name, "attempt", i+1, "backoff", backoff, "error", err)
+		if backoff > 0 {
+			time.Sleep(backoff)
+		}
+		if !isConnError(err) {
+			err = fn()
+			continue
+		}
+		c.emit(Event{Type: EventReconnecting, Attempt: i + 1, Err: err})
+		if err = c.reconnect(); err != nil {
+			c.logger.Error("reconnect", "command", name, "attempt", i+1, "error", err)
+			continue
+		}
+		err = fn()
+	}
+	return err
+}
+
+// reconnect drops the connection, connects again and re-selects the mailbox.
+//
+// If connecting fails, the old (broken) go-imap client is kept, so the
+// methods fail with a connection error instead of using a nil one.
+func (c *client) reconnect() error {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	ic := c.c
+	c.c = nil
+	c.emit(Event{Type: EventDisconnected})
+	if err := c.Connect(); err != nil {
+		if c.c == nil {
+			c.c = ic
+		}
+		return err
+	}
+	if c.selected == "" {
+		return nil
+	}
+	_, err := c.wait(c.c.Select(c.selected, false))
+	return err
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// MaxReferrals is the maximal number of referrals followed by one Connect - 3 by default.
+var MaxReferrals = 3
+
+// WithFollowReferrals makes Connect follow the login referrals (RFC 2221):
+// when the server refers to another server (in the greeting, or as the
+// reply to the login), connect there, with the same credentials (or the
+// user name in the referral URL).
+//
+// Only the referrals received over TLS, to a host in the domain of the
+// configured host are followed (see WithFollowReferralsTo); the referred
+// connection is never less protected than the configured one: an imap
+// referral requires STARTTLS, and implicit TLS is kept. Each Connect (and
+// reconnect) starts at the configured server again.
+//
+// Without it, Connect returns an ErrReferral error - see Referral.
+func WithFollowReferrals() Option {
+	return func(c *client) { c.followReferrals = true }
+}
+
+// WithFollowReferralsTo is WithFollowReferrals, following the referrals to
+// the hosts approved by approve, instead of the ones in the same domain.
+func WithFollowReferralsTo(approve func(host string) bool) Option {
+	return func(c *client) { c.followReferrals, c.approveReferral = true, approve }
+}
+
+// ErrReferralRefused is returned by follow for a referral which is not followed.
+var ErrReferralRefused = errors.New("referral refused")
+
+// Referral returns the IMAP URL of the referral (such as
+// "imap://user;AUTH=*@server2/"), if err is ErrReferral; "" otherwise.
+func Referral(err error) string {
+	var e *Error
+	if errors.As(err, &e) && e.Kind == ErrReferral {
+		return e.Referral
+	}
+	return ""
+}
+
+// referralURL returns the URL of the REFERRAL response code.
+func referralURL(err error) string {
+	var rspErr imap.ResponseError
+	if !errors.As(err, &rspErr) || rspErr.Response == nil {
+		return ""
+	}
+	if args := respCodeArgs(rspErr.Response); len(args) > 0 {
+		return imap.AsString(args[0])
+	}
+	return ""
+}
+
+// follow drops the connection, and points the client to the referred server.
+//
+// The configured server is restored by Connect, after the referrals.
+func (c *client) follow(ref string) error {
+	if c.fromConn {
+		return ErrConnHandedOver
+	}
+	if !c.isTLS {
+		return fmt.Errorf("%s: %w: received over an unencrypted connection", ref, ErrReferralRefused)
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return err
+	}
+	port := 0
+	switch strings.ToLower(u.Scheme) {
+	case "imap":
+		port = 143
+		if c.tls == forceTLS {
+			port = 993
+		} else {
+			c.requireStartTLS = true
+		}
+	case "imaps":
+		c.tls, port = forceTLS, 993
+	default:
+		return fmt.Errorf("%s: unknown referral scheme %q", ref, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%s: no host", ref)
+	}
+	if approve := c.approveReferral; approve != nil && !approve(host) ||
+		approve == nil && !sameDomain(c.host, host) {
+		return fmt.Errorf("%s: %w: host %q is not approved", ref, ErrReferralRefused, host)
+	}
+	if p := u.Port(); p != "" {
+		if port, err = strconv.Atoi(p); err != nil {
+			return fmt.Errorf("%s: bad port %q: %w", ref, p, err)
+		}
+	}
+	if u.User != nil {
+		username := u.User.Username()
+		if i := strings.Index(strings.ToUpper(username), ";AUTH="); i >= 0 {
+			username = username[:i]
+		}
+		if username != "" {
+			c.username = username
+		}
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.c, c.conn = nil, nil
+	c.stopKeepAlive()
+	c.host, c.port = host, port
+	return nil
+}
+
+// sameDomain reports whether host is in the domain of the configured host:
+// the configured host without its first label, if it has at least three.
+func sameDomain(configured, host string) bool {
+	configured, host = strings.ToLower(configured), strings.ToLower(host)
+	if configured == host {
+		return true
+	}
+	if net.ParseIP(configured) != nil {
+		return false
+	}
+	domain := configured
+	if labels := strings.Split(configured, "."); len(labels) >= 3 {
+		domain = strings.Join(labels[1:], ".")
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// ResyncClient is a Client which can resynchronize a mailbox
+// with CONDSTORE and QRESYNC (RFC 7162).
+type ResyncClient interface {
+	Client
+	Resync(mbox string, known ResyncState) (*ResyncResult, error)
+}
+
+// ResyncState is the locally known state of a mailbox.
+type ResyncState struct {
+	UIDValidity uint32
+	// ModSeq is the HIGHESTMODSEQ seen at the last synchronization.
+	ModSeq uint64
+	// KnownUIDs are the UIDs in the local cache - needed for detecting
+	// the vanished messages if the server supports only CONDSTORE.
+	KnownUIDs []uint32
+}
+
+// ResyncResult holds the changes since the known state.
+type ResyncResult struct {
+	UIDValidity   uint32
+	HighestModSeq uint64
+	// Reset is true if UIDVALIDITY has changed, so the local cache is invalid.
+	Reset bool
+	// Vanished are the UIDs of the expunged messages.
+	Vanished []uint32
+	// Changed holds the current flags of the new or changed messages, by UID.
+	Changed map[uint32]imap.FlagSet
+}
+
+// Resync selects mbox, and returns the changes since the known state.
+//
+// With QRESYNC, vanished messages are reported by the server, in the same
+// UID FETCH which returns the changed flags; with CONDSTORE only, they are
+// computed from known.KnownUIDs with an additional UID SEARCH.
+func (c *client) Resync(mbox string, known ResyncState) (*ResyncResult, error) {
+	c.enter()
+	defer c.leave()
+	qresync := c.c.Caps["QRESYNC"]
+	if !qresync && !c.c.Caps["CONDSTORE"] {
+		return nil, imap.NotAvailableError("CONDSTORE")
+	}
+	if qresync && !c.qresync {
+		if _, err := c.wait(c.c.Send("ENABLE", imap.Field("QRESYNC"))); err != nil {
+			return nil, err
+		}
+		c.qresync = true
+	}
+	mbox = c.serverName(mbox)
+	c.c.Data = nil
+	cmd, err := c.wait(c.c.Select(mbox, false))
+	if err != nil {
+		return nil, err
+	}
+	c.selected = mbox
+	res := &ResyncResult{Changed: make(map[uint32]imap.FlagSet)}
+	if c.c.Mailbox != nil {
+		res.UIDValidity = c.c.Mailbox.UIDValidity
+	}
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if resp.Label == "HIGHESTMODSEQ" {
+			if args := respCodeArgs(resp); len(args) > 0 {
+				res.HighestModSeq = asUint64(args[0])
+			}
+		}
+	}
+	c.c.Data = nil
+	if known.UIDValidity != 0 && known.UIDValidity != res.UIDValidity {
+		res.Reset = true
+		return res, nil
+	}
+
+	modifiers := []imap.Field{imap.Field("CHANGEDSINCE"), imap.Field(strconv.FormatUint(known.ModSeq, 10))}
+	if qresync {
+		modifiers = append(modifiers, imap.Field("VANISHED"))
+	}
+	all, _ := imap.NewSeqSet("1:*")
+	if cmd, err = c.wait(c.c.Send("UID FETCH", all, []imap.Field{imap.Field("FLAGS")}, modifiers)); err != nil {
+		return nil, err
+	}
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		switch resp.Label {
+		case "FETCH":
+			info := resp.MessageInfo()
+			res.Changed[info.UID] = info.Flags
+		case "VANISHED":
+			for _, f := range resp.Fields {
+				if imap.TypeOf(f) == imap.List || strings.EqualFold(imap.AsAtom(f), "VANISHED") {
+					continue
+				}
+				res.Vanished = append(res.Vanished, asUIDs(f)...)
+			}
+		}
+	}
+	c.c.Data = nil
+	if qresync || len(known.KnownUIDs) == 0 {
+		return res, nil
+	}
+
+	set := &imap.SeqSet{}
+	set.AddNum(known.KnownUIDs...)
+	if cmd, err = c.wait(c.c.UIDSearch(imap.Field("UID"), set)); err != nil {
+		return nil, err
+	}
+	present := make(map[uint32]bool, len(known.KnownUIDs))
+	for _, resp := range cmd.Data {
+		for _, uid := range resp.SearchResults() {
+			present[uid] = true
+		}
+	}
+	for _, uid := range known.KnownUIDs {
+		if !present[uid] {
+			res.Vanished = append(res.Vanished, uid)
+		}
+	}
+	return res, nil
+}
+
+// respCodeArgs returns the arguments of the response code of a status response.
+func respCodeArgs(resp *imap.Response) []imap.Field {
+	args := resp.Fields
+	if len(args) > 0 && strings.EqualFold(imap.AsAtom(args[0]), resp.Label) {
+		args = args[1:]
+	}
+	return args
+}
+
+// asUint64 returns the numeric value of f, which may be larger than a Number.
+func asUint64(f imap.Field) uint64 {
+	if imap.TypeOf(f) == imap.Number {
+		return uint64(imap.AsNumber(f))
+	}
+	n, _ := strconv.ParseUint(imap.AsAtom(f), 10, 64)
+	return n
+}
+
+// parseUIDSet parses a sequence set of UIDs, like "41,43:116".
+func parseUIDSet(s string) []uint32 {
+	var uids []uint32
+	for _, part := range strings.Split(s, ",") {
+		from, to := part, part
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		start, err := strconv.ParseUint(from, 10, 32)
+		if err != nil {
+			continue
+		}
+		stop, err := strconv.ParseUint(to, 10, 32)
+		if err != nil {
+			continue
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		for uid := start; uid <= stop; uid++ {
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids
+}
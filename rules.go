@@ -0,0 +1,156 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Rule routes the messages matching all its non-zero conditions to its
+// actions. A Loop applies the first matching rule of its Rules.
+type Rule struct {
+	// Name identifies the rule in the logs.
+	Name string
+
+	// Subject must match the Subject header field.
+	Subject *regexp.Regexp
+	// FromDomain must be the domain of the From address (case insensitive).
+	FromDomain string
+	// Headers must match the named header fields.
+	Headers map[string]*regexp.Regexp
+	// HasAttachment requires the message to have an attachment.
+	HasAttachment bool
+	// Cond must report true for the message of size bytes (-1 if unknown),
+	// if not nil; in a Loop, it may read the body, as msg is parsed for
+	// each rule.
+	Cond func(msg *mail.Message, size int64) bool
+
+	// Deliver delivers the message, if not nil.
+	Deliver MessageDeliverFunc
+	// Flag is set on the message, if not empty.
+	Flag string
+	// MoveTo is the mailbox to move the message to, instead of Loop.Outbox.
+	MoveTo string
+	// Drop marks the message as deleted, without any other action.
+	Drop bool
+}
+
+// Match reports whether msg matches all the conditions of the rule.
+// Reads the body of msg only if HasAttachment is set.
+func (r Rule) Match(msg *mail.Message) bool {
+	return r.match(msg, -1, func() bool { return hasAttachment(msg.Header.Get("Content-Type"), msg.Body) })
+}
+
+// match is Match, with attached reporting whether the message has an attachment.
+func (r Rule) match(msg *mail.Message, size int64, attached func() bool) bool {
+	if r.Subject != nil && !r.Subject.MatchString(msg.Header.Get("Subject")) {
+		return false
+	}
+	if r.FromDomain != "" {
+		addr, err := mail.ParseAddress(msg.Header.Get("From"))
+		if err != nil {
+			return false
+		}
+		i := strings.LastIndexByte(addr.Address, '@')
+		if i < 0 || !strings.EqualFold(addr.Address[i+1:], strings.TrimPrefix(r.FromDomain, "@")) {
+			return false
+		}
+	}
+	for k, re := range r.Headers {
+		if !re.MatchString(msg.Header.Get(k)) {
+			return false
+		}
+	}
+	if r.Cond != nil && !r.Cond(msg, size) {
+		return false
+	}
+	return !r.HasAttachment || attached()
+}
+
+// hasAttachment reports whether the body of the given content type has
+// an attachment part, looking into the nested multiparts, too.
+func hasAttachment(contentType string, body io.Reader) bool {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return false
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return false
+		}
+		if disp, dparams, err := mime.ParseMediaType(part.Header.Get("Content-Disposition")); err == nil &&
+			(disp == "attachment" || dparams["filename"] != "") {
+			return true
+		}
+		if hasAttachment(part.Header.Get("Content-Type"), part) {
+			return true
+		}
+	}
+}
+
+// matchRules returns the first rule matching the message, or nil.
+//
+// The message is parsed for each rule, so the rules reading the body see all
+// of it; whether it has an attachment is computed once, if needed.
+func matchRules(rules []Rule, r io.ReadSeeker) (*Rule, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	var scanned, attachment bool
+	var seekErr error
+	attached := func() bool {
+		if !scanned {
+			scanned = true
+			if _, seekErr = r.Seek(0, io.SeekStart); seekErr != nil {
+				return false
+			}
+			if msg, err := mail.ReadMessage(r); err == nil {
+				attachment = hasAttachment(msg.Header.Get("Content-Type"), msg.Body)
+			}
+		}
+		return attachment
+	}
+	var rule *Rule
+	for i := range rules {
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		msg, err := mail.ReadMessage(r)
+		if err != nil {
+			break
+		}
+		if rules[i].match(msg, size, attached) {
+			rule = &rules[i]
+			break
+		}
+		if seekErr != nil {
+			return nil, seekErr
+		}
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3archive archives the messages of an imapclient.Loop into an
+// S3-compatible object storage (AWS S3, MinIO, Ceph RGW...), with plain
+// HTTP requests signed with AWS Signature Version 4.
+//
+//	a := &s3archive.Archiver{Endpoint: "https://s3.eu-central-1.amazonaws.com",
+//		Region: "eu-central-1", Bucket: "mail-archive",
+//		AccessKey: ak, SecretKey: sk, SSE: s3archive.SSEKMS}
+//	l := imapclient.Loop{Client: c, DeliverMessage: a.DeliverMessage}
+package s3archive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tgulacsi/imapclient"
+)
+
+// DefaultKeyTemplate is the KeyTemplate of the Archiver if it is empty.
+const DefaultKeyTemplate = "%b/%Y/%m/%d/%v-%u-%h.eml"
+
+// The server-side encryption modes.
+const (
+	// SSES3 is encryption with keys managed by the storage.
+	SSES3 = "AES256"
+	// SSEKMS is encryption with a KMS key (KMSKeyID, or the default key).
+	SSEKMS = "aws:kms"
+)
+
+// Archiver stores the messages as objects: its Deliver is an
+// imapclient.DeliverFunc, its DeliverMessage an imapclient.MessageDeliverFunc.
+type Archiver struct {
+	// Endpoint is the URL of the service, such as
+	// "https://s3.eu-central-1.amazonaws.com" or "http://localhost:9000".
+	Endpoint string
+	// Region is the region of the bucket - "us-east-1" if empty.
+	Region string
+	// Bucket is the name of the bucket.
+	Bucket string
+	// PathStyle puts the bucket into the path (as MinIO needs)
+	// instead of the host name.
+	PathStyle bool
+	// AccessKey and SecretKey are the credentials; SessionToken is needed
+	// for temporary credentials only.
+	AccessKey, SecretKey, SessionToken string
+
+	// KeyTemplate is the key of the objects - DefaultKeyTemplate if empty.
+	// %Y, %m, %d and %H are replaced with the year, month, day and hour of
+	// the Date of the message (the current time, if unknown), in UTC;
+	// %b with the mailbox, %v with the UIDVALIDITY, %u with the UID,
+	// %h with the hash (hex) of the message, and %% with %.
+	KeyTemplate string
+
+	// SSE is the server-side encryption: SSES3, SSEKMS, or none if empty.
+	SSE string
+	// KMSKeyID is the KMS key of SSEKMS - the default key of the account if empty.
+	KMSKeyID string
+	// CustomerKey is the 256-bit key of the server-side encryption with
+	// customer-provided keys (SSE-C), instead of SSE.
+	CustomerKey []byte
+	// StorageClass is the storage class of the objects, such as
+	// "STANDARD_IA" or "GLACIER"; the default of the bucket if empty.
+	StorageClass string
+
+	// HTTPClient is the client of the requests - http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// Deliver stores the message; usable as an imapclient.DeliverFunc.
+func (a *Archiver) Deliver(r io.ReadSeeker, uid uint32, hash []byte) error {
+	return a.DeliverMessage(r, imapclient.DeliveryInfo{UID: uid, Hash: hash})
+}
+
+// DeliverMessage stores the message under Key(info), with its metadata
+// (imapclient.MessageHeaders) as user metadata (x-amz-meta-*);
+// usable as an imapclient.MessageDeliverFunc.
+func (a *Archiver) DeliverMessage(r io.ReadSeeker, info imapclient.DeliveryInfo) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", "message/rfc822")
+	for k, v := range imapclient.MessageHeaders(info) {
+		hdr.Set("X-Amz-Meta-"+k, mime.QEncoding.Encode("utf-8", v))
+	}
+	if a.StorageClass != "" {
+		hdr.Set("X-Amz-Storage-Class", a.StorageClass)
+	}
+	switch {
+	case len(a.CustomerKey) != 0:
+		sum := md5.Sum(a.CustomerKey)
+		hdr.Set("X-Amz-Server-Side-Encryption-Customer-Algorithm", "AES256")
+		hdr.Set("X-Amz-Server-Side-Encryption-Customer-Key", base64.StdEncoding.EncodeToString(a.CustomerKey))
+		hdr.Set("X-Amz-Server-Side-Encryption-Customer-Key-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+	case a.SSE != "":
+		hdr.Set("X-Amz-Server-Side-Encryption", a.SSE)
+		if a.SSE == SSEKMS && a.KMSKeyID != "" {
+			hdr.Set("X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id", a.KMSKeyID)
+		}
+	}
+	key := a.Key(info)
+	if err = a.put(key, hdr, body); err != nil {
+		return fmt.Errorf("put %s/%s: %w", a.Bucket, key, err)
+	}
+	return nil
+}
+
+// Key returns the key of the object of the message, by KeyTemplate.
+func (a *Archiver) Key(info imapclient.DeliveryInfo) string {
+	tmpl := a.KeyTemplate
+	if tmpl == "" {
+		tmpl = DefaultKeyTemplate
+	}
+	t := info.Date
+	if t.IsZero() {
+		t = time.Now()
+	}
+	t = t.UTC()
+	two := func(n int) string { return fmt.Sprintf("%02d", n) }
+	return strings.NewReplacer(
+		"%%", "%",
+		"%Y", strconv.Itoa(t.Year()), "%m", two(int(t.Month())),
+		"%d", two(t.Day()), "%H", two(t.Hour()),
+		"%b", info.Mailbox,
+		"%v", strconv.FormatUint(uint64(info.UIDValidity), 10),
+		"%u", strconv.FormatUint(uint64(info.UID), 10),
+		"%h", hex.EncodeToString(info.Hash),
+	).Replace(tmpl)
+}
+
+// s3Error is the error response of the service.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return "HTTP " + strconv.Itoa(e.StatusCode) + ": " + e.Code + ": " + e.Message
+}
+
+// put uploads the object with a signed PUT request.
+func (a *Archiver) put(key string, hdr http.Header, body []byte) error {
+	u, err := url.Parse(a.Endpoint)
+	if err != nil {
+		return err
+	}
+	path := "/" + key
+	if a.PathStyle {
+		path = "/" + a.Bucket + path
+	} else {
+		u.Host = a.Bucket + "." + u.Host
+	}
+	u.RawPath = uriEncode(path)
+	u.Path = path
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = hdr
+	a.sign(req, body, time.Now())
+
+	cl := a.HTTPClient
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	e := s3Error{StatusCode: resp.StatusCode}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<10))
+	if xml.Unmarshal(b, &e) != nil {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	if e.Code == "" && e.Message == "" {
+		return errors.New(resp.Status)
+	}
+	return &e
+}
+
+// sign signs the request with AWS Signature Version 4.
+func (a *Archiver) sign(req *http.Request, body []byte, now time.Time) {
+	region := a.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := amzDate[:8]
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, vv := range req.Header {
+		lk := strings.ToLower(k)
+		names = append(names, lk)
+		trimmed := make([]string, len(vv))
+		for i, v := range vv {
+			// trimmed, with the runs of spaces collapsed, as S3 canonicalizes them
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[lk] = strings.Join(trimmed, ",")
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + values[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + hex.EncodeToString(payloadHash[:]))
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	crHash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crHash[:])
+	key := []byte("AWS4" + a.SecretKey)
+	for _, s := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+a.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes the path as S3 expects it: everything except the
+// unreserved characters and the slashes is percent-encoded.
+func uriEncode(path string) string {
+	var buf strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// SASLFactory returns the imap.SASL of a mechanism for the credentials,
+// or nil if the mechanism cannot be used (cb is nil without an implicit
+// TLS connection, so the -PLUS mechanisms are not possible).
+type SASLFactory func(username, password string, cb *ChannelBinding) imap.SASL
+
+type saslMech struct {
+	name       string
+	preference int
+	factory    SASLFactory
+}
+
+var (
+	saslMu    sync.RWMutex
+	saslMechs []saslMech
+)
+
+func init() {
+	RegisterSASL("SCRAM-SHA-256-PLUS", 400, func(username, password string, cb *ChannelBinding) imap.SASL {
+		if cb == nil {
+			return nil
+		}
+		return ScramPlusAuth(true, username, password, *cb)
+	})
+	RegisterSASL("SCRAM-SHA-256", 300, func(username, password string, cb *ChannelBinding) imap.SASL {
+		a := ScramSHA256Auth(username, password).(*scramAuth)
+		a.cb = cb
+		return a
+	})
+	RegisterSASL("SCRAM-SHA-1-PLUS", 250, func(username, password string, cb *ChannelBinding) imap.SASL {
+		if cb == nil {
+			return nil
+		}
+		return ScramPlusAuth(false, username, password, *cb)
+	})
+	RegisterSASL("SCRAM-SHA-1", 200, func(username, password string, cb *ChannelBinding) imap.SASL {
+		a := ScramSHA1Auth(username, password).(*scramAuth)
+		a.cb = cb
+		return a
+	})
+	RegisterSASL("CRAM-MD5", 100, func(username, password string, _ *ChannelBinding) imap.SASL {
+		return CramAuth(username, password)
+	})
+}
+
+// RegisterSASL registers a SASL mechanism (by its name in the AUTH= capability),
+// replacing the previous registration of the same name.
+//
+// On Connect, the mechanisms supported by the server are tried in decreasing
+// preference, before the LOGIN command. The built-in mechanisms are
+// SCRAM-SHA-256-PLUS (400), SCRAM-SHA-256 (300), SCRAM-SHA-1-PLUS (250),
+// SCRAM-SHA-1 (200) and CRAM-MD5 (100); a negative preference disables a mechanism.
+func RegisterSASL(mech string, preference int, factory SASLFactory) {
+	mech = strings.ToUpper(mech)
+	saslMu.Lock()
+	defer saslMu.Unlock()
+	for i, m := range saslMechs {
+		if m.name == mech {
+			saslMechs = append(saslMechs[:i], saslMechs[i+1:]...)
+			break
+		}
+	}
+	if preference < 0 || factory == nil {
+		return
+	}
+	saslMechs = append(saslMechs, saslMech{name: mech, preference: preference, factory: factory})
+	sort.SliceStable(saslMechs, func(i, j int) bool { return saslMechs[i].preference > saslMechs[j].preference })
+}
+
+// cleartextSASL are the mechanisms which send the password as is, so they are
+// not used over an unencrypted connection without WithAllowCleartext.
+var cleartextSASL = map[string]bool{"PLAIN": true, "LOGIN": true}
+
+// saslMechanisms returns the registered mechanisms supported by the server,
+// strongest first.
+func (c *client) saslMechanisms() []saslMech {
+	saslMu.RLock()
+	defer saslMu.RUnlock()
+	var mechs []saslMech
+	for _, m := range saslMechs {
+		if cleartextSASL[m.name] && !c.isTLS && !c.allowCleartext {
+			continue
+		}
+		if c.c.Caps["AUTH="+m.name] {
+			mechs = append(mechs, m)
+		}
+	}
+	return mechs
+}
+
+// authSASL tries the mutually supported mechanisms, strongest first,
+// and returns the last error if none succeeded.
+func (c *client) authSASL() error {
+	var err error
+	cb := c.channelBinding()
+	for _, m := range c.saslMechanisms() {
+		a := m.factory(c.username, c.password, cb)
+		if a == nil {
+			continue
+		}
+		if _, err = c.c.Auth(a); err == nil {
+			return nil
+		}
+		c.logger.Warn("Authenticate", "mechanism", m.name, "username", c.username, "error", err)
+		if c.c.State() != imap.Login || saslFinal(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// saslFinal reports whether the failed authentication must not be retried
+// with another mechanism (or LOGIN): the server failed the mutual
+// authentication, or rejected the credentials definitely.
+func saslFinal(err error) bool {
+	if errors.Is(err, ErrScramServer) {
+		return true
+	}
+	var rspErr imap.ResponseError
+	return errors.As(err, &rspErr) && rspErr.Response != nil &&
+		strings.EqualFold(rspErr.Response.Label, "AUTHENTICATIONFAILED")
+}
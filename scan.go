@@ -0,0 +1,172 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Verdict is the result of a content scan.
+type Verdict struct {
+	// Positive is true if the scanner found something (a virus,
+	// leaked data) in the message.
+	Positive bool
+	// Reason names the finding, for logging.
+	Reason string
+}
+
+// Scanner inspects the content of a message - for virus scanning or DLP checks.
+type Scanner interface {
+	Scan(r io.Reader) (Verdict, error)
+}
+
+// ScannerFunc is a function usable as a Scanner.
+type ScannerFunc func(r io.Reader) (Verdict, error)
+
+// Scan calls f(r).
+func (f ScannerFunc) Scan(r io.Reader) (Verdict, error) { return f(r) }
+
+// ScanAction is the handling of the messages with a positive Verdict.
+type ScanAction int
+
+const (
+	// Quarantine marks the message as seen, and moves it to Loop.Quarantine
+	// (just marks it as seen if that is empty).
+	Quarantine = ScanAction(iota)
+	// Reject handles the message as a given up delivery: calls
+	// Loop.OnDeadLetter, marks the message as seen and moves it to Loop.Errbox.
+	Reject
+)
+
+// ScanError is the error of OnDeadLetter for the messages rejected by the Scanner.
+type ScanError struct {
+	Verdict Verdict
+}
+
+func (e *ScanError) Error() string { return "scan: " + e.Verdict.Reason }
+
+// Clamd is a Scanner which asks clamd (ClamAV) with the INSTREAM command.
+type Clamd struct {
+	// Addr is the address of clamd - "localhost:3310" if empty,
+	// or a path of a unix socket if it starts with "/".
+	Addr string
+	// Timeout is the timeout of the whole scan - Timeout if zero.
+	Timeout time.Duration
+}
+
+// clamdChunkSize is the size of the chunks sent to clamd.
+const clamdChunkSize = 32 << 10
+
+// Scan streams the message to clamd, and returns its verdict,
+// with the name of the signature found as Reason.
+func (s Clamd) Scan(r io.Reader) (Verdict, error) {
+	network, addr := "tcp", s.Addr
+	if addr == "" {
+		addr = "localhost:3310"
+	} else if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = Timeout
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	bw := bufio.NewWriter(conn)
+	bw.WriteString("zINSTREAM\x00")
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := bw.Write(buf[:4+n]); werr != nil {
+				return Verdict{}, werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Verdict{}, err
+		}
+	}
+	bw.Write([]byte{0, 0, 0, 0})
+	if err = bw.Flush(); err != nil {
+		return Verdict{}, err
+	}
+	resp, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && resp == "" {
+		return Verdict{}, fmt.Errorf("clamd: %w", err)
+	}
+	return parseClamdResponse(resp)
+}
+
+// parseClamdResponse parses the response of INSTREAM:
+//
+//	stream: OK
+//	stream: Eicar-Test-Signature FOUND
+func parseClamdResponse(resp string) (Verdict, error) {
+	resp = strings.TrimSpace(strings.TrimRight(resp, "\x00"))
+	if i := strings.IndexByte(resp, ':'); i >= 0 {
+		resp = strings.TrimSpace(resp[i+1:])
+	}
+	switch {
+	case resp == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(resp, " FOUND"):
+		return Verdict{Positive: true, Reason: strings.TrimSuffix(resp, " FOUND")}, nil
+	}
+	return Verdict{}, fmt.Errorf("clamd: %s", resp)
+}
+
+// scan asks the Scanner of the loop about the message.
+// Unlike the spam check, a failed scan fails closed: the message is not delivered.
+func (l *Loop) scan(body io.ReadSeeker) (Verdict, error) {
+	if l.Scanner == nil {
+		return Verdict{}, nil
+	}
+	verdict, err := l.Scanner.Scan(body)
+	if _, seekErr := body.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	return verdict, err
+}
+
+// quarantine handles a message with a positive verdict, by ScanAction.
+func (l *Loop) quarantine(c Client, info DeliveryInfo, verdict Verdict) {
+	if l.ScanAction == Reject {
+		if l.OnDeadLetter != nil {
+			l.OnDeadLetter(info, &ScanError{Verdict: verdict})
+		}
+		l.finish(c, info, l.Errbox)
+		return
+	}
+	l.finish(c, info, l.Quarantine)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// ErrScramServer is returned when the server's SCRAM signature is invalid.
+var ErrScramServer = errors.New("SCRAM: server signature mismatch")
+
+// ChannelBinding is the TLS channel binding data of RFC 5929 / RFC 9266,
+// used by the SCRAM-*-PLUS mechanisms.
+type ChannelBinding struct {
+	// Type is "tls-unique" or "tls-exporter".
+	Type string
+	Data []byte
+}
+
+type scramAuth struct {
+	name               string
+	hash               func() hash.Hash
+	username, password string
+	cb                 *ChannelBinding
+	plus               bool // the server supports channel binding
+
+	gs2, nonce, firstBare string
+	serverSignature       []byte
+	done                  bool
+}
+
+// ScramSHA1Auth returns an imap.SASL usable for SCRAM-SHA-1 authentication (RFC 5802).
+func ScramSHA1Auth(username, password string) imap.SASL {
+	return &scramAuth{name: "SCRAM-SHA-1", hash: sha1.New, username: username, password: password}
+}
+
+// ScramSHA256Auth returns an imap.SASL usable for SCRAM-SHA-256 authentication (RFC 7677).
+func ScramSHA256Auth(username, password string) imap.SASL {
+	return &scramAuth{name: "SCRAM-SHA-256", hash: sha256.New, username: username, password: password}
+}
+
+// ScramPlusAuth returns an imap.SASL for SCRAM-SHA-256-PLUS (or SCRAM-SHA-1-PLUS
+// if useSHA256 is false), binding the authentication to the TLS channel.
+func ScramPlusAuth(useSHA256 bool, username, password string, cb ChannelBinding) imap.SASL {
+	a := ScramSHA1Auth(username, password).(*scramAuth)
+	if useSHA256 {
+		a = ScramSHA256Auth(username, password).(*scramAuth)
+	}
+	a.cb, a.plus = &cb, true
+	return a
+}
+
+func (a *scramAuth) Start(s *imap.ServerInfo) (mech string, ir []byte, err error) {
+	mech = a.name
+	switch {
+	case a.cb != nil && a.plus:
+		mech += "-PLUS"
+		a.gs2 = "p=" + a.cb.Type + ",,"
+	case a.cb != nil:
+		// we could bind, but the server does not advertise -PLUS
+		a.gs2 = "y,,"
+	default:
+		a.gs2 = "n,,"
+	}
+	var b [18]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return "", nil, err
+	}
+	a.nonce = base64.RawStdEncoding.EncodeToString(b[:])
+	a.firstBare = "n=" + scramName(a.username) + ",r=" + a.nonce
+	return mech, []byte(a.gs2 + a.firstBare), nil
+}
+
+func (a *scramAuth) Next(challenge []byte) (response []byte, err error) {
+	if a.serverSignature != nil {
+		if a.done {
+			return nil, fmt.Errorf("SCRAM: unexpected challenge %q", challenge)
+		}
+		a.done = true
+		attrs := scramAttrs(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, fmt.Errorf("SCRAM: server error %q", e)
+		}
+		v, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(v, a.serverSignature) {
+			return nil, ErrScramServer
+		}
+		return []byte{}, nil
+	}
+
+	serverFirst := string(challenge)
+	attrs := scramAttrs(serverFirst)
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, fmt.Errorf("SCRAM: bad server nonce %q", nonce)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, fmt.Errorf("SCRAM: bad salt %q: %v", attrs["s"], err)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter <= 0 {
+		return nil, fmt.Errorf("SCRAM: bad iteration count %q", attrs["i"])
+	}
+
+	cbind := []byte(a.gs2)
+	if a.cb != nil && a.plus {
+		cbind = append(cbind, a.cb.Data...)
+	}
+	finalBare := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+	authMessage := []byte(a.firstBare + "," + serverFirst + "," + finalBare)
+
+	salted := pbkdf2(a.hash, []byte(a.password), salt, iter)
+	clientKey := a.hmac(salted, []byte("Client Key"))
+	h := a.hash()
+	h.Write(clientKey)
+	proof := a.hmac(h.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = a.hmac(a.hmac(salted, []byte("Server Key")), authMessage)
+	return []byte(finalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (a *scramAuth) hmac(key, data []byte) []byte {
+	h := hmac.New(a.hash, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// scramName escapes the ',' and '=' characters of a SCRAM user name - as
+// the saslname of the GS2 header (RFC 5801), also used by OAUTHBEARER.
+func scramName(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+// scramAttrs parses the "k=v,k=v" attributes of a SCRAM message.
+func scramAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			attrs[kv[:i]] = kv[i+1:]
+		}
+	}
+	return attrs
+}
+
+// pbkdf2 is the PBKDF2 key derivation of RFC 8018, with the output length
+// of the hash function (as SCRAM requires).
+func pbkdf2(h func() hash.Hash, password, salt []byte, iter int) []byte {
+	prf := hmac.New(h, password)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], 1)
+	prf.Write(salt)
+	prf.Write(idx[:])
+	u := prf.Sum(nil)
+	t := append([]byte(nil), u...)
+	for n := 1; n < iter; n++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for i := range t {
+			t[i] ^= u[i]
+		}
+	}
+	return t
+}
+
+// channelBinding returns the channel binding data of the implicit TLS
+// connection - tls-exporter for TLS 1.3, tls-unique before, or nil.
+func (c *client) channelBinding() *ChannelBinding {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if state.Version >= tls.VersionTLS13 {
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil
+		}
+		return &ChannelBinding{Type: "tls-exporter", Data: data}
+	}
+	if len(state.TLSUnique) == 0 {
+		return nil
+	}
+	return &ChannelBinding{Type: "tls-unique", Data: append([]byte(nil), state.TLSUnique...)}
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// SearchCriteria are the conditions of a search; a message must match all
+// the non-zero conditions. The zero value matches every message.
+type SearchCriteria struct {
+	// From, To, Cc, Subject are substrings of the respective header fields.
+	From, To, Cc, Subject string
+	// Body is a substring of the body, Text of the header or body.
+	Body, Text string
+	// Since and Before restrict the internal date (day granularity, Before is exclusive).
+	Since, Before time.Time
+	// SentSince and SentBefore restrict the Date header field.
+	SentSince, SentBefore time.Time
+	// Younger and Older restrict the age of the internal date, with second
+	// granularity (RFC 5032 WITHIN). Without WITHIN, they are converted to
+	// Since and Before, with day granularity.
+	Younger, Older time.Duration
+	// WithFlags and WithoutFlags are the flags (system flags or keywords)
+	// the message must have, or must not have.
+	WithFlags, WithoutFlags []string
+	// Larger and Smaller restrict the RFC822 size; zero means no limit.
+	Larger, Smaller uint32
+	// Header holds header field name - substring pairs.
+	Header map[string]string
+	// Raw search keys appended verbatim, for extensions.
+	Raw []imap.Field
+}
+
+// searchDate is the date format of SEARCH.
+const searchDate = "2-Jan-2006"
+
+// systemFlags maps the system flags to their SEARCH key and its negation.
+var systemFlags = map[string][2]string{
+	`\Answered`: {"ANSWERED", "UNANSWERED"},
+	`\Deleted`:  {"DELETED", "UNDELETED"},
+	`\Draft`:    {"DRAFT", "UNDRAFT"},
+	`\Flagged`:  {"FLAGGED", "UNFLAGGED"},
+	`\Recent`:   {"RECENT", "OLD"},
+	`\Seen`:     {"SEEN", "UNSEEN"},
+}
+
+// fields returns the search keys, using quote for the string arguments.
+func (crit SearchCriteria) fields(quote func(string) imap.Field) []imap.Field {
+	fields := make([]imap.Field, 0, 8)
+	for _, kv := range [][2]string{
+		{"FROM", crit.From}, {"TO", crit.To}, {"CC", crit.Cc},
+		{"SUBJECT", crit.Subject}, {"BODY", crit.Body}, {"TEXT", crit.Text},
+	} {
+		if kv[1] != "" {
+			fields = append(fields, imap.Field(kv[0]), quote(kv[1]))
+		}
+	}
+	for _, kv := range []struct {
+		key string
+		t   time.Time
+	}{
+		{"SINCE", crit.Since}, {"BEFORE", crit.Before},
+		{"SENTSINCE", crit.SentSince}, {"SENTBEFORE", crit.SentBefore},
+	} {
+		if !kv.t.IsZero() {
+			fields = append(fields, imap.Field(kv.key), imap.Field(kv.t.Format(searchDate)))
+		}
+	}
+	if crit.Younger > 0 {
+		fields = append(fields, imap.Field("YOUNGER"), imap.Field(strconv.FormatInt(int64(crit.Younger/time.Second), 10)))
+	}
+	if crit.Older > 0 {
+		fields = append(fields, imap.Field("OLDER"), imap.Field(strconv.FormatInt(int64(crit.Older/time.Second), 10)))
+	}
+	for _, flag := range crit.WithFlags {
+		if keys, ok := systemFlags[flag]; ok {
+			fields = append(fields, imap.Field(keys[0]))
+		} else {
+			fields = append(fields, imap.Field("KEYWORD"), imap.Field(flag))
+		}
+	}
+	for _, flag := range crit.WithoutFlags {
+		if keys, ok := systemFlags[flag]; ok {
+			fields = append(fields, imap.Field(keys[1]))
+		} else {
+			fields = append(fields, imap.Field("UNKEYWORD"), imap.Field(flag))
+		}
+	}
+	if crit.Larger > 0 {
+		fields = append(fields, imap.Field("LARGER"), imap.Field(strconv.FormatUint(uint64(crit.Larger), 10)))
+	}
+	if crit.Smaller > 0 {
+		fields = append(fields, imap.Field("SMALLER"), imap.Field(strconv.FormatUint(uint64(crit.Smaller), 10)))
+	}
+	for k, v := range crit.Header {
+		fields = append(fields, imap.Field("HEADER"), quote(k), quote(v))
+	}
+	fields = append(fields, crit.Raw...)
+	if len(fields) == 0 {
+		fields = append(fields, imap.Field("ALL"))
+	}
+	return fields
+}
+
+// withoutWithin returns crit with Younger and Older converted to Since and Before,
+// relative to now.
+func (crit SearchCriteria) withoutWithin(now time.Time) SearchCriteria {
+	if crit.Younger > 0 {
+		if since := now.Add(-crit.Younger); crit.Since.IsZero() || since.After(crit.Since) {
+			crit.Since = since
+		}
+		crit.Younger = 0
+	}
+	if crit.Older > 0 {
+		if before := now.Add(-crit.Older); crit.Before.IsZero() || before.Before(crit.Before) {
+			crit.Before = before
+		}
+		crit.Older = 0
+	}
+	return crit
+}
+
+// within returns crit as the server can handle it.
+func (c *client) within(crit SearchCriteria) SearchCriteria {
+	if c.c.Caps["WITHIN"] {
+		return crit
+	}
+	return crit.withoutWithin(time.Now())
+}
+
+// Search selects mbox, and returns the UIDs of the messages matching crit.
+//
+// If the server does not support UTF-8 search strings (ErrBadCharset), then
+// the strings are sent UTF-7 encoded.
+func (c *client) Search(mbox string, crit SearchCriteria) ([]uint32, error) {
+	c.enter()
+	defer c.leave()
+	var uids []uint32
+	err := c.retry("Search", func() error {
+		var err error
+		uids, err = c.search(mbox, crit)
+		return err
+	})
+	return uids, err
+}
+
+func (c *client) search(mbox string, crit SearchCriteria) ([]uint32, error) {
+	err := c.selectMailbox(mbox)
+	if err != nil {
+		return nil, err
+	}
+	crit = c.within(crit)
+	ok := false
+	var cmd *imap.Command
+	if !c.noUTF8 {
+		fields := crit.fields(func(s string) imap.Field { return c.c.Quote(s) })
+		if cmd, err = c.wait(c.c.UIDSearch(fields...)); err != nil {
+			c.logger.Debug("UIDSearch", "fields", fields, "error", err)
+			if errors.Is(err, ErrBadCharset) {
+				c.noUTF8 = true
+			} else {
+				return nil, err
+			}
+		} else {
+			ok = true
+		}
+	}
+	if !ok && c.noUTF8 {
+		fields := crit.fields(func(s string) imap.Field { return c.c.Quote(imap.UTF7Encode(s)) })
+		cmd, err = c.wait(c.c.Send("UID SEARCH", fields))
+		c.logger.Debug("UID SEARCH", "fields", fields, "error", err)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err = cmd.Result(imap.OK); err != nil {
+		return nil, err
+	}
+	c.logger.Debug("Search", "data", cmd.Data)
+	var uids []uint32
+	for _, resp := range cmd.Data {
+		uids = append(uids, resp.SearchResults()...)
+	}
+	return uids, nil
+}
+
+// Match reports whether the message matches crit, evaluated on the client
+// side - for Client implementations without a server-side search.
+// Raw search keys are ignored.
+func (crit SearchCriteria) Match(body []byte, flags imap.FlagSet, internalDate time.Time) bool {
+	contains := func(s, sub string) bool {
+		return sub == "" || strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	day := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	var hdr mail.Header
+	var text []byte
+	if parsed, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+		hdr = parsed.Header
+		text, _ = io.ReadAll(parsed.Body)
+	}
+	if !contains(hdr.Get("From"), crit.From) || !contains(hdr.Get("To"), crit.To) ||
+		!contains(hdr.Get("Cc"), crit.Cc) || !contains(hdr.Get("Subject"), crit.Subject) ||
+		!contains(string(text), crit.Body) || !contains(string(body), crit.Text) {
+		return false
+	}
+	for k, v := range crit.Header {
+		if _, ok := hdr[textproto.CanonicalMIMEHeaderKey(k)]; !ok || !contains(hdr.Get(k), v) {
+			return false
+		}
+	}
+	if !crit.Since.IsZero() && day(internalDate).Before(day(crit.Since)) ||
+		!crit.Before.IsZero() && !day(internalDate).Before(day(crit.Before)) {
+		return false
+	}
+	if age := time.Since(internalDate); crit.Younger > 0 && age >= crit.Younger ||
+		crit.Older > 0 && age <= crit.Older {
+		return false
+	}
+	if !crit.SentSince.IsZero() || !crit.SentBefore.IsZero() {
+		sent, err := hdr.Date()
+		if err != nil ||
+			!crit.SentSince.IsZero() && day(sent).Before(day(crit.SentSince)) ||
+			!crit.SentBefore.IsZero() && !day(sent).Before(day(crit.SentBefore)) {
+			return false
+		}
+	}
+	return crit.MatchFlags(flags, uint32(len(body)))
+}
+
+// MatchFlags reports whether the flags and the size match crit - the
+// conditions Match checks without the message.
+func (crit SearchCriteria) MatchFlags(flags imap.FlagSet, size uint32) bool {
+	for _, flag := range crit.WithFlags {
+		if !flags[flag] {
+			return false
+		}
+	}
+	for _, flag := range crit.WithoutFlags {
+		if flags[flag] {
+			return false
+		}
+	}
+	return !(crit.Larger > 0 && size <= crit.Larger || crit.Smaller > 0 && size >= crit.Smaller)
+}
+
+// NeedsHeader reports whether crit has conditions on the header fields,
+// so Match needs at least the header of the message.
+func (crit SearchCriteria) NeedsHeader() bool {
+	return crit.NeedsBody() || crit.From != "" || crit.To != "" || crit.Cc != "" ||
+		crit.Subject != "" || len(crit.Header) != 0 || !crit.SentSince.IsZero() || !crit.SentBefore.IsZero()
+}
+
+// NeedsBody reports whether crit has conditions on the body, so Match
+// needs the whole message.
+func (crit SearchCriteria) NeedsBody() bool {
+	return crit.Body != "" || crit.Text != ""
+}
@@ -0,0 +1,297 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMessage is a message of fakeServer.
+type fakeMessage struct {
+	uid   uint32
+	flags []string
+	body  string
+}
+
+// fakeServer is a minimal IMAP4rev1 server with one mailbox (INBOX),
+// answering the commands the client sends in the tests and benchmarks.
+type fakeServer struct {
+	mu   sync.Mutex
+	msgs []*fakeMessage
+}
+
+// newFakeServer returns a fakeServer with n messages of the given body.
+func newFakeServer(n int, body string) *fakeServer {
+	s := &fakeServer{}
+	for i := 1; i <= n; i++ {
+		s.msgs = append(s.msgs, &fakeMessage{uid: uint32(i), body: body})
+	}
+	return s
+}
+
+// dialer returns a Dialer connecting to the server through net.Pipe.
+func (s *fakeServer) dialer() Dialer {
+	return DialerFunc(func(_, _ string) (net.Conn, error) {
+		cConn, sConn := net.Pipe()
+		go s.serve(sConn)
+		return cConn, nil
+	})
+}
+
+// newFakeClient returns a connected client of a fakeServer with n messages.
+func newFakeClient(tb testing.TB, n int, body string, opts ...Option) (Client, *fakeServer) {
+	tb.Helper()
+	s := newFakeServer(n, body)
+	c := NewClientWithOptions("localhost", append([]Option{
+		WithPort(143), WithoutTLS(), WithAllowCleartext(), WithAuth("user", "secret"),
+		WithDialer(s.dialer()),
+	}, opts...)...)
+	if err := c.Connect(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close(false) })
+	return c, s
+}
+
+var fakeBodyItem = regexp.MustCompile(`BODY(?:\.PEEK)?\[\](?:<(\d+)\.(\d+)>)?`)
+
+// serve answers the commands read from conn, till LOGOUT.
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	bw := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format+"\r\n", args...)
+	}
+	reply("* OK [CAPABILITY IMAP4rev1 UIDPLUS] fake server ready")
+	bw.Flush()
+	for {
+		line, err := readFakeCommand(br, bw)
+		if err != nil {
+			return
+		}
+		tag, rest, _ := cutFake(line, " ")
+		name, args, _ := cutFake(rest, " ")
+		name = strings.ToUpper(name)
+		if name == "UID" {
+			name, args, _ = cutFake(args, " ")
+			name = "UID " + strings.ToUpper(name)
+		}
+		switch name {
+		case "CAPABILITY":
+			reply("* CAPABILITY IMAP4rev1 UIDPLUS")
+			reply("%s OK CAPABILITY completed", tag)
+		case "LOGIN":
+			reply("%s OK [CAPABILITY IMAP4rev1 UIDPLUS] LOGIN completed", tag)
+		case "NOOP", "CHECK", "UNSELECT", "CLOSE", "EXPUNGE", "UID EXPUNGE":
+			reply("%s OK %s completed", tag, name)
+		case "SELECT", "EXAMINE":
+			s.mu.Lock()
+			reply("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)")
+			reply("* %d EXISTS", len(s.msgs))
+			reply("* 0 RECENT")
+			reply("* OK [UIDVALIDITY 1] UIDs valid")
+			reply("* OK [UIDNEXT %d] next UID", len(s.msgs)+1)
+			s.mu.Unlock()
+			mode := "READ-WRITE"
+			if name == "EXAMINE" {
+				mode = "READ-ONLY"
+			}
+			reply("%s OK [%s] %s completed", tag, mode, name)
+		case "LIST", "LSUB":
+			reply(`* %s (\HasNoChildren) "/" INBOX`, name)
+			reply("%s OK %s completed", tag, name)
+		case "UID SEARCH":
+			s.mu.Lock()
+			uids := make([]string, len(s.msgs))
+			for i, m := range s.msgs {
+				uids[i] = strconv.FormatUint(uint64(m.uid), 10)
+			}
+			s.mu.Unlock()
+			reply("* SEARCH %s", strings.Join(uids, " "))
+			reply("%s OK SEARCH completed", tag)
+		case "UID FETCH":
+			set, items, _ := cutFake(args, " ")
+			s.fetch(bw, set, items)
+			reply("%s OK FETCH completed", tag)
+		case "UID STORE":
+			set, items, _ := cutFake(args, " ")
+			s.store(bw, set, items)
+			reply("%s OK STORE completed", tag)
+		case "LOGOUT":
+			reply("* BYE logging out")
+			reply("%s OK LOGOUT completed", tag)
+			bw.Flush()
+			return
+		default:
+			reply("%s BAD unknown command %s", tag, name)
+		}
+		if bw.Flush() != nil {
+			return
+		}
+	}
+}
+
+// readFakeCommand reads a command line, with its literals.
+func readFakeCommand(br *bufio.Reader, bw *bufio.Writer) (string, error) {
+	var buf strings.Builder
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		buf.WriteString(line)
+		i := strings.LastIndexByte(line, '{')
+		if i < 0 || !strings.HasSuffix(line, "}") {
+			return buf.String(), nil
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(line[i+1:len(line)-1], "+"))
+		if err != nil {
+			return buf.String(), nil
+		}
+		if !strings.HasSuffix(line, "+}") {
+			bw.WriteString("+ go ahead\r\n")
+			bw.Flush()
+		}
+		lit := make([]byte, n)
+		if _, err = io.ReadFull(br, lit); err != nil {
+			return "", err
+		}
+		buf.Write(lit)
+	}
+}
+
+// matching returns the sequence numbers and the messages of the UID set.
+func (s *fakeServer) matching(set string) ([]int, []*fakeMessage) {
+	var seqs []int
+	var msgs []*fakeMessage
+	for _, r := range strings.Split(set, ",") {
+		lo, hi, isRange := cutFake(r, ":")
+		if !isRange {
+			hi = lo
+		}
+		from, _ := strconv.ParseUint(lo, 10, 32)
+		to, _ := strconv.ParseUint(hi, 10, 32)
+		if hi == "*" {
+			to = 1<<32 - 1
+		}
+		if lo == "*" {
+			from = 1<<32 - 1
+		}
+		if from > to {
+			from, to = to, from
+		}
+		for i, m := range s.msgs {
+			if uint64(m.uid) >= from && uint64(m.uid) <= to {
+				seqs = append(seqs, i+1)
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	return seqs, msgs
+}
+
+func (s *fakeServer) fetch(bw *bufio.Writer, set, items string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upper := strings.ToUpper(items)
+	seqs, msgs := s.matching(set)
+	for i, m := range msgs {
+		fmt.Fprintf(bw, "* %d FETCH (UID %d", seqs[i], m.uid)
+		if strings.Contains(upper, "FLAGS") {
+			fmt.Fprintf(bw, " FLAGS (%s)", strings.Join(m.flags, " "))
+		}
+		if strings.Contains(upper, "RFC822.SIZE") {
+			fmt.Fprintf(bw, " RFC822.SIZE %d", len(m.body))
+		}
+		if sub := fakeBodyItem.FindStringSubmatch(upper); sub != nil {
+			data := m.body
+			if sub[1] != "" {
+				off, _ := strconv.Atoi(sub[1])
+				n, _ := strconv.Atoi(sub[2])
+				if off > len(data) {
+					off = len(data)
+				}
+				if data = data[off:]; n < len(data) {
+					data = data[:n]
+				}
+				fmt.Fprintf(bw, " BODY[]<%d> {%d}\r\n%s", off, len(data), data)
+			} else {
+				fmt.Fprintf(bw, " BODY[] {%d}\r\n%s", len(data), data)
+			}
+		}
+		bw.WriteString(")\r\n")
+	}
+}
+
+func (s *fakeServer) store(bw *bufio.Writer, set, items string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, value, _ := cutFake(items, " ")
+	item = strings.ToUpper(item)
+	flags := strings.Fields(strings.Trim(value, "()"))
+	seqs, msgs := s.matching(set)
+	for i, m := range msgs {
+		switch strings.TrimSuffix(item, ".SILENT") {
+		case "FLAGS":
+			m.flags = append(m.flags[:0], flags...)
+		case "+FLAGS":
+			for _, f := range flags {
+				if !hasFakeFlag(m.flags, f) {
+					m.flags = append(m.flags, f)
+				}
+			}
+		case "-FLAGS":
+			kept := m.flags[:0]
+			for _, f := range m.flags {
+				if !hasFakeFlag(flags, f) {
+					kept = append(kept, f)
+				}
+			}
+			m.flags = kept
+		}
+		if !strings.HasSuffix(item, ".SILENT") {
+			fmt.Fprintf(bw, "* %d FETCH (UID %d FLAGS (%s))\r\n", seqs[i], m.uid, strings.Join(m.flags, " "))
+		}
+	}
+}
+
+func hasFakeFlag(flags []string, f string) bool {
+	for _, g := range flags {
+		if strings.EqualFold(f, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// cutFake slices s around the first sep.
+func cutFake(s, sep string) (before, after string, found bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,650 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// LoadSieve reads the rules from the Sieve (RFC 5228) script file; see ParseSieve.
+func LoadSieve(fileName string, deliver MessageDeliverFunc) ([]Rule, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return ParseSieve(fh, deliver)
+}
+
+// ParseSieve parses a subset of Sieve (RFC 5228) into Rules for Loop, so
+// the routing can be changed without recompiling the program:
+//
+//	require ["fileinto", "imap4flags"];
+//	if header :contains "subject" "invoice" { fileinto "Invoices"; }
+//	elsif address :domain :is "from" ["example.com", "example.org"] { addflag "$Partner"; keep; }
+//	elsif size :over 10M { discard; }
+//
+// Top-level commands are if/elsif/else chains and actions; each if (and
+// each top-level action) ends with an implicit stop, as the Loop applies
+// the first matching rule only. The supported actions are fileinto (MoveTo),
+// addflag / setflag with one flag (Flag), discard (Drop), keep (delivers
+// with deliver) and stop. The supported tests are header, address (:all,
+// :localpart, :domain), exists, size (:over, :under), allof, anyof, not,
+// true and false; with the :is, :contains, :matches and :regex match types,
+// case insensitive.
+//
+// As the implicit keep of Sieve, a block without fileinto and discard
+// delivers the message with deliver, too (like one with keep).
+func ParseSieve(r io.Reader, deliver MessageDeliverFunc) ([]Rule, error) {
+	p := sieveParser{sc: sieveScanner{r: bufio.NewReader(r), line: 1}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	// prev is the negation of the tests of the previous branches of the chain
+	var prev []sieveTest
+	for p.tok.kind != sieveEOF {
+		if p.tok.kind != sieveIdent {
+			return nil, p.errorf("command expected")
+		}
+		line, name := p.tok.line, strings.ToLower(p.tok.text)
+		switch name {
+		case "require":
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			exts, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+			for _, ext := range exts {
+				switch ext {
+				case "fileinto", "imap4flags", "regex":
+				default:
+					return nil, p.errorf("unsupported extension %q", ext)
+				}
+			}
+			if err = p.expect(";"); err != nil {
+				return nil, err
+			}
+			continue
+
+		case "if", "elsif", "else":
+			if name == "if" {
+				prev = nil
+			} else if prev == nil {
+				return nil, p.errorf("%s without if", name)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			var test sieveTest
+			if name != "else" {
+				var err error
+				if test, err = p.test(); err != nil {
+					return nil, err
+				}
+			}
+			rule, err := p.block(deliver)
+			if err != nil {
+				return nil, err
+			}
+			conds := append(prev[:len(prev):len(prev)], test)
+			if test == nil {
+				conds = prev
+			}
+			implicitKeep(&rule, deliver)
+			rule.Name = "line " + strconv.Itoa(line)
+			rule.Cond = allOf(conds)
+			rules = append(rules, rule)
+			if name == "else" {
+				prev = nil
+			} else {
+				prev = append(prev[:len(prev):len(prev)], notTest(test))
+			}
+
+		default:
+			prev = nil
+			var rule Rule
+			if err := p.action(&rule, deliver); err != nil {
+				return nil, err
+			}
+			implicitKeep(&rule, deliver)
+			rule.Name = "line " + strconv.Itoa(line)
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// sieveTest is a compiled Sieve test.
+type sieveTest func(msg *mail.Message, size int64) bool
+
+func allOf(tests []sieveTest) func(*mail.Message, int64) bool {
+	return func(msg *mail.Message, size int64) bool {
+		for _, t := range tests {
+			if !t(msg, size) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func anyOf(tests []sieveTest) sieveTest {
+	return func(msg *mail.Message, size int64) bool {
+		for _, t := range tests {
+			if t(msg, size) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func notTest(t sieveTest) sieveTest {
+	return func(msg *mail.Message, size int64) bool { return !t(msg, size) }
+}
+
+type sieveParser struct {
+	sc  sieveScanner
+	tok sieveToken
+}
+
+func (p *sieveParser) next() error {
+	var err error
+	p.tok, err = p.sc.scan()
+	return err
+}
+
+func (p *sieveParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("sieve line %d: %s", p.tok.line, fmt.Sprintf(format, args...))
+}
+
+// expect consumes the punctuation s.
+func (p *sieveParser) expect(s string) error {
+	if p.tok.kind != sievePunct || p.tok.text != s {
+		return p.errorf("%q expected, got %q", s, p.tok.text)
+	}
+	return p.next()
+}
+
+func (p *sieveParser) isPunct(s string) bool {
+	return p.tok.kind == sievePunct && p.tok.text == s
+}
+
+// stringList parses a string or a string list.
+func (p *sieveParser) stringList() ([]string, error) {
+	if p.tok.kind == sieveString {
+		s := p.tok.text
+		return []string{s}, p.next()
+	}
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	var list []string
+	for {
+		if p.tok.kind != sieveString {
+			return nil, p.errorf("string expected")
+		}
+		list = append(list, p.tok.text)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.isPunct("]") {
+			return list, p.next()
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// tags parses the tagged arguments.
+func (p *sieveParser) tags() ([]string, error) {
+	var tags []string
+	for p.tok.kind == sieveTag {
+		tags = append(tags, strings.ToLower(p.tok.text))
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if tags[len(tags)-1] == ":comparator" {
+			// only the default i;ascii-casemap is supported
+			cmp, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+			if len(cmp) != 1 || cmp[0] != "i;ascii-casemap" {
+				return nil, p.errorf("unsupported comparator %q", cmp)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// test parses a test.
+func (p *sieveParser) test() (sieveTest, error) {
+	if p.tok.kind != sieveIdent {
+		return nil, p.errorf("test expected")
+	}
+	name := strings.ToLower(p.tok.text)
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	switch name {
+	case "true", "false":
+		v := name == "true"
+		return func(*mail.Message, int64) bool { return v }, nil
+	case "not":
+		t, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		return notTest(t), nil
+	case "allof", "anyof":
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var tests []sieveTest
+		for {
+			t, err := p.test()
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, t)
+			if p.isPunct(")") {
+				break
+			}
+			if err = p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if name == "anyof" {
+			return anyOf(tests), nil
+		}
+		return sieveTest(allOf(tests)), nil
+	case "exists":
+		names, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		return func(msg *mail.Message, _ int64) bool {
+			for _, k := range names {
+				if _, ok := msg.Header[textproto.CanonicalMIMEHeaderKey(k)]; !ok {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case "size":
+		tags, err := p.tags()
+		if err != nil {
+			return nil, err
+		}
+		if len(tags) != 1 || tags[0] != ":over" && tags[0] != ":under" {
+			return nil, p.errorf("size needs :over or :under")
+		}
+		if p.tok.kind != sieveNumber {
+			return nil, p.errorf("number expected")
+		}
+		limit, over := p.tok.num, tags[0] == ":over"
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		return func(_ *mail.Message, size int64) bool {
+			return size >= 0 && (over && size > limit || !over && size < limit)
+		}, nil
+	case "header", "address":
+		tags, err := p.tags()
+		if err != nil {
+			return nil, err
+		}
+		names, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		keys, err := p.stringList()
+		if err != nil {
+			return nil, err
+		}
+		match, part := ":is", ":all"
+		for _, t := range tags {
+			switch t {
+			case ":is", ":contains", ":matches", ":regex":
+				match = t
+			case ":all", ":localpart", ":domain":
+				if name != "address" {
+					return nil, p.errorf("%s for header", t)
+				}
+				part = t
+			case ":comparator":
+			default:
+				return nil, p.errorf("unsupported tag %s", t)
+			}
+		}
+		matches, err := sieveMatcher(match, keys)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if name == "header" {
+			return func(msg *mail.Message, _ int64) bool {
+				for _, k := range names {
+					for _, v := range msg.Header[textproto.CanonicalMIMEHeaderKey(k)] {
+						if matches(v) {
+							return true
+						}
+					}
+				}
+				return false
+			}, nil
+		}
+		return func(msg *mail.Message, _ int64) bool {
+			for _, k := range names {
+				addrs, _ := msg.Header.AddressList(k)
+				for _, a := range addrs {
+					s := a.Address
+					if part != ":all" {
+						local, domain := s, ""
+						if i := strings.LastIndexByte(s, '@'); i >= 0 {
+							local, domain = s[:i], s[i+1:]
+						}
+						if s = local; part == ":domain" {
+							s = domain
+						}
+					}
+					if matches(s) {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, p.errorf("unsupported test %q", name)
+}
+
+// sieveMatcher returns the case insensitive matcher of the keys.
+func sieveMatcher(match string, keys []string) (func(string) bool, error) {
+	res := make([]*regexp.Regexp, 0, len(keys))
+	for _, k := range keys {
+		var expr string
+		switch match {
+		case ":is":
+			expr = "^" + regexp.QuoteMeta(k) + "$"
+		case ":contains":
+			expr = regexp.QuoteMeta(k)
+		case ":matches":
+			var buf strings.Builder
+			buf.WriteString("^")
+			for _, r := range k {
+				switch r {
+				case '*':
+					buf.WriteString(".*")
+				case '?':
+					buf.WriteString(".")
+				default:
+					buf.WriteString(regexp.QuoteMeta(string(r)))
+				}
+			}
+			buf.WriteString("$")
+			expr = buf.String()
+		case ":regex":
+			expr = k
+		}
+		re, err := regexp.Compile("(?is)" + expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return func(s string) bool {
+		for _, re := range res {
+			if re.MatchString(s) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// block parses the actions of a block into a rule.
+func (p *sieveParser) block(deliver MessageDeliverFunc) (Rule, error) {
+	var rule Rule
+	if err := p.expect("{"); err != nil {
+		return rule, err
+	}
+	for !p.isPunct("}") {
+		if p.tok.kind == sieveEOF {
+			return rule, p.errorf("unterminated block")
+		}
+		if err := p.action(&rule, deliver); err != nil {
+			return rule, err
+		}
+	}
+	return rule, p.next()
+}
+
+// implicitKeep makes the rule deliver the message, unless it has an
+// action cancelling the implicit keep (fileinto or discard).
+func implicitKeep(rule *Rule, deliver MessageDeliverFunc) {
+	if rule.MoveTo == "" && !rule.Drop {
+		rule.Deliver = deliver
+	}
+}
+
+// action parses an action into rule.
+func (p *sieveParser) action(rule *Rule, deliver MessageDeliverFunc) error {
+	if p.tok.kind != sieveIdent {
+		return p.errorf("action expected")
+	}
+	name := strings.ToLower(p.tok.text)
+	if err := p.next(); err != nil {
+		return err
+	}
+	if _, err := p.tags(); err != nil { // :create, :copy and the like
+		return err
+	}
+	switch name {
+	case "fileinto", "addflag", "setflag":
+		args, err := p.stringList()
+		if err != nil {
+			return err
+		}
+		if len(args) != 1 {
+			return p.errorf("%s needs exactly one argument", name)
+		}
+		if name == "fileinto" {
+			if rule.MoveTo != "" {
+				return p.errorf("only one fileinto is supported")
+			}
+			rule.MoveTo = args[0]
+		} else {
+			if rule.Flag != "" {
+				return p.errorf("only one flag is supported")
+			}
+			rule.Flag = args[0]
+		}
+	case "keep":
+		rule.Deliver = deliver
+	case "discard":
+		rule.Drop = true
+	case "stop":
+	case "if", "elsif", "else":
+		return p.errorf("nested %s is not supported", name)
+	default:
+		return p.errorf("unsupported action %q", name)
+	}
+	return p.expect(";")
+}
+
+type sieveTokenKind int
+
+const (
+	sieveEOF = sieveTokenKind(iota)
+	sieveIdent
+	sieveTag
+	sieveString
+	sieveNumber
+	sievePunct
+)
+
+type sieveToken struct {
+	kind sieveTokenKind
+	text string
+	num  int64
+	line int
+}
+
+type sieveScanner struct {
+	r    *bufio.Reader
+	line int
+}
+
+func (sc *sieveScanner) read() (rune, error) {
+	r, _, err := sc.r.ReadRune()
+	if r == '\n' {
+		sc.line++
+	}
+	return r, err
+}
+
+func (sc *sieveScanner) unread(r rune) {
+	sc.r.UnreadRune()
+	if r == '\n' {
+		sc.line--
+	}
+}
+
+func (sc *sieveScanner) scan() (sieveToken, error) {
+	for {
+		r, err := sc.read()
+		if err == io.EOF {
+			return sieveToken{kind: sieveEOF, line: sc.line}, nil
+		} else if err != nil {
+			return sieveToken{}, err
+		}
+		tok := sieveToken{line: sc.line}
+		switch {
+		case unicode.IsSpace(r):
+			continue
+		case r == '#':
+			if _, err = sc.r.ReadString('\n'); err != nil && err != io.EOF {
+				return tok, err
+			}
+			sc.line++
+			continue
+		case r == '/':
+			if next, _ := sc.read(); next != '*' {
+				return tok, fmt.Errorf("sieve line %d: unexpected '/'", tok.line)
+			}
+			for prev := rune(0); ; {
+				c, err := sc.read()
+				if err != nil {
+					return tok, fmt.Errorf("sieve line %d: unterminated comment", tok.line)
+				}
+				if prev == '*' && c == '/' {
+					break
+				}
+				prev = c
+			}
+			continue
+		case r == '"':
+			var buf strings.Builder
+			for {
+				c, err := sc.read()
+				if err != nil {
+					return tok, fmt.Errorf("sieve line %d: unterminated string", tok.line)
+				}
+				if c == '"' {
+					break
+				}
+				if c == '\\' {
+					if c, err = sc.read(); err != nil {
+						return tok, fmt.Errorf("sieve line %d: unterminated string", tok.line)
+					}
+				}
+				buf.WriteRune(c)
+			}
+			tok.kind, tok.text = sieveString, buf.String()
+			return tok, nil
+		case strings.ContainsRune(";,()[]{}", r):
+			tok.kind, tok.text = sievePunct, string(r)
+			return tok, nil
+		case r == ':' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r):
+			var buf strings.Builder
+			buf.WriteRune(r)
+			for {
+				c, err := sc.read()
+				if err != nil {
+					break
+				}
+				if c != '_' && !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+					sc.unread(c)
+					break
+				}
+				buf.WriteRune(c)
+			}
+			tok.text = buf.String()
+			switch {
+			case r == ':':
+				tok.kind = sieveTag
+			case unicode.IsDigit(r):
+				tok.kind = sieveNumber
+				return tok, tok.parseNumber()
+			default:
+				tok.kind = sieveIdent
+			}
+			return tok, nil
+		default:
+			return tok, fmt.Errorf("sieve line %d: unexpected %q", tok.line, r)
+		}
+	}
+}
+
+// parseNumber parses the number with an optional K, M or G quantifier.
+func (tok *sieveToken) parseNumber() error {
+	s, mul := tok.text, int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mul = 1 << 10
+	case "M":
+		mul = 1 << 20
+	case "G":
+		mul = 1 << 30
+	}
+	if mul != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("sieve line %d: bad number %q", tok.line, tok.text)
+	}
+	tok.num = n * mul
+	return nil
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"errors"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// SortField is a sort criterion of RFC 5256.
+type SortField string
+
+// The sort criteria.
+const (
+	SortArrival SortField = "ARRIVAL"
+	SortCc      SortField = "CC"
+	SortDate    SortField = "DATE"
+	SortFrom    SortField = "FROM"
+	SortSize    SortField = "SIZE"
+	SortSubject SortField = "SUBJECT"
+	SortTo      SortField = "TO"
+)
+
+// SortKey is a sort criterion, with its direction.
+type SortKey struct {
+	Field   SortField
+	Reverse bool
+}
+
+// Sort selects mbox, and returns the UIDs of the messages matching search,
+// ordered by the criteria (newest first with []SortKey{{SortDate, true}}).
+//
+// Uses UID SORT if the server supports it, sorts the fetched envelopes otherwise.
+func (c *client) Sort(mbox string, criteria []SortKey, search SearchCriteria) ([]uint32, error) {
+	c.enter()
+	defer c.leave()
+	if c.c.Caps["SORT"] && !c.noUTF8 {
+		uids, err := c.serverSort(mbox, criteria, search)
+		if err == nil || !errors.Is(err, ErrBadCharset) {
+			return uids, err
+		}
+		c.noUTF8 = true
+	}
+
+	uids, err := c.Search(mbox, search)
+	if err != nil || len(uids) == 0 {
+		return uids, err
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+	entries := make([]sortEntry, 0, len(uids))
+	if err = c.retry("Sort", func() error {
+		entries = entries[:0]
+		return c.fetch(set, []string{"ENVELOPE", "RFC822.SIZE", "INTERNALDATE"}, func(resp *imap.Response) error {
+			info := resp.MessageInfo()
+			e := sortEntry{uid: info.UID, arrival: info.InternalDate, size: info.Size}
+			if env := imap.AsList(info.Attrs["ENVELOPE"]); len(env) >= 7 {
+				e.date, _ = mail.ParseDate(imap.AsString(env[0]))
+				e.subject = imap.AsString(env[1])
+				e.from = firstMailbox(envelopeAddresses(env[2]))
+				e.to = firstMailbox(envelopeAddresses(env[5]))
+				e.cc = firstMailbox(envelopeAddresses(env[6]))
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return sortEntries(entries, criteria), nil
+}
+
+func (c *client) serverSort(mbox string, criteria []SortKey, search SearchCriteria) ([]uint32, error) {
+	if err := c.selectMailbox(mbox); err != nil {
+		return nil, err
+	}
+	keys := make([]imap.Field, 0, 2*len(criteria))
+	for _, k := range criteria {
+		if k.Reverse {
+			keys = append(keys, imap.Field("REVERSE"))
+		}
+		keys = append(keys, imap.Field(string(k.Field)))
+	}
+	if len(keys) == 0 {
+		keys = append(keys, imap.Field(string(SortArrival)))
+	}
+	fields := append([]imap.Field{keys, imap.Field("UTF-8")},
+		c.within(search).fields(func(s string) imap.Field { return c.c.Quote(s) })...)
+	var cmd *imap.Command
+	if err := c.retry("UID SORT", func() error {
+		var err error
+		cmd, err = c.wait(c.c.Send("UID SORT", fields...))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, resp := range append(cmd.Data, c.c.Data...) {
+		if resp.Label != "SORT" {
+			continue
+		}
+		for _, f := range resp.Fields[1:] {
+			uids = append(uids, imap.AsNumber(f))
+		}
+	}
+	c.c.Data = nil
+	return uids, nil
+}
+
+// SortMessage holds the sort criteria values of a message, for SortMessages.
+type SortMessage struct {
+	UID          uint32
+	InternalDate time.Time
+	Size         uint32
+	// Header is the header of the message, nil if unknown.
+	Header mail.Header
+}
+
+// SortMessages orders msgs by the criteria (ties broken by UID), and returns
+// their UIDs - for Client implementations without a server-side sort.
+func SortMessages(msgs []SortMessage, criteria []SortKey) []uint32 {
+	entries := make([]sortEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		e := sortEntry{uid: msg.UID, arrival: msg.InternalDate, size: msg.Size}
+		if msg.Header != nil {
+			e.date, _ = msg.Header.Date()
+			e.subject = msg.Header.Get("Subject")
+			for _, x := range []struct {
+				dst *string
+				key string
+			}{{&e.from, "From"}, {&e.to, "To"}, {&e.cc, "Cc"}} {
+				addrs, _ := msg.Header.AddressList(x.key)
+				*x.dst = firstMailbox(addrs)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return sortEntries(entries, criteria)
+}
+
+// sortEntry holds the sort criteria values of a message.
+type sortEntry struct {
+	uid           uint32
+	arrival, date time.Time
+	from, to, cc  string
+	subject       string
+	size          uint32
+}
+
+// sortEntries sorts the entries by the criteria (ties broken by UID),
+// and returns their UIDs.
+func sortEntries(entries []sortEntry, criteria []SortKey) []uint32 {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		for _, k := range criteria {
+			cmp := compareSortEntries(a, b, k.Field)
+			if k.Reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return a.uid < b.uid
+	})
+	uids := make([]uint32, len(entries))
+	for i, e := range entries {
+		uids[i] = e.uid
+	}
+	return uids
+}
+
+func compareSortEntries(a, b sortEntry, field SortField) int {
+	switch field {
+	case SortArrival:
+		return compareTimes(a.arrival, b.arrival)
+	case SortDate:
+		da, db := a.date, b.date
+		if da.IsZero() {
+			da = a.arrival
+		}
+		if db.IsZero() {
+			db = b.arrival
+		}
+		return compareTimes(da, db)
+	case SortFrom:
+		return strings.Compare(strings.ToLower(a.from), strings.ToLower(b.from))
+	case SortTo:
+		return strings.Compare(strings.ToLower(a.to), strings.ToLower(b.to))
+	case SortCc:
+		return strings.Compare(strings.ToLower(a.cc), strings.ToLower(b.cc))
+	case SortSubject:
+		return strings.Compare(baseSubject(a.subject), baseSubject(b.subject))
+	case SortSize:
+		switch {
+		case a.size < b.size:
+			return -1
+		case a.size > b.size:
+			return 1
+		}
+	}
+	return 0
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// baseSubject returns the subject without the "Re:", "Fwd:" prefixes and
+// "(fwd)" suffixes, lowercased - a simplification of RFC 5256 base subject.
+func baseSubject(subject string) string {
+	s := strings.ToLower(strings.TrimSpace(subject))
+	for {
+		trimmed := strings.TrimSpace(strings.TrimSuffix(s, "(fwd)"))
+		for _, prefix := range []string{"re:", "fw:", "fwd:"} {
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, prefix))
+		}
+		if trimmed == s {
+			return s
+		}
+		s = trimmed
+	}
+}
+
+// firstMailbox returns the address of the first mailbox, or "".
+func firstMailbox(addrs []*mail.Address) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0].Address
+}
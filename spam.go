@@ -0,0 +1,175 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// JunkKeyword marks the messages as spam, for the learning filters - "$Junk" by default.
+	JunkKeyword = "$Junk"
+	// NotJunkKeyword marks the messages as ham - "$NotJunk" by default.
+	NotJunkKeyword = "$NotJunk"
+)
+
+// MarkSpam flags the messages of the selected mailbox with JunkKeyword
+// (clearing NotJunkKeyword), and moves them to the Junk mailbox (see SpecialUse).
+// Failing to set the keywords (on servers not allowing keywords) is just logged.
+func MarkSpam(c Client, uids ...uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	setKeywords(c, uids, JunkKeyword, NotJunkKeyword)
+	return c.MoveToJunk(uids...)
+}
+
+// MarkHam flags the messages of the selected mailbox (usually Junk) with
+// NotJunkKeyword (clearing JunkKeyword), and moves them to mbox ("INBOX" if empty).
+func MarkHam(c Client, mbox string, uids ...uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	if mbox == "" {
+		mbox = "INBOX"
+	}
+	setKeywords(c, uids, NotJunkKeyword, JunkKeyword)
+	return c.MoveMany(uids, mbox)
+}
+
+// setKeywords sets set and clears clear on the messages, logging the errors.
+func setKeywords(c Client, uids []uint32, set, clear string) {
+	if err := c.SetFlagsSilent(uids, set, true); err != nil {
+		Log.Warn("set keyword", "uids", uids, "keyword", set, "error", err)
+		return
+	}
+	if err := c.SetFlagsSilent(uids, clear, false); err != nil {
+		Log.Warn("clear keyword", "uids", uids, "keyword", clear, "error", err)
+	}
+}
+
+// SpamClassifier decides whether a message is spam.
+type SpamClassifier interface {
+	IsSpam(r io.Reader) (bool, error)
+}
+
+// Spamc is a SpamClassifier which asks spamd (SpamAssassin) with the spamc
+// protocol, with the CHECK command.
+type Spamc struct {
+	// Addr is the address of spamd - "localhost:783" if empty,
+	// or a path of a unix socket if it starts with "/".
+	Addr string
+	// User is the user whose preferences are used, if not empty.
+	User string
+	// Timeout is the timeout of the whole check - Timeout if zero.
+	Timeout time.Duration
+}
+
+// IsSpam sends the message to spamd, and returns its verdict.
+func (s Spamc) IsSpam(r io.Reader) (bool, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	network, addr := "tcp", s.Addr
+	if addr == "" {
+		addr = "localhost:783"
+	} else if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = Timeout
+	}
+	conn, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	var req bytes.Buffer
+	req.WriteString("CHECK SPAMC/1.5\r\nContent-length: " + strconv.Itoa(len(body)) + "\r\n")
+	if s.User != "" {
+		req.WriteString("User: " + s.User + "\r\n")
+	}
+	req.WriteString("\r\n")
+	req.Write(body)
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return false, err
+	}
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+// parseSpamdResponse parses the response of CHECK:
+//
+//	SPAMD/1.1 0 EX_OK
+//	Spam: True ; 15.0 / 5.0
+func parseSpamdResponse(br *bufio.Reader) (bool, error) {
+	status, err := br.ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("spamd: %w", err)
+	}
+	if fields := strings.Fields(status); len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") || fields[1] != "0" {
+		return false, fmt.Errorf("spamd: %s", strings.TrimSpace(status))
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimSpace(line); line == "" {
+			if err == nil {
+				continue
+			}
+			return false, fmt.Errorf("spamd: no Spam header: %w", err)
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(line[:i], "Spam") {
+			verdict := line[i+1:]
+			if j := strings.IndexByte(verdict, ';'); j >= 0 {
+				verdict = verdict[:j]
+			}
+			verdict = strings.TrimSpace(verdict)
+			return strings.EqualFold(verdict, "True") || strings.EqualFold(verdict, "Yes"), nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("spamd: no Spam header: %w", err)
+		}
+	}
+}
+
+// isSpam asks the Spam classifier of the loop about the message, failing open.
+func (l *Loop) isSpam(uid uint32, body io.ReadSeeker) bool {
+	if l.Spam == nil {
+		return false
+	}
+	spam, err := l.Spam.IsSpam(body)
+	if _, seekErr := body.Seek(0, io.SeekStart); err == nil {
+		err = seekErr
+	}
+	if err != nil {
+		Log.Warn("spam check", "uid", uid, "error", err)
+		return false
+	}
+	return spam
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The special-use mailbox attributes of RFC 6154.
+const (
+	UseAll     = `\All`
+	UseArchive = `\Archive`
+	UseDrafts  = `\Drafts`
+	UseFlagged = `\Flagged`
+	UseJunk    = `\Junk`
+	UseSent    = `\Sent`
+	UseTrash   = `\Trash`
+)
+
+// SpecialUseNames are the usual names of the special-use mailboxes, tried
+// (case-insensitively, also under INBOX) when the server does not mark any
+// mailbox with the attribute.
+var SpecialUseNames = map[string][]string{
+	UseArchive: {"Archive", "Archives"},
+	UseDrafts:  {"Drafts", "Draft"},
+	UseJunk:    {"Junk", "Spam", "Junk E-mail", "Junk Email", "Bulk Mail"},
+	UseSent:    {"Sent", "Sent Items", "Sent Messages", "Sent Mail"},
+	UseTrash:   {"Trash", "Deleted Items", "Deleted Messages", "Deleted"},
+}
+
+// WithSpecialUse sets the mailbox names of the special uses
+// (such as UseTrash: "Papierkorb"), overriding the discovery.
+func WithSpecialUse(mapping map[string]string) Option {
+	return func(c *client) { c.specialUse = mapping }
+}
+
+// SpecialUse returns the name of the mailbox of the special use (such as UseTrash):
+// the one set with WithSpecialUse, or the one marked with the attribute by
+// the server (RFC 6154), or the one with a name in SpecialUseNames.
+//
+// Returns an ErrMailboxNotFound error if there is no such mailbox.
+func (c *client) SpecialUse(use string) (string, error) {
+	if name := c.specialUse[use]; name != "" {
+		return name, nil
+	}
+	c.enter()
+	defer c.leave()
+	if name, ok := c.specialUseCache[use]; ok {
+		return name, nil
+	}
+	mboxes, err := c.Mailboxes("*")
+	if err != nil {
+		return "", err
+	}
+	name, ok := findSpecialUse(use, mboxes)
+	if !ok {
+		return "", &Error{Op: "SpecialUse", Kind: ErrMailboxNotFound, Err: fmt.Errorf("no %s mailbox", use)}
+	}
+	if c.specialUseCache == nil {
+		c.specialUseCache = make(map[string]string)
+	}
+	c.specialUseCache[use] = name
+	return name, nil
+}
+
+// findSpecialUse returns the mailbox with the special-use attribute,
+// or with one of the SpecialUseNames.
+func findSpecialUse(use string, mboxes []Mailbox) (string, bool) {
+	for _, m := range mboxes {
+		for attr := range m.Attrs {
+			if strings.EqualFold(attr, use) {
+				return m.Name, true
+			}
+		}
+	}
+	for _, name := range SpecialUseNames[use] {
+		for _, m := range mboxes {
+			if !m.Selectable() {
+				continue
+			}
+			if strings.EqualFold(m.Name, name) ||
+				m.Delim != "" && strings.EqualFold(m.Name, "INBOX"+m.Delim+name) {
+				return m.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// MoveToTrash moves the messages of the selected mailbox to the Trash
+// mailbox (see SpecialUse).
+func (c *client) MoveToTrash(uids ...uint32) error {
+	return c.moveToSpecial(UseTrash, uids)
+}
+
+// MoveToJunk moves the messages of the selected mailbox to the Junk
+// mailbox (see SpecialUse).
+func (c *client) MoveToJunk(uids ...uint32) error {
+	return c.moveToSpecial(UseJunk, uids)
+}
+
+func (c *client) moveToSpecial(use string, uids []uint32) error {
+	mbox, err := c.SpecialUse(use)
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	c.enter()
+	defer c.leave()
+	// the name is the server's: no personal prefix or delimiter translation
+	return c.moveMany(uids, mbox)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+)
+
+// SpoolMemoryLimit is the size above which the default spool of the delivery
+// loop moves the message body into a temporary file - 1MiB by default.
+var SpoolMemoryLimit = 1 << 20
+
+// BodyBuffer holds a message body for the delivery: it is written first,
+// then read (and seeked), then closed, which releases its resources.
+type BodyBuffer interface {
+	io.Writer
+	io.ReadSeeker
+	io.Closer
+}
+
+// NewSpool returns a BodyBuffer which holds the body in memory up to
+// memLimit bytes, and in a temporary file (removed on Close) above that.
+func NewSpool(memLimit int) BodyBuffer {
+	return &spool{limit: memLimit}
+}
+
+type spool struct {
+	limit   int
+	buf     bytes.Buffer
+	file    *os.File
+	r       *bytes.Reader
+	reading bool
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.reading {
+		return 0, errors.New("spool: write after read")
+	}
+	if s.file == nil && s.buf.Len()+len(p) <= s.limit {
+		return s.buf.Write(p)
+	}
+	if s.file == nil {
+		fh, err := os.CreateTemp("", "imapclient-spool-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = fh
+		if _, err = fh.Write(s.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+	return s.file.Write(p)
+}
+
+// read switches to reading, at the start of the body.
+func (s *spool) read() error {
+	if s.reading {
+		return nil
+	}
+	s.reading = true
+	if s.file != nil {
+		_, err := s.file.Seek(0, io.SeekStart)
+		return err
+	}
+	s.r = bytes.NewReader(s.buf.Bytes())
+	return nil
+}
+
+func (s *spool) Read(p []byte) (int, error) {
+	if err := s.read(); err != nil {
+		return 0, err
+	}
+	if s.file != nil {
+		return s.file.Read(p)
+	}
+	return s.r.Read(p)
+}
+
+func (s *spool) Seek(offset int64, whence int) (int64, error) {
+	if err := s.read(); err != nil {
+		return 0, err
+	}
+	if s.file != nil {
+		return s.file.Seek(offset, whence)
+	}
+	return s.r.Seek(offset, whence)
+}
+
+// Close releases the memory, and removes the temporary file.
+func (s *spool) Close() error {
+	s.buf, s.r = bytes.Buffer{}, nil
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	if rmErr := os.Remove(s.file.Name()); err == nil {
+		err = rmErr
+	}
+	s.file = nil
+	return err
+}
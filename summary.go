@@ -0,0 +1,313 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"encoding/json"
+	"io"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// SummaryClient is a Client which can fetch the summaries of the messages,
+// with their body structure, in one UID FETCH.
+type SummaryClient interface {
+	Client
+	Summaries(mbox string, uids []uint32) ([]MessageSummary, error)
+}
+
+var _ SummaryClient = (*client)(nil)
+
+// MessageSummary is the summary of a message, for the machine-readable
+// (JSON) listings.
+type MessageSummary struct {
+	Mailbox      string    `json:"mailbox,omitempty"`
+	UID          uint32    `json:"uid"`
+	Flags        []string  `json:"flags"`
+	Size         uint32    `json:"size"`
+	InternalDate time.Time `json:"internalDate"`
+	Envelope     *Envelope `json:"envelope,omitempty"`
+	// Structure is the outline of the MIME structure, nil if unknown.
+	Structure *BodyPart `json:"structure,omitempty"`
+}
+
+// BodyPart is the outline of a MIME part, parsed from BODYSTRUCTURE.
+type BodyPart struct {
+	// Part is the part specifier, such as "1" or "2.1" (as for ReadBinaryTo);
+	// empty for the message itself.
+	Part string `json:"part,omitempty"`
+	// Type is the lowercase media type, such as "text/plain" or "multipart/mixed".
+	Type        string            `json:"type"`
+	Params      map[string]string `json:"params,omitempty"`
+	Encoding    string            `json:"encoding,omitempty"`
+	Size        uint32            `json:"size,omitempty"`
+	Disposition string            `json:"disposition,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	Parts       []*BodyPart       `json:"parts,omitempty"`
+}
+
+// MarshalJSON returns the envelope as a JSON object, with the addresses
+// as {"name", "address"} objects.
+func (env *Envelope) MarshalJSON() ([]byte, error) {
+	type address struct {
+		Name    string `json:"name,omitempty"`
+		Address string `json:"address"`
+	}
+	addrs := func(list []*mail.Address) []address {
+		if len(list) == 0 {
+			return nil
+		}
+		res := make([]address, len(list))
+		for i, a := range list {
+			res[i] = address{Name: a.Name, Address: a.Address}
+		}
+		return res
+	}
+	var date *time.Time
+	if !env.Date.IsZero() {
+		date = &env.Date
+	}
+	return json.Marshal(struct {
+		Date      *time.Time `json:"date,omitempty"`
+		Subject   string     `json:"subject"`
+		From      []address  `json:"from,omitempty"`
+		Sender    []address  `json:"sender,omitempty"`
+		ReplyTo   []address  `json:"replyTo,omitempty"`
+		To        []address  `json:"to,omitempty"`
+		Cc        []address  `json:"cc,omitempty"`
+		Bcc       []address  `json:"bcc,omitempty"`
+		InReplyTo string     `json:"inReplyTo,omitempty"`
+		MessageID string     `json:"messageId,omitempty"`
+	}{date, env.Subject, addrs(env.From), addrs(env.Sender), addrs(env.ReplyTo),
+		addrs(env.To), addrs(env.Cc), addrs(env.Bcc), env.InReplyTo, env.MessageID})
+}
+
+// Summaries selects mbox, and returns the summaries of the messages,
+// fetched in one UID FETCH, in the order of uids.
+func (c *client) Summaries(mbox string, uids []uint32) ([]MessageSummary, error) {
+	c.enter()
+	defer c.leave()
+	if len(uids) == 0 {
+		return []MessageSummary{}, nil
+	}
+	if err := c.selectMailbox(mbox); err != nil {
+		return nil, err
+	}
+	set := &imap.SeqSet{}
+	set.AddNum(uids...)
+	byUID := make(map[uint32]MessageSummary, len(uids))
+	if err := c.retry("Summaries", func() error {
+		return c.fetch(set, []string{"FLAGS", "RFC822.SIZE", "INTERNALDATE", "ENVELOPE", "BODYSTRUCTURE"}, func(resp *imap.Response) error {
+			info := resp.MessageInfo()
+			if info == nil {
+				return nil
+			}
+			byUID[info.UID] = MessageSummary{
+				Mailbox: mbox, UID: info.UID, Flags: sortedFlags(info.Flags),
+				Size: info.Size, InternalDate: info.InternalDate,
+				Envelope:  parseEnvelope(info.Attrs["ENVELOPE"]),
+				Structure: parseBodyStructure(info.Attrs["BODYSTRUCTURE"], ""),
+			}
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+	sums := make([]MessageSummary, 0, len(byUID))
+	for _, uid := range uids {
+		if s, ok := byUID[uid]; ok {
+			sums = append(sums, s)
+		}
+	}
+	return sums, nil
+}
+
+// Summaries returns the summaries of the messages of mbox: with
+// a SummaryClient in one UID FETCH, otherwise from ListWithInfo and
+// GetEnvelope, without the body structure.
+func Summaries(c Client, mbox string, uids []uint32) ([]MessageSummary, error) {
+	if sc, ok := c.(SummaryClient); ok {
+		return sc.Summaries(mbox, uids)
+	}
+	infos, err := c.ListWithInfo(mbox, "", true)
+	if err != nil {
+		return nil, err
+	}
+	byUID := make(map[uint32]MessageInfo, len(infos))
+	for _, info := range infos {
+		byUID[info.UID] = info
+	}
+	sums := make([]MessageSummary, 0, len(uids))
+	for _, uid := range uids {
+		info, ok := byUID[uid]
+		if !ok {
+			continue
+		}
+		s := MessageSummary{Mailbox: mbox, UID: uid, Flags: sortedFlags(info.Flags), Size: info.Size, InternalDate: info.InternalDate}
+		if s.Envelope, err = c.GetEnvelope(uid); err != nil {
+			Log.Warn("GetEnvelope", "mbox", mbox, "uid", uid, "error", err)
+		}
+		sums = append(sums, s)
+	}
+	return sums, nil
+}
+
+// SummaryBatch is the number of messages whose summaries DumpJSON fetches at once.
+var SummaryBatch = 1000
+
+// DumpJSON writes the summaries of all the messages of mbox into w, as a
+// JSON array of MessageSummary objects, one per line.
+func DumpJSON(c Client, mbox string, w io.Writer) error {
+	uids, err := c.Search(mbox, SearchCriteria{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if _, err = io.WriteString(w, "["); err != nil {
+		return err
+	}
+	sep := "\n"
+	for len(uids) > 0 {
+		batch := uids
+		if SummaryBatch > 0 && len(batch) > SummaryBatch {
+			batch = batch[:SummaryBatch]
+		}
+		uids = uids[len(batch):]
+		sums, err := Summaries(c, mbox, batch)
+		if err != nil {
+			return err
+		}
+		for _, s := range sums {
+			b, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if _, err = io.WriteString(w, sep+string(b)); err != nil {
+				return err
+			}
+			sep = ",\n"
+		}
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
+
+// sortedFlags returns the flags as a sorted slice, without \Recent.
+func sortedFlags(flags imap.FlagSet) []string {
+	res := make([]string, 0, len(flags))
+	for f := range flags {
+		if f != `\Recent` {
+			res = append(res, f)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// parseBodyStructure parses a BODYSTRUCTURE (or a part of it) with the
+// part specifier part - only the fields of the outline.
+func parseBodyStructure(f imap.Field, part string) *BodyPart {
+	fields := imap.AsList(f)
+	if len(fields) == 0 {
+		return nil
+	}
+	bp := &BodyPart{Part: part}
+	if imap.TypeOf(fields[0]) == imap.List { // multipart: (part part... subtype params ...)
+		i := 0
+		for ; i < len(fields) && imap.TypeOf(fields[i]) == imap.List; i++ {
+			sub := strconv.Itoa(i + 1)
+			if part != "" {
+				sub = part + "." + sub
+			}
+			if p := parseBodyStructure(fields[i], sub); p != nil {
+				bp.Parts = append(bp.Parts, p)
+			}
+		}
+		subtype := "mixed"
+		if i < len(fields) {
+			subtype = strings.ToLower(imap.AsString(fields[i]))
+		}
+		bp.Type = "multipart/" + subtype
+		if i+1 < len(fields) {
+			bp.Params = bodyParams(fields[i+1])
+		}
+		if i+2 < len(fields) {
+			bp.Disposition, _ = bodyDisposition(fields[i+2])
+		}
+		return bp
+	}
+	if part == "" { // a single part message is part 1
+		bp.Part = "1"
+	}
+	// (type subtype params id description encoding size ...)
+	if len(fields) < 7 {
+		return nil
+	}
+	mainType := strings.ToLower(imap.AsString(fields[0]))
+	bp.Type = mainType + "/" + strings.ToLower(imap.AsString(fields[1]))
+	bp.Params = bodyParams(fields[2])
+	bp.Encoding = strings.ToLower(imap.AsString(fields[5]))
+	bp.Size = imap.AsNumber(fields[6])
+	ext := 7 // the extension fields: md5 disposition language location
+	switch {
+	case mainType == "text":
+		ext++ // lines
+	case bp.Type == "message/rfc822":
+		ext += 3 // envelope body lines
+	}
+	var dparams map[string]string
+	if ext+1 < len(fields) {
+		bp.Disposition, dparams = bodyDisposition(fields[ext+1])
+	}
+	if bp.Filename = dparams["filename"]; bp.Filename == "" {
+		bp.Filename = bp.Params["name"]
+	}
+	bp.Filename = decodeWords(bp.Filename)
+	return bp
+}
+
+// bodyParams parses a body parameter list: ("name" "value" ...), with
+// lowercase names.
+func bodyParams(f imap.Field) map[string]string {
+	list := imap.AsList(f)
+	if len(list) < 2 {
+		return nil
+	}
+	params := make(map[string]string, len(list)/2)
+	for i := 0; i+1 < len(list); i += 2 {
+		params[strings.ToLower(imap.AsString(list[i]))] = imap.AsString(list[i+1])
+	}
+	return params
+}
+
+// bodyDisposition parses a body disposition: ("attachment" ("filename" "x")).
+func bodyDisposition(f imap.Field) (string, map[string]string) {
+	list := imap.AsList(f)
+	if len(list) == 0 {
+		return "", nil
+	}
+	var params map[string]string
+	if len(list) > 1 {
+		params = bodyParams(list[1])
+	}
+	return strings.ToLower(imap.AsString(list[0])), params
+}
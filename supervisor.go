@@ -0,0 +1,140 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RestartDelay is the wait before a Supervisor restarts a crashed loop - 10 seconds by default.
+var RestartDelay = 10 * time.Second
+
+// Supervisor runs several delivery Loops concurrently (e.g. for INBOX and
+// some project folders, possibly of different accounts), restarting the
+// ones which crash (panic).
+type Supervisor struct {
+	mu    sync.Mutex
+	loops []*supervised
+}
+
+// LoopStatus is the status of a supervised Loop.
+type LoopStatus struct {
+	// Name is the name given to Add.
+	Name string
+	// Running is true while the loop runs.
+	Running bool
+	// Rounds and Delivered are the number of rounds and delivered messages.
+	Rounds, Delivered int
+	// Restarts is the number of restarts after a crash.
+	Restarts int
+	// LastRound is the end of the last round, LastError is its error, or the reason of the last crash.
+	LastRound time.Time
+	LastError error
+}
+
+type supervised struct {
+	loop   *Loop
+	status LoopStatus
+}
+
+// NewSupervisor returns a new Supervisor, without loops.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{}
+}
+
+// Add adds the loop under the given name. Must be called before Run.
+func (s *Supervisor) Add(name string, l *Loop) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loops = append(s.loops, &supervised{loop: l, status: LoopStatus{Name: name}})
+}
+
+// Status returns the status of all the loops, in the order of Add.
+func (s *Supervisor) Status() []LoopStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]LoopStatus, len(s.loops))
+	for i, sl := range s.loops {
+		statuses[i] = sl.status
+	}
+	return statuses
+}
+
+// Run runs all the loops, till ctx is cancelled; then waits for them to stop.
+// Returns ctx.Err().
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.mu.Lock()
+	loops := append([]*supervised(nil), s.loops...)
+	s.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, sl := range loops {
+		wg.Add(1)
+		go func(sl *supervised) {
+			defer wg.Done()
+			s.supervise(ctx, sl)
+		}(sl)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// supervise runs the loop, restarting it after RestartDelay if it panics.
+func (s *Supervisor) supervise(ctx context.Context, sl *supervised) {
+	sl.loop.report = func(n int, err error) {
+		s.mu.Lock()
+		sl.status.Rounds++
+		sl.status.Delivered += n
+		sl.status.LastRound, sl.status.LastError = time.Now(), err
+		s.mu.Unlock()
+	}
+	defer func() { sl.loop.report = nil }()
+	for {
+		s.setRunning(sl, true)
+		err := runLoop(ctx, sl.loop)
+		s.setRunning(sl, false)
+		if ctx.Err() != nil {
+			return
+		}
+		Log.Error("loop crashed", "name", sl.status.Name, "error", err)
+		s.mu.Lock()
+		sl.status.Restarts++
+		sl.status.LastError = err
+		s.mu.Unlock()
+		if !sleepContext(ctx, RestartDelay) {
+			return
+		}
+	}
+}
+
+func (s *Supervisor) setRunning(sl *supervised, running bool) {
+	s.mu.Lock()
+	sl.status.Running = running
+	s.mu.Unlock()
+}
+
+// runLoop runs l, converting a panic into an error.
+func runLoop(ctx context.Context, l *Loop) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return l.Run(ctx)
+}
@@ -0,0 +1,368 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/mail"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// SyncResult is the summary of a Sync run.
+type SyncResult struct {
+	Mailboxes, Added, Deleted, FlagsChanged int
+}
+
+// syncState is the state of Sync, by source mailbox name.
+type syncState map[string]*syncMailbox
+
+type syncMailbox struct {
+	UIDValidity uint32 `json:"uidvalidity"`
+	ModSeq      uint64 `json:"modseq,omitempty"`
+	// UIDs maps the source UIDs to the destination UIDs (0 if unknown).
+	UIDs map[uint32]uint32 `json:"uids"`
+	// Flags are the flags of the source messages at the last run.
+	Flags map[uint32][]string `json:"flags"`
+}
+
+// Sync mirrors the mailboxes of src to dst one-way, incrementally: it can be
+// run repeatedly, and each run applies only the changes since the previous
+// one - the new messages are appended, the deleted ones are deleted, and the
+// flag changes are applied on dst.
+//
+// The state (the mapping of the source UIDs to the destination UIDs, and
+// the flags) is kept in the JSON file at statePath. Without UIDPLUS on dst,
+// the new messages are found by their Message-ID.
+//
+// If src supports CONDSTORE (as a ResyncClient), only the changes since the
+// last run are fetched; then the Date header is used as the internal date of
+// the new messages. Otherwise all the messages are listed in each run.
+//
+// The Mailboxes, Rename and Progress options have the same meaning as for
+// Migrate (Progress is called after each new message).
+func Sync(src, dst Client, statePath string, opts MigrateOptions) (SyncResult, error) {
+	var res SyncResult
+	state := make(syncState)
+	if b, err := os.ReadFile(statePath); err == nil {
+		if err = json.Unmarshal(b, &state); err != nil {
+			return res, err
+		}
+	} else if !os.IsNotExist(err) {
+		return res, err
+	}
+	save := func() error {
+		b, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(statePath, b)
+	}
+
+	patterns := opts.Mailboxes
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		mboxes, err := src.Mailboxes(pattern)
+		if err != nil {
+			return res, err
+		}
+		for _, mbox := range mboxes {
+			if seen[mbox.Name] || !mbox.Selectable() {
+				continue
+			}
+			seen[mbox.Name] = true
+			dstName := mbox.Name
+			if opts.Rename != nil {
+				dstName = opts.Rename(mbox.Name)
+			}
+			err := syncMailboxes(src, dst, mbox.Name, dstName, state, &res, opts.Progress)
+			if saveErr := save(); err == nil {
+				err = saveErr
+			}
+			if err != nil {
+				return res, err
+			}
+			res.Mailboxes++
+		}
+	}
+	return res, nil
+}
+
+// syncChange is a new or changed source message.
+type syncChange struct {
+	uid          uint32
+	flags        []string
+	internalDate time.Time
+	messageID    string
+}
+
+func syncMailboxes(src, dst Client, srcName, dstName string, state syncState, res *SyncResult, progress func(MigrateProgress)) error {
+	st, err := src.Status(srcName)
+	if err != nil {
+		return err
+	}
+	ms := state[srcName]
+	if ms == nil || ms.UIDValidity != st.UIDValidity {
+		if ms != nil {
+			Log.Warn("UIDVALIDITY changed, full sync", "mbox", srcName)
+		}
+		ms = &syncMailbox{UIDValidity: st.UIDValidity}
+		state[srcName] = ms
+	}
+	if ms.UIDs == nil {
+		ms.UIDs = make(map[uint32]uint32)
+	}
+	if ms.Flags == nil {
+		ms.Flags = make(map[uint32][]string)
+	}
+	first := len(ms.UIDs) == 0
+	if first {
+		if err = dst.CreateMailbox(dstName); err != nil {
+			Log.Debug("CreateMailbox", "mbox", dstName, "error", err)
+		}
+	}
+
+	changes, vanished, err := syncChanges(src, srcName, ms)
+	if err != nil {
+		return err
+	}
+
+	// the new messages
+	var present map[string]bool
+	if first {
+		// a restarted or reset sync must not duplicate the messages
+		if present, err = messageKeys(dst, dstName); err != nil {
+			return err
+		}
+	}
+	var news int
+	for _, ch := range changes {
+		if _, ok := ms.UIDs[ch.uid]; !ok {
+			news++
+		}
+	}
+	var buf bytes.Buffer
+	var done int
+	var changed []syncChange
+	for _, ch := range changes {
+		if _, ok := ms.UIDs[ch.uid]; ok {
+			changed = append(changed, ch)
+			continue
+		}
+		buf.Reset()
+		if _, err = src.ReadTo(&buf, ch.uid); err != nil {
+			return err
+		}
+		msg, _ := mail.ReadMessage(bytes.NewReader(buf.Bytes()))
+		if ch.messageID == "" && msg != nil {
+			ch.messageID = msg.Header.Get("Message-Id")
+		}
+		if ch.internalDate.IsZero() && msg != nil {
+			ch.internalDate, _ = msg.Header.Date()
+		}
+		var dstUID uint32
+		if key := messageKey(ch.messageID, buf.Bytes()); present[key] {
+			dstUID = findByMessageID(dst, dstName, ch.messageID)
+		} else {
+			if dstUID, err = dst.Append(dstName, ch.flags, ch.internalDate, bytes.NewReader(buf.Bytes())); err != nil {
+				return err
+			}
+			if dstUID == 0 {
+				dstUID = findByMessageID(dst, dstName, ch.messageID)
+			}
+			res.Added++
+		}
+		ms.UIDs[ch.uid], ms.Flags[ch.uid] = dstUID, ch.flags
+		done++
+		if progress != nil {
+			progress(MigrateProgress{Mailbox: srcName, Done: done, Total: news})
+		}
+	}
+
+	if len(changed) == 0 && len(vanished) == 0 {
+		return nil
+	}
+	// select dstName for the flag changes and deletions
+	if _, err = dst.Search(dstName, SearchCriteria{Raw: []imap.Field{imap.Field("UID"), imap.Field("*")}}); err != nil {
+		return err
+	}
+	for _, ch := range changed {
+		if dstUID := ms.UIDs[ch.uid]; dstUID != 0 {
+			n, err := syncFlags(dst, dstUID, ms.Flags[ch.uid], ch.flags)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				res.FlagsChanged++
+			}
+		}
+		ms.Flags[ch.uid] = ch.flags
+	}
+	var expunge []uint32
+	for _, uid := range vanished {
+		if dstUID := ms.UIDs[uid]; dstUID != 0 {
+			if err = dst.MarkDeleted(dstUID); err != nil {
+				return err
+			}
+			expunge = append(expunge, dstUID)
+		}
+		delete(ms.UIDs, uid)
+		delete(ms.Flags, uid)
+		res.Deleted++
+	}
+	if len(expunge) > 0 {
+		if err = dst.Expunge(expunge...); err != nil {
+			Log.Info("Expunge", "mbox", dstName, "error", err)
+		}
+	}
+	return nil
+}
+
+// syncChanges returns the new and changed messages of srcName, and the
+// vanished UIDs, since the state ms, whose ModSeq it updates.
+func syncChanges(src Client, srcName string, ms *syncMailbox) ([]syncChange, []uint32, error) {
+	rc, ok := src.(ResyncClient)
+	if ok && ms.ModSeq > 0 {
+		known := ResyncState{UIDValidity: ms.UIDValidity, ModSeq: ms.ModSeq, KnownUIDs: make([]uint32, 0, len(ms.UIDs))}
+		for uid := range ms.UIDs {
+			known.KnownUIDs = append(known.KnownUIDs, uid)
+		}
+		sort.Slice(known.KnownUIDs, func(i, j int) bool { return known.KnownUIDs[i] < known.KnownUIDs[j] })
+		rr, err := rc.Resync(srcName, known)
+		var notAvailable imap.NotAvailableError
+		if err == nil && !rr.Reset {
+			ms.ModSeq = rr.HighestModSeq
+			changes := make([]syncChange, 0, len(rr.Changed))
+			for uid, flags := range rr.Changed {
+				changes = append(changes, syncChange{uid: uid, flags: appendFlags(flags)})
+			}
+			sortSyncChanges(changes)
+			return changes, rr.Vanished, nil
+		} else if err != nil && !errors.As(err, &notAvailable) {
+			return nil, nil, err
+		}
+	} else if ok {
+		// just learn HIGHESTMODSEQ, before listing: the changes in between are applied again
+		rr, err := rc.Resync(srcName, ResyncState{ModSeq: math.MaxInt64})
+		var notAvailable imap.NotAvailableError
+		if err == nil {
+			ms.ModSeq = rr.HighestModSeq
+		} else if !errors.As(err, &notAvailable) {
+			return nil, nil, err
+		}
+	}
+
+	infos, err := src.ListWithInfo(srcName, "", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := make(map[uint32]bool, len(infos))
+	var changes []syncChange
+	for _, info := range infos {
+		current[info.UID] = true
+		flags := appendFlags(info.Flags)
+		if old, ok := ms.Flags[info.UID]; ok && sameFlags(old, flags) {
+			continue
+		}
+		changes = append(changes, syncChange{uid: info.UID, flags: flags, internalDate: info.InternalDate, messageID: info.MessageID})
+	}
+	sortSyncChanges(changes)
+	var vanished []uint32
+	for uid := range ms.UIDs {
+		if !current[uid] {
+			vanished = append(vanished, uid)
+		}
+	}
+	return changes, vanished, nil
+}
+
+func sortSyncChanges(changes []syncChange) {
+	for i := range changes {
+		sort.Strings(changes[i].flags)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].uid < changes[j].uid })
+}
+
+func sameFlags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncFlags changes the flags of the dst message from old to flags (both sorted).
+// Returns the number of the changed flags.
+func syncFlags(dst Client, uid uint32, old, flags []string) (int, error) {
+	want := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		want[f] = true
+	}
+	var n int
+	for _, f := range old {
+		if !want[f] {
+			if err := dst.SetFlag(uid, f, false); err != nil {
+				return n, err
+			}
+			n++
+		}
+		delete(want, f)
+	}
+	for _, f := range flags {
+		if want[f] {
+			if err := dst.SetFlag(uid, f, true); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// findByMessageID returns the largest UID of the messages in mbox with the given Message-ID, or 0.
+func findByMessageID(c Client, mbox, messageID string) uint32 {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		return 0
+	}
+	uids, err := c.Search(mbox, SearchCriteria{Header: map[string]string{"Message-ID": messageID}})
+	if err != nil {
+		Log.Warn("Search", "mbox", mbox, "message-id", messageID, "error", err)
+		return 0
+	}
+	var max uint32
+	for _, uid := range uids {
+		if uid > max {
+			max = uid
+		}
+	}
+	return max
+}
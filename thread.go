@@ -0,0 +1,308 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thread is a conversation: a tree of messages, linked by the References
+// and In-Reply-To headers.
+type Thread struct {
+	// UID is the UID of the message; zero for a message which is only
+	// referenced by the others (not in the UID set, or deleted).
+	UID       uint32
+	MessageID string
+	Subject   string
+	Date      time.Time
+	// Children are the replies, ordered by Date.
+	Children []*Thread
+
+	parent *Thread
+}
+
+// UIDs returns the UIDs of the messages of the thread, depth first.
+func (t *Thread) UIDs() []uint32 {
+	var uids []uint32
+	var walk func(*Thread)
+	walk = func(t *Thread) {
+		if t.UID != 0 {
+			uids = append(uids, t.UID)
+		}
+		for _, c := range t.Children {
+			walk(c)
+		}
+	}
+	walk(t)
+	return uids
+}
+
+// threadFields are the header fields needed for threading.
+var threadFields = []string{"Message-Id", "In-Reply-To", "References", "Subject", "Date"}
+
+// headersFetcher is implemented by the clients which can fetch the header
+// fields of many messages at once.
+type headersFetcher interface {
+	fetchHeaderFieldsMany(uids []uint32, fields []string) (map[uint32]textproto.MIMEHeader, error)
+}
+
+// Threads fetches the Message-ID, In-Reply-To, References, Subject and Date
+// header fields of the messages of the selected mailbox, and groups them
+// into conversations with the JWZ algorithm (https://www.jwz.org/doc/threading.html)
+// - for servers without the THREAD extension. The threads are ordered by
+// the date of their first message.
+func Threads(c Client, uids []uint32) ([]*Thread, error) {
+	var headers map[uint32]textproto.MIMEHeader
+	if hf, ok := c.(headersFetcher); ok {
+		var err error
+		if headers, err = hf.fetchHeaderFieldsMany(uids, threadFields); err != nil {
+			return nil, err
+		}
+	} else {
+		headers = make(map[uint32]textproto.MIMEHeader, len(uids))
+		for _, uid := range uids {
+			hdr, err := c.FetchHeaderFields(uid, threadFields)
+			if err != nil {
+				return nil, err
+			}
+			headers[uid] = hdr
+		}
+	}
+	return ThreadHeaders(headers), nil
+}
+
+var rMessageID = regexp.MustCompile(`<[^<>]+>`)
+
+// messageIDs returns the message ids of the References or In-Reply-To header.
+func messageIDs(s string) []string {
+	if ids := rMessageID.FindAllString(s, -1); len(ids) != 0 {
+		return ids
+	}
+	return strings.Fields(s)
+}
+
+// ThreadHeaders groups the messages, given by their headers, into conversations;
+// see Threads.
+func ThreadHeaders(headers map[uint32]textproto.MIMEHeader) []*Thread {
+	uids := make([]uint32, 0, len(headers))
+	for uid := range headers {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	// 1. link the messages by their references
+	byID := make(map[string]*Thread, len(headers))
+	container := func(id string) *Thread {
+		t := byID[id]
+		if t == nil {
+			t = &Thread{MessageID: id}
+			byID[id] = t
+		}
+		return t
+	}
+	for _, uid := range uids {
+		hdr := mail.Header(headers[uid])
+		id := strings.TrimSpace(hdr.Get("Message-Id"))
+		if ids := messageIDs(id); len(ids) != 0 {
+			id = ids[0]
+		}
+		if t := byID[id]; id == "" || t != nil && t.UID != 0 {
+			// missing or duplicate Message-ID
+			id = "<" + strconv.FormatUint(uint64(uid), 10) + "@uid>"
+		}
+		t := container(id)
+		t.UID, t.Subject = uid, hdr.Get("Subject")
+		t.Date, _ = hdr.Date()
+
+		refs := messageIDs(hdr.Get("References"))
+		if irt := messageIDs(hdr.Get("In-Reply-To")); len(irt) != 0 &&
+			(len(refs) == 0 || refs[len(refs)-1] != irt[0]) {
+			refs = append(refs, irt[0])
+		}
+		var prev *Thread
+		for _, ref := range refs {
+			r := container(ref)
+			if prev != nil && r.parent == nil && r != prev && !prev.descends(r) {
+				prev.adopt(r)
+			}
+			prev = r
+		}
+		if prev != nil && prev != t && !prev.descends(t) {
+			t.orphan()
+			prev.adopt(t)
+		}
+	}
+
+	// 2. the root set, without the empty containers
+	var roots []*Thread
+	for _, id := range sortedKeys(byID) {
+		if t := byID[id]; t.parent == nil {
+			roots = append(roots, t.prune()...)
+		}
+	}
+
+	// 3. group the roots by subject
+	bySubject := make(map[string]int, len(roots))
+	merged := make([]*Thread, 0, len(roots))
+	for _, t := range roots {
+		subject := baseSubject(t.subject())
+		i, ok := bySubject[subject]
+		if subject == "" || !ok {
+			bySubject[subject] = len(merged)
+			merged = append(merged, t)
+			continue
+		}
+		other := merged[i]
+		switch {
+		case other.UID == 0 && t.UID == 0:
+			for _, c := range t.Children {
+				other.adopt(c)
+			}
+		case other.UID == 0:
+			other.adopt(t)
+		case t.UID == 0:
+			t.adopt(other)
+			merged[i] = t
+		case isReply(t.Subject) && !isReply(other.Subject):
+			other.adopt(t)
+		case isReply(other.Subject) && !isReply(t.Subject):
+			t.adopt(other)
+			merged[i] = t
+		default:
+			// siblings under a new empty container
+			e := &Thread{}
+			e.adopt(other)
+			e.adopt(t)
+			merged[i] = e
+		}
+	}
+	for _, t := range merged {
+		t.sort()
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].date().Before(merged[j].date()) })
+	return merged
+}
+
+func sortedKeys(m map[string]*Thread) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isReply reports whether the subject has a "Re:" (or "Fwd:") prefix.
+func isReply(subject string) bool {
+	return baseSubject(subject) != strings.ToLower(strings.TrimSpace(subject))
+}
+
+// descends reports whether t is a descendant of (or the same as) a.
+func (t *Thread) descends(a *Thread) bool {
+	for ; t != nil; t = t.parent {
+		if t == a {
+			return true
+		}
+	}
+	return false
+}
+
+// adopt makes c a child of t.
+func (t *Thread) adopt(c *Thread) {
+	c.parent = t
+	t.Children = append(t.Children, c)
+}
+
+// orphan removes t from the children of its parent.
+func (t *Thread) orphan() {
+	if t.parent == nil {
+		return
+	}
+	siblings := t.parent.Children
+	for i, c := range siblings {
+		if c == t {
+			t.parent.Children = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	t.parent = nil
+}
+
+// prune removes the empty containers of the tree rooted at t, promoting
+// their children, and returns the resulting roots (for t as a root).
+func (t *Thread) prune() []*Thread {
+	var children []*Thread
+	for _, c := range t.Children {
+		children = append(children, c.prune()...)
+	}
+	t.Children = children[:len(children):len(children)]
+	for _, c := range t.Children {
+		c.parent = t
+	}
+	if t.UID != 0 {
+		return []*Thread{t}
+	}
+	switch {
+	case len(t.Children) == 0:
+		return nil
+	case t.parent == nil && len(t.Children) > 1:
+		// an empty root with many children is kept
+		return []*Thread{t}
+	}
+	promoted := t.Children
+	for _, c := range promoted {
+		c.parent = t.parent
+	}
+	t.Children = nil
+	return promoted
+}
+
+// subject returns the subject of the thread: of its own message, or its first child.
+func (t *Thread) subject() string {
+	if t.UID != 0 || len(t.Children) == 0 {
+		return t.Subject
+	}
+	return t.Children[0].subject()
+}
+
+// date returns the date of the first message of the thread.
+func (t *Thread) date() time.Time {
+	if t.UID != 0 {
+		return t.Date
+	}
+	var first time.Time
+	for _, c := range t.Children {
+		if d := c.date(); first.IsZero() || d.Before(first) {
+			first = d
+		}
+	}
+	return first
+}
+
+// sort orders the children by date, recursively.
+func (t *Thread) sort() {
+	sort.SliceStable(t.Children, func(i, j int) bool { return t.Children[i].date().Before(t.Children[j].date()) })
+	for _, c := range t.Children {
+		c.sort()
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import "crypto/tls"
+
+// tlsPolicy holds the TLS settings of the options below, applied over the TLS config.
+type tlsPolicy struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	serverName   string
+	alpn         []string
+}
+
+// WithTLSMinVersion sets the minimum TLS version (such as tls.VersionTLS13),
+// instead of the one of the TLS config - or tls.VersionTLS12, if it has none.
+func WithTLSMinVersion(version uint16) Option {
+	return func(c *client) { c.tlsPolicy.minVersion = version }
+}
+
+// WithCipherSuites restricts the cipher suites of TLS 1.0-1.2 (see
+// tls.CipherSuites; the TLS 1.3 suites are not configurable).
+func WithCipherSuites(ids ...uint16) Option {
+	return func(c *client) { c.tlsPolicy.cipherSuites = ids }
+}
+
+// WithServerName sets the server name of SNI and of the certificate
+// verification, instead of the host - for connecting by IP address or
+// through a load balancer.
+func WithServerName(name string) Option {
+	return func(c *client) { c.tlsPolicy.serverName = name }
+}
+
+// WithALPN sets the ALPN protocols offered in the TLS handshake, such as "imap".
+func WithALPN(protocols ...string) Option {
+	return func(c *client) { c.tlsPolicy.alpn = protocols }
+}
+
+// apply applies the policy to cfg.
+func (p tlsPolicy) apply(cfg *tls.Config) {
+	if p.minVersion != 0 {
+		cfg.MinVersion = p.minVersion
+	} else if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	if len(p.cipherSuites) != 0 {
+		cfg.CipherSuites = p.cipherSuites
+	}
+	if p.serverName != "" {
+		cfg.ServerName = p.serverName
+	}
+	if len(p.alpn) != 0 {
+		cfg.NextProtos = p.alpn
+	}
+}
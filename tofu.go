@@ -0,0 +1,161 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CertStore stores the public key fingerprints of the servers, for
+// trust-on-first-use (see WithTOFU).
+type CertStore interface {
+	// Fingerprint returns the stored fingerprint of the server ("host:port"),
+	// or "" if it is not known.
+	Fingerprint(server string) (string, error)
+	// SetFingerprint stores the fingerprint of the server.
+	SetFingerprint(server, fingerprint string) error
+}
+
+// WithTOFU makes the client trust the server certificate on first use:
+// instead of verifying the certificate chain, the fingerprint of its public
+// key (see Fingerprint) is stored in store on the first connection, and the
+// later connections fail with a *CertMismatchError if it has changed.
+//
+// Meant for self-hosted servers with self-signed certificates - a much safer
+// choice than InsecureSkipVerify. As the public key is pinned, renewing the
+// certificate with the same key does not break the connections.
+func WithTOFU(store CertStore) Option {
+	return func(c *client) { c.certStore = store }
+}
+
+// CertMismatchError is the error of connecting to a server whose public key
+// differs from the one recorded by WithTOFU: possibly a man-in-the-middle attack.
+type CertMismatchError struct {
+	Server      string
+	Known, Got  string
+	Certificate *x509.Certificate
+}
+
+func (e *CertMismatchError) Error() string {
+	return "the certificate of " + e.Server + " has CHANGED (possible man-in-the-middle attack): " +
+		"its key is " + e.Got + ", but " + e.Known + " is known - remove it from the store if the change is legitimate"
+}
+
+// Fingerprint returns the fingerprint of the public key of the certificate:
+// "sha256:" and the hex encoded SHA-256 hash of its SubjectPublicKeyInfo.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyPinned is the VerifyConnection of the TLS config with WithTOFU.
+func (c *client) verifyPinned(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no server certificate")
+	}
+	cert := cs.PeerCertificates[0]
+	server := c.host + ":" + strconv.Itoa(c.port)
+	got := Fingerprint(cert)
+	known, err := c.certStore.Fingerprint(server)
+	if err != nil {
+		return err
+	}
+	switch known {
+	case got:
+		return nil
+	case "":
+		c.logger.Warn("TOFU: trusting the certificate on first use", "server", server,
+			"subject", cert.Subject.String(), "fingerprint", got)
+		return c.certStore.SetFingerprint(server, got)
+	}
+	return &CertMismatchError{Server: server, Known: known, Got: got, Certificate: cert}
+}
+
+// FileCertStore is a CertStore in a text file of "host:port fingerprint"
+// lines, replaced atomically on each change.
+type FileCertStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileCertStore returns a FileCertStore using the file at path,
+// which is created on the first use.
+func NewFileCertStore(path string) *FileCertStore {
+	return &FileCertStore{path: path}
+}
+
+// Fingerprint returns the stored fingerprint of the server.
+func (fs *FileCertStore) Fingerprint(server string) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	m, err := fs.load()
+	return m[server], err
+}
+
+// SetFingerprint stores the fingerprint of the server.
+func (fs *FileCertStore) SetFingerprint(server, fingerprint string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	m, err := fs.load()
+	if err != nil {
+		return err
+	}
+	m[server] = fingerprint
+	servers := make([]string, 0, len(m))
+	for s := range m {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	var buf bytes.Buffer
+	for _, s := range servers {
+		buf.WriteString(s + " " + m[s] + "\n")
+	}
+	return writeFileAtomic(fs.path, buf.Bytes())
+}
+
+func (fs *FileCertStore) load() (map[string]string, error) {
+	m := make(map[string]string)
+	b, err := os.ReadFile(fs.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return m, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) == 2 {
+			m[fields[0]] = fields[1]
+		}
+	}
+	return m, scanner.Err()
+}
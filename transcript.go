@@ -0,0 +1,287 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WithTranscript records the IMAP exchange to w, one "C: " (client) or
+// "S: " (server) prefixed line per protocol line, with the credentials of
+// LOGIN and AUTHENTICATE redacted. The transcript can be played back with
+// NewReplayConn.
+//
+// Compression is disabled, and as the recording happens below STARTTLS,
+// it stops after a successful STARTTLS: use implicit TLS or WithoutTLS
+// for a full transcript.
+func WithTranscript(w io.Writer) Option {
+	return func(c *client) {
+		c.transcript = w
+		c.noCompress = true
+	}
+}
+
+const (
+	clientPrefix = "C: "
+	serverPrefix = "S: "
+	redacted     = "<redacted>"
+)
+
+// recordConn is a net.Conn which records the exchange.
+type recordConn struct {
+	net.Conn
+	mu      sync.Mutex
+	w       io.Writer
+	in, out []byte // partial lines
+	redactor
+	startTLS string // tag of the STARTTLS command in progress
+	off      bool
+}
+
+func newRecordConn(conn net.Conn, w io.Writer) *recordConn {
+	return &recordConn{Conn: conn, w: w}
+}
+
+func (rc *recordConn) Read(p []byte) (int, error) {
+	n, err := rc.Conn.Read(p)
+	if n > 0 {
+		rc.record(&rc.in, serverPrefix, p[:n])
+	}
+	return n, err
+}
+
+func (rc *recordConn) Write(p []byte) (int, error) {
+	rc.record(&rc.out, clientPrefix, p)
+	return rc.Conn.Write(p)
+}
+
+// record writes the complete lines of *buf + p, and keeps the rest in *buf.
+func (rc *recordConn) record(buf *[]byte, prefix string, p []byte) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.off {
+		return
+	}
+	*buf = append(*buf, p...)
+	for {
+		i := bytes.IndexByte(*buf, '\n')
+		if i < 0 {
+			return
+		}
+		line := string(bytes.TrimRight((*buf)[:i], "\r"))
+		*buf = (*buf)[i+1:]
+		if prefix == clientPrefix {
+			line = rc.clientLine(line)
+		}
+		fmt.Fprintf(rc.w, "%s%s\n", prefix, line)
+		if prefix == serverPrefix && rc.serverLine(line) {
+			fmt.Fprintln(rc.w, "# STARTTLS: the rest of the session is encrypted")
+			rc.off, rc.in, rc.out = true, nil, nil
+			return
+		}
+	}
+}
+
+// clientLine returns the line to be recorded, redacting the credentials.
+func (rc *recordConn) clientLine(line string) string {
+	if fields := strings.Fields(line); len(fields) >= 2 && strings.EqualFold(fields[1], "STARTTLS") {
+		rc.startTLS = fields[0]
+	}
+	return rc.redactor.clientLine(line)
+}
+
+// serverLine tracks the completion of the commands in progress, and reports
+// whether STARTTLS has succeeded.
+func (rc *recordConn) serverLine(line string) bool {
+	rc.redactor.serverLine(line)
+	if rc.startTLS != "" && strings.HasPrefix(line, rc.startTLS+" ") {
+		ok := strings.HasPrefix(strings.ToUpper(line[len(rc.startTLS)+1:]), "OK")
+		rc.startTLS = ""
+		return ok
+	}
+	return false
+}
+
+// NewReplayConn returns a net.Conn which plays the server side of a
+// transcript recorded with WithTranscript, to reproduce a session offline:
+//
+//	conn, err := imapclient.NewReplayConn(f)
+//	c := imapclient.NewClientWithOptions("localhost", imapclient.WithoutTLS(), imapclient.WithAllowCleartext(),
+//		imapclient.WithDialer(imapclient.DialerFunc(func(_, _ string) (net.Conn, error) { return conn, nil })))
+//
+// Every line written by the client consumes the next recorded client line;
+// the tags of the recorded commands are replaced with the actual ones in the
+// server responses. Reading when a client line is due blocks till the client
+// writes it (or the read deadline passes), as with a real server; writing
+// when a server line is due is an error.
+func NewReplayConn(r io.Reader) (net.Conn, error) {
+	rc := &replayConn{tags: make(map[string]string)}
+	rc.cond = sync.NewCond(&rc.mu)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), 64<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, clientPrefix):
+			rc.lines = append(rc.lines, replayLine{client: true, text: line[len(clientPrefix):]})
+		case strings.HasPrefix(line, serverPrefix):
+			rc.lines = append(rc.lines, replayLine{text: line[len(serverPrefix):]})
+		default:
+			return nil, fmt.Errorf("replay: bad transcript line %q", line)
+		}
+	}
+	return rc, scanner.Err()
+}
+
+type replayLine struct {
+	client bool
+	text   string
+}
+
+// replayConn is the net.Conn of NewReplayConn.
+type replayConn struct {
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled on Write, Close and deadline changes
+	deadline time.Time  // read deadline
+	lines    []replayLine
+	tags     map[string]string // recorded tag -> actual tag
+	rbuf     []byte            // unread server data
+	wbuf     []byte            // partial client line
+	closed   bool
+}
+
+func (rc *replayConn) Read(p []byte) (int, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	for len(rc.rbuf) == 0 {
+		if rc.closed || len(rc.lines) == 0 {
+			return 0, io.EOF
+		}
+		if rc.lines[0].client {
+			if err := rc.waitClient(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		text := rc.lines[0].text
+		rc.lines = rc.lines[1:]
+		if tag := firstField(text); rc.tags[tag] != "" {
+			text = rc.tags[tag] + text[len(tag):]
+		}
+		rc.rbuf = append(rc.rbuf, text...)
+		rc.rbuf = append(rc.rbuf, '\r', '\n')
+	}
+	n := copy(p, rc.rbuf)
+	rc.rbuf = rc.rbuf[n:]
+	return n, nil
+}
+
+func (rc *replayConn) Write(p []byte) (int, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return 0, io.ErrClosedPipe
+	}
+	rc.wbuf = append(rc.wbuf, p...)
+	for {
+		i := bytes.IndexByte(rc.wbuf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(bytes.TrimRight(rc.wbuf[:i], "\r"))
+		rc.wbuf = rc.wbuf[i+1:]
+		if len(rc.lines) == 0 || !rc.lines[0].client {
+			return 0, fmt.Errorf("replay: unexpected client line %q", line)
+		}
+		if recorded := rc.lines[0].text; recorded != redacted {
+			if tag := firstField(recorded); tag != "" {
+				rc.tags[tag] = firstField(line)
+			}
+		}
+		rc.lines = rc.lines[1:]
+		rc.cond.Broadcast()
+	}
+}
+
+// waitClient waits for a Write, a Close or the read deadline.
+func (rc *replayConn) waitClient() error {
+	if rc.deadline.IsZero() {
+		rc.cond.Wait()
+		return nil
+	}
+	d := time.Until(rc.deadline)
+	if d <= 0 {
+		return replayTimeout{}
+	}
+	t := time.AfterFunc(d, func() {
+		rc.mu.Lock()
+		rc.cond.Broadcast()
+		rc.mu.Unlock()
+	})
+	rc.cond.Wait()
+	t.Stop()
+	return nil
+}
+
+func (rc *replayConn) Close() error {
+	rc.mu.Lock()
+	rc.closed = true
+	rc.cond.Broadcast()
+	rc.mu.Unlock()
+	return nil
+}
+
+func (rc *replayConn) LocalAddr() net.Addr                { return replayAddr{} }
+func (rc *replayConn) RemoteAddr() net.Addr               { return replayAddr{} }
+func (rc *replayConn) SetDeadline(t time.Time) error      { return rc.SetReadDeadline(t) }
+func (rc *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (rc *replayConn) SetReadDeadline(t time.Time) error {
+	rc.mu.Lock()
+	rc.deadline = t
+	rc.cond.Broadcast()
+	rc.mu.Unlock()
+	return nil
+}
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
+
+// replayTimeout is returned by Read when the read deadline passes while
+// the client should write.
+type replayTimeout struct{}
+
+func (replayTimeout) Error() string   { return "replay: waiting for the client" }
+func (replayTimeout) Timeout() bool   { return true }
+func (replayTimeout) Temporary() bool { return true }
+
+func firstField(s string) string {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTranscriptReplay(t *testing.T) {
+	session := func(opts ...Option) ([]uint32, error) {
+		c := NewClientWithOptions("localhost", append([]Option{
+			WithPort(143), WithoutTLS(), WithAllowCleartext(), WithAuth("user", "secret"),
+		}, opts...)...)
+		if err := c.Connect(); err != nil {
+			return nil, err
+		}
+		uids, err := c.List("INBOX", "", true)
+		if closeErr := c.Close(false); err == nil {
+			err = closeErr
+		}
+		return uids, err
+	}
+
+	var transcript bytes.Buffer
+	s := newFakeServer(3, "Subject: replay\r\n\r\nbody\r\n")
+	want, err := session(WithDialer(s.dialer()), WithTranscript(&transcript))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, []uint32{1, 2, 3}) {
+		t.Fatalf("recorded List got %v, wanted [1 2 3]", want)
+	}
+	if strings.Contains(transcript.String(), "secret") {
+		t.Error("the password is not redacted")
+	}
+	for _, cmd := range []string{" LOGIN ", " SELECT ", " UID SEARCH ", " LOGOUT"} {
+		if !strings.Contains(transcript.String(), cmd) {
+			t.Errorf("no %q in the transcript", cmd)
+		}
+	}
+
+	conn, err := NewReplayConn(bytes.NewReader(transcript.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := session(WithDialer(DialerFunc(func(_, _ string) (net.Conn, error) { return conn, nil })))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed List got %v, wanted %v", got, want)
+	}
+	if rc := conn.(*replayConn); len(rc.lines) != 0 {
+		t.Errorf("%d lines of the transcript are not replayed: %v", len(rc.lines), rc.lines)
+	}
+}
+
+func TestReplayConnBlocksForClient(t *testing.T) {
+	conn, err := NewReplayConn(strings.NewReader("S: * OK ready\nC: a1 NOOP\nS: a1 OK done\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "* OK ready\r\n" {
+		t.Fatalf("greeting: %q, %v", buf[:n], err)
+	}
+	done := make(chan string)
+	go func() {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- string(buf[:n])
+	}()
+	if _, err = conn.Write([]byte("x7 NOOP\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-done; got != "x7 OK done\r\n" {
+		t.Errorf("got %q, wanted the completion with the actual tag", got)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// PathSeparator separates the levels of the mailbox names given to the
+// methods naming a mailbox (Select, Move, CreateMailbox, Append...): it is
+// replaced by the hierarchy delimiter of the server - "/" by default;
+// empty disables the replacement.
+var PathSeparator = "/"
+
+// MailboxTree is the mailbox hierarchy, as built from LIST responses.
+type MailboxTree struct {
+	// Delim is the hierarchy delimiter of the server, empty if flat.
+	Delim string
+	// Roots are the top-level mailboxes.
+	Roots []*MailboxNode
+
+	nodes map[string]*MailboxNode
+}
+
+// MailboxNode is a mailbox in the MailboxTree.
+type MailboxNode struct {
+	Mailbox
+	// Leaf is the last level of the name.
+	Leaf     string
+	Parent   *MailboxNode
+	Children []*MailboxNode
+}
+
+// NewMailboxTree builds the tree of the mailboxes. The missing intermediate
+// levels are added with the \NonExistent attribute.
+func NewMailboxTree(mboxes []Mailbox) *MailboxTree {
+	t := &MailboxTree{nodes: make(map[string]*MailboxNode, len(mboxes))}
+	for _, m := range mboxes {
+		if t.Delim == "" && m.Delim != "" {
+			t.Delim = m.Delim
+		}
+	}
+	sorted := append([]Mailbox(nil), mboxes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, m := range sorted {
+		if n := t.nodes[m.Name]; n != nil {
+			n.Mailbox = m
+			continue
+		}
+		t.add(m)
+	}
+	return t
+}
+
+func (t *MailboxTree) add(m Mailbox) *MailboxNode {
+	n := &MailboxNode{Mailbox: m, Leaf: m.Name}
+	t.nodes[m.Name] = n
+	if t.Delim != "" {
+		if i := strings.LastIndex(m.Name, t.Delim); i > 0 {
+			parentName := m.Name[:i]
+			n.Leaf = m.Name[i+len(t.Delim):]
+			parent := t.nodes[parentName]
+			if parent == nil {
+				parent = t.add(Mailbox{Name: parentName, Delim: t.Delim, Attrs: imap.NewFlagSet(`\NonExistent`)})
+			}
+			n.Parent = parent
+			parent.Children = append(parent.Children, n)
+			return n
+		}
+	}
+	t.Roots = append(t.Roots, n)
+	return n
+}
+
+// Find returns the node of the mailbox, or nil.
+func (t *MailboxTree) Find(name string) *MailboxNode {
+	return t.nodes[name]
+}
+
+// Children returns the children of the mailbox (the roots for "").
+func (t *MailboxTree) Children(name string) []*MailboxNode {
+	if name == "" {
+		return t.Roots
+	}
+	if n := t.nodes[name]; n != nil {
+		return n.Children
+	}
+	return nil
+}
+
+// Join joins the levels with the hierarchy delimiter.
+func (t *MailboxTree) Join(levels ...string) string {
+	return strings.Join(levels, t.Delim)
+}
+
+// Split splits the mailbox name into its levels.
+func (t *MailboxTree) Split(name string) []string {
+	if t.Delim == "" {
+		return []string{name}
+	}
+	return strings.Split(name, t.Delim)
+}
+
+// Walk calls fn for each mailbox, parents before children,
+// and stops at the first error.
+func (t *MailboxTree) Walk(fn func(*MailboxNode) error) error {
+	var walk func([]*MailboxNode) error
+	walk = func(nodes []*MailboxNode) error {
+		for _, n := range nodes {
+			if err := fn(n); err != nil {
+				return err
+			}
+			if err := walk(n.Children); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(t.Roots)
+}
+
+// MailboxTree lists all the mailboxes, and returns their tree.
+func (c *client) MailboxTree() (*MailboxTree, error) {
+	mboxes, err := c.Mailboxes("*")
+	if err != nil {
+		return nil, err
+	}
+	t := NewMailboxTree(mboxes)
+	if t.Delim == "" {
+		t.Delim, _ = c.delimiter()
+	}
+	return t, nil
+}
+
+// delimiter returns the hierarchy delimiter of the server, with LIST "" "".
+func (c *client) delimiter() (string, error) {
+	c.enter()
+	defer c.leave()
+	if c.delim != nil {
+		return *c.delim, nil
+	}
+	cmd, err := c.wait(c.c.List("", ""))
+	if err != nil {
+		return "", err
+	}
+	var delim string
+	for _, resp := range cmd.Data {
+		if info := resp.MailboxInfo(); info != nil {
+			delim = info.Delim
+			break
+		}
+	}
+	c.delim = &delim
+	return delim, nil
+}
+
+// serverPath replaces PathSeparator in mbox with the hierarchy delimiter of the server.
+func (c *client) serverPath(mbox string) string {
+	if PathSeparator == "" || !strings.Contains(mbox, PathSeparator) {
+		return mbox
+	}
+	delim, err := c.delimiter()
+	if err != nil || delim == "" || delim == PathSeparator {
+		return mbox
+	}
+	return strings.Replace(mbox, PathSeparator, delim, -1)
+}
@@ -0,0 +1,279 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mxk/go-imap/imap"
+)
+
+// WatchInterval is the maximal interval between two checks of a watched
+// mailbox - 1 minute by default. With IDLE, a notification of the server
+// triggers the next check earlier.
+var WatchInterval = time.Minute
+
+// FlagChange is a change of the flags of a message, made by an other client.
+type FlagChange struct {
+	Mailbox string
+	UID     uint32
+	// Flags are the new flags, Old are the previous ones.
+	Flags, Old imap.FlagSet
+}
+
+// FlagWatcher is a Client which can report the flag changes of a mailbox.
+type FlagWatcher interface {
+	Client
+	WatchFlags(ctx context.Context, mbox string, changes chan<- FlagChange) error
+}
+
+var _ = FlagWatcher((*client)(nil))
+
+// WatchFlags reports the flag changes of the messages of mbox (present at
+// the start, or arrived since then) to changes, till ctx is cancelled;
+// then returns ctx.Err().
+//
+// The flags are polled every WatchInterval, or earlier if the server notifies
+// of a change in IDLE: with CONDSTORE, only the messages changed since the
+// previous check are fetched, otherwise the flags of all of them are compared.
+// The client must not be used for anything else while watching.
+func (c *client) WatchFlags(ctx context.Context, mbox string, changes chan<- FlagChange) error {
+	var known map[uint32]imap.FlagSet
+	var state ResyncState
+	for {
+		var changed map[uint32]imap.FlagSet
+		var err error
+		if c.Supports("CONDSTORE") {
+			var res *ResyncResult
+			if res, err = c.Resync(mbox, state); err == nil {
+				if res.Reset {
+					known, state = nil, ResyncState{}
+					continue
+				}
+				state.UIDValidity, state.ModSeq = res.UIDValidity, res.HighestModSeq
+				for _, uid := range res.Vanished {
+					delete(known, uid)
+				}
+				changed = res.Changed
+			}
+		} else if changed, err = c.allFlags(mbox); err == nil && known != nil {
+			for uid := range known {
+				if _, ok := changed[uid]; !ok {
+					delete(known, uid)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		if known == nil {
+			known = changed
+		} else {
+			for uid, flags := range changed {
+				old, ok := known[uid]
+				known[uid] = flags
+				if !ok || equalFlagSets(old, flags) {
+					continue
+				}
+				select {
+				case changes <- FlagChange{Mailbox: mbox, UID: uid, Flags: flags, Old: old}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		if !c.waitChange(ctx, mbox, WatchInterval) {
+			return ctx.Err()
+		}
+	}
+}
+
+// allFlags returns the flags of all the messages of mbox.
+func (c *client) allFlags(mbox string) (map[uint32]imap.FlagSet, error) {
+	c.enter()
+	defer c.leave()
+	flags := make(map[uint32]imap.FlagSet)
+	err := c.retry("WatchFlags", func() error {
+		if err := c.selectMailbox(mbox); err != nil {
+			return err
+		}
+		all, _ := imap.NewSeqSet("1:*")
+		return c.fetch(all, []string{"FLAGS"}, func(resp *imap.Response) error {
+			if info := resp.MessageInfo(); info.UID != 0 {
+				flags[info.UID] = info.Flags
+			}
+			return nil
+		})
+	})
+	return flags, err
+}
+
+func equalFlagSets(a, b imap.FlagSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for f := range a {
+		if !b[f] {
+			return false
+		}
+	}
+	return true
+}
+
+// waitChange waits at most d for a notification about mbox in IDLE (just
+// sleeps without IDLE), and reports whether it was not interrupted by ctx.
+func (c *client) waitChange(ctx context.Context, mbox string, d time.Duration) bool {
+	if !c.Supports("IDLE") {
+		return sleepContext(ctx, d)
+	}
+	events := make(chan IdleEvent, 16)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- c.Idle(mbox, events, stop) }()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	interrupted := false
+	select {
+	case <-ctx.Done():
+		interrupted = true
+	case <-t.C:
+	case <-events:
+	case err := <-done:
+		var notAvailable imap.NotAvailableError
+		if !errors.As(err, &notAvailable) {
+			c.logger.Warn("IDLE", "mbox", mbox, "error", err)
+		}
+		return sleepContext(ctx, d-time.Since(start))
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		c.logger.Warn("IDLE", "mbox", mbox, "error", err)
+	}
+	return !interrupted
+}
+
+// MailboxEvent is a change of a watched mailbox.
+type MailboxEvent struct {
+	Mailbox string
+	// Type is EXISTS, RECENT or EXPUNGE.
+	Type string
+	// Num is the number of (recent) messages for EXISTS (RECENT), the
+	// sequence number of the expunged message for EXPUNGE - zero if
+	// unknown, when polling.
+	Num uint32
+}
+
+// MailboxWatcher is a Client which can report the changes of a mailbox.
+type MailboxWatcher interface {
+	Client
+	WatchMailbox(ctx context.Context, mbox string) (<-chan MailboxEvent, error)
+}
+
+var _ = MailboxWatcher((*client)(nil))
+
+// WatchMailbox reports the new (EXISTS, RECENT) and expunged (EXPUNGE)
+// messages of mbox on the returned channel, till ctx is cancelled - then
+// the channel is closed.
+//
+// It waits in IDLE if the server supports it, and polls STATUS every
+// WatchInterval otherwise (or after an IDLE error); then an EXPUNGE is
+// reported for each message missing from the count, without sequence number.
+// The client must not be used for anything else while watching.
+func (c *client) WatchMailbox(ctx context.Context, mbox string) (<-chan MailboxEvent, error) {
+	st, err := c.Status(mbox)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan MailboxEvent, 16)
+	go func() {
+		defer close(ch)
+		send := func(ev MailboxEvent) bool {
+			ev.Mailbox = mbox
+			select {
+			case ch <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if c.Supports("IDLE") && !c.idleEvents(ctx, mbox, send) {
+			return
+		}
+		for sleepContext(ctx, WatchInterval) {
+			cur, err := c.Status(mbox)
+			if err != nil {
+				c.logger.Warn("WatchMailbox", "mbox", mbox, "error", err)
+				continue
+			}
+			// without expunges, the count grows by UIDNEXT-UIDNEXT'
+			arrived := cur.UIDNext - st.UIDNext
+			if cur.UIDValidity != st.UIDValidity || cur.UIDNext < st.UIDNext {
+				arrived = 0
+			}
+			for i := int64(st.Messages) + int64(arrived) - int64(cur.Messages); i > 0; i-- {
+				if !send(MailboxEvent{Type: "EXPUNGE"}) {
+					return
+				}
+			}
+			if cur.Messages > st.Messages || arrived > 0 {
+				if !send(MailboxEvent{Type: "EXISTS", Num: cur.Messages}) {
+					return
+				}
+			}
+			if cur.Recent != st.Recent && !send(MailboxEvent{Type: "RECENT", Num: cur.Recent}) {
+				return
+			}
+			st = cur
+		}
+	}()
+	return ch, nil
+}
+
+// idleEvents sends the EXISTS, RECENT and EXPUNGE notifications received in
+// IDLE to send, till ctx is cancelled (or send fails); then returns false.
+// Returns true after an IDLE error.
+func (c *client) idleEvents(ctx context.Context, mbox string, send func(MailboxEvent) bool) bool {
+	events := make(chan IdleEvent, 16)
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- c.Idle(mbox, events, stop) }()
+	for {
+		select {
+		case <-ctx.Done():
+			close(stop)
+			<-done
+			return false
+		case err := <-done:
+			c.logger.Warn("IDLE", "mbox", mbox, "error", err)
+			return true
+		case ev := <-events:
+			if ev.Type == "FETCH" {
+				continue
+			}
+			if !send(MailboxEvent{Type: ev.Type, Num: ev.Num}) {
+				close(stop)
+				<-done
+				return false
+			}
+		}
+	}
+}
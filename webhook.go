@@ -0,0 +1,207 @@
+/*
+Copyright 2014 Tamás Gulácsi
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imapclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook delivers the messages by POSTing them to an HTTP endpoint:
+// its Deliver is a DeliverFunc, its DeliverMessage is a MessageDeliverFunc.
+//
+// The request body is the raw message (as message/rfc822, with the UID and
+// the hash in the X-Imap-Uid and X-Message-Hash headers), or, with JSON,
+// an object of the metadata (mailbox, uid, size, hash, from, subject,
+// messageId, date, flags) and the base64 encoded raw message (raw).
+//
+// With Secret, the body is signed with HMAC-SHA256, sent in the
+// X-Signature-256 header as "sha256=" + hex.
+//
+// Any 2xx response means a successful delivery. Connection errors, 408,
+// 429 and 5xx responses are retried as configured by Retry, other
+// responses fail the delivery immediately.
+type Webhook struct {
+	// URL is the endpoint.
+	URL string
+	// Secret is the key of the HMAC signature; no signature if empty.
+	Secret []byte
+	// JSON makes the request body a JSON object with the metadata.
+	JSON bool
+	// Header holds additional request headers (such as Authorization).
+	Header http.Header
+	// Client is the HTTP client - http.DefaultClient if nil.
+	Client *http.Client
+	// Timeout is the timeout of each request - Timeout if zero.
+	Timeout time.Duration
+	// Retry configures the retries - DefaultRetryPolicy if its Retries is zero.
+	Retry RetryPolicy
+}
+
+// webhookMessage is the JSON request body of Webhook.
+type webhookMessage struct {
+	Mailbox     string     `json:"mailbox,omitempty"`
+	UIDValidity uint32     `json:"uidValidity,omitempty"`
+	UID         uint32     `json:"uid"`
+	Size        int64      `json:"size"`
+	Hash        string     `json:"hash,omitempty"`
+	From        string     `json:"from,omitempty"`
+	Subject     string     `json:"subject,omitempty"`
+	MessageID   string     `json:"messageId,omitempty"`
+	Date        *time.Time `json:"date,omitempty"`
+	Flags       []string   `json:"flags,omitempty"`
+	Raw         []byte     `json:"raw"`
+}
+
+// Deliver POSTs the message; usable as a DeliverFunc.
+func (w *Webhook) Deliver(r io.ReadSeeker, uid uint32, hash []byte) error {
+	return w.DeliverMessage(r, DeliveryInfo{UID: uid, Hash: hash})
+}
+
+// DeliverMessage POSTs the message with its metadata; usable as a MessageDeliverFunc.
+func (w *Webhook) DeliverMessage(r io.ReadSeeker, info DeliveryInfo) error {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	body, contentType := raw, "message/rfc822"
+	if w.JSON {
+		if info.Size == 0 {
+			info.Size = int64(len(raw))
+		}
+		msg := webhookMessage{
+			Mailbox: info.Mailbox, UIDValidity: info.UIDValidity, UID: info.UID,
+			Size: info.Size, Hash: hex.EncodeToString(info.Hash),
+			From: info.From, Subject: info.Subject, MessageID: info.MessageID,
+			Flags: info.Flags, Raw: raw,
+		}
+		if !info.Date.IsZero() {
+			msg.Date = &info.Date
+		}
+		if body, err = json.Marshal(msg); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+
+	policy := w.Retry
+	if policy.Retries == 0 {
+		policy = DefaultRetryPolicy
+	}
+	err = w.post(body, contentType, info)
+	for i := 0; i < policy.Retries && retryableWebhookError(err); i++ {
+		sleep := policy.backoff(i)
+		if d := RetryAfter(err); d > sleep {
+			sleep = d
+		}
+		Log.Warn("webhook", "url", w.URL, "uid", info.UID, "retry", i+1, "sleep", sleep, "error", err)
+		time.Sleep(sleep)
+		err = w.post(body, contentType, info)
+	}
+	return err
+}
+
+// webhookStatusError is the error of an unsuccessful HTTP response.
+type webhookStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *webhookStatusError) Error() string {
+	return "HTTP " + strconv.Itoa(e.StatusCode) + ": " + e.Body
+}
+
+// retryableWebhookError reports whether the failed request should be retried.
+func retryableWebhookError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var se *webhookStatusError
+	if !errors.As(err, &se) {
+		return true // connection error or timeout
+	}
+	return se.StatusCode == http.StatusRequestTimeout ||
+		se.StatusCode == http.StatusTooManyRequests || se.StatusCode >= 500
+}
+
+// post sends one request.
+func (w *Webhook) post(body []byte, contentType string, info DeliveryInfo) error {
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = Timeout
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vv := range w.Header {
+		req.Header[k] = vv
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Imap-Uid", strconv.FormatUint(uint64(info.UID), 10))
+	if info.Mailbox != "" {
+		req.Header.Set("X-Imap-Mailbox", info.Mailbox)
+	}
+	if len(info.Hash) != 0 {
+		req.Header.Set("X-Message-Hash", hex.EncodeToString(info.Hash))
+	}
+	if len(w.Secret) != 0 {
+		mac := hmac.New(sha256.New, w.Secret)
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	cl := w.Client
+	if cl == nil {
+		cl = http.DefaultClient
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", w.URL, err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = &webhookStatusError{StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(msg))}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		e := &Error{Op: "webhook", Kind: ErrThrottled, Err: err}
+		if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return e
+	}
+	return fmt.Errorf("webhook %s: %w", w.URL, err)
+}